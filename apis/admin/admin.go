@@ -0,0 +1,119 @@
+// Package admin serves model management endpoints: list resident models,
+// load one from a GGUF path and unload one after draining its requests.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/haydenlabs/gollum/engine"
+)
+
+// defaultDrain bounds how long an unload waits for in-flight requests.
+const defaultDrain = 60 * time.Second
+
+type API struct {
+	adm   engine.ModelAdmin
+	token string
+}
+
+// NewAPI serves adm to requests carrying token as a bearer token. With no
+// token every request is refused, since loading a model reads any path the
+// server can.
+func NewAPI(adm engine.ModelAdmin, token string) *API { return &API{adm: adm, token: token} }
+
+func (a *API) Register(r *gin.Engine) {
+	g := r.Group("/admin", a.auth)
+	g.GET("/models", a.List)
+	g.POST("/models", a.Load)
+	g.DELETE("/models/:name", a.Unload)
+}
+
+func (a *API) auth(c *gin.Context) {
+	if a.token == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled: no token configured"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+func (a *API) List(c *gin.Context) {
+	data := []gin.H{}
+	for _, mi := range a.adm.ModelInfo() {
+		data = append(data, info(mi))
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+type loadRequest struct {
+	Name string `json:"name"` // defaults to the file name without .gguf
+	Path string `json:"path"`
+}
+
+func (a *API) Load(c *gin.Context) {
+	var req loadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+		return
+	}
+	mi, err := a.adm.LoadModel(req.Name, req.Path)
+	switch {
+	case errors.Is(err, engine.ErrModelExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, info(mi))
+}
+
+// Unload drains the model for up to ?timeout= (a Go duration, default 60s)
+// before freeing it; requests still running then are failed.
+func (a *API) Unload(c *gin.Context) {
+	timeout := defaultDrain
+	if t := c.Query("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout: " + err.Error()})
+			return
+		}
+		timeout = d
+	}
+	// The drain outlives a client that hangs up: the model is already gone
+	// from routing and must still be freed.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := a.adm.UnloadModel(ctx, c.Param("name"))
+	switch {
+	case errors.Is(err, engine.ErrUnknownModel):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil && !errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": c.Param("name"), "drained": err == nil})
+}
+
+func info(mi engine.ModelInfo) gin.H {
+	return gin.H{
+		"name":         mi.Name,
+		"path":         mi.Path,
+		"arch":         mi.Arch,
+		"weight_bytes": mi.WeightBytes,
+		"kv_bytes":     mi.KVBytes,
+		"in_flight":    mi.InFlight,
+	}
+}
@@ -1,8 +1,12 @@
 package openai
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"time"
 
@@ -10,6 +14,8 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/grammar"
+	"github.com/haydenlabs/gollum/sampling"
 )
 
 type API struct {
@@ -26,10 +32,11 @@ func (a *API) Register(r *gin.Engine) {
 }
 
 func (a *API) Models(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"object": "list",
-		"data":   []gin.H{{"id": "toy-1", "object": "model", "created": time.Now().Unix(), "owned_by": "gollum"}},
-	})
+	var data []gin.H
+	for _, name := range a.eng.Models() {
+		data = append(data, gin.H{"id": name, "object": "model", "created": time.Now().Unix(), "owned_by": "gollum"})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
 }
 
 type ChatMessage struct {
@@ -38,11 +45,94 @@ type ChatMessage struct {
 }
 
 type ChatCompletionRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Stream      bool          `json:"stream"`
-	MaxTokens   int           `json:"max_tokens"`
-	Temperature float32       `json:"temperature"`
+	Model            string        `json:"model"`
+	Messages         []ChatMessage `json:"messages"`
+	Stream           bool          `json:"stream"`
+	MaxTokens        int           `json:"max_tokens"`
+	Temperature      float32       `json:"temperature"`
+	TopP             float32       `json:"top_p"`
+	PresencePenalty  float32       `json:"presence_penalty"`
+	FrequencyPenalty float32       `json:"frequency_penalty"`
+	Seed             *int64        `json:"seed"`
+	Stop             stopList      `json:"stop"`
+	ResponseFormat   *struct {
+		Type       string `json:"type"` // text | json_object | json_schema
+		JSONSchema struct {
+			Name   string          `json:"name"`
+			Schema json.RawMessage `json:"schema"`
+			Strict bool            `json:"strict"`
+		} `json:"json_schema"`
+	} `json:"response_format"`
+	// Extensions beyond the OpenAI schema, named as in llama.cpp and vLLM.
+	TopK              int     `json:"top_k"`
+	MinP              float32 `json:"min_p"`
+	TypicalP          float32 `json:"typical_p"`
+	RepetitionPenalty float32 `json:"repetition_penalty"`
+	RepeatLastN       int     `json:"repeat_last_n"`
+	Mirostat          int     `json:"mirostat"`
+	MirostatTau       float32 `json:"mirostat_tau"`
+	MirostatEta       float32 `json:"mirostat_eta"`
+	Grammar           string  `json:"grammar"`          // GBNF
+	PromptLookup      int     `json:"prompt_lookup"`    // n-gram size for prompt-lookup speculation, -1 to disable
+	ContextOverflow   string  `json:"context_overflow"` // reject | truncate | shift
+	SinkTokens        int     `json:"sink_tokens"`      // leading tokens a shift keeps
+}
+
+// stopList accepts "stop" as either a string or an array of strings.
+type stopList []string
+
+func (s *stopList) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = stopList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("stop: want a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// grammar compiles the output constraint the request asks for, if any.
+func (r *ChatCompletionRequest) grammar() (*grammar.Grammar, error) {
+	if r.Grammar != "" {
+		return grammar.Parse(r.Grammar)
+	}
+	if r.ResponseFormat == nil {
+		return nil, nil
+	}
+	switch r.ResponseFormat.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return grammar.FromJSONSchema([]byte(`{"type":"object"}`))
+	case "json_schema":
+		if len(r.ResponseFormat.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("response_format.json_schema.schema is required")
+		}
+		return grammar.FromJSONSchema(r.ResponseFormat.JSONSchema.Schema)
+	}
+	return nil, fmt.Errorf("unsupported response_format type %q", r.ResponseFormat.Type)
+}
+
+func (r *ChatCompletionRequest) samplingParams() sampling.Params {
+	return sampling.Params{
+		Temperature:      r.Temperature,
+		TopK:             r.TopK,
+		TopP:             r.TopP,
+		MinP:             r.MinP,
+		TypicalP:         r.TypicalP,
+		RepeatPenalty:    r.RepetitionPenalty,
+		RepeatLastN:      r.RepeatLastN,
+		PresencePenalty:  r.PresencePenalty,
+		FrequencyPenalty: r.FrequencyPenalty,
+		Mirostat:         r.Mirostat,
+		MirostatTau:      r.MirostatTau,
+		MirostatEta:      r.MirostatEta,
+		Seed:             r.Seed,
+	}
 }
 
 func (a *API) ChatCompletions(c *gin.Context) {
@@ -51,63 +141,198 @@ func (a *API) ChatCompletions(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if req.Model == "" {
-		req.Model = "toy-1"
+	g, err := req.grammar()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.ContextOverflow {
+	case "", engine.OverflowReject, engine.OverflowTruncate, engine.OverflowShift:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported context_overflow %q", req.ContextOverflow)})
+		return
 	}
 	id := "chatcmpl_" + uuid.New().String()
 
-	// Collapse messages to a prompt (very naive for toy backend)
-	prompt := ""
-	for _, m := range req.Messages {
-		if m.Role == "user" || m.Role == "system" {
-			prompt += m.Content + "\n"
-		}
+	// Messages collapse to a prompt in engine.ChatPrompt (very naive for toy backend)
+	msgs := make([]engine.Message, len(req.Messages))
+	for i, m := range req.Messages {
+		msgs[i] = engine.Message{Role: m.Role, Content: m.Content}
 	}
 
 	ctx := c.Request.Context()
+	greq := &engine.GenRequest{
+		Model: req.Model, Prompt: engine.ChatPrompt(msgs), MaxTokens: req.MaxTokens, Stop: req.Stop, Grammar: g, PromptLookup: req.PromptLookup, Sampling: req.samplingParams(),
+		Messages: msgs, Overflow: req.ContextOverflow, SinkTokens: req.SinkTokens,
+	}
+	ch, trace, err := a.eng.Generate(ctx, greq)
+	switch {
+	case errors.Is(err, engine.ErrUnknownModel):
+		c.JSON(http.StatusNotFound, modelNotFound(err))
+		return
+	case errors.Is(err, engine.ErrLoadTimeout):
+		c.JSON(http.StatusServiceUnavailable, errorBody(err))
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(err))
+		return
+	}
+	req.Model = greq.Model
+	// Hold the headers until the first token so a request that fails before
+	// producing anything gets a real status code instead of an event stream.
+	first, ok := <-ch
+	if ok && first.Err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(first.Err, engine.ErrStopped):
+			status = http.StatusServiceUnavailable // the model is being unloaded
+		case errors.Is(first.Err, engine.ErrContextOverflow):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, errorBody(first.Err))
+		return
+	}
+
 	stream := c.Writer
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 	c.Status(http.StatusOK)
 
-	ch, trace, err := a.eng.Generate(ctx, &engine.GenRequest{
-		Model: req.Model, Prompt: prompt, MaxTokens: req.MaxTokens, Temperature: req.Temperature,
-	})
-	if err != nil {
-		fmt.Fprintf(stream, "data: %s\n\n", toJSON(gin.H{"error": err.Error()}))
-		return
-	}
 	// Send an initial event like OpenAI
 	fmt.Fprintf(stream, "data: %s\n\n", toJSON(gin.H{
 		"id": id, "object": "chat.completion.chunk", "created": time.Now().Unix(),
 		"model": req.Model, "choices": []gin.H{{"index": 0, "delta": gin.H{"role": "assistant", "content": ""}, "finish_reason": nil}},
 	}))
 
-	for tok := range ch {
+	finish := ""
+	for tok := first; ok; tok, ok = <-ch {
+		if tok.Err != nil {
+			// Mid-stream failure: the status is already sent, so report it in-band.
+			fmt.Fprintf(stream, "data: %s\n\n", toJSON(errorBody(tok.Err)))
+			fmt.Fprint(stream, "data: [DONE]\n\n")
+			return
+		}
+		finish = tok.FinishReason
+		if tok.Text == "" && finish != "" {
+			continue
+		}
 		fmt.Fprintf(stream, "data: %s\n\n", toJSON(gin.H{
 			"id": id, "object": "chat.completion.chunk", "created": time.Now().Unix(),
 			"model": req.Model, "choices": []gin.H{{"index": 0, "delta": gin.H{"content": tok.Text}, "finish_reason": nil}},
 		}))
 		stream.(http.Flusher).Flush()
 	}
+	if finish == "" {
+		return // cancelled
+	}
 	// done
 	fmt.Fprintf(stream, "data: %s\n\n", toJSON(gin.H{
 		"id": id, "object": "chat.completion.chunk", "created": time.Now().Unix(),
-		"model": req.Model, "choices": []gin.H{{"index": 0, "delta": gin.H{}, "finish_reason": "stop"}},
+		"model": req.Model, "choices": []gin.H{{"index": 0, "delta": gin.H{}, "finish_reason": finish}},
 	}))
 	fmt.Fprint(stream, "data: [DONE]\n\n")
 
 	_ = trace // currently unused; wire into logs later
 }
 
+type EmbeddingRequest struct {
+	Model          string         `json:"model"`
+	Input          embeddingInput `json:"input"`
+	EncodingFormat string         `json:"encoding_format"` // float | base64
+	Normalize      *bool          `json:"normalize"`       // extension: L2-normalize, default true
+}
+
+// embeddingInput accepts "input" as a string, an array of strings, an array
+// of token IDs or an array of token arrays.
+type embeddingInput struct {
+	texts  []string
+	tokens [][]int
+}
+
+func (in *embeddingInput) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		in.texts = []string{one}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(b, &texts); err == nil {
+		in.texts = texts
+		return nil
+	}
+	var ids []int
+	if err := json.Unmarshal(b, &ids); err == nil {
+		in.tokens = [][]int{ids}
+		return nil
+	}
+	var batch [][]int
+	if err := json.Unmarshal(b, &batch); err == nil {
+		in.tokens = batch
+		return nil
+	}
+	return fmt.Errorf("input: want a string, an array of strings, an array of token IDs or an array of those")
+}
+
 func (a *API) Embeddings(c *gin.Context) {
+	var req EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported encoding_format %q", req.EncodingFormat)})
+		return
+	}
+	ereq := &engine.EmbedRequest{
+		Model: req.Model, Texts: req.Input.texts, Tokens: req.Input.tokens, Normalize: req.Normalize == nil || *req.Normalize,
+	}
+	res, err := a.eng.Embeddings(c.Request.Context(), ereq)
+	switch {
+	case errors.Is(err, engine.ErrUnknownModel):
+		c.JSON(http.StatusNotFound, modelNotFound(err))
+		return
+	case errors.Is(err, engine.ErrLoadTimeout):
+		c.JSON(http.StatusServiceUnavailable, errorBody(err))
+		return
+	case errors.Is(err, engine.ErrInvalidInput) || errors.Is(err, engine.ErrNoEmbeddings):
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error"}})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(err))
+		return
+	}
+	data := make([]gin.H, len(res.Vectors))
+	for i, v := range res.Vectors {
+		var emb any = v
+		if req.EncodingFormat == "base64" {
+			// Little-endian float32s, as the OpenAI clients decode them.
+			buf := make([]byte, 4*len(v))
+			for j, x := range v {
+				binary.LittleEndian.PutUint32(buf[4*j:], math.Float32bits(x))
+			}
+			emb = base64.StdEncoding.EncodeToString(buf)
+		}
+		data[i] = gin.H{"object": "embedding", "index": i, "embedding": emb}
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"object": "list",
-		"data":   []gin.H{},
+		"object":     "list",
+		"data":       data,
+		"model":      ereq.Model,
+		"dimensions": res.Dim,
+		"usage":      gin.H{"prompt_tokens": res.Tokens, "total_tokens": res.Tokens},
 	})
 }
 
+// errorBody is the OpenAI error object.
+func errorBody(err error) gin.H {
+	return gin.H{"error": gin.H{"message": err.Error(), "type": "server_error"}}
+}
+
+func modelNotFound(err error) gin.H {
+	return gin.H{"error": gin.H{"message": err.Error(), "type": "invalid_request_error", "code": "model_not_found"}}
+}
+
 func toJSON(v any) string {
 	b, _ := json.Marshal(v)
 	return string(b)
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/haydenlabs/gollum/apis/admin"
 	"github.com/haydenlabs/gollum/apis/openai"
+	eng "github.com/haydenlabs/gollum/engine"
 	"github.com/haydenlabs/gollum/engine/impl"
 	"github.com/haydenlabs/gollum/metrics"
 	"github.com/haydenlabs/gollum/obs"
@@ -23,7 +29,11 @@ func main() {
 	// Register metrics
 	metrics.MustRegister()
 
-	engine := impl.NewEngine()
+	opts, err := engineOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine := impl.NewEngineWithOptions(opts)
 	r := gin.Default()
 	obs.Install(r)
 
@@ -33,6 +43,9 @@ func main() {
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	api := openai.NewAPI(engine)
 	api.Register(r)
+	if adm, ok := engine.(eng.ModelAdmin); ok {
+		admin.NewAPI(adm, os.Getenv("GOLLUM_ADMIN_TOKEN")).Register(r)
+	}
 
 	// selfTestMetal() // Disabled - Metal files temporarily disabled
 
@@ -47,3 +60,42 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// engineOptions reads model residency settings from the environment:
+// GOLLUM_MEMORY_BUDGET (bytes, or with a K, M or G suffix), GOLLUM_IDLE_UNLOAD
+// and GOLLUM_LOAD_TIMEOUT (Go durations).
+func engineOptions() (impl.Options, error) {
+	var opts impl.Options
+	if v := os.Getenv("GOLLUM_MEMORY_BUDGET"); v != "" {
+		mult := int64(1)
+		switch strings.ToUpper(v[len(v)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			v = v[:len(v)-1]
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, fmt.Errorf("GOLLUM_MEMORY_BUDGET: %w", err)
+		}
+		opts.MemoryBudget = int64(n * float64(mult))
+	}
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+	}{{"GOLLUM_IDLE_UNLOAD", &opts.IdleTimeout}, {"GOLLUM_LOAD_TIMEOUT", &opts.LoadTimeout}} {
+		if v := os.Getenv(d.env); v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %w", d.env, err)
+			}
+			*d.dst = t
+		}
+	}
+	return opts, nil
+}
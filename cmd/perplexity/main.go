@@ -0,0 +1,50 @@
+// Command perplexity measures what storing K and V quantized costs a model:
+// it scores the same text with each KV type and prints the perplexities and
+// their change from the first. With -low-memory the weights are streamed
+// from the file instead of loaded, so models larger than memory can be
+// scored, slowly.
+//
+//	perplexity -model models/llama.gguf -text wiki.test.raw -kv f32,q8_0,q4_0
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/haydenlabs/gollum/engine/impl"
+)
+
+func main() {
+	model := flag.String("model", "", "GGUF model to score with")
+	textPath := flag.String("text", "", "text file to score")
+	kv := flag.String("kv", "f32,q8_0,q4_0", "comma-separated KV types to compare")
+	window := flag.Int("window", 512, "tokens scored per window")
+	lowMemory := flag.Bool("low-memory", false, "stream weights from the file a layer at a time")
+	flag.Parse()
+	if *model == "" || *textPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	text, err := os.ReadFile(*textPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var base float64
+	fmt.Printf("%-8s %12s %9s\n", "kv_type", "perplexity", "change")
+	for i, typ := range strings.Split(*kv, ",") {
+		ppl, err := impl.Perplexity(*model, typ, string(text), *window, *lowMemory)
+		if err != nil {
+			log.Fatalf("%s: %v", typ, err)
+		}
+		if i == 0 {
+			base = ppl
+			fmt.Printf("%-8s %12.4f\n", typ, ppl)
+			continue
+		}
+		fmt.Printf("%-8s %12.4f %+8.2f%%\n", typ, ppl, 100*(ppl/base-1))
+	}
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrNoEmbeddings = errors.New("engine: model does not produce embeddings")
+	ErrInvalidInput = errors.New("engine: invalid input")
+)
+
+// EmbedRequest asks for one vector per input. Texts are tokenized by the
+// model and come first; Tokens are used as given.
+type EmbedRequest struct {
+	Model     string
+	Texts     []string
+	Tokens    [][]int
+	Normalize bool // scale each vector to unit L2 norm
+}
+
+type EmbedResult struct {
+	Vectors [][]float32
+	Dim     int
+	Tokens  int // input tokens across all inputs
+}
+
+// Embedder is implemented by backends with Capabilities.Embeddings. Embed
+// returns the pooled hidden state of tokens, which fit the context.
+type Embedder interface {
+	Embed(tokens []int) ([]float32, error)
+}
+
+// Embed checks and tokenizes req's inputs and runs them through ops.
+// Inputs that are empty, longer than the context or hold unknown token IDs
+// fail the whole request with ErrInvalidInput.
+func Embed(ctx context.Context, ops KernelOps, req *EmbedRequest) (*EmbedResult, error) {
+	caps := ops.Capabilities()
+	emb, ok := ops.(Embedder)
+	if !ok || !caps.Embeddings {
+		return nil, ErrNoEmbeddings
+	}
+	inputs := make([][]int, 0, len(req.Texts)+len(req.Tokens))
+	for _, text := range req.Texts {
+		inputs = append(inputs, ops.Tokenizer().Encode(text))
+	}
+	inputs = append(inputs, req.Tokens...)
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%w: no inputs", ErrInvalidInput)
+	}
+	res := &EmbedResult{Dim: caps.EmbedDim}
+	for i, toks := range inputs {
+		switch {
+		case len(toks) == 0:
+			return nil, fmt.Errorf("%w: input %d is empty", ErrInvalidInput, i)
+		case caps.ContextLen > 0 && len(toks) > caps.ContextLen:
+			return nil, fmt.Errorf("%w: input %d has %d tokens, the context holds %d", ErrInvalidInput, i, len(toks), caps.ContextLen)
+		}
+		for _, id := range toks {
+			if id < 0 || caps.VocabSize > 0 && id >= caps.VocabSize {
+				return nil, fmt.Errorf("%w: input %d has token %d outside the vocabulary", ErrInvalidInput, i, id)
+			}
+		}
+		res.Tokens += len(toks)
+	}
+	// One input at a time, so a cancelled request stops early.
+	for _, toks := range inputs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		v, err := emb.Embed(toks)
+		if err != nil {
+			return nil, err
+		}
+		if req.Normalize {
+			normalize(v)
+		}
+		res.Vectors = append(res.Vectors, v)
+	}
+	return res, nil
+}
+
+func normalize(v []float32) {
+	ss := float64(0)
+	for _, x := range v {
+		ss += float64(x) * float64(x)
+	}
+	if ss == 0 {
+		return
+	}
+	scale := float32(1 / math.Sqrt(ss))
+	for i := range v {
+		v[i] *= scale
+	}
+}
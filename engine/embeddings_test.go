@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// embedOps embeds tokens as their count and the sum of their ids.
+type embedOps struct{ *scriptOps }
+
+func (o embedOps) Embed(tokens []int) ([]float32, error) {
+	v := []float32{float32(len(tokens)), 0}
+	for _, id := range tokens {
+		v[1] += float32(id)
+	}
+	return v, nil
+}
+
+func newEmbedOps() embedOps {
+	o := embedOps{newScriptOps(nil)}
+	o.caps.Embeddings, o.caps.EmbedDim, o.caps.ContextLen = true, 2, 4
+	return o
+}
+
+func TestEmbed(t *testing.T) {
+	res, err := Embed(context.Background(), newEmbedOps(), &EmbedRequest{Texts: []string{"abc", "hi"}, Tokens: [][]int{{9, 9, 9, 9}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Texts first, then token inputs.
+	want := [][]float32{{3, 6}, {1, 4}, {4, 36}}
+	if res.Dim != 2 || res.Tokens != 8 || len(res.Vectors) != len(want) {
+		t.Fatalf("dim %d, %d tokens, %d vectors", res.Dim, res.Tokens, len(res.Vectors))
+	}
+	for i := range want {
+		if res.Vectors[i][0] != want[i][0] || res.Vectors[i][1] != want[i][1] {
+			t.Errorf("vector %d: %v, want %v", i, res.Vectors[i], want[i])
+		}
+	}
+
+	res, err = Embed(context.Background(), newEmbedOps(), &EmbedRequest{Tokens: [][]int{{2, 2, 0}}, Normalize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Vectors[0]; v[0] != 0.6 || v[1] != 0.8 {
+		t.Errorf("normalized %v, want [0.6 0.8]", v)
+	}
+}
+
+func TestEmbedErrors(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	noEmbed := newEmbedOps()
+	noEmbed.caps.Embeddings = false
+	tests := []struct {
+		name string
+		ctx  context.Context
+		ops  KernelOps
+		req  EmbedRequest
+		err  error
+	}{
+		{"not an embedder", context.Background(), newScriptOps(nil), EmbedRequest{Texts: []string{"a"}}, ErrNoEmbeddings},
+		{"embeddings off", context.Background(), noEmbed, EmbedRequest{Texts: []string{"a"}}, ErrNoEmbeddings},
+		{"no inputs", context.Background(), newEmbedOps(), EmbedRequest{}, ErrInvalidInput},
+		{"empty text", context.Background(), newEmbedOps(), EmbedRequest{Texts: []string{"a", "  "}}, ErrInvalidInput},
+		{"empty tokens", context.Background(), newEmbedOps(), EmbedRequest{Tokens: [][]int{{}}}, ErrInvalidInput},
+		{"longer than the context", context.Background(), newEmbedOps(), EmbedRequest{Texts: []string{"abcab"}}, ErrInvalidInput},
+		{"past the vocabulary", context.Background(), newEmbedOps(), EmbedRequest{Tokens: [][]int{{1, len(testVocab)}}}, ErrInvalidInput},
+		{"negative id", context.Background(), newEmbedOps(), EmbedRequest{Tokens: [][]int{{-1}}}, ErrInvalidInput},
+		{"cancelled", cancelled, newEmbedOps(), EmbedRequest{Texts: []string{"a"}}, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Embed(tt.ctx, tt.ops, &tt.req)
+			if !errors.Is(err, tt.err) || res != nil {
+				t.Errorf("got %v, %v, want %v", res, err, tt.err)
+			}
+		})
+	}
+}
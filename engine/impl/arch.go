@@ -0,0 +1,59 @@
+package impl
+
+import (
+	"math"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// archSpec is how a model family, keyed by general.architecture, maps onto
+// the shared transformer. What families vary beyond this, such as biases,
+// head sizes, window lengths and soft-capping, comes from the tensors present
+// and the metadata.
+type archSpec struct {
+	neox        bool // RoPE rotates dimension i with i+dim/2 instead of adjacent pairs
+	fusedQKV    bool // attn_qkv holds the Q, then K, then V rows
+	fusedGateUp bool // ffn_up holds the gate rows, then the up rows
+	gelu        bool // GeGLU feed-forward instead of SwiGLU
+	embedScale  bool // embeddings are multiplied by sqrt(n_embd)
+	postNorms   bool // attention and FFN outputs are normalized again before the residual add
+	// moeRawWeights mixes experts by their router probabilities as they are,
+	// rather than renormalized over the experts chosen.
+	moeRawWeights bool
+	// swaEvery picks the layers a sliding window applies to: those with
+	// l%swaEvery == 0. 0 means every layer.
+	swaEvery int
+	// attnScale overrides the 1/sqrt(head size) applied to attention scores.
+	attnScale func(m *gguf.Model) float32
+}
+
+var archs = map[string]archSpec{
+	"llama":    {}, // Mixtral too: its layers have expert tensors
+	"mistral":  {},
+	"qwen2":    {neox: true},
+	"qwen2moe": {neox: true, moeRawWeights: true},
+	"phi3":     {neox: true, fusedQKV: true, fusedGateUp: true},
+	"gemma":    {neox: true, gelu: true, embedScale: true},
+	"gemma2": {neox: true, gelu: true, embedScale: true, postNorms: true, swaEvery: 2,
+		attnScale: func(m *gguf.Model) float32 {
+			if m.NumLayers == 46 { // the 27B model scales by n_embd/n_head, not its head size
+				return float32(1 / math.Sqrt(float64(m.EmbedDim/m.NumHeads)))
+			}
+			return float32(1 / math.Sqrt(float64(m.HeadDim)))
+		}},
+}
+
+// geluTanh is the tanh approximation of GELU that Gemma's GeGLU uses.
+func geluTanh(x float32) float32 {
+	const c = 0.7978845608028654 // sqrt(2/pi)
+	return 0.5 * x * (1 + float32(math.Tanh(c*float64(x+0.044715*x*x*x))))
+}
+
+func softcap(x []float32, limit float32) {
+	if limit <= 0 {
+		return
+	}
+	for i, v := range x {
+		x[i] = limit * float32(math.Tanh(float64(v/limit)))
+	}
+}
@@ -0,0 +1,194 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var families = []string{"llama", "mistral", "qwen2", "phi3", "gemma", "gemma2", "mixtral", "qwen2moe"}
+
+// TestFamiliesForwardAgrees checks that a prompt run all at once, a token
+// at a time and in chunks gives each position the same logits, so KV
+// written by earlier steps is read back as the family's attention expects.
+func TestFamiliesForwardAgrees(t *testing.T) {
+	for _, arch := range families {
+		t.Run(arch, func(t *testing.T) {
+			be := newSynth(arch).load(t)
+			full := runChunked(t, be, 0, synthTokens, len(synthTokens))
+			for i, chunk := range []int{1, 5} {
+				got := runChunked(t, be, i+1, synthTokens, chunk)
+				if d := maxDiff(full, got); d > 1e-4 {
+					t.Errorf("%d tokens a step: logits differ from the full pass by %g", chunk, d)
+				}
+			}
+		})
+	}
+}
+
+func TestLlamaTiedOutput(t *testing.T) {
+	s := newSynth("llama")
+	s.set("output.weight", s.dims("token_embd.weight"), s.get("token_embd.weight"))
+	want := runChunked(t, s.load(t), 0, synthTokens, 5)
+	s.drop("output.weight")
+	got := runChunked(t, s.load(t), 0, synthTokens, 5)
+	if d := maxDiff(want, got); d != 0 {
+		t.Errorf("without output.weight logits differ from projecting by token_embd by %g", d)
+	}
+}
+
+// TestMistralSlidingWindow changes one early token. Through two layers of a
+// 4-token window it can reach 6 positions on and no further.
+func TestMistralSlidingWindow(t *testing.T) {
+	be := newSynth("mistral").load(t)
+	toks := append([]int(nil), synthTokens...)
+	want := runChunked(t, be, 0, toks, 5)
+	toks[2] = 20
+	got := runChunked(t, be, 1, toks, 5)
+	if d := maxDiff(want[3:4], got[3:4]); d == 0 {
+		t.Error("changing token 2 did not change position 3")
+	}
+	if d := maxDiff(want[9:], got[9:]); d != 0 {
+		t.Errorf("changing token 2 changed positions beyond the window by %g", d)
+	}
+}
+
+func TestQwen2Biases(t *testing.T) {
+	s := newSynth("qwen2")
+	biased := runChunked(t, s.load(t), 0, synthTokens, 5)
+	var names []string
+	for _, tn := range s.tensors {
+		if len(tn.dims) == 1 && tn.name[len(tn.name)-5:] == ".bias" {
+			names = append(names, tn.name)
+		}
+	}
+	if len(names) != 3*synthLayers {
+		t.Fatalf("%d bias tensors", len(names))
+	}
+	for _, name := range names {
+		s.set(name, []uint64{uint64(len(s.get(name)))}, make([]float32, len(s.get(name))))
+	}
+	zero := runChunked(t, s.load(t), 0, synthTokens, 5)
+	for _, name := range names {
+		s.drop(name)
+	}
+	none := runChunked(t, s.load(t), 0, synthTokens, 5)
+	if d := maxDiff(zero, none); d != 0 {
+		t.Errorf("zero biases differ from none by %g", d)
+	}
+	if d := maxDiff(biased, none); d < 1e-3 {
+		t.Errorf("biases changed logits by only %g", d)
+	}
+}
+
+// TestPhi3Fused checks the fused QKV and gate-up tensors against the same
+// weights split as qwen2 stores them; both rotate NeoX style.
+func TestPhi3Fused(t *testing.T) {
+	fused := runChunked(t, newSynth("phi3").load(t), 0, synthTokens, 5)
+	s := newSynth("qwen2")
+	for l := 0; l < synthLayers; l++ {
+		for _, b := range []string{"attn_q.bias", "attn_k.bias", "attn_v.bias"} {
+			s.drop(fmt.Sprintf("blk.%d.%s", l, b))
+		}
+	}
+	split := runChunked(t, s.load(t), 0, synthTokens, 5)
+	if d := maxDiff(fused, split); d > 1e-5 {
+		t.Errorf("fused tensors differ from split ones by %g", d)
+	}
+}
+
+// TestGemmaEmbeddingScale compares Gemma with a copy of the family that
+// does not scale embeddings, given them pre-scaled.
+func TestGemmaEmbeddingScale(t *testing.T) {
+	spec := archs["gemma"]
+	spec.embedScale = false
+	archs["gemma-unscaled"] = spec
+	defer delete(archs, "gemma-unscaled")
+
+	s := newSynth("gemma")
+	emb := s.get("token_embd.weight")
+	dims := s.dims("token_embd.weight")
+	s.set("output.weight", dims, emb)
+	want := runChunked(t, s.load(t), 0, synthTokens, 5)
+	scaled := make([]float32, len(emb))
+	for i, v := range emb {
+		scaled[i] = v * float32(math.Sqrt(synthEmbd))
+	}
+	s.set("token_embd.weight", dims, scaled)
+	s.rename("gemma-unscaled")
+	got := runChunked(t, s.load(t), 0, synthTokens, 5)
+	if d := maxDiff(want, got); d != 0 {
+		t.Errorf("scaled embeddings differ from pre-scaled ones by %g", d)
+	}
+}
+
+func TestGemma2Softcap(t *testing.T) {
+	s := newSynth("gemma2")
+	peak := func(rows [][]float32) float32 {
+		m := float32(0)
+		for _, r := range rows {
+			for _, v := range r {
+				m = max(m, float32(math.Abs(float64(v))))
+			}
+		}
+		return m
+	}
+	if p := peak(runChunked(t, s.load(t), 0, synthTokens, 5)); p > 3 {
+		t.Errorf("logits reach %g past the soft cap of 3", p)
+	}
+	s.dropMeta("gemma2.final_logit_softcapping")
+	if p := peak(runChunked(t, s.load(t), 0, synthTokens, 5)); p <= 3 {
+		t.Errorf("uncapped logits only reach %g, so the cap is not exercised", p)
+	}
+}
+
+// TestMixtralExperts makes every expert the dense llama feed-forward, which
+// mixing by renormalized router weights must then reproduce.
+func TestMixtralExperts(t *testing.T) {
+	dense := newSynth("llama")
+	want := runChunked(t, dense.load(t), 0, synthTokens, 5)
+	s := newSynth("mixtral")
+	for l := 0; l < synthLayers; l++ {
+		for _, f := range []string{"gate", "up", "down"} {
+			p := fmt.Sprintf("blk.%d.ffn_%s", l, f)
+			stackExperts(s, p+"_exps.weight", dense, p+".weight")
+		}
+	}
+	got := runChunked(t, s.load(t), 0, synthTokens, 5)
+	if d := maxDiff(want, got); d > 1e-4 {
+		t.Errorf("identical experts differ from the dense model by %g", d)
+	}
+}
+
+// TestQwen2MoESharedExpert silences the routed experts and leaves the shared
+// one ungated, which must then match qwen2 with it as the dense feed-forward.
+func TestQwen2MoESharedExpert(t *testing.T) {
+	dense := newSynth("qwen2")
+	want := runChunked(t, dense.load(t), 0, synthTokens, 5)
+	s := newSynth("qwen2moe")
+	for l := 0; l < synthLayers; l++ {
+		p := fmt.Sprintf("blk.%d.", l)
+		down := p + "ffn_down_exps.weight"
+		s.set(down, []uint64{synthFF, synthExperts * synthEmbd}, make([]float32, synthExperts*synthEmbd*synthFF))
+		s.drop(p + "ffn_gate_inp_shexp.weight")
+		for _, f := range []string{"gate", "up", "down"} {
+			w := dense.get(p + "ffn_" + f + ".weight")
+			s.set(p+"ffn_"+f+"_shexp.weight", dense.dims(p+"ffn_"+f+".weight"), w)
+		}
+	}
+	got := runChunked(t, s.load(t), 0, synthTokens, 5)
+	if d := maxDiff(want, got); d > 1e-5 {
+		t.Errorf("the shared expert differs from the dense feed-forward by %g", d)
+	}
+}
+
+// stackExperts sets the expert tensor name of s to every expert a copy of
+// the dense tensor from of src.
+func stackExperts(s *synthModel, name string, src *synthModel, from string) {
+	w, dims := src.get(from), src.dims(from)
+	var data []float32
+	for e := 0; e < synthExperts; e++ {
+		data = append(data, w...)
+	}
+	s.set(name, []uint64{dims[0], dims[1] * synthExperts}, data)
+}
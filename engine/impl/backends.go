@@ -2,9 +2,10 @@ package impl
 
 import (
 	"math"
-	"strings"
 
 	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/kernels/cpu"
+	"github.com/haydenlabs/gollum/tokenizer"
 )
 
 const Kdim = 64 // embedding dimension
@@ -22,93 +23,141 @@ func init() {
 	}
 }
 
-type stubOps struct{}
+// stubOps is the toy backend. Its "KV" is a rolling hash of the tokens so far,
+// stored per position in the pager's blocks, so prefix sharing and
+// copy-on-write behave as they would with a real cache.
+type stubOps struct {
+	tok *tokenizer.Pieces
+	kv  map[int]*[engine.KVBlockTokens]uint64
+}
 
 func NewMetalOps() *stubOps {
-	return &stubOps{}
+	return &stubOps{tok: tokenizer.NewPieces(tinyVocab), kv: make(map[int]*[engine.KVBlockTokens]uint64)}
 }
 
-func (m *stubOps) Prefill(batch *engine.Batch) error {
-	// Toy implementation: just simulate some processing time
-	return nil
+func (m *stubOps) Capabilities() engine.Capabilities {
+	return engine.Capabilities{
+		MaxBatch:       32,
+		MaxBatchTokens: 512,
+		DTypes:         []string{"f32"},
+		Embeddings:     true,
+		EmbedDim:       Kdim,
+		VocabSize:      tinyVocabSize, // the logits Forward returns; byte fallbacks only come from prompts
+		ContextLen:     4096,
+	}
 }
 
-func (m *stubOps) Decode(step *engine.Step) (int, error) {
-	// Toy implementation: simulate processing time
-	return step.BatchSize, nil
-}
+func (m *stubOps) Tokenizer() engine.Tokenizer { return m.tok }
 
-// PredictNext with persistent KV: per item, create KV handle if 0, append (K=V=Q), attend over full sequence, project.
-func (m *stubOps) PredictNext(ctxs []engine.DecodeCtx) []string {
-	M := len(ctxs)
+// Forward appends each token to the sequence's KV (demo: a hash chain), then
+// projects the state of sequences that want logits onto the tiny vocab.
+func (m *stubOps) Forward(step *engine.Step) ([]engine.SeqResult, error) {
+	type row struct{ seq, pos int }
+	var want []row
+	for i, s := range step.Seqs {
+		h := uint64(0)
+		if s.Pos > 0 {
+			h = m.slot(s.Blocks, s.Pos-1)
+		}
+		for j, tok := range s.Tokens {
+			h = h*31 + uint64(tok) + 1
+			m.setSlot(s.Blocks, s.Pos+j, h)
+		}
+		switch {
+		case s.AllLogits:
+			for j := range s.Tokens {
+				want = append(want, row{i, j})
+			}
+		case s.Logits:
+			want = append(want, row{i, len(s.Tokens) - 1})
+		}
+	}
+	M := len(want)
+	results := make([]engine.SeqResult, 0, len(step.Seqs))
 	if M == 0 {
-		return nil
+		return results, nil
 	}
 	ctxVec := make([]float32, M*Kdim)
-	// Build Q from prompt, ensure KV handle exists, append, attend
-	for i := 0; i < M; i++ {
-		p := ctxs[i].Prompt
-		q := promptVec(p, Kdim)
-		h := ctxs[i].KVHandle
-		if h == 0 {
-			h = i + 1 // Simple stub handle
-			// Persist handle back into bound block when scheduler sees it next tick:
-			// (scheduler reads rs.kv.KVHandle to pass it here; we set it via side-effect below)
-		}
-		// Append token K/V (demo: K=V=Q) - stub implementation
-		// In a real implementation, this would call metal.KVAppend(h, q, q, Kdim)
-
-		// Simple attention: just use the query vector for now
-		copy(ctxVec[i*Kdim:(i+1)*Kdim], q)
-
-		// Store handle into the KV block if available (idempotent). We expose a tiny hook:
-		// In this minimal patch, scheduler carries KVHandle via DecodeCtx and expects us to reuse 'h' next call.
-		ctxs[i].KVHandle = h
+	for r, w := range want {
+		s := step.Seqs[w.seq]
+		copy(ctxVec[r*Kdim:(r+1)*Kdim], stateVec(m.slot(s.Blocks, s.Pos+w.pos), Kdim))
 	}
 	V := len(tinyVocab)
 	// Project ctx -> logits
 	logits := cpuMatMul(ctxVec, M, projW, Kdim, V)
-	res := make([]string, M)
-	for i := 0; i < M; i++ {
-		best := 0
-		bestv := logits[i*V]
-		for j := 1; j < V; j++ {
-			if logits[i*V+j] > bestv {
-				best = j
-				bestv = logits[i*V+j]
+	for r := 0; r < M; {
+		s := step.Seqs[want[r].seq]
+		start := r
+		for ; r < M && want[r].seq == want[start].seq; r++ {
+			if prev := s.Tokens[want[r].pos]; prev < V {
+				logits[r*V+prev] = float32(math.Inf(-1)) // don't repeat the previous word
 			}
 		}
-		res[i] = tinyVocab[best]
-		if strings.HasSuffix(ctxs[i].Prompt, res[i]) {
-			res[i] = "."
+		results = append(results, engine.SeqResult{Seq: s.Seq, Logits: logits[start*V : r*V]})
+	}
+	return results, nil
+}
+
+// Embed mean-pools the state after each token, computed as Forward would
+// but without touching the KV.
+func (m *stubOps) Embed(tokens []int) ([]float32, error) {
+	out := make([]float32, Kdim)
+	h := uint64(0)
+	for _, tok := range tokens {
+		h = h*31 + uint64(tok) + 1
+		for i, v := range stateVec(h, Kdim) {
+			out[i] += v / float32(len(tokens))
 		}
 	}
-	return res
+	return out, nil
 }
 
-func promptVec(prompt string, dim int) []float32 {
+func (m *stubOps) slot(blocks []int, pos int) uint64 {
+	if b := m.kv[blocks[pos/engine.KVBlockTokens]]; b != nil {
+		return b[pos%engine.KVBlockTokens]
+	}
+	return 0
+}
+
+func (m *stubOps) setSlot(blocks []int, pos int, h uint64) {
+	id := blocks[pos/engine.KVBlockTokens]
+	b := m.kv[id]
+	if b == nil {
+		b = new([engine.KVBlockTokens]uint64)
+		m.kv[id] = b
+	}
+	b[pos%engine.KVBlockTokens] = h
+}
+
+func (m *stubOps) CopyKV(dst, src *engine.KVBlock, tokens int) error {
+	if sb := m.kv[src.ID]; sb != nil {
+		db := new([engine.KVBlockTokens]uint64)
+		copy(db[:tokens], sb[:tokens])
+		m.kv[dst.ID] = db
+	}
+	return nil
+}
+
+// ShiftKV moves the states of later positions down. The hashes still cover
+// the dropped tokens; the toy model has no positions to correct.
+func (m *stubOps) ShiftKV(blocks []int, from, n, length int) error {
+	for p := from + n; p < length; p++ {
+		m.setSlot(blocks, p-n, m.slot(blocks, p))
+	}
+	return nil
+}
+
+func stateVec(h uint64, dim int) []float32 {
 	// Simple hash-based embedding
 	vec := make([]float32, dim)
-	hash := 0
-	for _, c := range prompt {
-		hash = hash*31 + int(c)
-	}
 	for i := 0; i < dim; i++ {
-		vec[i] = float32(math.Sin(float64(hash+i)) * 0.1)
+		vec[i] = float32(math.Sin(float64(h%1000003)+float64(i)) * 0.1)
 	}
 	return vec
 }
 
 func cpuMatMul(A []float32, M int, B []float32, K, N int) []float32 {
 	C := make([]float32, M*N)
-	for i := 0; i < M; i++ {
-		for j := 0; j < N; j++ {
-			sum := float32(0)
-			for k := 0; k < K; k++ {
-				sum += A[i*K+k] * B[k*N+j]
-			}
-			C[i*N+j] = sum
-		}
-	}
+	cpu.MatMul(C, A, B, M, N, K)
 	return C
 }
@@ -0,0 +1,80 @@
+package impl
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/metrics"
+)
+
+// generate runs req to the end on a fresh scheduler over the toy backend.
+func generate(t *testing.T, req *engine.GenRequest) (string, string) {
+	t.Helper()
+	s := engine.NewScheduler(NewMetalOps())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	go s.Run(ctx)
+	ch, _ := s.Enqueue(ctx, req)
+	var text strings.Builder
+	for tok := range ch {
+		if tok.Err != nil {
+			t.Fatal(tok.Err)
+		}
+		text.WriteString(tok.Text)
+		if tok.FinishReason != "" {
+			return text.String(), tok.FinishReason
+		}
+	}
+	t.Fatal("stream closed without a finish reason")
+	return "", ""
+}
+
+// TestPromptLookup speculates over a prompt whose byte-fallback tokens lie
+// outside the toy model's logits. Greedy output must match decoding without
+// speculation, and proposals must still be made from the in-vocabulary
+// tokens.
+func TestPromptLookup(t *testing.T) {
+	const prompt = " llama!! on!! the!! high!! plain!!.!! gentle!!,!! wind!! hums!! softly!!"
+	want, reason := generate(t, &engine.GenRequest{Model: "plain", Prompt: prompt, MaxTokens: 40, PromptLookup: -1})
+	if reason != engine.FinishLength {
+		t.Fatalf("finished with %q", reason)
+	}
+	proposed := metrics.SpecTokens.WithLabelValues("lookup", "lookup", "proposed")
+	before := count(proposed)
+	got, reason := generate(t, &engine.GenRequest{Model: "lookup", Prompt: prompt, MaxTokens: 40, PromptLookup: 1})
+	if reason != engine.FinishLength {
+		t.Fatalf("with prompt lookup, finished with %q", reason)
+	}
+	if got != want {
+		t.Errorf("with prompt lookup:\n%q\nwant\n%q", got, want)
+	}
+	if count(proposed) == before {
+		t.Error("prompt lookup proposed nothing")
+	}
+}
+
+// TestToyVocabSize checks that the toy backend reports as many tokens as its
+// logit rows hold, byte fallbacks aside.
+func TestToyVocabSize(t *testing.T) {
+	m := NewMetalOps()
+	blk := []int{0}
+	res, err := m.Forward(&engine.Step{Seqs: []engine.SeqStep{{Seq: 1, Tokens: []int{0, 1, 2}, Blocks: blk, Logits: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res[0].Logits), m.Capabilities().VocabSize; got != want {
+		t.Errorf("Forward returned %d logits, Capabilities reports %d tokens", got, want)
+	}
+}
+
+func count(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,112 @@
+package impl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// modelConfig holds optional per-model settings, read from a JSON file next to
+// the GGUF with the same base name (models/llama.json for models/llama.gguf).
+type modelConfig struct {
+	Draft       string `json:"draft"`        // GGUF of a smaller model from the same family, relative to the model's directory
+	DraftTokens int    `json:"draft_tokens"` // tokens the draft proposes per step; default 4
+	// Prompt-lookup speculation: match the last PromptLookup tokens earlier in
+	// the sequence and propose up to LookupTokens of what followed.
+	PromptLookup int `json:"prompt_lookup"`
+	LookupTokens int `json:"lookup_tokens"` // default 8
+	// Overrides for what the GGUF says about positions.
+	ContextLength int         `json:"context_length"`
+	RopeFreqBase  float32     `json:"rope_freq_base"`
+	RopeScaling   *ropeConfig `json:"rope_scaling"`
+	KVType        string      `json:"kv_type"` // f32 (default), q8_0 or q4_0
+	// LowMemory maps the GGUF instead of loading it and streams the weights
+	// from the file a layer at a time, for models larger than memory.
+	LowMemory bool `json:"low_memory"`
+}
+
+// ropeConfig overrides the fields of gguf.RopeScaling it sets.
+type ropeConfig struct {
+	Type                  string  `json:"type"` // none, linear, ntk, yarn or longrope
+	Factor                float32 `json:"factor"`
+	OriginalContextLength int     `json:"original_context_length"`
+	AttnFactor            float32 `json:"attn_factor"`
+	BetaFast              float32 `json:"beta_fast"`
+	BetaSlow              float32 `json:"beta_slow"`
+	// LongRoPE's per-frequency factors, one per rotated pair of a head.
+	ShortFactors []float32 `json:"short_factors"`
+	LongFactors  []float32 `json:"long_factors"`
+}
+
+// override applies the config's position settings to m before its backend is built.
+func (c modelConfig) override(m *gguf.Model) {
+	if c.ContextLength > 0 {
+		m.ContextLen = c.ContextLength
+	}
+	if c.RopeFreqBase > 0 {
+		m.RopeBase = c.RopeFreqBase
+	}
+	rc := c.RopeScaling
+	if rc == nil {
+		return
+	}
+	rs := &m.Rope
+	if rc.Type != "" {
+		rs.Type = rc.Type
+	}
+	if rc.Factor > 0 {
+		rs.Factor = rc.Factor
+	}
+	if rc.OriginalContextLength > 0 {
+		rs.OrigContext = rc.OriginalContextLength
+	}
+	if rc.AttnFactor > 0 {
+		rs.AttnFactor = rc.AttnFactor
+	}
+	if rc.BetaFast > 0 {
+		rs.BetaFast = rc.BetaFast
+	}
+	if rc.BetaSlow > 0 {
+		rs.BetaSlow = rc.BetaSlow
+	}
+	if rc.ShortFactors != nil {
+		rs.ShortFactors = rc.ShortFactors
+	}
+	if rc.LongFactors != nil {
+		rs.LongFactors = rc.LongFactors
+	}
+}
+
+// kvType returns the GGUF type the config stores K and V as.
+func (c modelConfig) kvType() (uint32, error) {
+	switch c.KVType {
+	case "", "f32":
+		return gguf.TypeF32, nil
+	case "q8_0":
+		return gguf.TypeQ8_0, nil
+	case "q4_0":
+		return gguf.TypeQ4_0, nil
+	}
+	return 0, fmt.Errorf("unsupported kv_type %q", c.KVType)
+}
+
+func loadModelConfig(ggufPath string) (modelConfig, error) {
+	var cfg modelConfig
+	path := strings.TrimSuffix(ggufPath, ".gguf") + ".json"
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,246 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/haydenlabs/gollum/gguf"
+	"github.com/haydenlabs/gollum/kernels/cpu"
+)
+
+// encoder is a BERT-style bidirectional model for embeddings: token, token
+// type and position embeddings, then post-norm layers whose attention sees
+// the whole input. "bert" learns absolute positions and uses a GELU
+// feed-forward; "nomic-bert" rotates Q and K (NeoX style), fuses QKV and
+// uses SwiGLU.
+type encoder struct {
+	nEmbd, nHead, nFF, nVocab, nPos int
+	eps                             float32
+	ropeBase                        float32
+	rotary                          bool
+
+	tokEmbd, posEmbd  cpu.Matrix
+	typeEmbd          []float32
+	embNorm, embNormB []float32
+	layers            []encoderLayer
+}
+
+type encoderLayer struct {
+	wq, wk, wv, wqkv    cpu.Matrix // Q, K and V, or fused QKV
+	bq, bk, bv, bqkv    []float32
+	wo                  cpu.Matrix
+	bo                  []float32
+	attnNorm, attnNormB []float32
+	wUp, wGate          cpu.Matrix // gate only for SwiGLU
+	bUp                 []float32
+	wDown               cpu.Matrix
+	bDown               []float32
+	outNorm, outNormB   []float32
+}
+
+func isEncoder(arch string) bool { return arch == "bert" || arch == "nomic-bert" }
+
+func newEncoder(m *gguf.Model) (*encoder, error) {
+	e := &encoder{
+		nEmbd:    m.EmbedDim,
+		nHead:    m.NumHeads,
+		nFF:      m.FFNDim,
+		nVocab:   m.VocabSize,
+		nPos:     m.ContextLen,
+		eps:      m.NormEps,
+		ropeBase: m.RopeBase,
+		rotary:   m.Arch == "nomic-bert",
+	}
+	ws := &weights{m: m}
+	get := func(name string, size int) []float32 { return ws.vec(name, size, true) }
+	opt := func(name string, size int) []float32 { return ws.vec(name, size, false) }
+	mat := func(name string, rows, cols int) cpu.Matrix { return ws.mat(name, rows, cols, true) }
+	d, ff := e.nEmbd, e.nFF
+	e.tokEmbd = mat("token_embd.weight", e.nVocab, d)
+	if tn, ok := m.GGUF.Tensors["token_types.weight"]; ok && tn.Size >= uint64(d) && tn.Size%uint64(d) == 0 {
+		e.typeEmbd = make([]float32, d)
+		ws.mat("token_types.weight", int(tn.Size)/d, d, true).Row(0, e.typeEmbd) // every token is type 0
+	}
+	if !e.rotary {
+		e.posEmbd = mat("position_embd.weight", e.nPos, d)
+	}
+	e.embNorm = get("token_embd_norm.weight", d)
+	e.embNormB = opt("token_embd_norm.bias", d)
+	e.layers = make([]encoderLayer, m.NumLayers)
+	for l := range e.layers {
+		p := fmt.Sprintf("blk.%d.", l)
+		el := encoderLayer{
+			wo:        mat(p+"attn_output.weight", d, d),
+			bo:        opt(p+"attn_output.bias", d),
+			attnNorm:  get(p+"attn_output_norm.weight", d),
+			attnNormB: opt(p+"attn_output_norm.bias", d),
+			wUp:       mat(p+"ffn_up.weight", ff, d),
+			bUp:       opt(p+"ffn_up.bias", ff),
+			wDown:     mat(p+"ffn_down.weight", d, ff),
+			bDown:     opt(p+"ffn_down.bias", d),
+			outNorm:   get(p+"layer_output_norm.weight", d),
+			outNormB:  opt(p+"layer_output_norm.bias", d),
+		}
+		if _, ok := m.GGUF.Tensors[p+"attn_qkv.weight"]; ok {
+			el.wqkv = mat(p+"attn_qkv.weight", 3*d, d)
+			el.bqkv = opt(p+"attn_qkv.bias", 3*d)
+		} else {
+			el.wq, el.bq = mat(p+"attn_q.weight", d, d), opt(p+"attn_q.bias", d)
+			el.wk, el.bk = mat(p+"attn_k.weight", d, d), opt(p+"attn_k.bias", d)
+			el.wv, el.bv = mat(p+"attn_v.weight", d, d), opt(p+"attn_v.bias", d)
+		}
+		if e.rotary {
+			el.wGate = mat(p+"ffn_gate.weight", ff, d)
+		}
+		e.layers[l] = el
+	}
+	if err := ws.err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// hidden returns the last layer's output for every token.
+func (e *encoder) hidden(tokens []int) ([]float32, error) {
+	n, d := len(tokens), e.nEmbd
+	if !e.rotary && n > e.nPos {
+		return nil, fmt.Errorf("%d tokens exceed %d positions", n, e.nPos)
+	}
+	x := make([]float32, n*d)
+	pe := make([]float32, d)
+	for i, tok := range tokens {
+		if tok < 0 || tok >= e.nVocab {
+			return nil, fmt.Errorf("token %d out of range", tok)
+		}
+		xi := x[i*d : (i+1)*d]
+		e.tokEmbd.Row(tok, xi)
+		if e.typeEmbd != nil {
+			addInPlace(xi, e.typeEmbd)
+		}
+		if e.posEmbd.Rows > 0 {
+			e.posEmbd.Row(i, pe)
+			addInPlace(xi, pe)
+		}
+	}
+	layerNorm(x, x, e.embNorm, e.embNormB, d, e.eps)
+
+	headDim := d / e.nHead
+	q := make([]float32, n*d)
+	k := make([]float32, n*d)
+	v := make([]float32, n*d)
+	att := make([]float32, n*d)
+	o := make([]float32, n*d)
+	up := make([]float32, n*e.nFF)
+	gate := make([]float32, n*e.nFF)
+	var qkv []float32
+	for l := range e.layers {
+		el := &e.layers[l]
+		if el.wqkv.Rows > 0 {
+			if qkv == nil {
+				qkv = make([]float32, n*3*d)
+			}
+			linearBias(qkv, x, el.wqkv, el.bqkv, n)
+			for i := 0; i < n; i++ {
+				row := qkv[i*3*d:]
+				copy(q[i*d:(i+1)*d], row[:d])
+				copy(k[i*d:(i+1)*d], row[d:2*d])
+				copy(v[i*d:(i+1)*d], row[2*d:3*d])
+			}
+		} else {
+			linearBias(q, x, el.wq, el.bq, n)
+			linearBias(k, x, el.wk, el.bk, n)
+			linearBias(v, x, el.wv, el.bv, n)
+		}
+		if e.rotary {
+			for i := 0; i < n; i++ {
+				ropeNeox(q[i*d:(i+1)*d], e.nHead, headDim, i, e.ropeBase)
+				ropeNeox(k[i*d:(i+1)*d], e.nHead, headDim, i, e.ropeBase)
+			}
+		}
+		fullAttention(att, q, k, v, n, e.nHead, headDim)
+		linearBias(o, att, el.wo, el.bo, n)
+		addInPlace(x, o)
+		layerNorm(x, x, el.attnNorm, el.attnNormB, d, e.eps)
+
+		linearBias(up, x, el.wUp, el.bUp, n)
+		if el.wGate.Rows > 0 {
+			linear(gate, x, el.wGate, n)
+			for i := range up {
+				up[i] *= silu(gate[i])
+			}
+		} else {
+			for i := range up {
+				up[i] = gelu(up[i])
+			}
+		}
+		linearBias(o, up, el.wDown, el.bDown, n)
+		addInPlace(x, o)
+		layerNorm(x, x, el.outNorm, el.outNormB, d, e.eps)
+	}
+	return x, nil
+}
+
+// fullAttention is unmasked attention among n tokens, one head at a time.
+func fullAttention(out, Q, K, V []float32, n, nHead, headDim int) {
+	d := nHead * headDim
+	scale := 1.0 / float32(math.Sqrt(float64(headDim)))
+	scores := make([]float32, n)
+	for h := 0; h < nHead; h++ {
+		off := h * headDim
+		for i := 0; i < n; i++ {
+			q := Q[i*d+off : i*d+off+headDim]
+			for j := 0; j < n; j++ {
+				k := K[j*d+off : j*d+off+headDim]
+				sum := float32(0)
+				for c, qv := range q {
+					sum += qv * k[c]
+				}
+				scores[j] = sum * scale
+			}
+			softmaxInPlace(scores)
+			o := out[i*d+off : i*d+off+headDim]
+			for c := range o {
+				o[c] = 0
+			}
+			for j, w := range scores {
+				vj := V[j*d+off : j*d+off+headDim]
+				for c := range o {
+					o[c] += w * vj[c]
+				}
+			}
+		}
+	}
+}
+
+// linearBias is linear plus a bias per output, if b is non-nil.
+func linearBias(y, x []float32, w cpu.Matrix, b []float32, n int) {
+	linear(y, x, w, n)
+	if b == nil {
+		return
+	}
+	out := w.Rows
+	for i := 0; i < n; i++ {
+		addInPlace(y[i*out:(i+1)*out], b)
+	}
+}
+
+// ropeNeox rotates dimension i of each head with dimension i+headDim/2.
+func ropeNeox(x []float32, heads, headDim, pos int, base float32) {
+	half := headDim / 2
+	for i := 0; i < half; i++ {
+		theta := float64(pos) * math.Pow(float64(base), -float64(2*i)/float64(headDim))
+		sin, cos := math.Sincos(theta)
+		c, s := float32(cos), float32(sin)
+		for h := 0; h < heads; h++ {
+			p := x[h*headDim:]
+			x0, x1 := p[i], p[i+half]
+			p[i] = x0*c - x1*s
+			p[i+half] = x0*s + x1*c
+		}
+	}
+}
+
+// gelu is the exact, erf-based GELU that BERT was trained with.
+func gelu(x float32) float32 {
+	return 0.5 * x * (1 + float32(math.Erf(float64(x)/math.Sqrt2)))
+}
@@ -0,0 +1,303 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// synthWordPieces is the vocabulary of the synthetic encoders.
+var synthWordPieces = []string{"[PAD]", "[UNK]", "[CLS]", "[SEP]", "the", "cat", "sat", "un", "##aff", "##able", ",", "."}
+
+// newSynthEncoder builds an encoder as its GGUF files lay it out: learned
+// positions, token types and biases everywhere for bert; fused QKV, a gated
+// feed-forward and no biases but the norms' for nomic-bert. pooling is the
+// GGUF's pooling_type, 0 for none.
+func newSynthEncoder(arch string, pooling uint32) *synthModel {
+	s := &synthModel{arch: arch, typ: gguf.TypeF32}
+	d, ff, V := synthEmbd, synthFF, len(synthWordPieces)
+	types := make([]int32, V)
+	for i := range types {
+		types[i] = 1
+	}
+	types[0], types[1], types[2], types[3] = 3, 2, 3, 3
+	s.meta("general.architecture", arch)
+	s.hparam("embedding_length", uint32(d))
+	s.hparam("block_count", uint32(synthLayers))
+	s.hparam("attention.head_count", uint32(synthHeads))
+	s.hparam("feed_forward_length", uint32(ff))
+	s.hparam("context_length", uint32(64))
+	s.hparam("attention.layer_norm_epsilon", float32(1e-5))
+	if arch == "nomic-bert" {
+		s.hparam("rope.freq_base", float32(1000))
+	}
+	if pooling != 0 {
+		s.hparam("pooling_type", pooling)
+	}
+	s.meta("tokenizer.ggml.model", "bert")
+	s.meta("tokenizer.ggml.tokens", synthWordPieces)
+	s.meta("tokenizer.ggml.token_type", types)
+	s.meta("tokenizer.ggml.cls_token_id", uint32(2))
+	s.meta("tokenizer.ggml.seperator_token_id", uint32(3))
+
+	bert := arch == "bert"
+	bias := func(name string, n int) {
+		if bert {
+			s.set(name, []uint64{uint64(n)}, synthData(name, n, 0.1))
+		}
+	}
+	norm := func(name string) {
+		s.vec(name+".weight", d)
+		s.set(name+".bias", []uint64{uint64(d)}, synthData(name+".bias", d, 0.1))
+	}
+	s.mat("token_embd.weight", V, d, 0.5)
+	s.mat("token_types.weight", 2, d, 0.5)
+	if bert {
+		s.mat("position_embd.weight", 64, d, 0.5)
+	}
+	norm("token_embd_norm")
+	for l := 0; l < synthLayers; l++ {
+		p := fmt.Sprintf("blk.%d.", l)
+		if bert {
+			for _, w := range []string{"attn_q", "attn_k", "attn_v"} {
+				s.mat(p+w+".weight", d, d, 0.3)
+				bias(p+w+".bias", d)
+			}
+		} else {
+			s.mat(p+"attn_qkv.weight", 3*d, d, 0.3)
+		}
+		s.mat(p+"attn_output.weight", d, d, 0.3)
+		bias(p+"attn_output.bias", d)
+		norm(p + "attn_output_norm")
+		s.mat(p+"ffn_up.weight", ff, d, 0.3)
+		bias(p+"ffn_up.bias", ff)
+		if !bert {
+			s.mat(p+"ffn_gate.weight", ff, d, 0.3)
+		}
+		s.mat(p+"ffn_down.weight", d, ff, 0.3)
+		bias(p+"ffn_down.bias", d)
+		norm(p + "layer_output_norm")
+	}
+	return s
+}
+
+// refEncode runs s in float64 straight from its tensors, one token and one
+// head at a time, and returns the last layer's output for each token.
+func refEncode(s *synthModel, toks []int) [][]float64 {
+	d, ff, hd, n := synthEmbd, synthFF, synthEmbd/synthHeads, len(toks)
+	bert := s.arch == "bert"
+	has := func(name string) bool {
+		for _, t := range s.tensors {
+			if t.name == name {
+				return true
+			}
+		}
+		return false
+	}
+	// linear is W·x plus the bias, if the model has one.
+	linear := func(name string, x []float64, rows int) []float64 {
+		w := s.get(name + ".weight")
+		y := make([]float64, rows)
+		for r := range y {
+			for c, v := range x {
+				y[r] += float64(w[r*len(x)+c]) * v
+			}
+			if has(name + ".bias") {
+				y[r] += float64(s.get(name + ".bias")[r])
+			}
+		}
+		return y
+	}
+	layerNorm := func(name string, x []float64) {
+		mean, vari := 0.0, 0.0
+		for _, v := range x {
+			mean += v / float64(d)
+		}
+		for _, v := range x {
+			vari += (v - mean) * (v - mean) / float64(d)
+		}
+		w, b := s.get(name+".weight"), s.get(name+".bias")
+		for i := range x {
+			x[i] = (x[i]-mean)/math.Sqrt(vari+1e-5)*float64(w[i]) + float64(b[i])
+		}
+	}
+	rope := func(x []float64, pos int) {
+		for h := 0; h < synthHeads; h++ {
+			p := x[h*hd:]
+			for i := 0; i < hd/2; i++ {
+				sin, cos := math.Sincos(float64(pos) * math.Pow(1000, -float64(2*i)/float64(hd)))
+				p[i], p[i+hd/2] = p[i]*cos-p[i+hd/2]*sin, p[i]*sin+p[i+hd/2]*cos
+			}
+		}
+	}
+
+	x := make([][]float64, n)
+	for i, tok := range toks {
+		x[i] = make([]float64, d)
+		for j := range x[i] {
+			x[i][j] = float64(s.get("token_embd.weight")[tok*d+j]) + float64(s.get("token_types.weight")[j])
+			if bert {
+				x[i][j] += float64(s.get("position_embd.weight")[i*d+j])
+			}
+		}
+		layerNorm("token_embd_norm", x[i])
+	}
+	for l := 0; l < synthLayers; l++ {
+		p := fmt.Sprintf("blk.%d.", l)
+		q, k, v := make([][]float64, n), make([][]float64, n), make([][]float64, n)
+		for i := range x {
+			if bert {
+				q[i], k[i], v[i] = linear(p+"attn_q", x[i], d), linear(p+"attn_k", x[i], d), linear(p+"attn_v", x[i], d)
+			} else {
+				qkv := linear(p+"attn_qkv", x[i], 3*d)
+				q[i], k[i], v[i] = qkv[:d], qkv[d:2*d], qkv[2*d:]
+				rope(q[i], i)
+				rope(k[i], i)
+			}
+		}
+		for i := range x {
+			att := make([]float64, d)
+			for h := 0; h < synthHeads; h++ {
+				w := make([]float64, n)
+				sum := 0.0
+				for j := range w {
+					for c := h * hd; c < (h+1)*hd; c++ {
+						w[j] += q[i][c] * k[j][c]
+					}
+					w[j] = math.Exp(w[j] / math.Sqrt(float64(hd)))
+					sum += w[j]
+				}
+				for j := range w {
+					for c := h * hd; c < (h+1)*hd; c++ {
+						att[c] += w[j] / sum * v[j][c]
+					}
+				}
+			}
+			o := linear(p+"attn_output", att, d)
+			for j := range o {
+				o[j] += x[i][j]
+			}
+			layerNorm(p+"attn_output_norm", o)
+			up := linear(p+"ffn_up", o, ff)
+			if bert {
+				for j := range up {
+					up[j] = 0.5 * up[j] * (1 + math.Erf(up[j]/math.Sqrt2))
+				}
+			} else {
+				gate := linear(p+"ffn_gate", o, ff)
+				for j := range up {
+					up[j] *= gate[j] / (1 + math.Exp(-gate[j]))
+				}
+			}
+			down := linear(p+"ffn_down", up, d)
+			for j := range down {
+				down[j] += o[j]
+			}
+			layerNorm(p+"layer_output_norm", down)
+			x[i] = down
+		}
+	}
+	return x
+}
+
+// encoderTokens is "the cat, unaffable." between [CLS] and [SEP].
+var encoderTokens = []int{2, 4, 5, 10, 7, 8, 9, 11, 3}
+
+func TestEncoderMatchesReference(t *testing.T) {
+	for _, arch := range []string{"bert", "nomic-bert"} {
+		t.Run(arch, func(t *testing.T) {
+			s := newSynthEncoder(arch, 0)
+			be := s.load(t)
+			if got := be.Tokenizer().Encode("The cat, unaffable."); fmt.Sprint(got) != fmt.Sprint(encoderTokens) {
+				t.Fatalf("tokens %v, want %v", got, encoderTokens)
+			}
+			h, err := be.enc.hidden(encoderTokens)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := refEncode(s, encoderTokens)
+			d := synthEmbd
+			for i := range want {
+				for j := range want[i] {
+					if diff := math.Abs(float64(h[i*d+j]) - want[i][j]); diff > 1e-4 {
+						t.Fatalf("token %d, dim %d: %g, want %g", i, j, h[i*d+j], want[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncoderPooling(t *testing.T) {
+	for _, arch := range []string{"bert", "nomic-bert"} {
+		want := refEncode(newSynthEncoder(arch, 0), encoderTokens)
+		n := len(want)
+		mean := make([]float64, synthEmbd)
+		for _, row := range want {
+			for j, v := range row {
+				mean[j] += v / float64(n)
+			}
+		}
+		tests := []struct {
+			name    string
+			pooling uint32
+			want    []float64
+		}{
+			{"unset takes CLS", 0, want[0]},
+			{"mean", 1, mean},
+			{"cls", 2, want[0]},
+			{"last", 3, want[n-1]},
+		}
+		for _, tt := range tests {
+			t.Run(arch+"/"+tt.name, func(t *testing.T) {
+				be := newSynthEncoder(arch, tt.pooling).load(t)
+				res, err := engine.Embed(context.Background(), be, &engine.EmbedRequest{Texts: []string{"The cat, unaffable."}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Dim != synthEmbd || res.Tokens != n || len(res.Vectors) != 1 {
+					t.Fatalf("dim %d, %d tokens, %d vectors", res.Dim, res.Tokens, len(res.Vectors))
+				}
+				checkVector(t, res.Vectors[0], tt.want)
+
+				// Normalized, it points the same way at unit length.
+				res, err = engine.Embed(context.Background(), be, &engine.EmbedRequest{Tokens: [][]int{encoderTokens}, Normalize: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				norm := 0.0
+				for _, v := range tt.want {
+					norm += v * v
+				}
+				unit := make([]float64, len(tt.want))
+				for j, v := range tt.want {
+					unit[j] = v / math.Sqrt(norm)
+				}
+				checkVector(t, res.Vectors[0], unit)
+			})
+		}
+	}
+}
+
+func TestEncoderRankPooling(t *testing.T) {
+	be := newSynthEncoder("bert", 4).load(t)
+	if _, err := engine.Embed(context.Background(), be, &engine.EmbedRequest{Texts: []string{"the cat"}}); err != engine.ErrNoEmbeddings {
+		t.Errorf("rank pooling: %v, want %v", err, engine.ErrNoEmbeddings)
+	}
+}
+
+func checkVector(t *testing.T, got []float32, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d dimensions, want %d", len(got), len(want))
+	}
+	for j := range want {
+		if math.Abs(float64(got[j])-want[j]) > 1e-4 {
+			t.Fatalf("dim %d: %g, want %g", j, got[j], want[j])
+		}
+	}
+}
@@ -2,94 +2,170 @@ package impl
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/haydenlabs/gollum/engine"
 	"github.com/haydenlabs/gollum/gguf"
 )
 
 type goEngine struct {
-	scheduler *engine.Scheduler
-	models    map[string]*gguf.Model // model name -> loaded model
-	backend   engine.KernelOps        // the inference backend
+	reg *registry
 }
 
-func NewEngine() engine.Engine {
-	// Find and load models
-	models := make(map[string]*gguf.Model)
-	var backend engine.KernelOps
-	
+// Options tune how the engine keeps models resident.
+type Options struct {
+	MemoryBudget int64         // bytes of weights and KV across resident models; 0 = unlimited
+	IdleTimeout  time.Duration // unload models unused this long; 0 = never
+	LoadTimeout  time.Duration // how long a request waits for its model to load; default 2m
+}
+
+func NewEngine() engine.Engine { return NewEngineWithOptions(Options{}) }
+
+// NewEngineWithOptions serves every GGUF in ./models under its file name
+// without the extension, loading each on first use. If there are none, the
+// toy backend serves as toy-1.
+func NewEngineWithOptions(opts Options) engine.Engine {
+	reg := newRegistry(opts)
 	modelFiles, err := gguf.FindModels(".")
 	if err != nil {
 		log.Printf("Warning: failed to find models: %v", err)
-	} else {
-		for _, path := range modelFiles {
-			log.Printf("Loading model: %s", path)
-			model, err := gguf.LoadModel(path)
-			if err != nil {
-				log.Printf("Failed to load %s: %v", path, err)
-				continue
-			}
-			// Use filename (without extension) as model ID
-			modelName := filepath.Base(path)
-			modelName = modelName[:len(modelName)-5] // remove .gguf
-			models[modelName] = model
-			log.Printf("Loaded model: %s (layers=%d, embed=%d, vocab=%d)",
-				modelName, model.NumLayers, model.EmbedDim, model.VocabSize)
-		}
 	}
-
-	if len(models) == 0 {
+	for _, path := range modelFiles {
+		modelName := strings.TrimSuffix(filepath.Base(path), ".gguf")
+		reg.register(modelName, path)
+		log.Printf("Found model: %s (%s)", modelName, path)
+	}
+	if len(modelFiles) == 0 {
 		log.Printf("No GGUF models found, using toy backend")
-		backend = NewMetalOps()
-	} else {
-		// Use the first model for now
-		var model *gguf.Model
-		for _, m := range models {
-			model = m
-			break
-		}
-		ggufBackend, err := NewGGUFBackend(model)
-		if err != nil {
-			log.Printf("Failed to create GGUF backend: %v", err)
-			backend = NewMetalOps()
-		} else {
-			backend = ggufBackend
-		}
+		reg.add(toyModel, nil, NewMetalOps())
 	}
+	return &goEngine{reg: reg}
+}
 
-	scheduler := engine.NewScheduler(backend)
-	// Start the scheduler in the background
-	go scheduler.Run(context.Background())
-	return &goEngine{
-		scheduler: scheduler,
-		models:    models,
-		backend:   backend,
+// loadBackend reads a GGUF and builds its backend, with any overrides from
+// the model's config file.
+func loadBackend(path string) (*gguf.Model, *GGUFBackend, error) {
+	cfg, cfgErr := loadModelConfig(path) // configure reports a bad one
+	load := gguf.LoadModel
+	if cfgErr == nil && cfg.LowMemory {
+		load = gguf.MapModel
+	}
+	model, err := load(path)
+	if err != nil {
+		return nil, nil, err
 	}
+	kvType := uint32(gguf.TypeF32)
+	if cfgErr == nil {
+		cfg.override(model)
+		if kvType, err = cfg.kvType(); err != nil {
+			return nil, nil, err
+		}
+	}
+	backend, err := newGGUFBackend(model, kvType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return model, backend, nil
 }
 
 func (e *goEngine) Generate(ctx context.Context, req *engine.GenRequest) (<-chan engine.Token, *engine.Trace, error) {
+	lm, err := e.reg.acquire(ctx, req.Model)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer e.reg.release(lm)
+	req.Model = lm.name
 	if req.MaxTokens <= 0 {
 		req.MaxTokens = 64
 	}
-	ch, trace := e.scheduler.Enqueue(ctx, req)
+	ch, trace := lm.scheduler.Enqueue(ctx, req)
 	return ch, trace, nil
 }
 
-func (e *goEngine) Embeddings(ctx context.Context, input string) ([]float32, error) {
-	// stub: fixed-size vector
-	out := make([]float32, 128)
-	for i := range out {
-		out[i] = float32((i*7)%13) / 13.0
+func (e *goEngine) Embeddings(ctx context.Context, req *engine.EmbedRequest) (*engine.EmbedResult, error) {
+	lm, err := e.reg.acquire(ctx, req.Model)
+	if err != nil {
+		return nil, err
 	}
-	return out, nil
+	defer e.reg.release(lm)
+	req.Model = lm.name
+	return engine.Embed(ctx, lm.backend, req)
 }
 
+func (e *goEngine) Models() []string { return e.reg.names() }
+
+func (e *goEngine) LoadModel(name, path string) (engine.ModelInfo, error) {
+	if filepath.Ext(path) != ".gguf" {
+		return engine.ModelInfo{}, fmt.Errorf("%s: not a .gguf file", path)
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), ".gguf")
+	}
+	lm, err := e.reg.load(name, path)
+	if err != nil {
+		return engine.ModelInfo{}, err
+	}
+	e.reg.mu.Lock()
+	defer e.reg.mu.Unlock()
+	return lm.infoLocked(), nil
+}
+
+func (e *goEngine) UnloadModel(ctx context.Context, name string) error {
+	err := e.reg.remove(ctx, name)
+	if errors.Is(err, engine.ErrUnknownModel) {
+		return err
+	}
+	log.Printf("Unloaded model: %s", name)
+	return err
+}
+
+func (e *goEngine) ModelInfo() []engine.ModelInfo { return e.reg.info() }
+
+// GetModel returns a resident model's GGUF.
 func (e *goEngine) GetModel(name string) (*gguf.Model, error) {
-	if model, ok := e.models[name]; ok {
-		return model, nil
+	lm, ok := e.reg.resident(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", engine.ErrUnknownModel, name)
+	}
+	if lm.model == nil {
+		return nil, fmt.Errorf("model %s has no GGUF", name)
+	}
+	return lm.model, nil
+}
+
+// configure applies the model's config file to its scheduler and returns
+// the draft model it pairs it with, if any.
+func configure(s *engine.Scheduler, target *gguf.Model) *GGUFBackend {
+	cfg, err := loadModelConfig(target.Path)
+	if err != nil {
+		log.Printf("Ignoring model config: %v", err)
+		return nil
+	}
+	if cfg.PromptLookup > 0 {
+		s.SetPromptLookup(cfg.PromptLookup, cfg.LookupTokens)
+	}
+	if cfg.Draft == "" {
+		return nil
+	}
+	path := cfg.Draft
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(target.Path), path)
+	}
+	_, be, err := loadBackend(path)
+	if err != nil {
+		log.Printf("Failed to load draft model %s: %v", path, err)
+		return nil
+	}
+	err = s.SetDraft(be, cfg.DraftTokens)
+	if err != nil {
+		log.Printf("Not using draft model %s: %v", path, err)
+		return nil
 	}
-	return nil, fmt.Errorf("model not found: %s", name)
+	log.Printf("Speculative decoding with draft %s", filepath.Base(path))
+	return be
 }
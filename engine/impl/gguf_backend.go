@@ -1,147 +1,294 @@
 package impl
 
 import (
+	"fmt"
 	"log"
 	"math"
 
 	"github.com/haydenlabs/gollum/engine"
 	"github.com/haydenlabs/gollum/gguf"
+	"github.com/haydenlabs/gollum/kernels/cpu"
 	"github.com/haydenlabs/gollum/tokenizer"
 )
 
+// kvBudgetBytes bounds how much KV the backend advertises to the pager.
+const kvBudgetBytes int64 = 2 << 30
+
 // GGUFBackend wraps a loaded GGUF model and performs inference
 type GGUFBackend struct {
 	model     *gguf.Model
 	tokenizer tokenizer.Tokenizer
-	weights   map[string][]float32 // layer weights
+	tf        *transformer
+	enc       *encoder // instead of tf for embedding-only encoders
+	kvBlocks  int
 }
 
 // NewGGUFBackend creates a new backend from a loaded model
 func NewGGUFBackend(model *gguf.Model) (*GGUFBackend, error) {
+	return newGGUFBackend(model, gguf.TypeF32)
+}
+
+// newGGUFBackend is NewGGUFBackend with K and V stored as kvType: F32, Q8_0
+// or Q4_0.
+func newGGUFBackend(model *gguf.Model, kvType uint32) (*GGUFBackend, error) {
+	tok, err := tokenizer.FromGGUF(model.GGUF)
+	if err != nil {
+		log.Printf("Falling back to simple tokenizer: %v", err)
+		tok = tokenizer.NewSimpleBPE(model.VocabSize)
+	}
 	be := &GGUFBackend{
 		model:     model,
-		tokenizer: tokenizer.NewSimpleBPE(model.VocabSize),
-		weights:   make(map[string][]float32),
+		tokenizer: tok,
 	}
 
-	// Load weights from GGUF tensors
-	for name, tensor := range model.GGUF.Tensors {
-		be.weights[name] = tensor.Data
-		log.Printf("Loaded weight: %s (size=%d)", name, len(tensor.Data))
+	if isEncoder(model.Arch) {
+		// Encoders only embed: nothing is cached between calls.
+		be.enc, err = newEncoder(model)
+		if err != nil {
+			return nil, err
+		}
+		return be, nil
+	}
+
+	// Size KV storage: enough for a few full contexts, capped by the memory
+	// budget, which a quantized KV type stretches over more blocks.
+	rowBytes, err := kvRowBytes(kvType, model.HeadDim, model.NumKVHeads*model.HeadDim)
+	if err != nil {
+		return nil, fmt.Errorf("model %s: %w", model.Arch, err)
+	}
+	bytesPerBlock := 2 * rowBytes * model.NumLayers * engine.KVBlockTokens
+	be.kvBlocks = 8 * model.ContextLen / engine.KVBlockTokens
+	if bytesPerBlock > 0 && int64(be.kvBlocks)*int64(bytesPerBlock) > kvBudgetBytes {
+		be.kvBlocks = int(kvBudgetBytes / int64(bytesPerBlock))
 	}
 
+	be.tf, err = newTransformer(model, be.kvBlocks, kvType)
+	if err != nil {
+		return nil, err
+	}
 	return be, nil
 }
 
-func (g *GGUFBackend) Prefill(batch *engine.Batch) error {
-	// TODO: Implement prefill logic
-	// 1. Tokenize all prompts in batch
-	// 2. Lookup embeddings
-	// 3. Run through transformer layers
-	// 4. Store KV cache
-	return nil
+func (g *GGUFBackend) Capabilities() engine.Capabilities {
+	var eog []int
+	if t, ok := g.tokenizer.(interface{ EOG() []int }); ok {
+		eog = t.EOG()
+	}
+	return engine.Capabilities{
+		MaxBatch:       16,
+		MaxBatchTokens: 512,
+		DTypes:         gguf.SupportedTypes(),
+		Embeddings:     g.model.Pooling != "rank",
+		EmbedDim:       g.model.EmbedDim,
+		VocabSize:      g.model.VocabSize,
+		ContextLen:     g.model.ContextLen,
+		EOGTokens:      eog,
+		KVBlocks:       g.kvBlocks,
+	}
+}
+
+func (g *GGUFBackend) Tokenizer() engine.Tokenizer { return g.tokenizer }
+
+// label names the backend in its metrics as the model it serves.
+func (g *GGUFBackend) label(name string) {
+	if g.tf != nil {
+		g.tf.name = name
+	}
+}
+
+// Forward packs the tokens of every sequence in the step into one ragged
+// batch, so each weight matrix is read once per layer for the whole step
+// rather than once per sequence; positions and causal masks stay each
+// sequence's own. A sequence that fails its checks gets its error back and
+// is left out of the batch.
+func (g *GGUFBackend) Forward(step *engine.Step) ([]engine.SeqResult, error) {
+	results := make([]engine.SeqResult, len(step.Seqs))
+	batch := make([]batchSeq, 0, len(step.Seqs))
+	idx := make([]int, 0, len(step.Seqs)) // batch[j] is step.Seqs[idx[j]]
+	for i, s := range step.Seqs {
+		results[i].Seq = s.Seq
+		if g.tf == nil {
+			results[i].Err = fmt.Errorf("%s is an embedding model and cannot generate", g.model.Arch)
+			continue
+		}
+		bs := batchSeq{tokens: s.Tokens, pos: s.Pos, blocks: s.Blocks}
+		switch {
+		case s.AllLogits:
+			bs.nLogits = len(s.Tokens)
+		case s.Logits:
+			bs.nLogits = 1
+		}
+		if err := g.tf.check(bs); err != nil {
+			results[i].Err = err
+			continue
+		}
+		batch = append(batch, bs)
+		idx = append(idx, i)
+	}
+	if len(batch) == 0 {
+		return results, nil
+	}
+	logits, err := g.tf.forward(batch)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range idx {
+		results[i].Logits = logits[j]
+	}
+	return results, nil
+}
+
+// Embed pools the final hidden states of tokens as the model's metadata says.
+// Without a pooling type a decoder takes the last token, the only one a
+// causal model lets see the whole input, and an encoder takes [CLS].
+func (g *GGUFBackend) Embed(tokens []int) ([]float32, error) {
+	pooling := g.model.Pooling
+	var h []float32
+	var err error
+	if g.enc != nil {
+		if pooling == "" {
+			pooling = "cls"
+		}
+		h, err = g.enc.hidden(tokens)
+	} else {
+		h, err = g.tf.hidden(tokens)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d, n := g.model.EmbedDim, len(tokens)
+	switch pooling {
+	case "mean":
+		out := make([]float32, d)
+		for i := 0; i < n; i++ {
+			addInPlace(out, h[i*d:(i+1)*d])
+		}
+		for j := range out {
+			out[j] /= float32(n)
+		}
+		return out, nil
+	case "cls":
+		return h[:d:d], nil
+	case "last", "":
+		return h[(n-1)*d:], nil
+	}
+	return nil, fmt.Errorf("%s pooling is not supported", pooling)
 }
 
-func (g *GGUFBackend) Decode(step *engine.Step) (int, error) {
-	// TODO: Implement decode step
-	// 1. For each sequence in batch, get last token
-	// 2. Lookup embedding
-	// 3. Run through transformer layers (single token)
-	// 4. Append to KV cache
-	return step.BatchSize, nil
+func (g *GGUFBackend) CopyKV(dst, src *engine.KVBlock, tokens int) error {
+	if g.tf == nil {
+		return nil
+	}
+	g.tf.kv.copyBlock(dst.ID, src.ID, tokens)
+	return nil
 }
 
-func (g *GGUFBackend) PredictNext(ctxs []engine.DecodeCtx) []string {
-	// For now, return simple predictions
-	// Real implementation would:
-	// 1. Get logits from last layer
-	// 2. Apply temperature
-	// 3. Sample next token
-	// 4. Decode token to string
-	
-	results := make([]string, len(ctxs))
-	for i, ctx := range ctxs {
-		// Get last token from prompt
-		words := []string{"gollum", "loves", "kv", "cache", "prefix", "reuse"}
-		// Simple hash-based selection
-		idx := len(ctx.Prompt) % len(words)
-		results[i] = " " + words[idx]
+func (g *GGUFBackend) ShiftKV(blocks []int, from, n, length int) error {
+	if g.tf == nil {
+		return fmt.Errorf("%s has no KV cache", g.model.Arch)
 	}
-	return results
+	if need := (length + engine.KVBlockTokens - 1) / engine.KVBlockTokens; need > len(blocks) {
+		return fmt.Errorf("block table covers %d positions, need %d", len(blocks)*engine.KVBlockTokens, length)
+	}
+	g.tf.shiftKV(blocks, from, n, length)
+	return nil
 }
 
 // Helper function: matrix multiplication
 func matMul(A, B []float32, M, N, K int) []float32 {
 	result := make([]float32, M*N)
-	for i := 0; i < M; i++ {
-		for j := 0; j < N; j++ {
-			sum := float32(0)
-			for k := 0; k < K; k++ {
-				sum += A[i*K+k] * B[k*N+j]
+	cpu.MatMul(result, A, B, M, N, K)
+	return result
+}
+
+// Helper function: layer normalization of each row of x (row length d) into
+// y, scaled by gamma and shifted by beta if it is non-nil
+func layerNorm(y, x, gamma, beta []float32, d int, eps float32) {
+	for r := 0; r+d <= len(x) && r+d <= len(y); r += d {
+		mean := float32(0)
+		for _, v := range x[r : r+d] {
+			mean += v
+		}
+		mean /= float32(d)
+		variance := float32(0)
+		for _, v := range x[r : r+d] {
+			diff := v - mean
+			variance += diff * diff
+		}
+		variance /= float32(d)
+		scale := float32(1 / math.Sqrt(float64(variance+eps)))
+		for i := 0; i < d; i++ {
+			y[r+i] = (x[r+i] - mean) * scale * gamma[i]
+			if beta != nil {
+				y[r+i] += beta[i]
 			}
-			result[i*N+j] = sum
 		}
 	}
-	return result
 }
 
-// Helper function: layer normalization
-func layerNorm(x []float32, gamma, beta []float32) []float32 {
-	mean := float32(0)
-	variance := float32(0)
-	
-	for _, v := range x {
-		mean += v
-	}
-	mean /= float32(len(x))
-	
-	for _, v := range x {
-		diff := v - mean
-		variance += diff * diff
-	}
-	variance /= float32(len(x))
-	
-	result := make([]float32, len(x))
-	std := float32(math.Sqrt(float64(variance + 1e-5)))
-	
-	for i := range x {
-		result[i] = (x[i]-mean)/std*gamma[i] + beta[i]
-	}
-	
-	return result
+// attnOpts are the ways a family's attention departs from the plain kind.
+type attnOpts struct {
+	scale   float32 // applied to q·k
+	window  int     // a query sees only the last window positions, its own included; 0 = all
+	softcap float32 // scores become softcap·tanh(s/softcap); 0 = off
 }
 
-// Helper function: scaled dot-product attention
-func attention(Q, K, V []float32, batchSize, seqLen, numHeads, headDim int, kvHandle int) []float32 {
-	// TODO: Implement using KV cache from handle
-	// For now, simple computation without KV cache
-	
-	// Compute attention scores
-	scores := matMul(Q, transpose(K), batchSize*numHeads*seqLen, seqLen, headDim)
-	
-	// Scale
-	scale := 1.0 / float32(math.Sqrt(float64(headDim)))
-	for i := range scores {
-		scores[i] *= scale
-	}
-	
-	// Apply softmax (simplified)
-	// Compute QK^T @ V
-	
-	result := make([]float32, batchSize*seqLen*numHeads*headDim)
-	// ... (full attention implementation)
-	
-	return result
+// Helper function: scaled dot-product attention for a packed batch. Each
+// sequence's queries, at positions pos.., are causally masked against its
+// own paged KV. Query head h reads KV head h/(nHead/nKVHead).
+func attention(out, Q []float32, kv *kvCache, layer int, seqs []batchSeq, nHead, nKVHead, headDim int, opts attnOpts) {
+	as := make([]cpu.Attention, len(seqs))
+	pkv := make([]cpu.PagedKV, len(seqs))
+	for i, s := range seqs {
+		as[i] = cpu.Attention{
+			NHead: nHead, NKVHead: nKVHead, HeadDim: headDim,
+			Pos: s.pos, N: len(s.tokens),
+			Scale: opts.scale, Window: opts.window, Softcap: opts.softcap,
+		}
+		blocks := s.blocks
+		pkv[i] = cpu.PagedKV{
+			BlockLen: engine.KVBlockTokens,
+			Block:    func(b int) (cpu.Matrix, cpu.Matrix) { return kv.block(layer, blocks[b]) },
+		}
+	}
+	cpu.RunBatch(as, out, Q, pkv)
 }
 
-func reshape(x []float32, dims ...int) []float32 {
-	// Helper to reshape tensor
-	return x // Simplified
+func softmaxInPlace(x []float32) {
+	max := x[0]
+	for _, v := range x {
+		if v > max {
+			max = v
+		}
+	}
+	sum := float32(0)
+	for i, v := range x {
+		x[i] = float32(math.Exp(float64(v - max)))
+		sum += x[i]
+	}
+	for i := range x {
+		x[i] /= sum
+	}
 }
 
-func transpose(x []float32) []float32 {
-	// Helper to transpose - simplified
-	return x
+// Memory reports the bytes held by the weights and the KV storage allocated
+// so far. Weights left in a mapped file are not counted: their pages belong
+// to the operating system, which drops them as it needs.
+func (g *GGUFBackend) Memory() (weights, kv int64) {
+	mapped := g.model.GGUF.Mapped()
+	for _, t := range g.model.GGUF.Tensors {
+		switch {
+		case t.Raw != nil && mapped:
+		case t.Raw != nil:
+			weights += int64(len(t.Raw))
+		default:
+			weights += int64(4 * len(t.Data))
+		}
+	}
+	if g.tf != nil {
+		kv = g.tf.kv.allocated.Load()
+	}
+	return weights, kv
 }
 
 // GetModel returns the model for the backend
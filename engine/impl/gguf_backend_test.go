@@ -0,0 +1,190 @@
+package impl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/haydenlabs/gollum/engine"
+)
+
+// packedSeq is one sequence of TestPackedStepsMatchSeparateRuns: its tokens,
+// its blocks, and how many tokens it feeds in each step, 0 for none. Once
+// chunks runs out it decodes a token a step. If last, it asks for the logits
+// of each step's last token only.
+type packedSeq struct {
+	toks   []int
+	blocks []int
+	chunks []int
+	last   bool
+}
+
+// TestPackedStepsMatchSeparateRuns packs three sequences into shared steps at
+// different positions, mixing prompt chunks that cross block boundaries with
+// single decode tokens, and checks each position's logits against the
+// sequence run by itself in one pass.
+func TestPackedStepsMatchSeparateRuns(t *testing.T) {
+	tokens := func(n, seed int) []int {
+		toks := make([]int, n)
+		for i := range toks {
+			toks[i] = (i*7+seed*13)%270 + 1
+		}
+		return toks
+	}
+	for _, arch := range []string{"llama", "mistral", "gemma2", "qwen2moe"} {
+		t.Run(arch, func(t *testing.T) {
+			be := newSynth(arch).load(t)
+			seqs := []*packedSeq{
+				{tokens(40, 1), []int{0, 1, 2}, []int{20}, false},
+				{tokens(23, 2), []int{3, 4, 5}, []int{0, 7, 7, 9}, true},
+				{tokens(35, 3), []int{6, 7, 8}, []int{0, 0, 17, 1, 1, 16}, false},
+			}
+			got := make([][][]float32, len(seqs)) // by position; nil where not asked for
+			for i, s := range seqs {
+				got[i] = make([][]float32, len(s.toks))
+			}
+			pos := make([]int, len(seqs))
+			for step := 0; ; step++ {
+				st := &engine.Step{}
+				var fed []int
+				for i, s := range seqs {
+					n := 1
+					if step < len(s.chunks) {
+						n = s.chunks[step]
+					}
+					n = min(n, len(s.toks)-pos[i])
+					if n == 0 {
+						continue
+					}
+					st.Seqs = append(st.Seqs, engine.SeqStep{
+						Seq: engine.SeqID(i + 1), Tokens: s.toks[pos[i] : pos[i]+n], Pos: pos[i], Blocks: s.blocks, Logits: s.last, AllLogits: !s.last,
+					})
+					fed = append(fed, i)
+				}
+				if len(fed) == 0 {
+					break
+				}
+				res, err := be.Forward(st)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res) != len(fed) {
+					t.Fatalf("step %d: %d results for %d sequences", step, len(res), len(fed))
+				}
+				for k, i := range fed {
+					r, ss := res[k], st.Seqs[k]
+					if r.Err != nil {
+						t.Fatal(r.Err)
+					}
+					if r.Seq != ss.Seq {
+						t.Fatalf("step %d: result %d is for sequence %d, want %d", step, k, r.Seq, ss.Seq)
+					}
+					pos[i] += len(ss.Tokens)
+					if !ss.AllLogits {
+						got[i][pos[i]-1] = r.Logits
+						continue
+					}
+					V := len(r.Logits) / len(ss.Tokens)
+					for j := range ss.Tokens {
+						got[i][ss.Pos+j] = r.Logits[j*V : (j+1)*V]
+					}
+				}
+			}
+			for i, s := range seqs {
+				want := runAlone(t, be, s.toks, []int{9, 10, 11})
+				for p := range want {
+					if got[i][p] == nil {
+						want[p] = nil
+					}
+				}
+				if d := maxDiff(want, got[i]); d > 1e-4 {
+					t.Errorf("sequence %d: packed logits differ from a run alone by %g", i+1, d)
+				}
+			}
+		})
+	}
+}
+
+// runAlone feeds toks through be in one step as the only sequence.
+func runAlone(t *testing.T, be engine.KernelOps, toks, blocks []int) [][]float32 {
+	t.Helper()
+	res, err := be.Forward(&engine.Step{Seqs: []engine.SeqStep{{Seq: 99, Tokens: toks, Blocks: blocks, AllLogits: true}}})
+	if err == nil {
+		err = res[0].Err
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	V := len(res[0].Logits) / len(toks)
+	rows := make([][]float32, len(toks))
+	for i := range rows {
+		rows[i] = res[0].Logits[i*V : (i+1)*V]
+	}
+	return rows
+}
+
+// TestShiftKVMatchesFreshForward deletes positions from a sequence's KV with
+// ShiftKV and checks that decoding from it gives the logits of the kept
+// tokens prefilled afresh at their new positions. A shift keeps each kept
+// position's KV as it was computed, which in the first layer depends only on
+// the token and its position but in later layers on the deleted tokens too,
+// so the models have one layer.
+func TestShiftKVMatchesFreshForward(t *testing.T) {
+	toks := make([]int, 41)
+	for i := range toks {
+		toks[i] = (i*11)%270 + 1
+	}
+	tests := []struct {
+		name, arch              string
+		yarn                    bool
+		from, n, length, blocks int
+	}{
+		{"llama", "llama", false, 4, 10, 40, 3},
+		{"whole blocks", "llama", false, 4, 16, 40, 3},
+		{"no sinks", "llama", false, 0, 16, 33, 3},
+		{"within a block", "qwen2", false, 2, 7, 12, 1},
+		{"sliding window", "mistral", false, 4, 10, 40, 3},
+		{"gemma2", "gemma2", false, 4, 10, 40, 3},
+		{"fused", "phi3", false, 4, 10, 40, 3},
+		{"yarn", "llama", true, 4, 10, 40, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSynth(tt.arch)
+			s.hparam("block_count", uint32(1))
+			for _, st := range append([]synthTensor(nil), s.tensors...) {
+				if strings.HasPrefix(st.name, "blk.1.") {
+					s.drop(st.name)
+				}
+			}
+			if tt.yarn {
+				s.hparam("rope.scaling.type", "yarn")
+				s.hparam("rope.scaling.factor", float32(4))
+				s.hparam("rope.scaling.original_context_length", uint32(64))
+			}
+			be := s.load(t)
+			blocks := []int{0, 1, 2}[:tt.blocks]
+			runAlone(t, be, toks[:tt.length], blocks)
+			if err := be.ShiftKV(blocks, tt.from, tt.n, tt.length); err != nil {
+				t.Fatal(err)
+			}
+			next := toks[tt.length]
+			pos := tt.length - tt.n
+			res, err := be.Forward(&engine.Step{Seqs: []engine.SeqStep{{Seq: 1, Tokens: []int{next}, Pos: pos, Blocks: blocks, Logits: true}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := append(append(append([]int(nil), toks[:tt.from]...), toks[tt.from+tt.n:tt.length]...), next)
+			want := runAlone(t, be, kept, []int{3, 4, 5})
+			if d := maxDiff(want[pos:], [][]float32{res[0].Logits}); d > 1e-4 {
+				t.Errorf("shifted logits differ from a fresh forward by %g", d)
+			}
+		})
+	}
+}
+
+func TestShiftKVShortBlockTable(t *testing.T) {
+	be := newSynth("llama").load(t)
+	if err := be.ShiftKV([]int{0}, 4, 4, 17); err == nil {
+		t.Error("shifting 17 positions in one block succeeded")
+	}
+}
@@ -0,0 +1,154 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/haydenlabs/gollum/gguf"
+	"github.com/haydenlabs/gollum/kernels/cpu"
+	"github.com/haydenlabs/gollum/metrics"
+)
+
+// moeLayer is a mixture-of-experts feed-forward. A router scores every
+// expert for each token and the top nUsed run, their outputs mixed by the
+// router's probabilities. Expert weights are stacked, expert-major, as the
+// ffn_*_exps tensors store them.
+type moeLayer struct {
+	nExp, nUsed, nFF int
+	router           cpu.Matrix // [nExp][d]
+	gate, up, down   cpu.Matrix // [nExp*nFF][d], [nExp*nFF][d], [nExp*d][nFF]
+	rawWeights       bool       // use the top-k probabilities as they are, not renormalized to sum to 1
+	nShared          int
+	shGate, shUp     cpu.Matrix // shared expert every token runs, if any
+	shDown           cpu.Matrix
+	shRouter         []float32 // gates the shared output by a sigmoid
+}
+
+func loadMoE(m *gguf.Model, spec archSpec, p string, ws *weights) *moeLayer {
+	d, ff, E := m.EmbedDim, m.ExpertFFNDim, m.Experts
+	ml := &moeLayer{
+		nExp:       E,
+		nUsed:      m.ExpertsUsed,
+		nFF:        ff,
+		router:     ws.mat(p+"ffn_gate_inp.weight", E, d, true),
+		gate:       ws.mat(p+"ffn_gate_exps.weight", E*ff, d, true),
+		up:         ws.mat(p+"ffn_up_exps.weight", E*ff, d, true),
+		down:       ws.mat(p+"ffn_down_exps.weight", E*d, ff, true),
+		rawWeights: spec.moeRawWeights,
+	}
+	if b, ok := m.GGUF.Bool(m.Arch + ".expert_weights_norm"); ok {
+		ml.rawWeights = !b
+	}
+	if _, ok := m.GGUF.Tensors[p+"ffn_gate_shexp.weight"]; ok {
+		sf := m.SharedFFNDim
+		ml.nShared = sf
+		ml.shGate = ws.mat(p+"ffn_gate_shexp.weight", sf, d, true)
+		ml.shUp = ws.mat(p+"ffn_up_shexp.weight", sf, d, true)
+		ml.shDown = ws.mat(p+"ffn_down_shexp.weight", d, sf, true)
+		ml.shRouter = ws.vec(p+"ffn_gate_inp_shexp.weight", d, false)
+	}
+	return ml
+}
+
+func (ml *moeLayer) check() error {
+	if ml.nUsed <= 0 || ml.nUsed > ml.nExp {
+		return fmt.Errorf("%d experts used of %d", ml.nUsed, ml.nExp)
+	}
+	return nil
+}
+
+// forward writes the layer's output for n rows of h into out. Tokens are
+// grouped by expert first, so each expert's weights are read once for all
+// the tokens routed to it rather than once per token.
+func (ml *moeLayer) forward(out, h []float32, n, d int, act func(float32) float32, model string) {
+	probs := make([]float32, n*ml.nExp)
+	linear(probs, h, ml.router, n)
+	type route struct {
+		row int
+		w   float32
+	}
+	routes := make([][]route, ml.nExp)
+	order := make([]int, ml.nExp)
+	for i := 0; i < n; i++ {
+		p := probs[i*ml.nExp : (i+1)*ml.nExp]
+		softmaxInPlace(p)
+		for e := range order {
+			order[e] = e
+		}
+		sort.SliceStable(order, func(a, b int) bool { return p[order[a]] > p[order[b]] })
+		sum := float32(0)
+		for _, e := range order[:ml.nUsed] {
+			sum += p[e]
+		}
+		for _, e := range order[:ml.nUsed] {
+			w := p[e]
+			if !ml.rawWeights {
+				w /= sum
+			}
+			routes[e] = append(routes[e], route{i, w})
+		}
+	}
+
+	for i := range out[:n*d] {
+		out[i] = 0
+	}
+	ff := ml.nFF
+	x := make([]float32, n*d)
+	g := make([]float32, n*ff)
+	u := make([]float32, n*ff)
+	y := make([]float32, n*d)
+	for e, rs := range routes {
+		if len(rs) == 0 {
+			continue
+		}
+		metrics.ExpertTokens.WithLabelValues(model, strconv.Itoa(e)).Add(float64(len(rs)))
+		metrics.ExpertBatch.WithLabelValues(model).Observe(float64(len(rs)))
+		m := len(rs)
+		for j, r := range rs {
+			copy(x[j*d:(j+1)*d], h[r.row*d:(r.row+1)*d])
+		}
+		ffn(y, x, ml.gate.Slice(e*ff, (e+1)*ff), ml.up.Slice(e*ff, (e+1)*ff), ml.down.Slice(e*d, (e+1)*d), m, ff, g, u, act)
+		for j, r := range rs {
+			o := out[r.row*d : (r.row+1)*d]
+			for c, v := range y[j*d : (j+1)*d] {
+				o[c] += r.w * v
+			}
+		}
+	}
+
+	if ml.nShared == 0 {
+		return
+	}
+	sf := ml.nShared
+	ffn(y, h, ml.shGate, ml.shUp, ml.shDown, n, sf, make([]float32, n*sf), make([]float32, n*sf), act)
+	for i := 0; i < n; i++ {
+		w := float32(1)
+		if ml.shRouter != nil {
+			s := float32(0)
+			for c, v := range h[i*d : (i+1)*d] {
+				s += ml.shRouter[c] * v
+			}
+			w = 1 / (1 + float32(math.Exp(float64(-s))))
+		}
+		addScaled(out[i*d:(i+1)*d], y[i*d:(i+1)*d], w)
+	}
+}
+
+// ffn is a gated feed-forward over n rows: down(act(gate x) * up x). g and u
+// are scratch of n*ff.
+func ffn(y, x []float32, gate, up, down cpu.Matrix, n, ff int, g, u []float32, act func(float32) float32) {
+	linear(g, x, gate, n)
+	linear(u, x, up, n)
+	for i := range g[:n*ff] {
+		g[i] = act(g[i]) * u[i]
+	}
+	linear(y, g, down, n)
+}
+
+func addScaled(x, y []float32, w float32) {
+	for i := range x {
+		x[i] += w * y[i]
+	}
+}
@@ -0,0 +1,89 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// Perplexity loads the model at path with its K and V stored as kvType (f32,
+// q8_0 or q4_0) and returns its perplexity over text: exp of the mean
+// negative log-likelihood of each token given the ones before it. The text
+// is scored in windows of up to window tokens, each from position 0, so
+// comparing KV types only needs the same text and window. lowMemory streams
+// the weights from the file as the low_memory model setting does, which the
+// model's config can also turn on.
+func Perplexity(path, kvType, text string, window int, lowMemory bool) (float64, error) {
+	cfg, err := loadModelConfig(path)
+	if err != nil {
+		return 0, err
+	}
+	load := gguf.LoadModel
+	if lowMemory || cfg.LowMemory {
+		load = gguf.MapModel
+	}
+	model, err := load(path)
+	if err != nil {
+		return 0, err
+	}
+	defer model.GGUF.Close()
+	cfg.override(model)
+	cfg.KVType = kvType
+	typ, err := cfg.kvType()
+	if err != nil {
+		return 0, err
+	}
+	be, err := newGGUFBackend(model, typ)
+	if err != nil {
+		return 0, err
+	}
+	if be.tf == nil {
+		return 0, fmt.Errorf("%s is an embedding model", model.Arch)
+	}
+	window = min(window, model.ContextLen, be.kvBlocks*engine.KVBlockTokens)
+	if window < 2 {
+		return 0, fmt.Errorf("window of %d tokens scores nothing", window)
+	}
+	blocks := make([]int, (window+engine.KVBlockTokens-1)/engine.KVBlockTokens)
+	for i := range blocks {
+		blocks[i] = i
+	}
+
+	tokens := be.tokenizer.Encode(text)
+	nll, n := 0.0, 0
+	for start := 0; start+1 < len(tokens); start += window {
+		w := tokens[start:min(start+window, len(tokens))]
+		if len(w) < 2 {
+			break
+		}
+		out, err := be.tf.forward([]batchSeq{{tokens: w, blocks: blocks, nLogits: len(w)}})
+		if err != nil {
+			return 0, err
+		}
+		logits := out[0]
+		V := model.VocabSize
+		for i, next := range w[1:] {
+			nll -= logProb(logits[i*V:(i+1)*V], next)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("text is too short to score")
+	}
+	return math.Exp(nll / float64(n)), nil
+}
+
+// logProb is the log-softmax of logits at id.
+func logProb(logits []float32, id int) float64 {
+	mx := logits[0]
+	for _, v := range logits {
+		mx = max(mx, v)
+	}
+	sum := 0.0
+	for _, v := range logits {
+		sum += math.Exp(float64(v - mx))
+	}
+	return float64(logits[id]-mx) - math.Log(sum)
+}
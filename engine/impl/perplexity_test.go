@@ -0,0 +1,40 @@
+package impl
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestPerplexityKVTypes scores the same text with K and V stored in each
+// type. Quantizing them may cost a little perplexity, never much.
+func TestPerplexityKVTypes(t *testing.T) {
+	// A smaller output projection keeps the random model's logits moderate,
+	// so its perplexity is of the order of its vocabulary, as a trained
+	// model's is of the order of its uncertainty, rather than ruled by a few
+	// confidently wrong tokens.
+	s := newSynth("llama")
+	s.mat("output.weight", len(s.get("token_embd.weight"))/synthEmbd, synthEmbd, 0.1)
+	path := s.write(t)
+	text := strings.Repeat("the cat sat on the mat. a cat sat on a hat. ", 8)
+	base, err := Perplexity(path, "f32", text, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.IsNaN(base) || base <= 1 {
+		t.Fatalf("f32 perplexity %g", base)
+	}
+	for _, c := range []struct {
+		kv     string
+		maxRel float64
+	}{{"q8_0", 0.005}, {"q4_0", 0.05}} {
+		ppl, err := Perplexity(path, c.kv, text, 64, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s: perplexity %.4f against %.4f for f32", c.kv, ppl, base)
+		if rel := math.Abs(ppl-base) / base; rel > c.maxRel {
+			t.Errorf("%s: perplexity %g is %.2f%% off f32's %g, want at most %g%%", c.kv, ppl, 100*rel, base, 100*c.maxRel)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/gguf"
+	"github.com/haydenlabs/gollum/metrics"
+)
+
+// toyModel is the name the toy backend serves under when no GGUF loads.
+const toyModel = "toy-1"
+
+// defaultLoadWait is how long a request waits for its model to load.
+const defaultLoadWait = 2 * time.Minute
+
+// loadedModel is one resident model: its backend and the scheduler that
+// batches its requests.
+type loadedModel struct {
+	name      string
+	model     *gguf.Model // nil for the toy backend, which is never evicted
+	backend   engine.KernelOps
+	draft     *GGUFBackend
+	scheduler *engine.Scheduler
+	stop      context.CancelFunc
+	done      chan struct{} // closed once the scheduler has stopped
+	unloaded  chan struct{} // closed once unload has stopped it
+
+	// Guarded by the registry.
+	refs     int // requests between acquire and release
+	lastUsed time.Time
+	stopped  bool // unloaded; the last release closes its files
+}
+
+// pendingLoad is a load in progress; done closes when lm or err is set.
+type pendingLoad struct {
+	done chan struct{}
+	lm   *loadedModel
+	err  error
+}
+
+// registry tracks every model that can be served and the ones resident.
+// Models load on the first request that names them. Idle models unload after
+// the idle timeout, and least recently used ones when resident memory is over
+// budget. Requests that name no model go to the first name in sorted order.
+type registry struct {
+	mu       sync.Mutex
+	paths    map[string]string // servable models: name -> GGUF path
+	models   map[string]*loadedModel
+	loading  map[string]*pendingLoad
+	draining map[string]*loadedModel // out of routing, being unloaded
+	budget   int64                   // bytes; 0 = unlimited
+	idle     time.Duration           // 0 = never unload for idleness
+	loadWait time.Duration
+
+	// loader reads a model and builds its backend; tests swap in their own.
+	loader func(path string) (*gguf.Model, *GGUFBackend, error)
+}
+
+func newRegistry(opts Options) *registry {
+	r := &registry{
+		paths:    make(map[string]string),
+		models:   make(map[string]*loadedModel),
+		loading:  make(map[string]*pendingLoad),
+		draining: make(map[string]*loadedModel),
+		loader:   loadBackend,
+		budget:   opts.MemoryBudget,
+		idle:     opts.IdleTimeout,
+		loadWait: opts.LoadTimeout,
+	}
+	if r.loadWait <= 0 {
+		r.loadWait = defaultLoadWait
+	}
+	go r.janitor()
+	return r
+}
+
+// register makes name servable from path without loading it.
+func (r *registry) register(name, path string) {
+	r.mu.Lock()
+	r.paths[name] = path
+	r.mu.Unlock()
+}
+
+// add starts a scheduler for backend and makes it resident as name.
+func (r *registry) add(name string, model *gguf.Model, backend engine.KernelOps) *loadedModel {
+	s := engine.NewScheduler(backend)
+	lm := &loadedModel{name: name, model: model, backend: backend, scheduler: s, done: make(chan struct{}), unloaded: make(chan struct{}), lastUsed: time.Now()}
+	if model != nil {
+		lm.draft = configure(s, model)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	lm.stop = stop
+	go func() {
+		s.Run(ctx)
+		close(lm.done)
+	}()
+	r.mu.Lock()
+	r.models[name] = lm
+	r.mu.Unlock()
+	return lm
+}
+
+// acquire returns the resident model for a request, loading it first if need
+// be. A model being unloaded is waited for and then loaded again. The caller
+// must release it once its work is handed to the scheduler or done; until
+// then it is not evicted.
+func (r *registry) acquire(ctx context.Context, name string) (*loadedModel, error) {
+	r.mu.Lock()
+	if name == "" {
+		if names := r.namesLocked(); len(names) > 0 {
+			name = names[0]
+		}
+	}
+	for {
+		if lm, ok := r.models[name]; ok {
+			lm.refs++
+			lm.lastUsed = time.Now()
+			r.mu.Unlock()
+			return lm, nil
+		}
+		if lm, ok := r.draining[name]; ok {
+			r.mu.Unlock()
+			if err := r.await(ctx, name, lm.unloaded); err != nil {
+				return nil, err
+			}
+			r.mu.Lock()
+			continue
+		}
+		path, ok := r.paths[name]
+		if !ok {
+			r.mu.Unlock()
+			return nil, fmt.Errorf("%w %q", engine.ErrUnknownModel, name)
+		}
+		pl := r.startLoadLocked(name, path)
+		r.mu.Unlock()
+		if err := r.await(ctx, name, pl.done); err != nil {
+			return nil, err
+		}
+		if pl.err != nil {
+			return nil, pl.err
+		}
+		r.mu.Lock()
+	}
+}
+
+func (r *registry) release(lm *loadedModel) {
+	r.mu.Lock()
+	lm.refs--
+	lm.lastUsed = time.Now()
+	last := lm.stopped && lm.refs == 0
+	r.mu.Unlock()
+	if last {
+		lm.close()
+	}
+}
+
+// await waits for a load, or an unload before one, on behalf of a request,
+// for at most the load timeout.
+func (r *registry) await(ctx context.Context, name string, done <-chan struct{}) error {
+	t := time.NewTimer(r.loadWait)
+	defer t.Stop()
+	select {
+	case <-done:
+		metrics.ModelLoadWaits.WithLabelValues(name, "served").Inc()
+		return nil
+	case <-t.C:
+		metrics.ModelLoadWaits.WithLabelValues(name, "timeout").Inc()
+		return fmt.Errorf("%w: %s", engine.ErrLoadTimeout, name)
+	case <-ctx.Done():
+		metrics.ModelLoadWaits.WithLabelValues(name, "cancelled").Inc()
+		return ctx.Err()
+	}
+}
+
+// startLoadLocked joins the load of name in progress or starts one. The load
+// carries on if its waiters give up.
+func (r *registry) startLoadLocked(name, path string) *pendingLoad {
+	if pl, ok := r.loading[name]; ok {
+		return pl
+	}
+	pl := &pendingLoad{done: make(chan struct{})}
+	r.loading[name] = pl
+	go func() {
+		start := time.Now()
+		log.Printf("Loading model: %s from %s", name, path)
+		model, backend, err := r.loader(path)
+		if err == nil {
+			backend.label(name)
+			pl.lm = r.add(name, model, backend)
+		}
+		r.mu.Lock()
+		delete(r.loading, name)
+		if err == nil {
+			r.paths[name] = path
+		}
+		r.mu.Unlock()
+		pl.err = err
+		close(pl.done)
+		if err != nil {
+			log.Printf("Failed to load %s: %v", path, err)
+			metrics.ModelLoads.WithLabelValues(name, "error").Inc()
+			return
+		}
+		metrics.ModelLoads.WithLabelValues(name, "ok").Inc()
+		metrics.ModelLoadSeconds.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		log.Printf("Loaded model: %s (layers=%d, embed=%d, vocab=%d) in %v",
+			name, model.NumLayers, model.EmbedDim, model.VocabSize, time.Since(start).Round(time.Millisecond))
+		r.evict(r.overBudget())
+	}()
+	return pl
+}
+
+// load makes name resident from path, as the admin API asks. It fails if name
+// is already resident, loading or unloading.
+func (r *registry) load(name, path string) (*loadedModel, error) {
+	r.mu.Lock()
+	_, resident := r.models[name]
+	_, loading := r.loading[name]
+	_, draining := r.draining[name]
+	if resident || loading || draining {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", engine.ErrModelExists, name)
+	}
+	pl := r.startLoadLocked(name, path)
+	r.mu.Unlock()
+	<-pl.done
+	return pl.lm, pl.err
+}
+
+// remove unloads name: it stops routing to it, drains its scheduler until ctx
+// ends and then stops it. The model stays servable and loads again on demand.
+func (r *registry) remove(ctx context.Context, name string) error {
+	r.mu.Lock()
+	lm, ok := r.models[name]
+	if ok {
+		r.takeLocked(lm)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w %q", engine.ErrUnknownModel, name)
+	}
+	metrics.ModelEvictions.WithLabelValues(name, "admin").Inc()
+	return r.unload(ctx, lm)
+}
+
+// takeLocked stops routing to lm. Requests for it wait until unload is done
+// with it rather than load a second copy.
+func (r *registry) takeLocked(lm *loadedModel) {
+	delete(r.models, lm.name)
+	r.draining[lm.name] = lm
+}
+
+// unload drains lm, taken out of routing, until ctx ends and stops it. Its
+// files close now, or when the last request holding it releases it.
+func (r *registry) unload(ctx context.Context, lm *loadedModel) error {
+	err := lm.scheduler.Drain(ctx)
+	lm.stop()
+	<-lm.done
+	r.mu.Lock()
+	delete(r.draining, lm.name)
+	lm.stopped = true
+	idle := lm.refs == 0
+	r.mu.Unlock()
+	if idle {
+		lm.close()
+	}
+	close(lm.unloaded)
+	metrics.ResidentBytes.DeleteLabelValues(lm.name)
+	return err
+}
+
+// evictableLocked reports whether lm can be unloaded without disturbing a request.
+func (r *registry) evictableLocked(lm *loadedModel) bool {
+	return lm.model != nil && lm.refs == 0 && lm.scheduler.InFlight() == 0
+}
+
+// janitor unloads idle models and keeps resident memory within budget.
+func (r *registry) janitor() {
+	interval := time.Second
+	if r.idle > 0 && r.idle/4 < interval {
+		interval = r.idle / 4
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		var idle []*loadedModel
+		r.mu.Lock()
+		for _, lm := range r.models {
+			if lm.scheduler.InFlight() > 0 {
+				lm.lastUsed = time.Now() // busy until its requests end
+				continue
+			}
+			if r.idle > 0 && time.Since(lm.lastUsed) > r.idle && r.evictableLocked(lm) {
+				r.takeLocked(lm)
+				idle = append(idle, lm)
+			}
+		}
+		r.mu.Unlock()
+		for _, lm := range idle {
+			log.Printf("Unloading idle model: %s", lm.name)
+			metrics.ModelEvictions.WithLabelValues(lm.name, "idle").Inc()
+			r.unload(context.Background(), lm)
+		}
+		r.evict(r.overBudget())
+		r.mu.Lock()
+		for name, lm := range r.models {
+			weights, kv := lm.memory()
+			metrics.ResidentBytes.WithLabelValues(name).Set(float64(weights + kv))
+		}
+		r.mu.Unlock()
+	}
+}
+
+// overBudget takes least recently used idle models out of routing until the
+// rest fit the budget, and returns them for unloading. The most recently used
+// model always stays.
+func (r *registry) overBudget() []*loadedModel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.budget <= 0 {
+		return nil
+	}
+	var total int64
+	lru := make([]*loadedModel, 0, len(r.models))
+	for _, lm := range r.models {
+		weights, kv := lm.memory()
+		total += weights + kv
+		lru = append(lru, lm)
+	}
+	sort.Slice(lru, func(i, j int) bool { return lru[i].lastUsed.Before(lru[j].lastUsed) })
+	var out []*loadedModel
+	for _, lm := range lru[:max(len(lru)-1, 0)] {
+		if total <= r.budget {
+			break
+		}
+		if !r.evictableLocked(lm) {
+			continue
+		}
+		weights, kv := lm.memory()
+		total -= weights + kv
+		r.takeLocked(lm)
+		out = append(out, lm)
+	}
+	return out
+}
+
+func (r *registry) evict(lms []*loadedModel) {
+	for _, lm := range lms {
+		log.Printf("Unloading model %s: over the memory budget", lm.name)
+		metrics.ModelEvictions.WithLabelValues(lm.name, "memory").Inc()
+		r.unload(context.Background(), lm)
+	}
+}
+
+// resident returns name's model if it is loaded, without loading it.
+func (r *registry) resident(name string) (*loadedModel, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lm, ok := r.models[name]
+	return lm, ok
+}
+
+func (r *registry) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.namesLocked()
+}
+
+// namesLocked lists servable models, resident or not.
+func (r *registry) namesLocked() []string {
+	seen := make(map[string]bool, len(r.paths)+len(r.models))
+	names := make([]string, 0, len(seen))
+	for name := range r.paths {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range r.models {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *registry) info() []engine.ModelInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]engine.ModelInfo, 0, len(r.models))
+	for _, lm := range r.models {
+		out = append(out, lm.infoLocked())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (lm *loadedModel) infoLocked() engine.ModelInfo {
+	mi := engine.ModelInfo{Name: lm.name, InFlight: lm.scheduler.InFlight(), LastUsed: lm.lastUsed}
+	if lm.model != nil {
+		mi.Path, mi.Arch = lm.model.Path, lm.model.Arch
+	}
+	mi.WeightBytes, mi.KVBytes = lm.memory()
+	return mi
+}
+
+// close unmaps the GGUF files of the model and its draft, if they are mapped.
+func (lm *loadedModel) close() {
+	if lm.model != nil {
+		lm.model.GGUF.Close()
+	}
+	if lm.draft != nil {
+		lm.draft.model.GGUF.Close()
+	}
+}
+
+// memory is the bytes held by the model and its draft.
+func (lm *loadedModel) memory() (weights, kv int64) {
+	if gb, ok := lm.backend.(*GGUFBackend); ok {
+		weights, kv = gb.Memory()
+	}
+	if lm.draft != nil {
+		w, k := lm.draft.Memory()
+		weights += w
+		kv += k
+	}
+	return weights, kv
+}
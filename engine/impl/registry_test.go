@@ -0,0 +1,301 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// fakeLoader maps synthetic models, counting loads per path. If gate is set,
+// each load waits for it to close.
+type fakeLoader struct {
+	mu    sync.Mutex
+	loads map[string]int
+	gate  chan struct{}
+}
+
+func (f *fakeLoader) load(path string) (*gguf.Model, *GGUFBackend, error) {
+	if f.gate != nil {
+		<-f.gate
+	}
+	f.mu.Lock()
+	f.loads[path]++
+	f.mu.Unlock()
+	m, err := gguf.MapModel(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	be, err := newGGUFBackend(m, gguf.TypeF32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, be, nil
+}
+
+func (f *fakeLoader) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loads[path]
+}
+
+// newTestRegistry serves synthetic models a and b, neither loaded yet.
+func newTestRegistry(t *testing.T, opts Options) (r *registry, fl *fakeLoader, a, b string) {
+	r = newRegistry(opts)
+	fl = &fakeLoader{loads: make(map[string]int)}
+	r.loader = fl.load
+	a, b = newSynth("llama").write(t), newSynth("llama").write(t)
+	r.register("a", a)
+	r.register("b", b)
+	return r, fl, a, b
+}
+
+// eventually fails t unless cond holds within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// unloaded fails t unless lm finishes unloading within a few seconds.
+func unloaded(t *testing.T, lm *loadedModel) {
+	t.Helper()
+	select {
+	case <-lm.unloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s to unload", lm.name)
+	}
+}
+
+func resident(r *registry, name string) bool {
+	_, ok := r.resident(name)
+	return ok
+}
+
+// drain reads ch to the end and returns its finish reason or error.
+func drain(ch <-chan engine.Token) (string, error) {
+	reason := ""
+	for tok := range ch {
+		if tok.Err != nil {
+			return "", tok.Err
+		}
+		reason += tok.FinishReason
+	}
+	return reason, nil
+}
+
+func TestRegistryLazyLoad(t *testing.T) {
+	r, fl, a, _ := newTestRegistry(t, Options{})
+	e := &goEngine{reg: r}
+	if names := e.Models(); len(names) != 2 || names[0] != "a" || names[1] != "b" || fl.count(a) != 0 {
+		t.Fatalf("models %v, %d loads before any request", names, fl.count(a))
+	}
+
+	// Requests arriving during a load share it.
+	fl.gate = make(chan struct{})
+	got := make(chan *loadedModel, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			lm, err := r.acquire(context.Background(), "a")
+			if err != nil {
+				t.Error(err)
+			}
+			got <- lm
+		}()
+	}
+	eventually(t, "a is loading", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.loading["a"] != nil
+	})
+	close(fl.gate)
+	first := <-got
+	for i := 0; i < 2; i++ {
+		if lm := <-got; lm != first {
+			t.Error("concurrent requests got different models")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		r.release(first)
+	}
+	if n := fl.count(a); n != 1 {
+		t.Errorf("%d loads, want 1", n)
+	}
+
+	// No model named is the first in order.
+	ch, _, err := e.Generate(context.Background(), &engine.GenRequest{Prompt: "the cat", MaxTokens: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := drain(ch); reason != engine.FinishLength || err != nil {
+		t.Errorf("generation ended with %q, %v", reason, err)
+	}
+	if resident(r, "b") {
+		t.Error("b loaded without a request")
+	}
+
+	if _, err := r.acquire(context.Background(), "nope"); !errors.Is(err, engine.ErrUnknownModel) {
+		t.Errorf("unknown model: %v", err)
+	}
+	r.register("broken", a+".missing")
+	for i := 1; i <= 2; i++ {
+		if _, err := r.acquire(context.Background(), "broken"); err == nil {
+			t.Fatal("loading a missing file succeeded")
+		}
+		if n := fl.count(a + ".missing"); n != i {
+			t.Errorf("a failed load is not retried: %d loads", n)
+		}
+	}
+}
+
+func TestRegistryAdmin(t *testing.T) {
+	r, fl, a, b := newTestRegistry(t, Options{})
+	e := &goEngine{reg: r}
+	info, err := e.LoadModel("x", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "x" || info.Path != b || info.Arch != "llama" || info.WeightBytes == 0 {
+		t.Errorf("info %+v", info)
+	}
+	if _, err := e.LoadModel("x", a); !errors.Is(err, engine.ErrModelExists) {
+		t.Errorf("loading x twice: %v", err)
+	}
+	if _, err := e.LoadModel("y", a+".txt"); err == nil {
+		t.Error("loaded a file that is not a GGUF")
+	}
+	if mi := e.ModelInfo(); len(mi) != 1 || mi[0].Name != "x" {
+		t.Errorf("resident %+v", mi)
+	}
+
+	lm, _ := r.resident("x")
+	if err := e.UnloadModel(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if resident(r, "x") || lm.model.GGUF.Mapped() {
+		t.Error("x still resident or mapped after unloading")
+	}
+	if err := e.UnloadModel(context.Background(), "x"); !errors.Is(err, engine.ErrUnknownModel) {
+		t.Errorf("unloading x twice: %v", err)
+	}
+	// It stays servable and loads again on demand.
+	lm, err = r.acquire(context.Background(), "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.release(lm)
+	if n := fl.count(b); n != 2 {
+		t.Errorf("%d loads of x, want 2", n)
+	}
+}
+
+// TestRegistryUnloadWaits unloads a model with a request running and checks
+// a request arriving meanwhile waits for the unload to finish before the
+// model loads again, rather than getting the old copy or a second one.
+func TestRegistryUnloadWaits(t *testing.T) {
+	r, fl, a, _ := newTestRegistry(t, Options{})
+	e := &goEngine{reg: r}
+	running, _, err := e.Generate(context.Background(), &engine.GenRequest{Model: "a", Prompt: "the cat", MaxTokens: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := r.resident("a")
+	removed := make(chan error, 1)
+	go func() { removed <- r.remove(context.Background(), "a") }()
+	eventually(t, "a is draining", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.draining["a"] != nil
+	})
+
+	lm, err := r.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.release(lm)
+	select {
+	case <-old.unloaded:
+	default:
+		t.Error("acquired while a was still unloading")
+	}
+	if lm == old || fl.count(a) != 2 {
+		t.Errorf("got the old model back (%v) or loaded %d times", lm == old, fl.count(a))
+	}
+	if err := <-removed; err != nil {
+		t.Error(err)
+	}
+	if reason, err := drain(running); reason != engine.FinishLength || err != nil {
+		t.Errorf("the running request ended with %q, %v", reason, err)
+	}
+	if old.model.GGUF.Mapped() {
+		t.Error("the unloaded model is still mapped")
+	}
+}
+
+func TestRegistryIdleEviction(t *testing.T) {
+	r, _, _, _ := newTestRegistry(t, Options{IdleTimeout: 100 * time.Millisecond})
+	a, err := r.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.release(a)
+	b, err := r.acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unloaded(t, a)
+	if resident(r, "a") || a.model.GGUF.Mapped() {
+		t.Error("a is still resident or mapped")
+	}
+	// b is held, so it stays however long it sits.
+	time.Sleep(300 * time.Millisecond)
+	if !resident(r, "b") {
+		t.Fatal("b unloaded while a request held it")
+	}
+	r.release(b)
+	unloaded(t, b)
+}
+
+func TestRegistryBudgetEviction(t *testing.T) {
+	// Room for one synthetic model and a half.
+	probe, _, _, _ := newTestRegistry(t, Options{})
+	lm, err := probe.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe.release(lm)
+	weights, _ := lm.memory()
+
+	r, _, _, _ := newTestRegistry(t, Options{MemoryBudget: weights * 3 / 2})
+	a, err := r.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// While a is held, loading b goes over budget rather than evict it.
+	b, err := r.acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.release(b)
+	time.Sleep(100 * time.Millisecond)
+	if !resident(r, "a") || !resident(r, "b") {
+		t.Fatal("a model was evicted while over budget with a held")
+	}
+	// Released, a is the least recently used and goes.
+	r.release(a)
+	r.mu.Lock()
+	b.lastUsed = time.Now()
+	r.mu.Unlock()
+	unloaded(t, a)
+	if resident(r, "a") || !resident(r, "b") || a.model.GGUF.Mapped() {
+		t.Error("a still resident or mapped, or b evicted too")
+	}
+}
@@ -0,0 +1,114 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// ropeTable holds the rotation frequency of each pair of rotated dimensions,
+// with the model's RoPE scaling folded in. Every variant here keeps the angle
+// linear in the position, so a rotation by pos+n is one by pos then one by n.
+type ropeTable struct {
+	dim    int       // rotated dimensions per head
+	freq   []float64 // radians per position, one per pair
+	mscale float32   // multiplies cos and sin; YaRN and LongRoPE temper attention this way
+	neox   bool      // pair dimension i with i+dim/2 rather than i+1
+}
+
+// newRopeTable follows llama.cpp's conventions. Linear scaling divides every
+// frequency by the factor; NTK-aware scaling raises the base instead so high
+// frequencies are left nearly alone; YaRN interpolates low frequencies,
+// keeps high ones and ramps between them; LongRoPE divides each frequency by
+// its own learned factor.
+func newRopeTable(dim int, base float32, ctxLen int, rs gguf.RopeScaling) (*ropeTable, error) {
+	t := &ropeTable{dim: dim, freq: make([]float64, dim/2), mscale: 1}
+	b := float64(base)
+	factor := float64(rs.Factor)
+	if factor <= 0 {
+		factor = 1
+	}
+	scale := func(i int) float64 { return 1 }
+	switch rs.Type {
+	case "none", "":
+	case "linear":
+		scale = func(int) float64 { return 1 / factor }
+	case "ntk":
+		b *= math.Pow(factor, float64(dim)/float64(dim-2))
+	case "yarn":
+		betaFast, betaSlow := float64(rs.BetaFast), float64(rs.BetaSlow)
+		if betaFast == 0 {
+			betaFast = 32
+		}
+		if betaSlow == 0 {
+			betaSlow = 1
+		}
+		// The pair whose wavelength fits nRot times in the original context.
+		corr := func(nRot float64) float64 {
+			return float64(dim) * math.Log(float64(rs.OrigContext)/(nRot*2*math.Pi)) / (2 * math.Log(b))
+		}
+		low := math.Max(0, math.Floor(corr(betaFast)))
+		high := math.Min(float64(dim-1), math.Ceil(corr(betaSlow)))
+		scale = func(i int) float64 {
+			ramp := 1 - math.Min(1, math.Max(0, (float64(i)-low)/math.Max(0.001, high-low)))
+			return (1-ramp)/factor + ramp
+		}
+		t.mscale = float32(1 + 0.1*math.Log(factor))
+		if rs.AttnFactor > 0 {
+			t.mscale *= rs.AttnFactor
+		}
+	case "longrope":
+		factors := rs.ShortFactors
+		if ctxLen > rs.OrigContext || factors == nil {
+			factors = rs.LongFactors
+		}
+		if len(factors) != dim/2 {
+			return nil, fmt.Errorf("longrope: %d factors for %d rotated pairs", len(factors), dim/2)
+		}
+		scale = func(i int) float64 { return 1 / float64(factors[i]) }
+		switch {
+		case rs.AttnFactor > 0:
+			t.mscale = rs.AttnFactor
+		case ctxLen > rs.OrigContext:
+			s := float64(ctxLen) / float64(rs.OrigContext)
+			t.mscale = float32(math.Sqrt(1 + math.Log(s)/math.Log(float64(rs.OrigContext))))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rope scaling type %q", rs.Type)
+	}
+	for i := range t.freq {
+		t.freq[i] = math.Pow(b, -float64(2*i)/float64(dim)) * scale(i)
+	}
+	return t, nil
+}
+
+// apply rotates pairs of the first dim dimensions of each head for position pos.
+func (t *ropeTable) apply(x []float32, heads, headDim, pos int) {
+	t.rotate(x, heads, headDim, pos, t.mscale)
+}
+
+// shift rotates by n positions, for keys already rotated and scaled.
+func (t *ropeTable) shift(x []float32, heads, headDim, n int) {
+	t.rotate(x, heads, headDim, n, 1)
+}
+
+func (t *ropeTable) rotate(x []float32, heads, headDim, pos int, mscale float32) {
+	i0, i1 := 0, 1 // offsets of the first pair; they advance by 2, or by 1 for NeoX
+	step := 2
+	if t.neox {
+		i1, step = len(t.freq), 1
+	}
+	for _, f := range t.freq {
+		sin, cos := math.Sincos(float64(pos) * f)
+		c, s := float32(cos)*mscale, float32(sin)*mscale
+		for h := 0; h < heads; h++ {
+			p := x[h*headDim:]
+			x0, x1 := p[i0], p[i1]
+			p[i0] = x0*c - x1*s
+			p[i1] = x0*s + x1*c
+		}
+		i0 += step
+		i1 += step
+	}
+}
@@ -0,0 +1,115 @@
+package impl
+
+import (
+	"math"
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// The expected values are what llama.cpp's ggml_rope_ext computes for the
+// same hyperparameters: theta_scale^i times freq_scale, ramped between the
+// two by rope_yarn with the corr dims of ggml_rope_yarn_corr_dims, divided by
+// the freq_factors tensor for LongRoPE, and mscale as rope_yarn leaves it.
+// They were worked out in float32 as ggml does, hence the tolerance.
+func TestRopeTable(t *testing.T) {
+	tests := []struct {
+		name   string
+		dim    int
+		base   float32
+		ctxLen int
+		rs     gguf.RopeScaling
+		freq   []float64
+		mscale float64
+	}{
+		{"none", 8, 10000, 64, gguf.RopeScaling{Type: "none"},
+			[]float64{1, 0.1, 0.01, 0.001}, 1},
+		{"linear", 8, 10000, 256, gguf.RopeScaling{Type: "linear", Factor: 4},
+			[]float64{0.25, 0.025, 0.0025, 0.00025}, 1},
+		// llama.cpp has no NTK type; these are its frequencies with
+		// rope_freq_base set to the NTK-aware base, 10000·4^(8/6).
+		{"ntk", 8, 10000, 256, gguf.RopeScaling{Type: "ntk", Factor: 4},
+			[]float64{1, 0.0629960522, 0.00396850239, 0.000249999983}, 1},
+		// corr dims 0 and 2: pair 0 extrapolates, pair 1 is half way, the rest interpolate.
+		{"yarn", 8, 10000, 256, gguf.RopeScaling{Type: "yarn", Factor: 4, OrigContext: 64},
+			[]float64{1, 0.0625, 0.00250000018, 0.000250000012}, 1.13862944},
+		{"yarn wider", 16, 10000, 2048, gguf.RopeScaling{Type: "yarn", Factor: 8, OrigContext: 256},
+			[]float64{1, 0.247052938, 0.0562500022, 0.0108703291, 0.00124999997, 0.000395284704, 0.000124999991, 3.95284696e-05}, 1.20794415},
+		{"yarn betas and attn factor", 16, 10000, 2048, gguf.RopeScaling{Type: "yarn", Factor: 8, OrigContext: 256, BetaFast: 16, BetaSlow: 2, AttnFactor: 0.5},
+			[]float64{1, 0.223994657, 0.0416666642, 0.00395284686, 0.00124999997, 0.000395284704, 0.000124999991, 3.95284696e-05}, 0.603972077},
+		{"longrope long", 8, 10000, 8192, gguf.RopeScaling{Type: "longrope", OrigContext: 4096, ShortFactors: []float32{1, 1.5, 2, 3}, LongFactors: []float32{1, 2, 4, 8}},
+			[]float64{1, 0.0500000007, 0.00250000018, 0.000125000006}, 1.040833},
+		{"longrope short", 8, 10000, 4096, gguf.RopeScaling{Type: "longrope", OrigContext: 4096, ShortFactors: []float32{1, 1.5, 2, 3}, LongFactors: []float32{1, 2, 4, 8}},
+			[]float64{1, 0.0666666701, 0.00500000035, 0.000333333359}, 1},
+		{"longrope attn factor", 8, 10000, 8192, gguf.RopeScaling{Type: "longrope", OrigContext: 4096, LongFactors: []float32{1, 2, 4, 8}, AttnFactor: 1.19},
+			[]float64{1, 0.0500000007, 0.00250000018, 0.000125000006}, 1.19},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := newRopeTable(tt.dim, tt.base, tt.ctxLen, tt.rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.freq {
+				if math.Abs(rt.freq[i]-want) > 1e-6*want {
+					t.Errorf("freq %v, want %v", rt.freq, tt.freq)
+					break
+				}
+			}
+			if math.Abs(float64(rt.mscale)-tt.mscale) > 1e-6 {
+				t.Errorf("mscale %v, want %v", rt.mscale, tt.mscale)
+			}
+		})
+	}
+}
+
+func TestRopeTableErrors(t *testing.T) {
+	for _, rs := range []gguf.RopeScaling{
+		{Type: "dynamic"},
+		{Type: "longrope", OrigContext: 4096, LongFactors: []float32{1, 2, 4}},
+	} {
+		if _, err := newRopeTable(8, 10000, 8192, rs); err == nil {
+			t.Errorf("%+v: no error", rs)
+		}
+	}
+}
+
+// TestRopeShift checks a rotation by pos then n equals one by pos+n, which
+// context shifting relies on, in both pairings.
+func TestRopeShift(t *testing.T) {
+	rt, err := newRopeTable(8, 10000, 2048, gguf.RopeScaling{Type: "yarn", Factor: 8, OrigContext: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, neox := range []bool{false, true} {
+		rt.neox = neox
+		x := synthData("rope", 2*8, 1)
+		a, b := append([]float32(nil), x...), append([]float32(nil), x...)
+		rt.apply(a, 2, 8, 37)
+		rt.apply(b, 2, 8, 25)
+		rt.shift(b, 2, 8, 12)
+		for i := range a {
+			if math.Abs(float64(a[i]-b[i])) > 1e-5 {
+				t.Fatalf("neox %v: rotated by 37 %v, by 25 then 12 %v", neox, a, b)
+			}
+		}
+	}
+}
+
+// TestRopeConfigOverride checks a model config's rope_scaling, LongRoPE
+// factors included, replaces what the GGUF gave.
+func TestRopeConfigOverride(t *testing.T) {
+	m := &gguf.Model{ContextLen: 4096, RopeBase: 10000, Rope: gguf.RopeScaling{Type: "none", OrigContext: 4096}}
+	modelConfig{ContextLength: 8192, RopeScaling: &ropeConfig{
+		Type:         "longrope",
+		ShortFactors: []float32{1, 1.5, 2, 3},
+		LongFactors:  []float32{1, 2, 4, 8},
+	}}.override(m)
+	rt, err := newRopeTable(8, m.RopeBase, m.ContextLen, m.Rope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0.00250000018; math.Abs(rt.freq[2]-want) > 1e-6*want || math.Abs(float64(rt.mscale)-1.040833) > 1e-6 {
+		t.Errorf("freq %v, mscale %v", rt.freq, rt.mscale)
+	}
+}
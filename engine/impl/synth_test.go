@@ -0,0 +1,438 @@
+package impl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// Sizes of the synthetic models: small enough to run in milliseconds, with
+// rows a whole number of quantization blocks and two KV heads shared by four
+// query heads.
+const (
+	synthEmbd    = 128
+	synthHeads   = 4
+	synthKVHeads = 2
+	synthFF      = 64
+	synthLayers  = 2
+	synthExperts = 4
+)
+
+// synthModel is a tiny model of one family, written out as a GGUF for the
+// loader to read. A tensor's values depend only on its name, so two models
+// that share tensor names share their weights.
+type synthModel struct {
+	arch    string
+	typ     uint32 // type matrices are stored in; vectors are always F32
+	md      []synthKV
+	tensors []synthTensor
+}
+
+type synthKV struct {
+	k string
+	v any
+}
+
+type synthTensor struct {
+	name string
+	dims []uint64 // innermost first, as GGUF orders them
+	data []float32
+}
+
+// newSynth builds a model of arch as its GGUF files lay it out: fused
+// tensors for phi3, biases for the qwen2 families, post-norms for gemma2,
+// experts for mixtral and qwen2moe, and tied embeddings for the gemmas.
+// Mixtral is written as a llama with experts, as its files are.
+func newSynth(arch string) *synthModel {
+	s := &synthModel{arch: arch, typ: gguf.TypeF32}
+	if arch == "mixtral" {
+		s.arch = "llama"
+	}
+	toks, scores, types := synthVocab()
+	d, hd, ff := synthEmbd, synthEmbd/synthHeads, synthFF
+	qDim, kvDim := synthHeads*hd, synthKVHeads*hd
+	s.meta("general.architecture", s.arch)
+	s.hparam("embedding_length", uint32(d))
+	s.hparam("block_count", uint32(synthLayers))
+	s.hparam("attention.head_count", uint32(synthHeads))
+	s.hparam("attention.head_count_kv", uint32(synthKVHeads))
+	s.hparam("feed_forward_length", uint32(ff))
+	s.hparam("context_length", uint32(256))
+	s.hparam("attention.layer_norm_rms_epsilon", float32(1e-6))
+	s.hparam("rope.freq_base", float32(10000))
+	s.meta("tokenizer.ggml.model", "llama")
+	s.meta("tokenizer.ggml.tokens", toks)
+	s.meta("tokenizer.ggml.scores", scores)
+	s.meta("tokenizer.ggml.token_type", types)
+	s.meta("tokenizer.ggml.bos_token_id", uint32(1))
+	s.meta("tokenizer.ggml.eos_token_id", uint32(2))
+	moe := arch == "mixtral" || arch == "qwen2moe"
+	if moe {
+		s.hparam("expert_count", uint32(synthExperts))
+		s.hparam("expert_used_count", uint32(2))
+	}
+	switch arch {
+	case "mistral":
+		s.hparam("attention.sliding_window", uint32(4))
+	case "gemma2":
+		s.hparam("attention.sliding_window", uint32(4))
+		s.hparam("attn_logit_softcapping", float32(2))
+		s.hparam("final_logit_softcapping", float32(3))
+	}
+
+	V := len(toks)
+	s.mat("token_embd.weight", V, d, 0.5)
+	s.vec("output_norm.weight", d)
+	if arch != "gemma" && arch != "gemma2" {
+		s.mat("output.weight", V, d, 0.3)
+	}
+	for l := 0; l < synthLayers; l++ {
+		p := fmt.Sprintf("blk.%d.", l)
+		s.vec(p+"attn_norm.weight", d)
+		if arch == "phi3" {
+			s.set(p+"attn_qkv.weight", []uint64{uint64(d), uint64(qDim + 2*kvDim)},
+				concat(synthData(p+"attn_q.weight", qDim*d, 0.3), synthData(p+"attn_k.weight", kvDim*d, 0.3), synthData(p+"attn_v.weight", kvDim*d, 0.3)))
+		} else {
+			s.mat(p+"attn_q.weight", qDim, d, 0.3)
+			s.mat(p+"attn_k.weight", kvDim, d, 0.3)
+			s.mat(p+"attn_v.weight", kvDim, d, 0.3)
+		}
+		if arch == "qwen2" || arch == "qwen2moe" {
+			s.set(p+"attn_q.bias", []uint64{uint64(qDim)}, synthData(p+"attn_q.bias", qDim, 0.5))
+			s.set(p+"attn_k.bias", []uint64{uint64(kvDim)}, synthData(p+"attn_k.bias", kvDim, 0.5))
+			s.set(p+"attn_v.bias", []uint64{uint64(kvDim)}, synthData(p+"attn_v.bias", kvDim, 0.5))
+		}
+		s.mat(p+"attn_output.weight", d, qDim, 0.3)
+		s.vec(p+"ffn_norm.weight", d)
+		switch {
+		case moe:
+			s.mat(p+"ffn_gate_inp.weight", synthExperts, d, 0.5)
+			s.mat(p+"ffn_gate_exps.weight", synthExperts*ff, d, 0.3)
+			s.mat(p+"ffn_up_exps.weight", synthExperts*ff, d, 0.3)
+			s.mat(p+"ffn_down_exps.weight", synthExperts*d, ff, 0.3)
+			if arch == "qwen2moe" {
+				s.vec(p+"ffn_gate_inp_shexp.weight", d)
+				s.mat(p+"ffn_gate_shexp.weight", ff, d, 0.3)
+				s.mat(p+"ffn_up_shexp.weight", ff, d, 0.3)
+				s.mat(p+"ffn_down_shexp.weight", d, ff, 0.3)
+			}
+		case arch == "phi3":
+			s.set(p+"ffn_up.weight", []uint64{uint64(d), uint64(2 * ff)},
+				concat(synthData(p+"ffn_gate.weight", ff*d, 0.3), synthData(p+"ffn_up.weight", ff*d, 0.3)))
+			s.mat(p+"ffn_down.weight", d, ff, 0.3)
+		default:
+			s.mat(p+"ffn_gate.weight", ff, d, 0.3)
+			s.mat(p+"ffn_up.weight", ff, d, 0.3)
+			s.mat(p+"ffn_down.weight", d, ff, 0.3)
+		}
+		if arch == "gemma2" {
+			s.vec(p+"post_attention_norm.weight", d)
+			s.vec(p+"post_ffw_norm.weight", d)
+		}
+	}
+	return s
+}
+
+// synthVocab is a SentencePiece vocabulary of a few words over byte fallback.
+func synthVocab() (toks []string, scores []float32, types []int32) {
+	toks = []string{"<unk>", "<s>", "</s>"}
+	types = []int32{2, 3, 3}
+	for b := 0; b < 256; b++ {
+		toks = append(toks, fmt.Sprintf("<0x%02X>", b))
+		types = append(types, 6)
+	}
+	for _, w := range []string{"▁", "▁the", "▁cat", "▁sat", "▁on", "▁mat", "▁a", "t", "h", "e", "c", "a", "s", "m", "o", "n", "▁t", "▁c", "at", "he"} {
+		toks = append(toks, w)
+		types = append(types, 1)
+	}
+	scores = make([]float32, len(toks))
+	for i := range scores {
+		scores[i] = -float32(i) * 0.01
+		if types[i] == 1 {
+			scores[i] = float32(len(toks[i]))
+		}
+	}
+	return toks, scores, types
+}
+
+// synthData is n values of a normal distribution with the given scale,
+// seeded by name.
+func synthData(name string, n int, scale float32) []float32 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	r := rand.New(rand.NewSource(int64(h.Sum64())))
+	out := make([]float32, n)
+	for i := range out {
+		out[i] = float32(r.NormFloat64()) * scale
+	}
+	return out
+}
+
+func concat(xs ...[]float32) []float32 {
+	var out []float32
+	for _, x := range xs {
+		out = append(out, x...)
+	}
+	return out
+}
+
+func (s *synthModel) meta(k string, v any) {
+	for i := range s.md {
+		if s.md[i].k == k {
+			s.md[i].v = v
+			return
+		}
+	}
+	s.md = append(s.md, synthKV{k, v})
+}
+
+// hparam sets a hyperparameter under the architecture's prefix.
+func (s *synthModel) hparam(k string, v any) { s.meta(s.arch+"."+k, v) }
+
+// dropMeta removes a metadata key.
+func (s *synthModel) dropMeta(k string) {
+	for i := range s.md {
+		if s.md[i].k == k {
+			s.md = append(s.md[:i], s.md[i+1:]...)
+			return
+		}
+	}
+}
+
+// rename makes s a model of another architecture, moving its hyperparameters.
+func (s *synthModel) rename(arch string) {
+	for i := range s.md {
+		if rest, ok := strings.CutPrefix(s.md[i].k, s.arch+"."); ok {
+			s.md[i].k = arch + "." + rest
+		}
+	}
+	s.arch = arch
+	s.meta("general.architecture", arch)
+}
+
+func (s *synthModel) set(name string, dims []uint64, data []float32) {
+	for i := range s.tensors {
+		if s.tensors[i].name == name {
+			s.tensors[i] = synthTensor{name, dims, data}
+			return
+		}
+	}
+	s.tensors = append(s.tensors, synthTensor{name, dims, data})
+}
+
+func (s *synthModel) get(name string) []float32 {
+	for _, t := range s.tensors {
+		if t.name == name {
+			return t.data
+		}
+	}
+	panic("no tensor " + name)
+}
+
+func (s *synthModel) dims(name string) []uint64 {
+	for _, t := range s.tensors {
+		if t.name == name {
+			return t.dims
+		}
+	}
+	panic("no tensor " + name)
+}
+
+func (s *synthModel) drop(name string) {
+	for i := range s.tensors {
+		if s.tensors[i].name == name {
+			s.tensors = append(s.tensors[:i], s.tensors[i+1:]...)
+			return
+		}
+	}
+}
+
+// mat adds a [rows][cols] matrix of random values.
+func (s *synthModel) mat(name string, rows, cols int, scale float32) {
+	s.set(name, []uint64{uint64(cols), uint64(rows)}, synthData(name, rows*cols, scale))
+}
+
+// vec adds a norm weight near 1.
+func (s *synthModel) vec(name string, n int) {
+	data := synthData(name, n, 0.1)
+	for i := range data {
+		data[i]++
+	}
+	s.set(name, []uint64{uint64(n)}, data)
+}
+
+// write saves s as a GGUF in a temporary directory and returns its path.
+func (s *synthModel) write(t testing.TB) string {
+	t.Helper()
+	le := binary.LittleEndian
+	var b bytes.Buffer
+	str := func(s string) {
+		binary.Write(&b, le, uint64(len(s)))
+		b.WriteString(s)
+	}
+	binary.Write(&b, le, uint32(0x46554747))
+	binary.Write(&b, le, uint32(3))
+	binary.Write(&b, le, uint64(len(s.tensors)))
+	binary.Write(&b, le, uint64(len(s.md)))
+	for _, kv := range s.md {
+		str(kv.k)
+		switch v := kv.v.(type) {
+		case string:
+			binary.Write(&b, le, uint32(8))
+			str(v)
+		case uint32:
+			binary.Write(&b, le, uint32(4))
+			binary.Write(&b, le, v)
+		case float32:
+			binary.Write(&b, le, uint32(6))
+			binary.Write(&b, le, v)
+		case bool:
+			binary.Write(&b, le, uint32(7))
+			binary.Write(&b, le, v)
+		case []string:
+			binary.Write(&b, le, []uint32{9, 8})
+			binary.Write(&b, le, uint64(len(v)))
+			for _, x := range v {
+				str(x)
+			}
+		case []float32:
+			binary.Write(&b, le, []uint32{9, 6})
+			binary.Write(&b, le, uint64(len(v)))
+			binary.Write(&b, le, v)
+		case []int32:
+			binary.Write(&b, le, []uint32{9, 5})
+			binary.Write(&b, le, uint64(len(v)))
+			binary.Write(&b, le, v)
+		default:
+			t.Fatalf("metadata %s: unsupported type %T", kv.k, v)
+		}
+	}
+	var data bytes.Buffer
+	for _, tn := range s.tensors {
+		typ := uint32(gguf.TypeF32)
+		if len(tn.dims) > 1 {
+			typ = s.typ
+		}
+		str(tn.name)
+		binary.Write(&b, le, uint32(len(tn.dims)))
+		binary.Write(&b, le, tn.dims)
+		binary.Write(&b, le, typ)
+		binary.Write(&b, le, uint64(data.Len()))
+		data.Write(encodeSynth(t, typ, tn.data))
+		for data.Len()%32 != 0 {
+			data.WriteByte(0)
+		}
+	}
+	for b.Len()%32 != 0 {
+		b.WriteByte(0)
+	}
+	b.Write(data.Bytes())
+	path := filepath.Join(t.TempDir(), s.arch+".gguf")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func encodeSynth(t testing.TB, typ uint32, x []float32) []byte {
+	t.Helper()
+	switch typ {
+	case gguf.TypeF32:
+		out := make([]byte, 4*len(x))
+		for i, v := range x {
+			binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(v))
+		}
+		return out
+	case gguf.TypeF16:
+		out := make([]byte, 2*len(x))
+		for i, v := range x {
+			binary.LittleEndian.PutUint16(out[2*i:], float16(v))
+		}
+		return out
+	}
+	elems, size := gguf.BlockSize(typ)
+	out := make([]byte, len(x)/elems*size)
+	if !gguf.Quantize(typ, x, out) {
+		t.Fatalf("cannot write tensors of type %s", gguf.TypeName(typ))
+	}
+	return out
+}
+
+// float16 rounds v to the nearest half-precision value; the test weights
+// are all normal numbers in its range.
+func float16(v float32) uint16 {
+	b := math.Float32bits(v)
+	sign := uint16(b>>16) & 0x8000
+	exp := int(b>>23&0xff) - 127 + 15
+	if exp <= 0 {
+		return sign
+	}
+	h := sign | uint16(exp)<<10 | uint16(b>>13&0x3ff)
+	if b&0x1fff > 0x1000 || (b&0x1fff == 0x1000 && h&1 == 1) {
+		h++
+	}
+	return h
+}
+
+// load writes s and builds a backend for it.
+func (s *synthModel) load(t testing.TB) *GGUFBackend {
+	t.Helper()
+	m, err := gguf.LoadModel(s.write(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := NewGGUFBackend(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be
+}
+
+// synthTokens is a prompt for the synthetic models, longer than their
+// sliding windows.
+var synthTokens = []int{1, 5, 9, 3, 12, 7, 4, 15, 8, 6, 10, 11, 270, 262, 275, 14}
+
+// runChunked feeds toks through be as one sequence, chunk tokens per step,
+// into KV block blk, and returns the logits of every position.
+func runChunked(t testing.TB, be engine.KernelOps, blk int, toks []int, chunk int) [][]float32 {
+	t.Helper()
+	var rows [][]float32
+	for pos := 0; pos < len(toks); pos += chunk {
+		end := min(pos+chunk, len(toks))
+		res, err := be.Forward(&engine.Step{Seqs: []engine.SeqStep{{
+			Seq: engine.SeqID(blk + 1), Tokens: toks[pos:end], Pos: pos, Blocks: []int{blk}, AllLogits: true,
+		}}})
+		if err == nil {
+			err = res[0].Err
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		V := len(res[0].Logits) / (end - pos)
+		for i := 0; i < end-pos; i++ {
+			rows = append(rows, res[0].Logits[i*V:(i+1)*V])
+		}
+	}
+	return rows
+}
+
+// maxDiff is the largest absolute difference between a and b.
+func maxDiff(a, b [][]float32) float32 {
+	m := float32(0)
+	for i := range a {
+		for j := range a[i] {
+			m = max(m, float32(math.Abs(float64(a[i][j]-b[i][j]))))
+		}
+	}
+	return m
+}
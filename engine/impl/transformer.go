@@ -0,0 +1,520 @@
+package impl
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/gguf"
+	"github.com/haydenlabs/gollum/kernels/cpu"
+)
+
+// transformer is a decoder-only Llama-style model: RMSNorm, rotary positions,
+// grouped-query attention over the paged KV cache, and a gated feed-forward.
+// The families in archs differ from Llama only in the ways archSpec describes.
+type transformer struct {
+	name                                        string // metrics label
+	arch                                        archSpec
+	nEmbd, nHead, nKVHead, headDim, nFF, nVocab int
+	eps                                         float32
+	rope                                        *ropeTable
+	window                                      int     // sliding attention window; 0 = none
+	attnScale, attnSoftcap, finalSoftcap        float32 // softcaps: 0 = off
+
+	tokEmbd, output cpu.Matrix
+	outNorm         []float32
+	layers          []layerWeights
+	kv              *kvCache
+
+	// A model mapped from its file streams through memory a layer at a
+	// time: pages lists where each layer's matrices lie in the mapping,
+	// outPages the output matrix's. file keeps the mapping alive while t is.
+	pages    [][][]byte
+	outPages [][]byte
+	file     *gguf.GGUF
+}
+
+type layerWeights struct {
+	attnNorm       []float32
+	wq, wk, wv, wo cpu.Matrix
+	bq, bk, bv     []float32  // optional
+	wqkv           cpu.Matrix // fused Q, K and V instead
+	bqkv           []float32
+	postAttnNorm   []float32
+	ffnNorm        []float32
+	wGate, wUp     cpu.Matrix // with fused gate-up, wUp holds both and wGate is empty
+	wDown          cpu.Matrix
+	moe            *moeLayer // instead of the dense feed-forward
+	postFFNNorm    []float32
+}
+
+func newTransformer(m *gguf.Model, kvBlocks int, kvType uint32) (*transformer, error) {
+	spec, ok := archs[m.Arch]
+	if !ok {
+		return nil, fmt.Errorf("unsupported architecture %q", m.Arch)
+	}
+	t := &transformer{
+		name:         strings.TrimSuffix(filepath.Base(m.Path), ".gguf"),
+		arch:         spec,
+		nEmbd:        m.EmbedDim,
+		nHead:        m.NumHeads,
+		nKVHead:      m.NumKVHeads,
+		headDim:      m.HeadDim,
+		nFF:          m.FFNDim,
+		nVocab:       m.VocabSize,
+		eps:          m.NormEps,
+		window:       m.SlidingWindow,
+		attnScale:    float32(1 / math.Sqrt(float64(m.HeadDim))),
+		attnSoftcap:  m.AttnSoftcap,
+		finalSoftcap: m.FinalSoftcap,
+	}
+	if spec.attnScale != nil {
+		t.attnScale = spec.attnScale(m)
+	}
+	var err error
+	if t.rope, err = newRopeTable(m.RopeDim, m.RopeBase, m.ContextLen, m.Rope); err != nil {
+		return nil, fmt.Errorf("model %s: %w", m.Arch, err)
+	}
+	t.rope.neox = spec.neox
+	ws := &weights{m: m}
+	get := func(name string, size int) []float32 { return ws.vec(name, size, true) }
+	opt := func(name string, size int) []float32 { return ws.vec(name, size, false) }
+	mat := func(name string, rows, cols int) cpu.Matrix { return ws.mat(name, rows, cols, true) }
+	d, ff := t.nEmbd, t.nFF
+	qDim, kvDim := t.nHead*t.headDim, t.nKVHead*t.headDim
+	t.tokEmbd = mat("token_embd.weight", t.nVocab, d)
+	t.outNorm = get("output_norm.weight", d)
+	t.outPages = ws.take() // streamed only if the output reuses them
+	if _, ok := m.GGUF.Tensors["output.weight"]; ok {
+		t.output = mat("output.weight", t.nVocab, d)
+		t.outPages = ws.take()
+	} else {
+		t.output = t.tokEmbd // tied embeddings
+	}
+	t.layers = make([]layerWeights, m.NumLayers)
+	for l := range t.layers {
+		p := fmt.Sprintf("blk.%d.", l)
+		lw := layerWeights{
+			attnNorm: get(p+"attn_norm.weight", d),
+			wo:       mat(p+"attn_output.weight", d, qDim),
+			ffnNorm:  get(p+"ffn_norm.weight", d),
+		}
+		if spec.fusedQKV {
+			lw.wqkv = mat(p+"attn_qkv.weight", qDim+2*kvDim, d)
+			lw.bqkv = opt(p+"attn_qkv.bias", qDim+2*kvDim)
+		} else {
+			lw.wq, lw.bq = mat(p+"attn_q.weight", qDim, d), opt(p+"attn_q.bias", qDim)
+			lw.wk, lw.bk = mat(p+"attn_k.weight", kvDim, d), opt(p+"attn_k.bias", kvDim)
+			lw.wv, lw.bv = mat(p+"attn_v.weight", kvDim, d), opt(p+"attn_v.bias", kvDim)
+		}
+		switch {
+		case m.Experts > 0:
+			lw.moe = loadMoE(m, spec, p, ws)
+			if err := lw.moe.check(); err != nil {
+				return nil, fmt.Errorf("model %s: %w", m.Arch, err)
+			}
+		case spec.fusedGateUp:
+			lw.wUp = mat(p+"ffn_up.weight", 2*ff, d)
+			lw.wDown = mat(p+"ffn_down.weight", d, ff)
+		default:
+			lw.wGate = mat(p+"ffn_gate.weight", ff, d)
+			lw.wUp = mat(p+"ffn_up.weight", ff, d)
+			lw.wDown = mat(p+"ffn_down.weight", d, ff)
+		}
+		if spec.postNorms {
+			lw.postAttnNorm = get(p+"post_attention_norm.weight", d)
+			lw.postFFNNorm = get(p+"post_ffw_norm.weight", d)
+		}
+		t.layers[l] = lw
+		if m.GGUF.Mapped() {
+			t.pages = append(t.pages, ws.take())
+		}
+	}
+	if err := ws.err(); err != nil {
+		return nil, err
+	}
+	if m.GGUF.Mapped() {
+		t.file = m.GGUF
+	}
+	rowBytes, err := kvRowBytes(kvType, t.headDim, kvDim)
+	if err != nil {
+		return nil, fmt.Errorf("model %s: %w", m.Arch, err)
+	}
+	t.kv = newKVCache(kvBlocks, len(t.layers), kvDim, kvType, rowBytes)
+	return t, nil
+}
+
+// batchSeq is one sequence's share of a packed batch: tokens at positions
+// pos.. whose K/V go into blocks.
+type batchSeq struct {
+	tokens  []int
+	pos     int
+	blocks  []int
+	nLogits int // logits rows wanted, for the last nLogits tokens
+}
+
+// check reports what would stop s from running.
+func (t *transformer) check(s batchSeq) error {
+	if need := (s.pos + len(s.tokens) + engine.KVBlockTokens - 1) / engine.KVBlockTokens; need > len(s.blocks) {
+		return fmt.Errorf("block table covers %d positions, need %d", len(s.blocks)*engine.KVBlockTokens, s.pos+len(s.tokens))
+	}
+	for _, tok := range s.tokens {
+		if tok < 0 || tok >= t.nVocab {
+			return fmt.Errorf("token %d out of range", tok)
+		}
+	}
+	return nil
+}
+
+// forward runs the sequences as one batch, writing their K/V into their
+// blocks, and returns each one's logits rows for its last nLogits tokens.
+func (t *transformer) forward(seqs []batchSeq) ([][]float32, error) {
+	x, err := t.run(t.kv, seqs)
+	if err != nil {
+		return nil, err
+	}
+	d, nl := t.nEmbd, 0
+	for _, s := range seqs {
+		nl += s.nLogits
+	}
+	out := make([][]float32, len(seqs))
+	if nl == 0 {
+		return out, nil
+	}
+	// Every sequence's rows share one pass over the output matrix.
+	last := make([]float32, nl*d)
+	row, r := 0, 0
+	for _, s := range seqs {
+		row += len(s.tokens)
+		copy(last[r*d:], x[(row-s.nLogits)*d:row*d])
+		r += s.nLogits
+	}
+	rmsNorm(last, last, t.outNorm, d, t.eps)
+	logits := make([]float32, nl*t.nVocab)
+	linear(logits, last, t.output, nl)
+	dontNeed(t.outPages)
+	runtime.KeepAlive(t.file)
+	softcap(logits, t.finalSoftcap)
+	r = 0
+	for i, s := range seqs {
+		if s.nLogits > 0 {
+			out[i] = logits[r*t.nVocab : (r+s.nLogits)*t.nVocab : (r+s.nLogits)*t.nVocab]
+		}
+		r += s.nLogits
+	}
+	return out, nil
+}
+
+// hidden returns the final normalized hidden state of every token of a
+// sequence run from position 0. Its KV goes to scratch, not the shared cache.
+func (t *transformer) hidden(tokens []int) ([]float32, error) {
+	nb := (len(tokens) + engine.KVBlockTokens - 1) / engine.KVBlockTokens
+	blocks := make([]int, nb)
+	for i := range blocks {
+		blocks[i] = i
+	}
+	kvDim := t.nKVHead * t.headDim
+	x, err := t.run(newKVCache(nb, len(t.layers), kvDim, gguf.TypeF32, 4*kvDim), []batchSeq{{tokens: tokens, blocks: blocks}})
+	if err != nil {
+		return nil, err
+	}
+	rmsNorm(x, x, t.outNorm, t.nEmbd, t.eps)
+	return x, nil
+}
+
+// run passes a batch through every layer, storing its K/V in kv, and returns
+// the residual stream, one row per token with each sequence's rows after the
+// previous one's. The matrix multiplies take every row at once; only RoPE,
+// which goes by each row's position, and attention, which keeps each
+// sequence to its own KV, see where one sequence ends and the next begins.
+func (t *transformer) run(kv *kvCache, seqs []batchSeq) ([]float32, error) {
+	n, d, ff := 0, t.nEmbd, t.nFF
+	qDim, kvDim := t.nHead*t.headDim, t.nKVHead*t.headDim
+	for _, s := range seqs {
+		if err := t.check(s); err != nil {
+			return nil, err
+		}
+		n += len(s.tokens)
+	}
+	x := make([]float32, n*d)
+	i := 0
+	for _, s := range seqs {
+		for _, tok := range s.tokens {
+			t.tokEmbd.Row(tok, x[i*d:(i+1)*d])
+			i++
+		}
+	}
+	if t.arch.embedScale {
+		s := float32(math.Sqrt(float64(d)))
+		for i := range x {
+			x[i] *= s
+		}
+	}
+	act := silu
+	if t.arch.gelu {
+		act = geluTanh
+	}
+	h := make([]float32, n*d)
+	q := make([]float32, n*qDim)
+	k := make([]float32, n*kvDim)
+	v := make([]float32, n*kvDim)
+	att := make([]float32, n*qDim)
+	o := make([]float32, n*d)
+	gate := make([]float32, n*ff)
+	up := make([]float32, n*ff)
+	var fused []float32
+	if t.pages != nil {
+		willNeed(t.pages[0])
+	}
+	for l := range t.layers {
+		lw := &t.layers[l]
+		// Streaming, layer l+1 is read in while l runs and l is dropped
+		// once done, so only about two layers are ever resident.
+		if t.pages != nil {
+			if l+1 < len(t.layers) {
+				willNeed(t.pages[l+1])
+			} else {
+				willNeed(t.outPages)
+			}
+		}
+		rmsNorm(h, x, lw.attnNorm, d, t.eps)
+		if lw.wqkv.Rows > 0 {
+			w := qDim + 2*kvDim
+			if len(fused) < n*w {
+				fused = make([]float32, n*w)
+			}
+			linearBias(fused, h, lw.wqkv, lw.bqkv, n)
+			for i := 0; i < n; i++ {
+				row := fused[i*w:]
+				copy(q[i*qDim:(i+1)*qDim], row[:qDim])
+				copy(k[i*kvDim:(i+1)*kvDim], row[qDim:qDim+kvDim])
+				copy(v[i*kvDim:(i+1)*kvDim], row[qDim+kvDim:w])
+			}
+		} else {
+			linearBias(q, h, lw.wq, lw.bq, n)
+			linearBias(k, h, lw.wk, lw.bk, n)
+			linearBias(v, h, lw.wv, lw.bv, n)
+		}
+		i := 0
+		for _, s := range seqs {
+			for j := range s.tokens {
+				t.rope.apply(q[i*qDim:(i+1)*qDim], t.nHead, t.headDim, s.pos+j)
+				t.rope.apply(k[i*kvDim:(i+1)*kvDim], t.nKVHead, t.headDim, s.pos+j)
+				kv.store(l, s.blocks, s.pos+j, k[i*kvDim:(i+1)*kvDim], v[i*kvDim:(i+1)*kvDim])
+				i++
+			}
+		}
+		attention(att, q, kv, l, seqs, t.nHead, t.nKVHead, t.headDim, t.attnOpts(l))
+		linear(o, att, lw.wo, n)
+		if lw.postAttnNorm != nil {
+			rmsNorm(o, o, lw.postAttnNorm, d, t.eps)
+		}
+		addInPlace(x, o)
+
+		rmsNorm(h, x, lw.ffnNorm, d, t.eps)
+		switch {
+		case lw.moe != nil:
+			lw.moe.forward(o, h, n, d, act, t.name)
+		case lw.wGate.Rows > 0:
+			ffn(o, h, lw.wGate, lw.wUp, lw.wDown, n, ff, gate, up, act)
+		default:
+			if len(fused) < n*2*ff {
+				fused = make([]float32, n*2*ff)
+			}
+			linear(fused, h, lw.wUp, n)
+			for i := 0; i < n; i++ {
+				copy(gate[i*ff:(i+1)*ff], fused[i*2*ff:])
+				copy(up[i*ff:(i+1)*ff], fused[i*2*ff+ff:])
+			}
+			for i := range gate {
+				gate[i] = act(gate[i]) * up[i]
+			}
+			linear(o, gate, lw.wDown, n)
+		}
+		if lw.postFFNNorm != nil {
+			rmsNorm(o, o, lw.postFFNNorm, d, t.eps)
+		}
+		addInPlace(x, o)
+		if t.pages != nil {
+			dontNeed(t.pages[l])
+		}
+	}
+	runtime.KeepAlive(t.file)
+	return x, nil
+}
+
+// attnOpts is how layer l's attention differs from plain causal attention.
+func (t *transformer) attnOpts(l int) attnOpts {
+	opts := attnOpts{scale: t.attnScale, softcap: t.attnSoftcap}
+	if every := t.arch.swaEvery; every == 0 || l%every == 0 {
+		opts.window = t.window
+	}
+	return opts
+}
+
+// shiftKV deletes positions from..from+n-1 by moving later ones down n
+// places. A key's rotation is linear in its position, so rotating it by -n
+// leaves it as if it had been computed at its new position.
+func (t *transformer) shiftKV(blocks []int, from, n, length int) {
+	k, v := make([]float32, t.kv.kvDim), make([]float32, t.kv.kvDim)
+	for p := from + n; p < length; p++ {
+		for l := range t.layers {
+			t.kv.load(l, blocks, p, k, v)
+			t.rope.shift(k, t.nKVHead, t.headDim, -n)
+			t.kv.store(l, blocks, p-n, k, v)
+		}
+	}
+}
+
+// kvCache holds K and V for every layer, one slab per pager block, allocated
+// on first write. Rows are float32, or Q8_0 or Q4_0 blocks quantized as they
+// are stored.
+type kvCache struct {
+	layers, kvDim int
+	typ           uint32
+	rowBytes      int          // of a quantized row
+	k, v          [][]float32  // [block][layer][slot][kvDim]
+	kq, vq        [][]byte     // the same, quantized
+	allocated     atomic.Int64 // bytes of K and V slabs
+}
+
+// kvRowBytes is the size of one position's K or V in a layer, stored as typ.
+// Quantized, each head's part of a row must be whole blocks.
+func kvRowBytes(typ uint32, headDim, kvDim int) (int, error) {
+	if typ == gguf.TypeF32 {
+		return 4 * kvDim, nil
+	}
+	if typ != gguf.TypeQ8_0 && typ != gguf.TypeQ4_0 {
+		return 0, fmt.Errorf("unsupported KV type %s", gguf.TypeName(typ))
+	}
+	elems, size := gguf.BlockSize(typ)
+	if headDim%elems != 0 {
+		return 0, fmt.Errorf("KV type %s needs a head size that is a multiple of %d, not %d", gguf.TypeName(typ), elems, headDim)
+	}
+	return kvDim / elems * size, nil
+}
+
+func newKVCache(blocks, layers, kvDim int, typ uint32, rowBytes int) *kvCache {
+	c := &kvCache{layers: layers, kvDim: kvDim, typ: typ, rowBytes: rowBytes}
+	if typ == gguf.TypeF32 {
+		c.k, c.v = make([][]float32, blocks), make([][]float32, blocks)
+	} else {
+		c.kq, c.vq = make([][]byte, blocks), make([][]byte, blocks)
+	}
+	return c
+}
+
+func (c *kvCache) slab(block int) ([]float32, []float32) {
+	if c.k[block] == nil {
+		size := c.layers * engine.KVBlockTokens * c.kvDim
+		c.k[block] = make([]float32, size)
+		c.v[block] = make([]float32, size)
+		c.allocated.Add(int64(2 * 4 * size))
+	}
+	return c.k[block], c.v[block]
+}
+
+func (c *kvCache) slabQ(block int) ([]byte, []byte) {
+	if c.kq[block] == nil {
+		size := c.layers * engine.KVBlockTokens * c.rowBytes
+		c.kq[block] = make([]byte, size)
+		c.vq[block] = make([]byte, size)
+		c.allocated.Add(int64(2 * size))
+	}
+	return c.kq[block], c.vq[block]
+}
+
+// row is the index of a layer's slot among a slab's rows.
+func (c *kvCache) row(layer, slot int) int {
+	return layer*engine.KVBlockTokens + slot
+}
+
+func (c *kvCache) store(layer int, blocks []int, pos int, k, v []float32) {
+	b, r := blocks[pos/engine.KVBlockTokens], c.row(layer, pos%engine.KVBlockTokens)
+	if c.typ == gguf.TypeF32 {
+		kb, vb := c.slab(b)
+		copy(kb[r*c.kvDim:(r+1)*c.kvDim], k)
+		copy(vb[r*c.kvDim:(r+1)*c.kvDim], v)
+		return
+	}
+	kb, vb := c.slabQ(b)
+	gguf.Quantize(c.typ, k[:c.kvDim], kb[r*c.rowBytes:(r+1)*c.rowBytes])
+	gguf.Quantize(c.typ, v[:c.kvDim], vb[r*c.rowBytes:(r+1)*c.rowBytes])
+}
+
+// load copies the K and V rows stored for a position into k and v.
+func (c *kvCache) load(layer int, blocks []int, pos int, k, v []float32) {
+	b, r := blocks[pos/engine.KVBlockTokens], c.row(layer, pos%engine.KVBlockTokens)
+	if c.typ == gguf.TypeF32 {
+		kb, vb := c.slab(b)
+		copy(k, kb[r*c.kvDim:(r+1)*c.kvDim])
+		copy(v, vb[r*c.kvDim:(r+1)*c.kvDim])
+		return
+	}
+	kb, vb := c.slabQ(b)
+	gguf.Dequantize(c.typ, kb[r*c.rowBytes:(r+1)*c.rowBytes], k[:c.kvDim])
+	gguf.Dequantize(c.typ, vb[r*c.rowBytes:(r+1)*c.rowBytes], v[:c.kvDim])
+}
+
+// block returns the K and V rows a layer keeps in a block, one per slot.
+func (c *kvCache) block(layer, block int) (cpu.Matrix, cpu.Matrix) {
+	lo, hi := c.row(layer, 0), c.row(layer+1, 0)
+	if c.typ == gguf.TypeF32 {
+		kb, vb := c.slab(block)
+		return cpu.FromF32(kb[lo*c.kvDim:hi*c.kvDim], hi-lo, c.kvDim), cpu.FromF32(vb[lo*c.kvDim:hi*c.kvDim], hi-lo, c.kvDim)
+	}
+	kb, vb := c.slabQ(block)
+	k := cpu.Matrix{Type: c.typ, Rows: hi - lo, Cols: c.kvDim, Raw: kb[lo*c.rowBytes : hi*c.rowBytes]}
+	v := cpu.Matrix{Type: c.typ, Rows: hi - lo, Cols: c.kvDim, Raw: vb[lo*c.rowBytes : hi*c.rowBytes]}
+	return k, v
+}
+
+func (c *kvCache) copyBlock(dst, src, tokens int) {
+	for l := 0; l < c.layers; l++ {
+		lo, hi := c.row(l, 0), c.row(l, tokens)
+		if c.typ == gguf.TypeF32 {
+			sk, sv := c.slab(src)
+			dk, dv := c.slab(dst)
+			copy(dk[lo*c.kvDim:hi*c.kvDim], sk[lo*c.kvDim:hi*c.kvDim])
+			copy(dv[lo*c.kvDim:hi*c.kvDim], sv[lo*c.kvDim:hi*c.kvDim])
+			continue
+		}
+		sk, sv := c.slabQ(src)
+		dk, dv := c.slabQ(dst)
+		copy(dk[lo*c.rowBytes:hi*c.rowBytes], sk[lo*c.rowBytes:hi*c.rowBytes])
+		copy(dv[lo*c.rowBytes:hi*c.rowBytes], sv[lo*c.rowBytes:hi*c.rowBytes])
+	}
+}
+
+// linear computes y[i] = W x[i] for n rows, with W stored [out][in] as GGUF lays it out.
+func linear(y, x []float32, w cpu.Matrix, n int) {
+	cpu.Linear(y, x, w, n)
+}
+
+// rmsNorm normalizes each row of x (row length d) into y and scales by gamma.
+func rmsNorm(y, x, gamma []float32, d int, eps float32) {
+	for r := 0; r+d <= len(x) && r+d <= len(y); r += d {
+		ss := float32(0)
+		for _, v := range x[r : r+d] {
+			ss += v * v
+		}
+		scale := float32(1 / math.Sqrt(float64(ss/float32(d)+eps)))
+		for i := 0; i < d; i++ {
+			y[r+i] = x[r+i] * scale * gamma[i]
+		}
+	}
+}
+
+func silu(x float32) float32 {
+	return x / (1 + float32(math.Exp(float64(-x))))
+}
+
+func addInPlace(x, y []float32) {
+	for i := range x {
+		x[i] += y[i]
+	}
+}
@@ -0,0 +1,96 @@
+package impl
+
+import (
+	"fmt"
+
+	"github.com/haydenlabs/gollum/gguf"
+	"github.com/haydenlabs/gollum/kernels/cpu"
+)
+
+// weights looks a model's tensors up by name for a backend being built. It
+// collects the ones missing or the wrong size so the load fails with all of
+// them, and notes which parts of a mapped file the matrices come from.
+type weights struct {
+	m       *gguf.Model
+	missing []string
+	pages   [][]byte // mapped data of the matrices looked up since the last take
+}
+
+// vec returns a tensor of size elements as float32, or nil if it is absent.
+func (w *weights) vec(name string, size int, required bool) []float32 {
+	tn, ok := w.m.GGUF.Tensors[name]
+	if !ok || tn.Data == nil {
+		if required {
+			w.missing = append(w.missing, name)
+		}
+		return nil
+	}
+	if len(tn.Data) != size {
+		w.missing = append(w.missing, fmt.Sprintf("%s (size %d, want %d)", name, len(tn.Data), size))
+		return nil
+	}
+	return tn.Data
+}
+
+// mat returns a [rows][cols] tensor as a matrix in the type it is stored in,
+// or the zero Matrix if it is absent.
+func (w *weights) mat(name string, rows, cols int, required bool) cpu.Matrix {
+	tn, ok := w.m.GGUF.Tensors[name]
+	if !ok || (tn.Data == nil && tn.Raw == nil) {
+		if required {
+			w.missing = append(w.missing, name)
+		}
+		return cpu.Matrix{}
+	}
+	if tn.Size != uint64(rows*cols) {
+		w.missing = append(w.missing, fmt.Sprintf("%s (size %d, want %d)", name, tn.Size, rows*cols))
+		return cpu.Matrix{}
+	}
+	if tn.Raw != nil && w.m.GGUF.Mapped() {
+		// Only a mapping's pages may be dropped: advice on memory the file
+		// was read into would zero it.
+		w.pages = append(w.pages, tn.Raw)
+	}
+	if tn.Data != nil {
+		return cpu.FromF32(tn.Data, rows, cols)
+	}
+	mat, err := cpu.NewMatrix(tn.Type, tn.Raw, rows, cols)
+	if err != nil {
+		w.missing = append(w.missing, fmt.Sprintf("%s (%v)", name, err))
+		return cpu.Matrix{}
+	}
+	return mat
+}
+
+// take returns the mapped data noted since the last call.
+func (w *weights) take() [][]byte {
+	p := w.pages
+	w.pages = nil
+	return p
+}
+
+func (w *weights) err() error {
+	if len(w.missing) == 0 {
+		return nil
+	}
+	missing := w.missing
+	if len(missing) > 3 {
+		missing = append(missing[:3], fmt.Sprintf("and %d more", len(missing)-3))
+	}
+	return fmt.Errorf("model %s: missing or malformed tensors: %v", w.m.Arch, missing)
+}
+
+// willNeed and dontNeed pass madvise-style hints for mapped weights on to
+// the operating system, so a model streamed from its file has the next
+// layer read ahead and the finished one's pages dropped.
+func willNeed(pages [][]byte) {
+	for _, p := range pages {
+		gguf.WillNeed(p)
+	}
+}
+
+func dontNeed(pages [][]byte) {
+	for _, p := range pages {
+		gguf.DontNeed(p)
+	}
+}
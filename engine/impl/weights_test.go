@@ -0,0 +1,36 @@
+package impl
+
+import (
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// TestMappedMatchesLoaded checks that a model streamed from its mapped file,
+// as low_memory runs it, computes the same logits as one read into memory:
+// both keep the weights in their stored type and run the same kernels.
+func TestMappedMatchesLoaded(t *testing.T) {
+	for _, typ := range []uint32{gguf.TypeF32, gguf.TypeF16, gguf.TypeQ8_0, gguf.TypeQ4_0} {
+		t.Run(gguf.TypeName(typ), func(t *testing.T) {
+			s := newSynth("llama")
+			s.typ = typ
+			path := s.write(t)
+			var logits [2][][]float32
+			for i, load := range []func(string) (*gguf.Model, error){gguf.LoadModel, gguf.MapModel} {
+				m, err := load(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer m.GGUF.Close()
+				be, err := NewGGUFBackend(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				logits[i] = runChunked(t, be, 0, synthTokens, 5)
+			}
+			if d := maxDiff(logits[0], logits[1]); d != 0 {
+				t.Errorf("mapped logits differ from loaded ones by %g", d)
+			}
+		})
+	}
+}
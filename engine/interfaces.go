@@ -1,49 +1,156 @@
 package engine
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
 
+	"github.com/haydenlabs/gollum/grammar"
+	"github.com/haydenlabs/gollum/sampling"
+)
+
+// Token is one streamed piece of output. The last value on a channel has
+// FinishReason set, along with any text held back until then, or Err if the
+// request failed. A channel closed without either was cancelled.
 type Token struct {
-	ID   int
-	Text string
+	ID           int
+	Text         string
+	FinishReason string
+	Err          error
 }
 
+// Finish reasons.
+const (
+	FinishStop          = "stop"           // end-of-generation token or stop sequence
+	FinishLength        = "length"         // MaxTokens reached
+	FinishContextLength = "context_length" // context window full
+)
+
 type Trace struct {
 	TTFTMs int64
 	TPOTMs int64
 }
 
 type GenRequest struct {
-	Model       string
-	Prompt      string
-	MaxTokens   int
-	Temperature float32
-	Priority    int
-}
-
-// DecodeCtx carries per-request state into the kernel, including bound KV handle.
-type DecodeCtx struct {
-	Prompt   string
-	KVHandle int
+	Model     string
+	Prompt    string
+	MaxTokens int
+	Stop      []string         // generation ends before the first occurrence of any of these
+	Grammar   *grammar.Grammar // if set, output is constrained to match it
+	// PromptLookup speculates by matching the last PromptLookup tokens
+	// earlier in the sequence; 0 uses the model's setting, < 0 turns off
+	// speculation of any kind.
+	PromptLookup int
+	Sampling     sampling.Params
+	Priority     int
+	// Messages, if set, are the chat turns Prompt was rendered from; the
+	// truncate policy drops the oldest of them to fit the context.
+	Messages []Message
+	// Overflow says what happens when the context fills: OverflowReject (the
+	// default), OverflowTruncate or OverflowShift.
+	Overflow string
+	// SinkTokens is how many leading tokens a context shift keeps; 0 uses 4.
+	SinkTokens int
 }
 
+// Engine serves requests for the models it has loaded. A request's Model
+// picks one; "" picks the default, and the engine fills in its name. Naming a
+// model that is not loaded fails with ErrUnknownModel.
 type Engine interface {
 	Generate(ctx context.Context, req *GenRequest) (<-chan Token, *Trace, error)
-	Embeddings(ctx context.Context, input string) ([]float32, error)
+	Embeddings(ctx context.Context, req *EmbedRequest) (*EmbedResult, error)
+	Models() []string
+}
+
+var (
+	ErrUnknownModel = errors.New("engine: unknown model")
+	ErrModelExists  = errors.New("engine: model already loaded")
+	ErrLoadTimeout  = errors.New("engine: timed out waiting for the model to load")
+)
+
+// ModelAdmin is implemented by engines that load and unload models while serving.
+type ModelAdmin interface {
+	// LoadModel loads the GGUF at path and serves it as name, or as the file
+	// name without extension if name is "".
+	LoadModel(name, path string) (ModelInfo, error)
+	// UnloadModel stops routing to name, waits for its requests to finish and
+	// frees it. Requests still running when ctx ends are failed. A model the
+	// engine can load by name loads again on its next request.
+	UnloadModel(ctx context.Context, name string) error
+	ModelInfo() []ModelInfo
+}
+
+// ModelInfo describes a resident model and the memory it holds.
+type ModelInfo struct {
+	Name        string
+	Path        string
+	Arch        string
+	WeightBytes int64 // including any draft model
+	KVBytes     int64 // KV storage allocated so far
+	InFlight    int   // requests queued or running
+	LastUsed    time.Time
 }
 
+// SeqID identifies a sequence for the lifetime of a request.
+type SeqID uint64
+
+// KernelOps is the backend contract. Each Forward call runs one scheduler step:
+// every sequence in it feeds some tokens and, if asked, gets logits back for the
+// position after its last token. Prefill chunks and decode tokens are the same
+// thing to a backend; a decode is a one-token chunk.
+//
+// A failure confined to one sequence goes in its SeqResult.Err. A non-nil error
+// from Forward fails every sequence in the step that has no result.
 type KernelOps interface {
-	Prefill(batch *Batch) error
-	Decode(step *Step) (int, error)
-	PredictNext(ctxs []DecodeCtx) []string
+	Capabilities() Capabilities
+	Tokenizer() Tokenizer
+	Forward(step *Step) ([]SeqResult, error)
 }
 
-type Batch struct {
-	Prompts []string
-	// future: tensors, kv handles, dtypes
+// Capabilities describes what a backend can run so the scheduler can size batches and KV.
+type Capabilities struct {
+	MaxBatch       int      // sequences per step
+	MaxBatchTokens int      // tokens per step across all sequences
+	DTypes         []string // weight types it can execute, e.g. "f16", "q4_0"
+	Embeddings     bool     // implements Embedder
+	EmbedDim       int      // length of its embedding vectors
+	Sampling       bool     // returns sampled IDs in SeqResult.Token instead of logits
+	VocabSize      int
+	ContextLen     int
+	EOGTokens      []int // token IDs that end generation
+	KVBlocks       int   // KV blocks of KVBlockTokens positions it has storage for; 0 = pager default
 }
 
 type Step struct {
-	BatchSize int
-	SeqLen    int
-	// future: kv ptrs, positions
+	Seqs []SeqStep
+}
+
+// SeqStep is one sequence's share of a step: Tokens occupy positions
+// Pos..Pos+len(Tokens)-1. Position p's KV lives in block Blocks[p/KVBlockTokens]
+// at slot p%KVBlockTokens; earlier positions are already there.
+type SeqStep struct {
+	Seq       SeqID
+	Tokens    []int
+	Pos       int
+	Blocks    []int
+	Logits    bool              // return logits (or a sampled token) for the last position
+	AllLogits bool              // return logits for every position, one row each; never sampled by the backend
+	Sampler   *sampling.Sampler // for backends with Capabilities.Sampling
+}
+
+// KVShifter is implemented by backends that can move KV between positions,
+// for context shifting. ShiftKV deletes positions from..from+n-1 of a
+// sequence of length positions by moving the later ones down n places,
+// re-rotating their keys for the new positions. The blocks it writes are
+// private to the sequence.
+type KVShifter interface {
+	ShiftKV(blocks []int, from, n, length int) error
+}
+
+type SeqResult struct {
+	Seq     SeqID
+	Logits  []float32 // nil if not requested or the backend sampled; len(Tokens) rows for AllLogits
+	Token   int       // sampled token when the backend samples itself
+	Logprob float32   // log-probability of Token, when sampled by the backend
+	Err     error     // this sequence failed; the others in the step are unaffected
 }
@@ -1,83 +1,260 @@
 package engine
 
-import "container/list"
+import (
+	"container/list"
+	"errors"
+)
+
+// KVBlockTokens is the number of token positions held by one KV block.
+const KVBlockTokens = 16
+
+var ErrKVExhausted = errors.New("kv pager: no free blocks")
 
 type KVBlock struct {
 	ID       int
-	Tokens   int
-	Pinned   bool
+	Tokens   int // capacity in token positions
+	Used     int // positions written so far
+	Refs     int // sequences sharing this block; shared blocks are read-only
 	KVHandle int // Bound metal KV handle for this block (0 = unbound). One handle per block.
 }
 
+// KVSeq is a sequence's block table: the ordered blocks holding its first Len positions.
+type KVSeq struct {
+	Blocks []*KVBlock
+	Len    int
+}
+
+// BlockIDs returns the block table as IDs, the form backends address KV by.
+func (s *KVSeq) BlockIDs() []int {
+	ids := make([]int, len(s.Blocks))
+	for i, b := range s.Blocks {
+		ids[i] = b.ID
+	}
+	return ids
+}
+
+func (s *KVSeq) last() *KVBlock {
+	if s == nil || len(s.Blocks) == 0 {
+		return nil
+	}
+	return s.Blocks[len(s.Blocks)-1]
+}
+
+// KVCopier is implemented by backends that hold KV contents outside the pager.
+// The pager calls it when a shared, partly filled block is copied on write.
+type KVCopier interface {
+	CopyKV(dst, src *KVBlock, tokens int) error
+}
+
 type KVPager struct {
 	blocks []*KVBlock
 	free   *list.List
-	lru    *list.List
-	nextID int
+	copier KVCopier
+	evict  func(want int) int // asks the prefix cache to release cached blocks
 }
 
 func NewKVPager() *KVPager {
-	p := &KVPager{free: list.New(), lru: list.New()}
-	for i := 0; i < 64; i++ {
-		b := &KVBlock{ID: i, Tokens: 4096}
+	return NewKVPagerSize(16384, KVBlockTokens)
+}
+
+func NewKVPagerSize(numBlocks, blockTokens int) *KVPager {
+	p := &KVPager{free: list.New()}
+	for i := 0; i < numBlocks; i++ {
+		b := &KVBlock{ID: i, Tokens: blockTokens}
 		p.blocks = append(p.blocks, b)
 		p.free.PushBack(b)
 	}
-	p.nextID = len(p.blocks)
 	return p
 }
 
-func (p *KVPager) Allocate(tokens int) *KVBlock {
-	for el := p.free.Front(); el != nil; el = el.Next() {
-		b := el.Value.(*KVBlock)
-		if b.Tokens >= tokens {
-			p.free.Remove(el)
-			p.lru.PushFront(b)
-			return b
+func (p *KVPager) SetCopier(c KVCopier) { p.copier = c }
+
+// SetEvictor installs the callback used when the free list runs dry. It should
+// release at least want cached blocks if it can and report how many it freed.
+func (p *KVPager) SetEvictor(fn func(want int) int) { p.evict = fn }
+
+// Allocate returns an empty block owned by the caller (Refs == 1).
+// Blocks held by anyone, including the prefix cache, are never handed out.
+func (p *KVPager) Allocate() *KVBlock {
+	if p.free.Len() == 0 && p.evict != nil {
+		p.evict(1)
+	}
+	el := p.free.Front()
+	if el == nil {
+		return nil
+	}
+	b := p.free.Remove(el).(*KVBlock)
+	b.Refs = 1
+	b.Used = 0
+	b.KVHandle = 0
+	return b
+}
+
+func (p *KVPager) Retain(b *KVBlock) {
+	if b != nil {
+		b.Refs++
+	}
+}
+
+// Release drops a reference; the last one returns b to the free list.
+func (p *KVPager) Release(b *KVBlock) {
+	if b == nil || b.Refs == 0 {
+		return
+	}
+	b.Refs--
+	if b.Refs == 0 {
+		p.Free(b)
+	}
+}
+
+// Free returns b to the free list, discarding its contents.
+func (p *KVPager) Free(b *KVBlock) {
+	if b == nil {
+		return
+	}
+	b.Refs = 0
+	b.Used = 0
+	p.free.PushBack(b)
+}
+
+// Share returns a new sequence that reads the first n positions of blocks.
+// The blocks are shared, not copied; writes past n copy the last block first.
+func (p *KVPager) Share(blocks []*KVBlock, n int) *KVSeq {
+	need := (n + KVBlockTokens - 1) / KVBlockTokens
+	if need > len(blocks) {
+		need = len(blocks)
+		n = need * KVBlockTokens
+	}
+	seq := &KVSeq{Blocks: make([]*KVBlock, 0, need), Len: n}
+	for _, b := range blocks[:need] {
+		p.Retain(b)
+		seq.Blocks = append(seq.Blocks, b)
+	}
+	return seq
+}
+
+// Fork shares all of seq's blocks with a new sequence, e.g. for parallel sampling or beam search.
+func (p *KVPager) Fork(seq *KVSeq) *KVSeq {
+	return p.Share(seq.Blocks, seq.Len)
+}
+
+// Append reserves n more positions at the end of seq. If the block being
+// written into is shared with another sequence it is copied first, so shared
+// blocks are never modified.
+func (p *KVPager) Append(seq *KVSeq, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if off := seq.Len % KVBlockTokens; off != 0 {
+		last := seq.Blocks[len(seq.Blocks)-1]
+		if last.Refs > 1 || last.Used > off {
+			cp, err := p.copyOnWrite(last, off)
+			if err != nil {
+				return err
+			}
+			seq.Blocks[len(seq.Blocks)-1] = cp
+		}
+	}
+	end := seq.Len + n
+	var added []*KVBlock
+	for len(seq.Blocks)*KVBlockTokens < end {
+		b := p.Allocate()
+		if b == nil {
+			for _, a := range added {
+				p.Free(a)
+			}
+			seq.Blocks = seq.Blocks[:len(seq.Blocks)-len(added)]
+			return ErrKVExhausted
 		}
+		added = append(added, b)
+		seq.Blocks = append(seq.Blocks, b)
 	}
-	for el := p.lru.Back(); el != nil; el = el.Prev() {
-		b := el.Value.(*KVBlock)
-		if !b.Pinned {
-			p.lru.Remove(el)
-			p.lru.PushFront(b)
-			return b
+	for i := seq.Len / KVBlockTokens; i < len(seq.Blocks); i++ {
+		used := end - i*KVBlockTokens
+		if used > KVBlockTokens {
+			used = KVBlockTokens
+		}
+		if used > seq.Blocks[i].Used {
+			seq.Blocks[i].Used = used
 		}
 	}
+	seq.Len = end
 	return nil
 }
 
-func (p *KVPager) Free(b *KVBlock) {
-	if b == nil {
+// Truncate drops positions past n, releasing blocks that no longer hold any of them.
+func (p *KVPager) Truncate(seq *KVSeq, n int) {
+	if n >= seq.Len {
 		return
 	}
-	for el := p.lru.Front(); el != nil; el = el.Next() {
-		if el.Value.(*KVBlock).ID == b.ID {
-			p.lru.Remove(el)
-			break
+	keep := (n + KVBlockTokens - 1) / KVBlockTokens
+	for _, b := range seq.Blocks[keep:] {
+		p.Release(b)
+	}
+	seq.Blocks = seq.Blocks[:keep]
+	seq.Len = n
+	if keep > 0 && seq.Blocks[keep-1].Refs == 1 {
+		if used := n - (keep-1)*KVBlockTokens; used < seq.Blocks[keep-1].Used {
+			seq.Blocks[keep-1].Used = used
 		}
 	}
-	b.Pinned = false
-	p.free.PushBack(b)
 }
 
-func (p *KVPager) Pin(b *KVBlock) {
-	if b != nil {
-		b.Pinned = true
+// Own copies every shared block holding positions from onward, so the
+// backend can rewrite them in place.
+func (p *KVPager) Own(seq *KVSeq, from int) error {
+	for i := from / KVBlockTokens; i < len(seq.Blocks); i++ {
+		if b := seq.Blocks[i]; b.Refs > 1 {
+			used := seq.Len - i*KVBlockTokens
+			if used > KVBlockTokens {
+				used = KVBlockTokens
+			}
+			cp, err := p.copyOnWrite(b, used)
+			if err != nil {
+				return err
+			}
+			seq.Blocks[i] = cp
+		}
 	}
+	return nil
 }
 
-func (p *KVPager) Unpin(b *KVBlock) {
-	if b != nil {
-		b.Pinned = false
+// Drop releases every block of seq.
+func (p *KVPager) Drop(seq *KVSeq) {
+	if seq == nil {
+		return
 	}
+	for _, b := range seq.Blocks {
+		p.Release(b)
+	}
+	seq.Blocks = nil
+	seq.Len = 0
 }
 
-func (p *KVPager) ByID(id int) *KVBlock {
-	for _, b := range p.blocks {
-		if b.ID == id {
-			return b
+func (p *KVPager) copyOnWrite(src *KVBlock, tokens int) (*KVBlock, error) {
+	dst := p.Allocate()
+	if dst == nil {
+		return nil, ErrKVExhausted
+	}
+	if p.copier != nil {
+		if err := p.copier.CopyKV(dst, src, tokens); err != nil {
+			p.Free(dst)
+			return nil, err
 		}
 	}
-	return nil
+	dst.Used = tokens
+	p.Release(src)
+	return dst, nil
+}
+
+func (p *KVPager) ByID(id int) *KVBlock {
+	if id < 0 || id >= len(p.blocks) {
+		return nil
+	}
+	return p.blocks[id]
+}
+
+// FreeBlocks reports blocks on the free list, not counting ones the prefix cache could evict.
+func (p *KVPager) FreeBlocks() int {
+	return p.free.Len()
 }
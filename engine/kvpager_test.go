@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordingCopier records the copies the pager asks for.
+type recordingCopier struct{ copies [][3]int } // dst, src, tokens
+
+func (c *recordingCopier) CopyKV(dst, src *KVBlock, tokens int) error {
+	c.copies = append(c.copies, [3]int{dst.ID, src.ID, tokens})
+	return nil
+}
+
+func refs(seq *KVSeq) []int {
+	r := make([]int, len(seq.Blocks))
+	for i, b := range seq.Blocks {
+		r[i] = b.Refs
+	}
+	return r
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKVPagerAppend(t *testing.T) {
+	p := NewKVPagerSize(4, KVBlockTokens)
+	seq := &KVSeq{}
+	if err := p.Append(seq, 20); err != nil {
+		t.Fatal(err)
+	}
+	if seq.Len != 20 || len(seq.Blocks) != 2 || seq.Blocks[0].Used != 16 || seq.Blocks[1].Used != 4 {
+		t.Fatalf("after 20 positions: len %d, %d blocks", seq.Len, len(seq.Blocks))
+	}
+	if err := p.Append(seq, 12); err != nil {
+		t.Fatal(err)
+	}
+	if len(seq.Blocks) != 2 || seq.Blocks[1].Used != 16 || p.FreeBlocks() != 2 {
+		t.Errorf("filling the last block: %d blocks, last used %d, %d free", len(seq.Blocks), seq.Blocks[1].Used, p.FreeBlocks())
+	}
+	// Too much for what is left: nothing is taken.
+	if err := p.Append(seq, 33); !errors.Is(err, ErrKVExhausted) {
+		t.Fatalf("appending past the pager's blocks: %v", err)
+	}
+	if seq.Len != 32 || len(seq.Blocks) != 2 || p.FreeBlocks() != 2 {
+		t.Errorf("a failed append left len %d, %d blocks, %d free", seq.Len, len(seq.Blocks), p.FreeBlocks())
+	}
+}
+
+func TestKVPagerCopyOnWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		shared func(p *KVPager, a *KVSeq) *KVSeq
+		copied bool
+		tokens int // positions copied
+	}{
+		// Both read the last block, partly filled: the writer copies it.
+		{"fork mid-block", func(p *KVPager, a *KVSeq) *KVSeq { return p.Fork(a) }, true, 20 % KVBlockTokens},
+		// The reader stops before positions a wrote: it must not write over them.
+		{"share fewer positions", func(p *KVPager, a *KVSeq) *KVSeq { return p.Share(a.Blocks, 18) }, true, 18 % KVBlockTokens},
+		// Alone in a block another sequence wrote further into.
+		{"partly used", func(p *KVPager, a *KVSeq) *KVSeq {
+			b := p.Share(a.Blocks, 18)
+			p.Drop(a)
+			return b
+		}, true, 18 % KVBlockTokens},
+		// At a block boundary nothing is shared past it: no copy.
+		{"share whole blocks", func(p *KVPager, a *KVSeq) *KVSeq { return p.Share(a.Blocks, 16) }, false, 0},
+	}
+	for _, tt := range tests {
+		p := NewKVPagerSize(8, KVBlockTokens)
+		c := &recordingCopier{}
+		p.SetCopier(c)
+		a := &KVSeq{}
+		if err := p.Append(a, 20); err != nil {
+			t.Fatal(err)
+		}
+		aLast := a.Blocks[1]
+		b := tt.shared(p, a)
+		before := b.Blocks[len(b.Blocks)-1]
+		if err := p.Append(b, 1); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case tt.copied && len(c.copies) != 1:
+			t.Errorf("%s: %d copies, want 1", tt.name, len(c.copies))
+		case tt.copied && c.copies[0] != [3]int{b.Blocks[1].ID, before.ID, tt.tokens}:
+			t.Errorf("%s: copied %v, want block %d's %d positions to block %d", tt.name, c.copies[0], before.ID, tt.tokens, b.Blocks[1].ID)
+		case !tt.copied && len(c.copies) != 0:
+			t.Errorf("%s: copied %v", tt.name, c.copies)
+		}
+		if b.Blocks[len(b.Blocks)-1] == aLast {
+			t.Errorf("%s: the writer still shares the block the other sequence wrote", tt.name)
+		}
+		if aLast.Refs > 0 && aLast.Used != 4 {
+			t.Errorf("%s: the other sequence's block now has %d positions used, want 4", tt.name, aLast.Used)
+		}
+		if w := b.Blocks[len(b.Blocks)-1]; w.Refs != 1 || w.Used != (b.Len-1)%KVBlockTokens+1 {
+			t.Errorf("%s: the written block has %d refs and %d used, len %d", tt.name, w.Refs, w.Used, b.Len)
+		}
+	}
+}
+
+func TestKVPagerForkRelease(t *testing.T) {
+	p := NewKVPagerSize(8, KVBlockTokens)
+	a := &KVSeq{}
+	if err := p.Append(a, 40); err != nil {
+		t.Fatal(err)
+	}
+	b := p.Fork(a)
+	c := p.Fork(b)
+	if !equal(refs(a), []int{3, 3, 3}) || c.Len != 40 {
+		t.Fatalf("refs after two forks: %v", refs(a))
+	}
+	// c diverges in its last block; a and b still share it.
+	if err := p.Append(c, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !equal(refs(a), []int{3, 3, 2}) || !equal(refs(c), []int{3, 3, 1}) {
+		t.Errorf("refs after c wrote: a %v, c %v", refs(a), refs(c))
+	}
+	blocks := append([]*KVBlock(nil), a.Blocks...)
+	blocks = append(blocks, c.Blocks[2])
+	p.Drop(a)
+	p.Drop(c)
+	if p.FreeBlocks() != 8-3 {
+		t.Errorf("%d free with b alive, want 5", p.FreeBlocks())
+	}
+	p.Drop(b)
+	for _, blk := range blocks {
+		if blk.Refs != 0 {
+			t.Errorf("block %d has %d refs after every sequence was dropped", blk.ID, blk.Refs)
+		}
+	}
+	if p.FreeBlocks() != 8 {
+		t.Errorf("%d free after every sequence was dropped, want 8", p.FreeBlocks())
+	}
+	// Releasing what is already free changes nothing.
+	p.Release(blocks[0])
+	if blocks[0].Refs != 0 || p.FreeBlocks() != 8 {
+		t.Errorf("a second release: refs %d, %d free", blocks[0].Refs, p.FreeBlocks())
+	}
+}
+
+func TestKVPagerTruncate(t *testing.T) {
+	p := NewKVPagerSize(8, KVBlockTokens)
+	a := &KVSeq{}
+	if err := p.Append(a, 40); err != nil {
+		t.Fatal(err)
+	}
+	b := p.Fork(a)
+	p.Truncate(a, 20)
+	if a.Len != 20 || len(a.Blocks) != 2 || !equal(refs(b), []int{2, 2, 1}) {
+		t.Fatalf("truncating a shared sequence: len %d, %d blocks, refs %v", a.Len, len(a.Blocks), refs(b))
+	}
+	// b still reads the block a stopped in, so its use stays.
+	if a.Blocks[1].Used != 16 {
+		t.Errorf("shared block's use cut to %d", a.Blocks[1].Used)
+	}
+	p.Drop(b)
+	p.Truncate(a, 17)
+	if a.Blocks[1].Used != 1 || p.FreeBlocks() != 6 {
+		t.Errorf("truncating an owned block: used %d, %d free", a.Blocks[1].Used, p.FreeBlocks())
+	}
+	p.Truncate(a, 0)
+	if len(a.Blocks) != 0 || p.FreeBlocks() != 8 {
+		t.Errorf("truncating to nothing: %d blocks, %d free", len(a.Blocks), p.FreeBlocks())
+	}
+	p.Truncate(a, 5) // past the end: nothing to do
+	if a.Len != 0 {
+		t.Errorf("truncating past the end grew the sequence to %d", a.Len)
+	}
+}
+
+func TestKVPagerOwn(t *testing.T) {
+	p := NewKVPagerSize(8, KVBlockTokens)
+	c := &recordingCopier{}
+	p.SetCopier(c)
+	a := &KVSeq{}
+	if err := p.Append(a, 40); err != nil {
+		t.Fatal(err)
+	}
+	b := p.Fork(a)
+	if err := p.Own(b, 20); err != nil {
+		t.Fatal(err)
+	}
+	if !equal(refs(b), []int{2, 1, 1}) || !equal(refs(a), []int{2, 1, 1}) {
+		t.Errorf("after owning from 20: a %v, b %v", refs(a), refs(b))
+	}
+	if len(c.copies) != 2 || c.copies[0][2] != 16 || c.copies[1][2] != 8 {
+		t.Errorf("copies %v, want a full block and 8 positions", c.copies)
+	}
+}
+
+// TestKVPagerEvictor checks that Allocate asks for cached blocks back once
+// the free list is empty.
+func TestKVPagerEvictor(t *testing.T) {
+	p := NewKVPagerSize(2, KVBlockTokens)
+	a := &KVSeq{}
+	if err := p.Append(a, 32); err != nil {
+		t.Fatal(err)
+	}
+	asked := 0
+	p.SetEvictor(func(want int) int {
+		asked += want
+		p.Release(a.Blocks[0])
+		return 1
+	})
+	if b := p.Allocate(); b == nil || b != a.Blocks[0] || asked != 1 {
+		t.Errorf("Allocate with nothing free got %v after asking for %d", b, asked)
+	}
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"errors"
+
+	"github.com/haydenlabs/gollum/metrics"
+)
+
+// Context overflow policies, for GenRequest.Overflow.
+const (
+	OverflowReject   = "reject"   // fail a prompt that does not fit; generation stops when the context fills
+	OverflowTruncate = "truncate" // drop the oldest non-system messages until the prompt fits
+	OverflowShift    = "shift"    // drop the oldest positions after the sink tokens, in the prompt and as generation goes
+)
+
+// defaultSinkTokens is how many leading positions a shift keeps. Attention
+// leans heavily on the first few tokens whatever they are, so losing them
+// hurts far more than losing the ones after.
+const defaultSinkTokens = 4
+
+var ErrContextOverflow = errors.New("engine: prompt does not fit the context window")
+
+// Message is one chat turn.
+type Message struct {
+	Role    string
+	Content string
+}
+
+// ChatPrompt renders messages the way the chat endpoint does: the content of
+// each system and user message on its own line.
+func ChatPrompt(msgs []Message) string {
+	prompt := ""
+	for _, m := range msgs {
+		if m.Role == "user" || m.Role == "system" {
+			prompt += m.Content + "\n"
+		}
+	}
+	return prompt
+}
+
+// fitPrompt makes rs's prompt fit the context as its overflow policy says,
+// or returns ErrContextOverflow.
+func (s *Scheduler) fitPrompt(rs *reqState) error {
+	limit := s.caps.ContextLen
+	if limit <= 0 || len(rs.tokens) < limit {
+		return nil
+	}
+	switch rs.req.Overflow {
+	case OverflowTruncate:
+		if s.truncateMessages(rs) {
+			metrics.ContextOverflows.WithLabelValues(rs.req.Model, "truncate").Inc()
+			return nil
+		}
+	case OverflowShift:
+		sinks, half := s.shiftSize(rs)
+		if half > 0 {
+			// Drop whole halves of the window, as a shift during generation
+			// would have had the prompt been streamed in.
+			drop := ((len(rs.tokens)-limit)/half + 1) * half
+			rs.tokens = append(rs.tokens[:sinks], rs.tokens[sinks+drop:]...)
+			metrics.ContextOverflows.WithLabelValues(rs.req.Model, "shift").Inc()
+			return nil
+		}
+	}
+	metrics.ContextOverflows.WithLabelValues(rs.req.Model, "reject").Inc()
+	return ErrContextOverflow
+}
+
+// truncateMessages drops the oldest messages other than system ones and the
+// last until the prompt leaves room for MaxTokens, or at least one token.
+// It reports whether the prompt then fits.
+func (s *Scheduler) truncateMessages(rs *reqState) bool {
+	room := 1
+	if rs.req.MaxTokens > 0 {
+		room = rs.req.MaxTokens
+	}
+	msgs := append([]Message(nil), rs.req.Messages...)
+	for len(rs.tokens)+room > s.caps.ContextLen {
+		i := 0
+		for i < len(msgs)-1 && msgs[i].Role == "system" {
+			i++
+		}
+		if i >= len(msgs)-1 {
+			break
+		}
+		msgs = append(msgs[:i], msgs[i+1:]...)
+		rs.tokens = s.tok.Encode(ChatPrompt(msgs))
+	}
+	return len(msgs) > 0 && len(rs.tokens) < s.caps.ContextLen
+}
+
+// shiftSize returns how many sink tokens rs keeps and how many positions a
+// shift drops after them: half of the rest of the window.
+func (s *Scheduler) shiftSize(rs *reqState) (sinks, half int) {
+	sinks = rs.req.SinkTokens
+	if sinks <= 0 {
+		sinks = defaultSinkTokens
+	}
+	return sinks, (s.caps.ContextLen - sinks) / 2
+}
+
+// shift makes room in a full context by deleting the positions after the
+// sink tokens from the sequence and its KV, moving the rest down in place
+// instead of prefilling them again. It reports whether it could.
+func (s *Scheduler) shift(rs *reqState) bool {
+	sh, ok := s.backend.(KVShifter)
+	if !ok || rs.req.Overflow != OverflowShift {
+		return false
+	}
+	sinks, half := s.shiftSize(rs)
+	if half <= 0 || sinks+half > rs.computed {
+		return false
+	}
+	if err := s.pgr.Own(rs.kv, sinks); err != nil {
+		metrics.KVEvents.WithLabelValues("exhausted", rs.req.Model).Inc()
+		return false
+	}
+	if err := sh.ShiftKV(rs.kv.BlockIDs(), sinks, half, rs.computed); err != nil {
+		metrics.BackendErrors.WithLabelValues(rs.req.Model, "seq").Inc()
+		return false
+	}
+	rs.computed -= half
+	s.pgr.Truncate(rs.kv, rs.computed)
+	rs.tokens = append(rs.tokens[:sinks], rs.tokens[sinks+half:]...)
+	if rs.prompt > sinks {
+		rs.prompt = max(sinks, rs.prompt-half)
+	}
+	// The KV no longer matches what a prefill of the tokens would write, so
+	// it must not be shared, and the draft model starts over.
+	rs.shifted = true
+	s.dropSpec(rs)
+	metrics.ContextOverflows.WithLabelValues(rs.req.Model, "shift").Inc()
+	return true
+}
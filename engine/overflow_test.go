@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+// overflowState is a request for s with its prompt encoded, as admit leaves it.
+func overflowState(s *Scheduler, req *GenRequest) *reqState {
+	if req.Messages != nil {
+		req.Prompt = ChatPrompt(req.Messages)
+	}
+	return &reqState{req: req, tokens: s.tok.Encode(req.Prompt)}
+}
+
+func TestTruncateMessages(t *testing.T) {
+	tests := []struct {
+		name      string
+		msgs      []Message
+		maxTokens int
+		want      string
+		fits      bool
+	}{
+		{
+			"oldest turn goes",
+			[]Message{{"system", "aa"}, {"user", "bbbb"}, {"user", "cc"}}, 4,
+			"aacc", true,
+		},
+		{
+			"only as many as needed",
+			[]Message{{"system", "a"}, {"user", "bbb"}, {"user", "ccc"}, {"user", "ab"}}, 3,
+			"acccab", true,
+		},
+		{
+			"room for one token by default",
+			[]Message{{"user", "aaaa"}, {"user", "bbbbbbbbb"}}, 0,
+			"bbbbbbbbb", true,
+		},
+		{
+			"assistant turns count as messages",
+			[]Message{{"system", "a"}, {"assistant", "b"}, {"user", "ccccccccc"}}, 0,
+			"accccccccc", false,
+		},
+		{
+			"system and last message kept",
+			[]Message{{"system", "aaaaaaaa"}, {"user", "bbb"}}, 1,
+			"aaaaaaaabbb", false,
+		},
+		{
+			"last message alone too long",
+			[]Message{{"user", "aaaaaaaaaaaa"}}, 0,
+			"aaaaaaaaaaaa", false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := newScriptOps(nil)
+			ops.caps.ContextLen = 10
+			s := NewScheduler(ops)
+			rs := overflowState(s, &GenRequest{Messages: tt.msgs, MaxTokens: tt.maxTokens})
+			fits := s.truncateMessages(rs)
+			if got := s.tok.Decode(rs.tokens); got != tt.want || fits != tt.fits {
+				t.Errorf("got %q (fits %v), want %q (%v)", got, fits, tt.want, tt.fits)
+			}
+		})
+	}
+}
+
+func TestShiftSize(t *testing.T) {
+	tests := []struct {
+		sinkTokens, ctxLen int
+		sinks, half        int
+	}{
+		{0, 100, 4, 48},
+		{8, 100, 8, 46},
+		{-1, 10, 4, 3},
+		{1, 4, 1, 1},
+		{9, 10, 9, 0},
+		{20, 10, 20, -5},
+	}
+	for _, tt := range tests {
+		ops := newScriptOps(nil)
+		ops.caps.ContextLen = tt.ctxLen
+		s := NewScheduler(ops)
+		sinks, half := s.shiftSize(&reqState{req: &GenRequest{SinkTokens: tt.sinkTokens}})
+		if sinks != tt.sinks || half != tt.half {
+			t.Errorf("%d sinks in %d: got %d, %d, want %d, %d", tt.sinkTokens, tt.ctxLen, sinks, half, tt.sinks, tt.half)
+		}
+	}
+}
+
+func TestFitPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		req  GenRequest
+		want string
+		err  error
+	}{
+		{"fits", GenRequest{Prompt: "abcabcabc"}, "abcabcabc", nil},
+		{"no room to generate", GenRequest{Prompt: "abcabcabca"}, "abcabcabca", ErrContextOverflow},
+		{"reject by default", GenRequest{Prompt: "abcabcabcabcabc", Overflow: OverflowReject}, "abcabcabcabcabc", ErrContextOverflow},
+		// Two sinks leave halves of four: two of them go.
+		{"shift", GenRequest{Prompt: "abcabcabcabcabc", Overflow: OverflowShift, SinkTokens: 2}, "abbcabc", nil},
+		{"shift by one half", GenRequest{Prompt: "abcabcabcabc", Overflow: OverflowShift, SinkTokens: 2}, "ababcabc", nil},
+		{"shift with the default sinks", GenRequest{Prompt: "abcabcabcab", Overflow: OverflowShift}, "abcabcab", nil},
+		{"no room to shift", GenRequest{Prompt: "abcabcabcabc", Overflow: OverflowShift, SinkTokens: 9}, "abcabcabcabc", ErrContextOverflow},
+		{
+			"truncate",
+			GenRequest{Messages: []Message{{"user", "aaaaaa"}, {"user", "bbbbbb"}}, Overflow: OverflowTruncate},
+			"bbbbbb", nil,
+		},
+		{"truncate without messages", GenRequest{Prompt: "abcabcabcabc", Overflow: OverflowTruncate}, "abcabcabcabc", ErrContextOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := newScriptOps(nil)
+			ops.caps.ContextLen = 10
+			s := NewScheduler(ops)
+			rs := overflowState(s, &tt.req)
+			err := s.fitPrompt(rs)
+			if got := s.tok.Decode(rs.tokens); got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("got %q (%v), want %q (%v)", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+// shiftOps is scriptOps with a KV cache it can shift, recording each shift.
+type shiftOps struct {
+	*scriptOps
+	shifts [][3]int // from, n, length
+}
+
+func (o *shiftOps) ShiftKV(blocks []int, from, n, length int) error {
+	o.shifts = append(o.shifts, [3]int{from, n, length})
+	return nil
+}
+
+func TestShiftDuringGeneration(t *testing.T) {
+	ops := &shiftOps{scriptOps: newScriptOps(map[SeqID][]int{1: {1, 2, 3, 1, 2, 3, 1, 2, 3, 1}})}
+	ops.caps.ContextLen = 8
+	s := NewScheduler(ops)
+	out := generate(t, s, &GenRequest{Prompt: "abc", MaxTokens: 10, Overflow: OverflowShift, SinkTokens: 2})
+	if out[0] != (output{text: "abcabcabca", reason: FinishLength}) {
+		t.Fatalf("got %+v", out[0])
+	}
+	// Each time the context fills, the three positions after the two sinks go.
+	if want := [][3]int{{2, 3, 7}, {2, 3, 7}}; len(ops.shifts) != len(want) || ops.shifts[0] != want[0] || ops.shifts[1] != want[1] {
+		t.Errorf("shifts %v, want %v", ops.shifts, want)
+	}
+	for i, step := range ops.steps {
+		for _, st := range step {
+			if end := st.Pos + len(st.Tokens); end > 8 {
+				t.Errorf("step %d writes position %d of a context of 8", i, end-1)
+			}
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"sync"
+
+	"github.com/haydenlabs/gollum/sampling"
 )
 
 type CacheEntry struct {
@@ -28,13 +30,13 @@ func NewPromptCache(capacity int) *PromptCache {
 	return &PromptCache{cap: capacity, ll: list.New(), items: make(map[string]*list.Element)}
 }
 
-func (pc *PromptCache) key(prompt string, model string, temp float32, maxTokens int) string {
-	h := sha256.Sum256([]byte(prompt + "|" + model + "|" + string(rune(int(temp*100))) + "|" + string(rune(maxTokens))))
+func (pc *PromptCache) key(prompt string, model string, sp sampling.Params, maxTokens int) string {
+	h := sha256.Sum256([]byte(prompt + "|" + model + "|" + sp.Key() + "|" + string(rune(maxTokens))))
 	return hex.EncodeToString(h[:])
 }
 
-func (pc *PromptCache) Get(prompt, model string, temp float32, maxTokens int) (tokens []string, ok bool) {
-	k := pc.key(prompt, model, temp, maxTokens)
+func (pc *PromptCache) Get(prompt, model string, sp sampling.Params, maxTokens int) (tokens []string, ok bool) {
+	k := pc.key(prompt, model, sp, maxTokens)
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
 	if el, ok := pc.items[k]; ok {
@@ -45,8 +47,8 @@ func (pc *PromptCache) Get(prompt, model string, temp float32, maxTokens int) (t
 	return nil, false
 }
 
-func (pc *PromptCache) Put(prompt, model string, temp float32, maxTokens int, tokens []string) {
-	k := pc.key(prompt, model, temp, maxTokens)
+func (pc *PromptCache) Put(prompt, model string, sp sampling.Params, maxTokens int, tokens []string) {
+	k := pc.key(prompt, model, sp, maxTokens)
 	pc.mu.Lock()
 	defer pc.mu.Unlock()
 	if el, ok := pc.items[k]; ok {
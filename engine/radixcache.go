@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/haydenlabs/gollum/metrics"
+)
+
+// blockKey is the run of token IDs stored in one KV block; children are keyed by their first block.
+type blockKey [KVBlockTokens]int
+
+// radixNode owns one reference on each block of its edge. Edges are whole blocks,
+// so a cached prefix always maps onto complete, read-only KV blocks.
+type radixNode struct {
+	model    string
+	key      []int
+	blocks   []*KVBlock
+	parent   *radixNode
+	children map[blockKey]*radixNode
+	lastUsed uint64
+}
+
+// RadixCache is a per-model radix tree over token IDs whose nodes hold KV block references.
+// Blocks stay valid for as long as the tree holds them; the pager only reuses a block once
+// every reference, the tree's included, has been released.
+type RadixCache struct {
+	mu    sync.Mutex
+	pgr   *KVPager
+	roots map[string]*radixNode
+	clock uint64
+}
+
+func NewRadixCache(pgr *KVPager) *RadixCache {
+	c := &RadixCache{pgr: pgr, roots: make(map[string]*radixNode)}
+	pgr.SetEvictor(c.Evict)
+	return c
+}
+
+func keyOf(ids []int) (k blockKey) {
+	copy(k[:], ids)
+	return k
+}
+
+func (c *RadixCache) root(model string) *radixNode {
+	r, ok := c.roots[model]
+	if !ok {
+		r = &radixNode{model: model, children: make(map[blockKey]*radixNode)}
+		c.roots[model] = r
+	}
+	return r
+}
+
+// Match returns the blocks holding the longest cached block-aligned prefix of ids
+// and the number of tokens they cover. The caller must Retain blocks it keeps.
+func (c *RadixCache) Match(model string, ids []int) ([]*KVBlock, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock++
+	n := c.root(model)
+	var blocks []*KVBlock
+	pos := 0
+	for len(ids)-pos >= KVBlockTokens {
+		child, ok := n.children[keyOf(ids[pos:])]
+		if !ok {
+			break
+		}
+		child.lastUsed = c.clock
+		m := matchBlocks(child.key, ids[pos:])
+		blocks = append(blocks, child.blocks[:m]...)
+		pos += m * KVBlockTokens
+		if m < len(child.blocks) {
+			break
+		}
+		n = child
+	}
+	return blocks, pos
+}
+
+// Insert caches the full blocks of a sequence whose first len(ids) positions are computed.
+// Segments already in the tree keep their existing blocks; new segments are retained.
+func (c *RadixCache) Insert(model string, ids []int, blocks []*KVBlock) {
+	full := len(ids) / KVBlockTokens
+	if full > len(blocks) {
+		full = len(blocks)
+	}
+	ids = ids[:full*KVBlockTokens]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock++
+	n := c.root(model)
+	pos := 0
+	for pos < len(ids) {
+		k := keyOf(ids[pos:])
+		child, ok := n.children[k]
+		if !ok {
+			child = &radixNode{
+				model:    model,
+				key:      append([]int(nil), ids[pos:]...),
+				blocks:   append([]*KVBlock(nil), blocks[pos/KVBlockTokens:full]...),
+				parent:   n,
+				children: make(map[blockKey]*radixNode),
+				lastUsed: c.clock,
+			}
+			for _, b := range child.blocks {
+				c.pgr.Retain(b)
+			}
+			n.children[k] = child
+			return
+		}
+		child.lastUsed = c.clock
+		m := matchBlocks(child.key, ids[pos:])
+		if m < len(child.blocks) {
+			child = c.split(child, m)
+		}
+		pos += m * KVBlockTokens
+		n = child
+	}
+}
+
+// split cuts n after its first m blocks and returns the new upper half.
+func (c *RadixCache) split(n *radixNode, m int) *radixNode {
+	k := keyOf(n.key)
+	upper := &radixNode{
+		model:    n.model,
+		key:      n.key[:m*KVBlockTokens],
+		blocks:   n.blocks[:m],
+		parent:   n.parent,
+		children: make(map[blockKey]*radixNode),
+		lastUsed: n.lastUsed,
+	}
+	n.key = n.key[m*KVBlockTokens:]
+	n.blocks = n.blocks[m:]
+	n.parent = upper
+	upper.children[keyOf(n.key)] = n
+	upper.parent.children[k] = upper
+	return upper
+}
+
+func matchBlocks(key, ids []int) int {
+	m := 0
+	for ; (m+1)*KVBlockTokens <= len(key) && (m+1)*KVBlockTokens <= len(ids); m++ {
+		if keyOf(key[m*KVBlockTokens:]) != keyOf(ids[m*KVBlockTokens:]) {
+			break
+		}
+	}
+	return m
+}
+
+// inUse reports whether a request other than the tree still reads n's blocks.
+func (n *radixNode) inUse() bool {
+	for _, b := range n.blocks {
+		if b.Refs > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+type nodeHeap []*radixNode
+
+func (h nodeHeap) Len() int           { return len(h) }
+func (h nodeHeap) Less(i, j int) bool { return h[i].lastUsed < h[j].lastUsed }
+func (h nodeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x any)        { *h = append(*h, x.(*radixNode)) }
+func (h *nodeHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// Evict drops least recently used leaves that no request is reading until at
+// least want blocks have gone back to the pager. It returns the number freed.
+func (c *RadixCache) Evict(want int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := &nodeHeap{}
+	var walk func(n *radixNode)
+	walk = func(n *radixNode) {
+		for _, ch := range n.children {
+			walk(ch)
+		}
+		if n.parent != nil && len(n.children) == 0 && !n.inUse() {
+			*h = append(*h, n)
+		}
+	}
+	for _, r := range c.roots {
+		walk(r)
+	}
+	heap.Init(h)
+	freed := 0
+	for freed < want && h.Len() > 0 {
+		n := heap.Pop(h).(*radixNode)
+		for _, b := range n.blocks {
+			c.pgr.Release(b)
+		}
+		freed += len(n.blocks)
+		metrics.KVEvents.WithLabelValues("evict", n.model).Inc()
+		p := n.parent
+		delete(p.children, keyOf(n.key))
+		if p.parent != nil && len(p.children) == 0 && !p.inUse() {
+			heap.Push(h, p)
+		}
+	}
+	return freed
+}
@@ -0,0 +1,180 @@
+package engine
+
+import "testing"
+
+// blockIDs is n blocks' worth of token IDs: block i is all base+i.
+func blockIDs(base int, n int) []int {
+	ids := make([]int, n*KVBlockTokens)
+	for i := range ids {
+		ids[i] = base + i/KVBlockTokens
+	}
+	return ids
+}
+
+// cached runs ids through a sequence that the cache then takes over, as a
+// finished request is, and returns its blocks.
+func cached(t *testing.T, p *KVPager, c *RadixCache, ids []int) []*KVBlock {
+	t.Helper()
+	seq := &KVSeq{}
+	blocks, n := c.Match("m", ids)
+	if n > 0 {
+		seq = p.Share(blocks, n)
+	}
+	if err := p.Append(seq, len(ids)-seq.Len); err != nil {
+		t.Fatal(err)
+	}
+	out := append([]*KVBlock(nil), seq.Blocks...)
+	c.Insert("m", ids, seq.Blocks)
+	p.Drop(seq)
+	return out
+}
+
+func sameBlocks(a, b []*KVBlock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRadixCacheMatch(t *testing.T) {
+	p := NewKVPagerSize(16, KVBlockTokens)
+	c := NewRadixCache(p)
+	ids := blockIDs(100, 3)
+	blocks := cached(t, p, c, append(ids, 7, 7, 7)) // the partial last block is not cached
+	for _, b := range blocks[:3] {
+		if b.Refs != 1 {
+			t.Errorf("cached block %d has %d refs, want the tree's 1", b.ID, b.Refs)
+		}
+	}
+	if blocks[3].Refs != 0 {
+		t.Errorf("the partial block has %d refs", blocks[3].Refs)
+	}
+	tests := []struct {
+		name string
+		ids  []int
+		n    int
+	}{
+		{"all", ids, 48},
+		{"longer", append(blockIDs(100, 3), blockIDs(200, 2)...), 48},
+		{"partial last block", append(blockIDs(100, 2), 102, 102, 102), 32},
+		{"diverges in block 2", append(blockIDs(100, 1), blockIDs(300, 2)...), 16},
+		{"other", blockIDs(300, 3), 0},
+		{"short", ids[:10], 0},
+	}
+	for _, tt := range tests {
+		got, n := c.Match("m", tt.ids)
+		if n != tt.n || !sameBlocks(got, blocks[:n/KVBlockTokens]) {
+			t.Errorf("%s: matched %d tokens in %d blocks, want %d", tt.name, n, len(got), tt.n)
+		}
+	}
+	if _, n := c.Match("other model", ids); n != 0 {
+		t.Errorf("another model's prompt matched %d tokens", n)
+	}
+}
+
+// TestRadixCacheSplit caches two prompts that share their first two blocks,
+// which must split the first one's edge there and keep its blocks.
+func TestRadixCacheSplit(t *testing.T) {
+	p := NewKVPagerSize(16, KVBlockTokens)
+	c := NewRadixCache(p)
+	x := append(blockIDs(100, 2), blockIDs(110, 2)...)
+	y := append(blockIDs(100, 2), blockIDs(120, 1)...)
+	xb := cached(t, p, c, x)
+	yb := cached(t, p, c, y)
+	if !sameBlocks(yb[:2], xb[:2]) {
+		t.Fatal("the second prompt did not reuse the first one's blocks")
+	}
+	root := c.roots["m"]
+	if len(root.children) != 1 {
+		t.Fatalf("root has %d children", len(root.children))
+	}
+	var upper *radixNode
+	for _, n := range root.children {
+		upper = n
+	}
+	if len(upper.key) != 2*KVBlockTokens || !sameBlocks(upper.blocks, xb[:2]) || len(upper.children) != 2 {
+		t.Fatalf("split node: %d tokens, %d blocks, %d children", len(upper.key), len(upper.blocks), len(upper.children))
+	}
+	for _, n := range upper.children {
+		if n.parent != upper {
+			t.Error("a lower half does not point back at the split node")
+		}
+	}
+	// Each block is held once by the tree, whichever half it landed in.
+	for _, b := range append(xb, yb[2]) {
+		if b.Refs != 1 {
+			t.Errorf("block %d has %d refs", b.ID, b.Refs)
+		}
+	}
+	if got, n := c.Match("m", x); n != 64 || !sameBlocks(got, xb) {
+		t.Errorf("after the split the first prompt matched %d tokens", n)
+	}
+	if got, n := c.Match("m", y); n != 48 || !sameBlocks(got, yb) {
+		t.Errorf("after the split the second prompt matched %d tokens", n)
+	}
+	// Inserting a prefix of a cached edge splits it without adding blocks.
+	cached(t, p, c, blockIDs(100, 1))
+	if p.FreeBlocks() != 16-5 {
+		t.Errorf("%d blocks free, want 11", p.FreeBlocks())
+	}
+}
+
+func TestRadixCacheEvict(t *testing.T) {
+	p := NewKVPagerSize(16, KVBlockTokens)
+	c := NewRadixCache(p)
+	shared := blockIDs(100, 1)
+	a := cached(t, p, c, append(shared, blockIDs(110, 2)...))
+	b := cached(t, p, c, append(shared, blockIDs(120, 1)...))
+	d := cached(t, p, c, blockIDs(130, 2))
+	// a's leaf is now the most recently used, and a request reads d's.
+	c.Match("m", append(shared, blockIDs(110, 2)...))
+	reader := p.Share(d, 32)
+
+	if freed := c.Evict(1); freed != 1 || b[1].Refs != 0 {
+		t.Fatalf("first eviction freed %d blocks; b's leaf has %d refs", freed, b[1].Refs)
+	}
+	// a's leaf goes next, then the shared node its removal left as a leaf;
+	// d's is in use throughout.
+	if freed := c.Evict(10); freed != 3 {
+		t.Errorf("second eviction freed %d blocks, want 3", freed)
+	}
+	for _, blk := range append(a, d...) {
+		want := 0
+		if blk == d[0] || blk == d[1] {
+			want = 2
+		}
+		if blk.Refs != want {
+			t.Errorf("block %d has %d refs, want %d", blk.ID, blk.Refs, want)
+		}
+	}
+	if _, n := c.Match("m", blockIDs(130, 2)); n != 32 {
+		t.Errorf("the in-use prompt matched %d tokens after eviction", n)
+	}
+	p.Drop(reader)
+	if freed := c.Evict(10); freed != 2 || p.FreeBlocks() != 16 {
+		t.Errorf("once unread: freed %d, %d blocks free", freed, p.FreeBlocks())
+	}
+}
+
+// TestRadixCacheEvictOnAllocate fills the pager with cached blocks, which
+// allocating must then reclaim.
+func TestRadixCacheEvictOnAllocate(t *testing.T) {
+	p := NewKVPagerSize(4, KVBlockTokens)
+	c := NewRadixCache(p)
+	cached(t, p, c, blockIDs(100, 4))
+	if p.FreeBlocks() != 0 {
+		t.Fatalf("%d free", p.FreeBlocks())
+	}
+	seq := &KVSeq{}
+	if err := p.Append(seq, 2*KVBlockTokens); err != nil {
+		t.Fatalf("allocating over cached blocks: %v", err)
+	}
+	if _, n := c.Match("m", blockIDs(100, 4)); n != 0 {
+		t.Errorf("%d tokens still cached in evicted blocks", n)
+	}
+}
@@ -2,11 +2,21 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/haydenlabs/gollum/grammar"
 	"github.com/haydenlabs/gollum/metrics"
+	"github.com/haydenlabs/gollum/sampling"
+)
+
+var (
+	errNoResult = errors.New("engine: backend returned no result for sequence")
+	errNoVocab  = errors.New("engine: backend does not report a vocabulary size; grammars need one")
+	ErrStopped  = errors.New("engine: scheduler stopped")
 )
 
 type reqState struct {
@@ -14,51 +24,115 @@ type reqState struct {
 	req       *GenRequest
 	ch        chan Token
 	trace     *Trace
+	sampler   *sampling.Sampler
+	grammar   *grammar.Constraint
+	spec      *specState
+	seq       SeqID
 	generated int
 	created   time.Time
-	kv        *KVBlock
+	kv        *KVSeq
+	tokens    []int    // prompt and generated token IDs; tokens[:computed] have KV
+	prompt    int      // prompt length in tokens
+	computed  int      // positions whose KV the backend has written
+	width     int      // logits per row, as the backend last returned them
+	pending   []int    // generated IDs whose text is an incomplete UTF-8 sequence
+	held      string   // decoded text that may be the start of a stop sequence
+	out       []string // emitted text, replayed by the prompt cache
+	shifted   bool     // a context shift moved KV, so it no longer matches a prefill of tokens
+	done      bool
 }
+
+func (rs *reqState) prefilling() bool { return rs.computed < rs.prompt }
+
 type Scheduler struct {
 	mu               sync.Mutex
 	incoming, active []*reqState
 	closed           bool
+	draining         bool
 	backend          KernelOps
+	caps             Capabilities
 	maxBatch         int
+	maxBatchedTokens int // per-step token budget shared by decode tokens and prefill chunks
 	stepInterval     time.Duration
 	pc               *PromptCache
 	pgr              *KVPager
-	pfx              *PrefixCache
+	pfx              *RadixCache
+	tok              Tokenizer
+	eog              map[int]bool
+	vocab            *grammar.Vocab // token texts for grammar masking, built on first use
+	draft            *drafter
+	lookup           promptLookup
+	nextSeq          SeqID
 }
 
 func NewScheduler(b KernelOps) *Scheduler {
-	return &Scheduler{backend: b, maxBatch: 32, stepInterval: 25 * time.Millisecond, pc: NewPromptCache(512), pgr: NewKVPager(), pfx: NewPrefixCache()}
+	caps := b.Capabilities()
+	pgr := NewKVPager()
+	if caps.KVBlocks > 0 {
+		pgr = NewKVPagerSize(caps.KVBlocks, KVBlockTokens)
+	}
+	s := &Scheduler{backend: b, caps: caps, maxBatch: 32, maxBatchedTokens: 512, stepInterval: 25 * time.Millisecond, pc: NewPromptCache(512), pgr: pgr, pfx: NewRadixCache(pgr), tok: b.Tokenizer(), lookup: promptLookup{k: 8}}
+	if s.tok == nil {
+		s.tok = newWhitespaceTokenizer()
+	}
+	if caps.MaxBatch > 0 {
+		s.maxBatch = caps.MaxBatch
+	}
+	if caps.MaxBatchTokens > 0 {
+		s.maxBatchedTokens = caps.MaxBatchTokens
+	}
+	if c, ok := b.(KVCopier); ok {
+		s.pgr.SetCopier(c)
+	}
+	s.eog = make(map[int]bool, len(caps.EOGTokens))
+	for _, id := range caps.EOGTokens {
+		s.eog[id] = true
+	}
+	return s
 }
 func (s *Scheduler) Enqueue(ctx context.Context, r *GenRequest) (<-chan Token, *Trace) {
-	rs := &reqState{ctx: ctx, req: r, ch: make(chan Token, 32), trace: &Trace{}, created: time.Now()}
-	// Cache fast-path: exact prompt/model/temp/maxTokens
-	if toks, ok := s.pc.Get(r.Prompt, r.Model, r.Temperature, r.MaxTokens); ok && len(toks) >= r.MaxTokens {
-		metrics.CacheEvents.WithLabelValues("prompt", "hit", r.Model).Inc()
-		go func() {
-			defer close(rs.ch)
-			for i := 0; i < r.MaxTokens; i++ {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					rs.ch <- Token{Text: toks[i]}
-				}
-			}
-			rs.trace.TTFTMs = 1
-			rs.trace.TPOTMs = 1
-			metrics.TTFTMs.WithLabelValues(r.Model).Observe(float64(rs.trace.TTFTMs))
-			metrics.TPOTMs.WithLabelValues(r.Model).Observe(float64(rs.trace.TPOTMs))
-		}()
+	rs := &reqState{ctx: ctx, req: r, ch: make(chan Token, 32), trace: &Trace{}, sampler: sampling.New(r.Sampling), created: time.Now()}
+	s.mu.Lock()
+	stopped := s.closed || s.draining
+	s.mu.Unlock()
+	if stopped {
+		rs.ch <- Token{Err: ErrStopped}
+		close(rs.ch)
 		return rs.ch, rs.trace
 	}
-	metrics.CacheEvents.WithLabelValues("prompt", "miss", r.Model).Inc()
+	// Cache fast-path: exact prompt/model/sampling/maxTokens, only when sampling is reproducible
+	// and there are no stop sequences or grammar to shape the output
+	if r.Sampling.Deterministic() && len(r.Stop) == 0 && r.Grammar == nil {
+		if toks, ok := s.pc.Get(r.Prompt, r.Model, r.Sampling, r.MaxTokens); ok && len(toks) >= r.MaxTokens {
+			metrics.CacheEvents.WithLabelValues("prompt", "hit", r.Model).Inc()
+			go func() {
+				defer close(rs.ch)
+				for _, t := range toks {
+					select {
+					case <-ctx.Done():
+						return
+					default:
+						rs.ch <- Token{Text: t}
+					}
+				}
+				rs.ch <- Token{FinishReason: FinishLength}
+				rs.trace.TTFTMs = 1
+				rs.trace.TPOTMs = 1
+				metrics.TTFTMs.WithLabelValues(r.Model).Observe(float64(rs.trace.TTFTMs))
+				metrics.TPOTMs.WithLabelValues(r.Model).Observe(float64(rs.trace.TPOTMs))
+			}()
+			return rs.ch, rs.trace
+		}
+		metrics.CacheEvents.WithLabelValues("prompt", "miss", r.Model).Inc()
+	}
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.draining {
+		rs.ch <- Token{Err: ErrStopped}
+		close(rs.ch)
+		return rs.ch, rs.trace
+	}
 	s.incoming = append(s.incoming, rs)
-	s.mu.Unlock()
 	return rs.ch, rs.trace
 }
 func (s *Scheduler) Run(ctx context.Context) {
@@ -82,150 +156,395 @@ func (s *Scheduler) shutdown() {
 	}
 	s.closed = true
 	for _, rs := range append(s.incoming, s.active...) {
+		select {
+		case rs.ch <- Token{Err: ErrStopped}:
+		default: // a reader this far behind will see the channel close instead
+		}
 		close(rs.ch)
 	}
+	s.incoming, s.active = nil, nil
 }
-func (s *Scheduler) tick() {
-	// Prefill
-	var prefill []*reqState
+
+// Drain stops taking requests and waits until those queued or running have
+// finished, or ctx ends.
+func (s *Scheduler) Drain(ctx context.Context) error {
 	s.mu.Lock()
-	if len(s.incoming) > 0 {
-		limit := s.maxBatch
-		if len(s.incoming) < limit {
-			limit = len(s.incoming)
+	s.draining = true
+	s.mu.Unlock()
+	t := time.NewTicker(s.stepInterval)
+	defer t.Stop()
+	for s.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
 		}
-		prefill = append(prefill, s.incoming[:limit]...)
-		s.incoming = s.incoming[limit:]
 	}
-	s.mu.Unlock()
-	if len(prefill) > 0 {
-		b := &Batch{Prompts: make([]string, 0, len(prefill))}
-		for _, rs := range prefill {
-			if ref, _, ok := s.pfx.GetLongest(rs.req.Model, rs.req.Prompt); ok {
-				if blk := s.pgr.ByID(ref.BlockID); blk != nil {
-					s.pgr.Pin(blk)
-					rs.kv = blk
-					metrics.CacheEvents.WithLabelValues("prefix", "hit", rs.req.Model).Inc()
-					metrics.KVEvents.WithLabelValues("pin", rs.req.Model).Inc()
-				} else {
-					metrics.CacheEvents.WithLabelValues("prefix", "miss", rs.req.Model).Inc()
-				}
-			} else {
-				metrics.CacheEvents.WithLabelValues("prefix", "miss", rs.req.Model).Inc()
-			}
-			if rs.kv == nil {
-				if blk := s.pgr.Allocate(2048); blk != nil {
-					rs.kv = blk
-					metrics.KVEvents.WithLabelValues("alloc", rs.req.Model).Inc()
-				}
+	return nil
+}
+
+// InFlight counts the requests queued or running.
+func (s *Scheduler) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.incoming) + len(s.active)
+}
+
+// admit moves waiting requests into the running set while there is room and KV to bind.
+func (s *Scheduler) admit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.incoming) > 0 && len(s.active) < s.maxBatch {
+		rs := s.incoming[0]
+		if rs.tokens == nil {
+			rs.tokens = s.tok.Encode(rs.req.Prompt)
+			if err := s.fitPrompt(rs); err != nil {
+				s.incoming = s.incoming[1:]
+				rs.ch <- Token{Err: err}
+				close(rs.ch)
+				continue
 			}
-			b.Prompts = append(b.Prompts, rs.req.Prompt)
+			rs.sampler.Accept(rs.tokens...)
+		}
+		if len(rs.tokens) == 0 {
+			s.incoming = s.incoming[1:]
+			close(rs.ch) // nothing to condition on
+			continue
 		}
-		_ = s.backend.Prefill(b)
-		for _, rs := range prefill {
-			if rs.trace.TTFTMs == 0 {
-				rs.trace.TTFTMs = time.Since(rs.created).Milliseconds()
+		if rs.req.Grammar != nil && rs.grammar == nil {
+			if s.caps.VocabSize == 0 {
+				s.incoming = s.incoming[1:]
+				rs.ch <- Token{Err: errNoVocab}
+				close(rs.ch)
+				continue
 			}
-			s.mu.Lock()
-			s.active = append(s.active, rs)
-			s.mu.Unlock()
+			rs.grammar = grammar.NewConstraint(rs.req.Grammar, s.grammarVocab())
+			rs.sampler.Constrain(rs.grammar)
 		}
+		if !s.bindKV(rs) {
+			// Out of KV blocks: retry once running sequences finish and release theirs.
+			return
+		}
+		s.incoming = s.incoming[1:]
+		s.nextSeq++
+		rs.seq = s.nextSeq
+		s.active = append(s.active, rs)
 	}
-	// Decode step
+}
+
+// tick runs one step. Running sequences each get a decode token first; what is
+// left of the token budget goes to prompt chunks, so a long prompt is spread
+// over several steps instead of stalling every stream while it is prefilled.
+func (s *Scheduler) tick() {
+	s.admit()
 	s.mu.Lock()
-	active := append([]*reqState{}, s.active...)
+	running := append([]*reqState{}, s.active...)
 	s.mu.Unlock()
-	if len(active) == 0 {
+	if len(running) == 0 {
 		return
 	}
-	produced, _ := s.backend.Decode(&Step{BatchSize: len(active), SeqLen: 1})
-	if produced <= 0 {
-		produced = len(active)
+	finished := false
+	budget := s.maxBatchedTokens
+	step := &Step{}
+	var stepped, decoding, specs, lookups []*reqState
+	for _, rs := range running {
+		if rs.ctx.Err() != nil {
+			close(rs.ch)
+			s.pgr.Drop(rs.kv)
+			s.dropSpec(rs)
+			rs.done, finished = true, true
+			continue
+		}
+		if !rs.prefilling() {
+			decoding = append(decoding, rs)
+			switch s.specMethod(rs) {
+			case "draft":
+				specs = append(specs, rs)
+			case "lookup":
+				lookups = append(lookups, rs)
+			}
+		}
 	}
-	if len(active) > 0 {
-		// use the first request's model as batch label (batches are single-model in many setups;
-		// if you support mixed-model batches, you can iterate per-model)
-		modelLabel := active[0].req.Model
-		metrics.BatchSize.WithLabelValues(modelLabel).Observe(float64(len(active)))
-		metrics.DecodeSteps.WithLabelValues(modelLabel).Inc()
+	spare := budget - len(decoding)
+	for _, rs := range lookups {
+		s.lookupPropose(rs, &spare)
+	}
+	if len(specs) > 0 {
+		s.propose(specs, &spare)
 	}
-	// Build decode contexts (prompt + bound KV handle id)
-	ctxs := make([]DecodeCtx, len(active))
-	for i, rs := range active {
-		kvHandle := 0
-		if rs.kv != nil {
-			kvHandle = rs.kv.KVHandle // may be 0 (lazily created by backend)
+	for _, rs := range decoding {
+		if budget == 0 {
+			s.discardProposals(rs)
+			continue
+		}
+		// A sequence with proposals feeds them after its last token and gets
+		// logits for every position to check them against.
+		var drafts []int
+		if rs.spec != nil {
+			drafts = rs.spec.tokens
 		}
-		ctxs[i] = DecodeCtx{Prompt: rs.req.Prompt, KVHandle: kvHandle}
+		rs.tokens = append(rs.tokens, drafts...)
+		if !s.schedule(step, rs, 1+len(drafts)) {
+			rs.tokens = rs.tokens[:len(rs.tokens)-len(drafts)]
+			s.discardProposals(rs)
+			continue
+		}
+		step.Seqs[len(step.Seqs)-1].AllLogits = len(drafts) > 0
+		stepped = append(stepped, rs)
+		budget -= 1 + len(drafts)
 	}
-	nexts := s.backend.PredictNext(ctxs)
-	// Emit up to 'produced' tokens
-	var still []*reqState
-	for i, rs := range active {
-		if rs.ctx.Err() != nil {
-			close(rs.ch)
+	decodes := s.maxBatchedTokens - budget
+	for _, rs := range running {
+		if budget == 0 {
+			break
+		}
+		if rs.done || !rs.prefilling() {
 			continue
 		}
-		if i < produced {
-			tokText := ""
-			if i < len(nexts) {
-				tokText = nexts[i]
-			}
-			rs.req.Prompt += tokText // evolve prompt context
-			rs.ch <- Token{Text: tokText}
-			rs.generated++
-			// Update KV handle from backend if it was created
-			if rs.kv != nil && i < len(ctxs) {
-				rs.kv.KVHandle = ctxs[i].KVHandle
-			}
+		n := len(rs.tokens) - rs.computed
+		if n > budget {
+			n = budget
 		}
-		if rs.req.MaxTokens > 0 && rs.generated >= rs.req.MaxTokens {
-			close(rs.ch)
-			rs.trace.TPOTMs = time.Since(rs.created).Milliseconds()
-			metrics.TTFTMs.WithLabelValues(rs.req.Model).Observe(float64(rs.trace.TTFTMs))
-			metrics.TPOTMs.WithLabelValues(rs.req.Model).Observe(float64(rs.trace.TPOTMs))
-
-			s.pc.Put(rs.req.Prompt, rs.req.Model, rs.req.Temperature, rs.req.MaxTokens, replayTokens(rs.req.Prompt))
-			if rs.kv == nil {
-				rs.kv = s.pgr.Allocate(2048)
+		if s.schedule(step, rs, n) {
+			stepped = append(stepped, rs)
+			budget -= n
+		}
+	}
+	// use the first request's model as batch label (batches are single-model in many setups;
+	// if you support mixed-model batches, you can iterate per-model)
+	modelLabel := running[0].req.Model
+	if len(step.Seqs) > 0 {
+		results, stepErr := s.backend.Forward(step)
+		bySeq := make(map[SeqID]*SeqResult, len(results))
+		for i := range results {
+			bySeq[results[i].Seq] = &results[i]
+		}
+		metrics.BatchSize.WithLabelValues(modelLabel).Observe(float64(len(step.Seqs)))
+		metrics.StepTokens.WithLabelValues(modelLabel, "decode").Observe(float64(decodes))
+		metrics.StepTokens.WithLabelValues(modelLabel, "prefill").Observe(float64(s.maxBatchedTokens - budget - decodes))
+		metrics.DecodeSteps.WithLabelValues(modelLabel).Inc()
+		for i, rs := range stepped {
+			ss := &step.Seqs[i]
+			res := bySeq[rs.seq]
+			err := stepErr
+			if res != nil {
+				err = res.Err
+			} else if err == nil && ss.Logits {
+				err = errNoResult
 			}
-			// Store all possible prefixes for LPM
-			if rs.kv != nil {
-				// Store the full prompt
-				s.pfx.Set(rs.req.Model, rs.req.Prompt, KVRef{BlockID: rs.kv.ID, Tokens: rs.generated})
-
-				// Store all tokenized prefixes for LPM
-				toks := strings.Fields(rs.req.Prompt)
-				for n := 1; n <= len(toks); n++ {
-					prefix := strings.Join(toks[:n], " ")
-					s.pfx.Set(rs.req.Model, prefix, KVRef{BlockID: rs.kv.ID, Tokens: rs.generated})
+			if err != nil {
+				if ss.AllLogits {
+					rs.tokens = rs.tokens[:len(rs.tokens)-len(rs.spec.tokens)]
+					s.discardProposals(rs)
 				}
-
-				s.pgr.Unpin(rs.kv) // release pin; will stay hot in LRU
-				metrics.KVEvents.WithLabelValues("unpin", rs.req.Model).Inc()
+				scope := "seq"
+				if res == nil && stepErr != nil {
+					scope = "step"
+				}
+				metrics.BackendErrors.WithLabelValues(rs.req.Model, scope).Inc()
+				s.fail(rs, err)
+				finished = true
+				continue
+			}
+			rs.computed += len(ss.Tokens)
+			if ss.AllLogits {
+				if s.verify(rs, res.Logits) {
+					finished = true
+				}
+				continue
+			}
+			if !ss.Logits {
+				continue
+			}
+			id := res.Token
+			if res.Logits != nil {
+				rs.width = len(res.Logits)
+				id = rs.sampler.Sample(res.Logits)
+			}
+			if s.emit(rs, id) {
+				finished = true
 			}
-			continue
 		}
-		still = append(still, rs)
+	}
+	if !finished {
+		return
 	}
 	s.mu.Lock()
+	still := s.active[:0]
+	for _, rs := range s.active {
+		if !rs.done {
+			still = append(still, rs)
+		}
+	}
 	s.active = still
 	s.mu.Unlock()
 }
 
-func replayTokens(prompt string) []string {
-	// naive split by known tiny vocab pieces; in a real system we'd store exact emitted tokens.
-	out := []string{}
-	tail := prompt
-	// This is a stub to satisfy the cache Put(); downstream will be replaced when we hold per-req emission buffers.
-	for len(tail) > 0 {
-		if len(tail) > 12 {
-			out = append(out, tail[:12])
-			tail = tail[12:]
-		} else {
-			out = append(out, tail)
-			break
+// schedule adds tokens[computed:computed+n] of rs to step, reserving KV for them.
+func (s *Scheduler) schedule(step *Step, rs *reqState, n int) bool {
+	end := rs.computed + n
+	if end > rs.kv.Len {
+		if err := s.pgr.Append(rs.kv, end-rs.kv.Len); err != nil {
+			metrics.KVEvents.WithLabelValues("exhausted", rs.req.Model).Inc()
+			return false
+		}
+	}
+	step.Seqs = append(step.Seqs, SeqStep{
+		Seq:     rs.seq,
+		Tokens:  rs.tokens[rs.computed:end],
+		Pos:     rs.computed,
+		Blocks:  rs.kv.BlockIDs(),
+		Logits:  end == len(rs.tokens),
+		Sampler: rs.sampler,
+	})
+	return true
+}
+
+// emit streams a sampled token and reports whether the request is now finished.
+func (s *Scheduler) emit(rs *reqState, id int) bool {
+	if rs.generated == 0 {
+		rs.trace.TTFTMs = time.Since(rs.created).Milliseconds()
+	}
+	rs.generated++
+	if s.eog[id] {
+		s.finish(rs, FinishStop)
+		return true
+	}
+	rs.tokens = append(rs.tokens, id)
+	rs.pending = append(rs.pending, id)
+	text := s.tok.Decode(rs.pending)
+	if !utf8.ValidString(text) && len(rs.pending) < utf8.UTFMax {
+		text = "" // wait for the rest of a multi-byte character
+	} else {
+		rs.pending = rs.pending[:0]
+	}
+	text, stopped := cutStop(rs, text)
+	if text != "" {
+		rs.out = append(rs.out, text)
+	}
+	rs.ch <- Token{ID: id, Text: text}
+	switch {
+	case stopped, rs.grammar != nil && rs.grammar.Done():
+		s.finish(rs, FinishStop)
+	case rs.req.MaxTokens > 0 && rs.generated >= rs.req.MaxTokens:
+		s.finish(rs, FinishLength)
+	case s.caps.ContextLen > 0 && len(rs.tokens) >= s.caps.ContextLen && !s.shift(rs):
+		s.finish(rs, FinishContextLength)
+	default:
+		return false
+	}
+	return true
+}
+
+// cutStop appends text to what rs is holding back and returns the part that
+// can be streamed. A stop sequence may span several tokens, so any tail that
+// could still grow into one stays held. If a stop sequence is complete, the
+// text before it is returned and the rest discarded.
+func cutStop(rs *reqState, text string) (string, bool) {
+	if len(rs.req.Stop) == 0 {
+		return text, false
+	}
+	held := rs.held + text
+	cut, keep := -1, 0
+	for _, stop := range rs.req.Stop {
+		if stop == "" {
+			continue
 		}
+		if i := strings.Index(held, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+		for k := len(stop) - 1; k > keep; k-- {
+			if strings.HasSuffix(held, stop[:k]) {
+				keep = k
+				break
+			}
+		}
+	}
+	if cut >= 0 {
+		rs.held = ""
+		return held[:cut], true
+	}
+	rs.held = held[len(held)-keep:]
+	return held[:len(held)-keep], false
+}
+
+// finish ends rs with reason, flushing text that was held back for a stop
+// sequence or an incomplete character.
+func (s *Scheduler) finish(rs *reqState, reason string) {
+	tail := rs.held
+	if len(rs.pending) > 0 {
+		tail += s.tok.Decode(rs.pending)
+	}
+	if tail != "" {
+		rs.out = append(rs.out, tail)
+	}
+	rs.ch <- Token{Text: tail, FinishReason: reason}
+	close(rs.ch)
+	rs.done = true
+	rs.trace.TPOTMs = time.Since(rs.created).Milliseconds()
+	metrics.TTFTMs.WithLabelValues(rs.req.Model).Observe(float64(rs.trace.TTFTMs))
+	metrics.TPOTMs.WithLabelValues(rs.req.Model).Observe(float64(rs.trace.TPOTMs))
+
+	if reason == FinishLength && rs.req.Sampling.Deterministic() && len(rs.req.Stop) == 0 && rs.req.Grammar == nil {
+		s.pc.Put(rs.req.Prompt, rs.req.Model, rs.req.Sampling, rs.req.MaxTokens, rs.out)
+	}
+	// Hand the sequence's full blocks to the prefix tree before dropping our refs.
+	if !rs.shifted {
+		s.pfx.Insert(rs.req.Model, rs.tokens[:rs.computed], rs.kv.Blocks)
+	}
+	s.pgr.Drop(rs.kv)
+	s.dropSpec(rs)
+}
+
+// grammarVocab decodes every token once so grammars can be checked against the vocabulary.
+func (s *Scheduler) grammarVocab() *grammar.Vocab {
+	if s.vocab == nil {
+		text := make([]string, s.caps.VocabSize)
+		for id := range text {
+			text[id] = s.tok.Decode([]int{id})
+		}
+		s.vocab = grammar.NewVocab(text, s.caps.EOGTokens)
+	}
+	return s.vocab
+}
+
+// fail ends rs with err as its last token. Its KV may be partly written, so
+// none of it goes to the prefix tree.
+func (s *Scheduler) fail(rs *reqState, err error) {
+	rs.ch <- Token{Err: err}
+	close(rs.ch)
+	rs.done = true
+	s.pgr.Drop(rs.kv)
+	s.dropSpec(rs)
+}
+
+// bindKV gives rs a block table covering its prompt. A cached prefix is shared
+// rather than recomputed; only the remainder gets fresh blocks.
+func (s *Scheduler) bindKV(rs *reqState) bool {
+	if rs.kv != nil {
+		return true
+	}
+	seq := &KVSeq{}
+	blocks, n := s.pfx.Match(rs.req.Model, rs.tokens)
+	if n >= len(rs.tokens) {
+		n = len(rs.tokens) - 1 // recompute the last prompt token so there is something to decode from
+	}
+	if n > 0 {
+		seq = s.pgr.Share(blocks, n)
+		metrics.CacheEvents.WithLabelValues("prefix", "hit", rs.req.Model).Inc()
+		metrics.KVEvents.WithLabelValues("share", rs.req.Model).Inc()
+	} else {
+		metrics.CacheEvents.WithLabelValues("prefix", "miss", rs.req.Model).Inc()
+	}
+	rs.prompt = len(rs.tokens)
+	rs.computed = seq.Len
+	need := rs.prompt - seq.Len
+	if err := s.pgr.Append(seq, need); err != nil {
+		s.pgr.Drop(seq)
+		metrics.KVEvents.WithLabelValues("exhausted", rs.req.Model).Inc()
+		return false
 	}
-	return out
+	metrics.KVEvents.WithLabelValues("alloc", rs.req.Model).Inc()
+	rs.kv = seq
+	return true
 }
@@ -0,0 +1,305 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testVocab is the pieces scriptOps's tokenizer knows; id 0 ends generation.
+var testVocab = []string{"<eos>", "a", "b", "c", "hi", "x", "E", "ND", "xE", "Z"}
+
+// pieceTokenizer encodes by longest match against a fixed list of pieces.
+type pieceTokenizer struct{ pieces []string }
+
+func (p pieceTokenizer) Encode(s string) []int {
+	var ids []int
+	for s != "" {
+		best := -1
+		for id, piece := range p.pieces {
+			if strings.HasPrefix(s, piece) && (best < 0 || len(piece) > len(p.pieces[best])) {
+				best = id
+			}
+		}
+		if best < 0 {
+			s = s[1:]
+			continue
+		}
+		ids = append(ids, best)
+		s = s[len(p.pieces[best]):]
+	}
+	return ids
+}
+
+func (p pieceTokenizer) Decode(ids []int) string {
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(p.pieces[id])
+	}
+	return b.String()
+}
+
+// scriptOps is a backend that answers each sequence with the next token of
+// its script, as logits with all the weight on it, and records every step.
+type scriptOps struct {
+	caps    Capabilities
+	scripts map[SeqID][]int
+	steps   [][]SeqStep
+	next    map[SeqID]int
+	calls   map[SeqID]int
+	fail    map[SeqID]int // the step, counting the sequence's own from 1, it fails in
+	errAt   int           // the step, counting from 1, Forward itself fails
+	errKeep SeqID         // the one sequence that step still has a result for
+}
+
+var errBackend = errors.New("backend failed")
+
+func newScriptOps(scripts map[SeqID][]int) *scriptOps {
+	return &scriptOps{
+		caps:    Capabilities{MaxBatch: 32, MaxBatchTokens: 512, VocabSize: len(testVocab), EOGTokens: []int{0}},
+		scripts: scripts,
+		next:    make(map[SeqID]int),
+		calls:   make(map[SeqID]int),
+	}
+}
+
+func (o *scriptOps) Capabilities() Capabilities { return o.caps }
+func (o *scriptOps) Tokenizer() Tokenizer       { return pieceTokenizer{testVocab} }
+
+func (o *scriptOps) Forward(step *Step) ([]SeqResult, error) {
+	seqs := make([]SeqStep, len(step.Seqs))
+	var results []SeqResult
+	for i, st := range step.Seqs {
+		st.Tokens = append([]int(nil), st.Tokens...)
+		seqs[i] = st
+		o.calls[st.Seq]++
+		if o.fail[st.Seq] == o.calls[st.Seq] {
+			results = append(results, SeqResult{Seq: st.Seq, Err: errBackend})
+			continue
+		}
+		if len(o.steps)+1 == o.errAt && st.Seq != o.errKeep || !st.Logits {
+			continue
+		}
+		id := 0
+		if script := o.scripts[st.Seq]; o.next[st.Seq] < len(script) {
+			id = script[o.next[st.Seq]]
+		}
+		o.next[st.Seq]++
+		logits := make([]float32, o.caps.VocabSize)
+		logits[id] = 1
+		results = append(results, SeqResult{Seq: st.Seq, Logits: logits})
+	}
+	o.steps = append(o.steps, seqs)
+	if len(o.steps) == o.errAt {
+		return results, errBackend
+	}
+	return results, nil
+}
+
+type output struct {
+	text   string
+	reason string
+	err    error
+}
+
+// generate enqueues reqs, ticks s until every one has finished and returns
+// what each streamed.
+func generate(t *testing.T, s *Scheduler, reqs ...*GenRequest) []output {
+	t.Helper()
+	chs := make([]<-chan Token, len(reqs))
+	for i, r := range reqs {
+		chs[i], _ = s.Enqueue(context.Background(), r)
+	}
+	out := make([]output, len(reqs))
+	open := len(reqs)
+	for step := 0; open > 0; step++ {
+		if step == 200 {
+			t.Fatalf("requests still running after %d steps", step)
+		}
+		s.tick()
+		for i, ch := range chs {
+			for ch != nil {
+				select {
+				case tok, ok := <-ch:
+					if !ok {
+						chs[i], ch = nil, nil
+						open--
+						break
+					}
+					out[i].text += tok.Text
+					out[i].reason += tok.FinishReason
+					if tok.Err != nil {
+						out[i].err = tok.Err
+					}
+				default:
+					ch = nil
+				}
+			}
+		}
+	}
+	return out
+}
+
+func TestChunkedPrefill(t *testing.T) {
+	ops := newScriptOps(map[SeqID][]int{1: {1, 2, 3, 1, 2, 3}, 2: {2, 2}})
+	ops.caps.MaxBatchTokens = 8
+	s := NewScheduler(ops)
+	out := generate(t, s,
+		&GenRequest{Prompt: "abc", MaxTokens: 6},
+		&GenRequest{Prompt: strings.Repeat("a", 30), MaxTokens: 2},
+	)
+	if out[0] != (output{text: "abcabc", reason: FinishLength}) || out[1] != (output{text: "bb", reason: FinishLength}) {
+		t.Fatalf("outputs %+v", out)
+	}
+
+	prompt := map[SeqID]int{1: 3, 2: 30}
+	var chunks []int
+	decoded := map[SeqID]int{}
+	for i, step := range ops.steps {
+		total, prefilling := 0, false
+		for _, st := range step {
+			total += len(st.Tokens)
+			if st.Pos >= prompt[st.Seq] {
+				if prefilling {
+					t.Errorf("step %d: a decode of seq %d follows a prompt chunk", i, st.Seq)
+				}
+				if len(st.Tokens) != 1 || !st.Logits {
+					t.Errorf("step %d: seq %d decodes %d tokens", i, st.Seq, len(st.Tokens))
+				}
+				decoded[st.Seq]++
+				continue
+			}
+			prefilling = true
+			if st.Seq == 2 {
+				if want := sum(chunks); st.Pos != want {
+					t.Errorf("step %d: chunk at %d, want %d", i, st.Pos, want)
+				}
+				chunks = append(chunks, len(st.Tokens))
+				if st.Logits != (st.Pos+len(st.Tokens) == 30) {
+					t.Errorf("step %d: chunk ending at %d asks for logits: %v", i, st.Pos+len(st.Tokens), st.Logits)
+				}
+			}
+		}
+		if total > 8 {
+			t.Errorf("step %d: %d tokens over a budget of 8", i, total)
+		}
+	}
+	// The short request decodes in every step while the long prompt goes
+	// in with what is left.
+	if want := []int{5, 7, 7, 7, 4}; !equal(chunks, want) {
+		t.Errorf("long prompt chunks %v, want %v", chunks, want)
+	}
+	if decoded[1] != 5 || decoded[2] != 1 {
+		t.Errorf("decode steps %v", decoded)
+	}
+}
+
+func sum(a []int) int {
+	n := 0
+	for _, x := range a {
+		n += x
+	}
+	return n
+}
+
+func TestCutStop(t *testing.T) {
+	tests := []struct {
+		name    string
+		stop    []string
+		pieces  []string
+		want    []string // streamed after each piece
+		stopped bool
+	}{
+		{"no stop sequences", nil, []string{"EN", "D"}, []string{"EN", "D"}, false},
+		{"split across pieces", []string{"END"}, []string{"hi", "xE", "ND", "more"}, []string{"hi", "x", ""}, true},
+		{"false start", []string{"END"}, []string{"xE", "N", "Z"}, []string{"x", "", "ENZ"}, false},
+		{"within one piece", []string{"END"}, []string{"aENDb"}, []string{"a"}, true},
+		{"earliest of several", []string{"STOP", "END"}, []string{"aEN", "DSTOP"}, []string{"a", ""}, true},
+		{"longest partial held", []string{"ab", "abc"}, []string{"xa", "b"}, []string{"x", ""}, true},
+		{"empty stop ignored", []string{""}, []string{"a"}, []string{"a"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &reqState{req: &GenRequest{Stop: tt.stop}}
+			var got []string
+			stopped := false
+			for _, p := range tt.pieces {
+				var text string
+				text, stopped = cutStop(rs, p)
+				got = append(got, text)
+				if stopped {
+					break
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || stopped != tt.stopped {
+				t.Errorf("streamed %q (stopped %v), want %q (%v)", got, stopped, tt.want, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestFinishReasons(t *testing.T) {
+	const hi, x, E, ND, xE, Z = 4, 5, 6, 7, 8, 9
+	tests := []struct {
+		name   string
+		req    GenRequest
+		ctxLen int
+		script []int
+		want   output
+	}{
+		{"end of generation", GenRequest{Prompt: "abc"}, 0, []int{hi, 0, hi}, output{text: "hi", reason: FinishStop}},
+		{"stop sequence over two tokens", GenRequest{Prompt: "abc", Stop: []string{"END"}}, 0, []int{hi, xE, ND, Z}, output{text: "hix", reason: FinishStop}},
+		{"stop sequence never completed", GenRequest{Prompt: "abc", Stop: []string{"END"}}, 0, []int{xE, Z, 0}, output{text: "xEZ", reason: FinishStop}},
+		{"held text flushed at the limit", GenRequest{Prompt: "abc", Stop: []string{"END"}, MaxTokens: 2}, 0, []int{hi, xE, ND}, output{text: "hixE", reason: FinishLength}},
+		{"max tokens", GenRequest{Prompt: "abc", MaxTokens: 3}, 0, []int{x, E, x, E}, output{text: "xEx", reason: FinishLength}},
+		{"context full", GenRequest{Prompt: "abc"}, 6, []int{x, x, x, x}, output{text: "xxx", reason: FinishContextLength}},
+		{"prompt fills the context", GenRequest{Prompt: "abc"}, 3, nil, output{err: ErrContextOverflow}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := newScriptOps(map[SeqID][]int{1: tt.script})
+			ops.caps.ContextLen = tt.ctxLen
+			out := generate(t, NewScheduler(ops), &tt.req)
+			if out[0] != tt.want {
+				t.Errorf("got %+v, want %+v", out[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardErrors(t *testing.T) {
+	scripts := map[SeqID][]int{1: {1, 1, 1, 1}, 2: {2, 2, 2, 2}, 3: {3, 3, 3, 3}}
+	reqs := func() []*GenRequest {
+		return []*GenRequest{{Prompt: "a", MaxTokens: 4}, {Prompt: "b", MaxTokens: 4}, {Prompt: "c", MaxTokens: 4}}
+	}
+
+	// The second sequence fails in its first decode; the others carry on.
+	ops := newScriptOps(scripts)
+	ops.fail = map[SeqID]int{2: 2}
+	out := generate(t, NewScheduler(ops), reqs()...)
+	want := []output{{text: "aaaa", reason: FinishLength}, {text: "b", err: errBackend}, {text: "cccc", reason: FinishLength}}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Errorf("request %d: got %+v, want %+v", i, out[i], want[i])
+		}
+	}
+	for i, step := range ops.steps[2:] {
+		for _, st := range step {
+			if st.Seq == 2 {
+				t.Errorf("step %d still runs the failed sequence", i+2)
+			}
+		}
+	}
+
+	// A step error fails only the sequences it has no result for.
+	ops = newScriptOps(scripts)
+	ops.errAt, ops.errKeep = 2, 3
+	out = generate(t, NewScheduler(ops), reqs()...)
+	want = []output{{text: "a", err: errBackend}, {text: "b", err: errBackend}, {text: "cccc", reason: FinishLength}}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Errorf("step error, request %d: got %+v, want %+v", i, out[i], want[i])
+		}
+	}
+}
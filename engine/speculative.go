@@ -0,0 +1,305 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/haydenlabs/gollum/metrics"
+	"github.com/haydenlabs/gollum/sampling"
+)
+
+// drafter is a small model run alongside the target to propose tokens.
+// It keeps its own KV, in its own pager.
+type drafter struct {
+	ops  KernelOps
+	caps Capabilities
+	pgr  *KVPager
+	k    int
+}
+
+// specState is a sequence's speculation in progress: the tokens proposed
+// for the current step with the distributions they were drawn from and, for a
+// draft model, its view of the sequence.
+type specState struct {
+	method   string // draft | lookup
+	kv       *KVSeq // draft only
+	computed int    // positions of rs.tokens the draft has KV for
+	sampler  *sampling.Sampler
+	tokens   []int
+	q        [][]float32
+	limit    int
+}
+
+// promptLookup is the scheduler-wide default for prompt-lookup speculation.
+type promptLookup struct {
+	ngram, k int
+}
+
+// SetDraft pairs the backend with a smaller draft model from the same family.
+// Each step the draft proposes up to k tokens per decoding sequence and the
+// target checks them all in one forward pass. Call it before Run.
+func (s *Scheduler) SetDraft(d KernelOps, k int) error {
+	caps := d.Capabilities()
+	if caps.VocabSize != s.caps.VocabSize {
+		return fmt.Errorf("engine: draft vocabulary has %d tokens, target has %d", caps.VocabSize, s.caps.VocabSize)
+	}
+	if k <= 0 {
+		k = 4
+	}
+	pgr := NewKVPager()
+	if caps.KVBlocks > 0 {
+		pgr = NewKVPagerSize(caps.KVBlocks, KVBlockTokens)
+	}
+	if c, ok := d.(KVCopier); ok {
+		pgr.SetCopier(c)
+	}
+	s.draft = &drafter{ops: d, caps: caps, pgr: pgr, k: k}
+	return nil
+}
+
+// SetPromptLookup turns on prompt-lookup speculation for requests that do not
+// choose for themselves: the last ngram tokens are looked up earlier in the
+// sequence and up to k of the tokens that followed are proposed. It needs no
+// draft model. Call it before Run.
+func (s *Scheduler) SetPromptLookup(ngram, k int) {
+	if k <= 0 {
+		k = s.lookup.k
+	}
+	s.lookup = promptLookup{ngram: ngram, k: k}
+}
+
+// specMethod says how rs speculates this step, if at all. A request that asks
+// for prompt lookup gets it even where a draft model is configured.
+//
+// Seeded sampling above temperature 0 never speculates: how many proposals a
+// step verifies depends on what else is running, and with it how many draws
+// the seeded generator makes, so the output would change with load.
+func (s *Scheduler) specMethod(rs *reqState) string {
+	if s.caps.Sampling || s.caps.VocabSize == 0 || rs.prefilling() || !rs.sampler.Speculative() {
+		return ""
+	}
+	if p := rs.req.Sampling; p.Seed != nil && p.Temperature > 0 {
+		return ""
+	}
+	switch {
+	case rs.req.PromptLookup > 0:
+		return "lookup"
+	case rs.req.PromptLookup < 0:
+		return ""
+	case s.draft != nil:
+		return "draft"
+	case s.lookup.ngram > 0:
+		return "lookup"
+	}
+	return ""
+}
+
+// specLimit caps proposals so the step fits the request's remaining tokens,
+// the context and the spare step budget.
+func (s *Scheduler) specLimit(rs *reqState, k, spare int) int {
+	limit := k
+	if rs.req.MaxTokens > 0 && rs.req.MaxTokens-rs.generated-1 < limit {
+		limit = rs.req.MaxTokens - rs.generated - 1
+	}
+	if s.caps.ContextLen > 0 && s.caps.ContextLen-len(rs.tokens)-1 < limit {
+		limit = s.caps.ContextLen - len(rs.tokens) - 1
+	}
+	if limit > spare {
+		limit = spare
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	return limit
+}
+
+// lookupPropose proposes the tokens that followed the most recent earlier
+// occurrence of the sequence's last n tokens. The prompt may hold IDs the
+// model has no logits for, as a toy vocabulary's byte fallbacks; a
+// continuation with any of them is not proposed.
+func (s *Scheduler) lookupPropose(rs *reqState, spare *int) {
+	n := rs.req.PromptLookup
+	if n <= 0 {
+		n = s.lookup.ngram
+	}
+	limit := s.specLimit(rs, s.lookup.k, *spare)
+	toks := rs.tokens
+	if limit == 0 || len(toks) <= n {
+		return
+	}
+	tail := toks[len(toks)-n:]
+	for start := len(toks) - n - 1; start >= 0; start-- {
+		if !equalInts(toks[start:start+n], tail) {
+			continue
+		}
+		follow := toks[start+n:]
+		if len(follow) > limit {
+			follow = follow[:limit]
+		}
+		for _, id := range follow {
+			if id >= rs.width || id >= s.caps.VocabSize {
+				return
+			}
+		}
+		*spare -= len(follow)
+		if rs.spec == nil {
+			rs.spec = &specState{method: "lookup"}
+		}
+		sp := rs.spec
+		for _, id := range follow {
+			// A proposal that is certain: the target keeps it with probability p.
+			q := make([]float32, s.caps.VocabSize)
+			q[id] = 1
+			sp.tokens = append(sp.tokens, id)
+			sp.q = append(sp.q, q)
+		}
+		return
+	}
+}
+
+func equalInts(a, b []int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// propose runs the draft model over seqs, up to k rounds batched across them,
+// leaving each sequence's proposals in rs.spec. spare is how many step
+// tokens the proposals may use in total.
+func (s *Scheduler) propose(seqs []*reqState, spare *int) {
+	d := s.draft
+	var active []*reqState
+	for _, rs := range seqs {
+		limit := s.specLimit(rs, d.k, *spare)
+		if limit == 0 {
+			continue
+		}
+		*spare -= limit
+		if rs.spec == nil {
+			rs.spec = &specState{method: "draft", kv: &KVSeq{}, sampler: sampling.New(rs.req.Sampling)}
+			rs.spec.sampler.Accept(rs.tokens...)
+		}
+		rs.spec.limit = limit
+		active = append(active, rs)
+	}
+	for round := 0; len(active) > 0; round++ {
+		step := &Step{}
+		var fed []*reqState
+		for _, rs := range active {
+			sp := rs.spec
+			// The first round brings the draft up to date, then each round
+			// feeds the previous proposal.
+			var toks []int
+			if round == 0 {
+				toks = rs.tokens[sp.computed:]
+			} else {
+				toks = sp.tokens[len(sp.tokens)-1:]
+			}
+			logits := true
+			if len(toks) > s.maxBatchedTokens {
+				toks, logits = toks[:s.maxBatchedTokens], false // long catch-up: no proposals this step
+			}
+			if end := sp.computed + len(toks); end > sp.kv.Len {
+				if err := d.pgr.Append(sp.kv, end-sp.kv.Len); err != nil {
+					continue
+				}
+			}
+			step.Seqs = append(step.Seqs, SeqStep{Seq: rs.seq, Tokens: toks, Pos: sp.computed, Blocks: sp.kv.BlockIDs(), Logits: logits})
+			fed = append(fed, rs)
+		}
+		if len(fed) == 0 {
+			return
+		}
+		results, err := d.ops.Forward(step)
+		bySeq := make(map[SeqID]*SeqResult, len(results))
+		for i := range results {
+			bySeq[results[i].Seq] = &results[i]
+		}
+		var next []*reqState
+		for i, rs := range fed {
+			sp, ss := rs.spec, &step.Seqs[i]
+			res := bySeq[rs.seq]
+			if err != nil || res == nil || res.Err != nil || (ss.Logits && len(res.Logits) == 0) {
+				// The draft is only an accelerator: start it over next time.
+				metrics.BackendErrors.WithLabelValues(rs.req.Model, "draft").Inc()
+				s.dropSpec(rs)
+				continue
+			}
+			sp.computed += len(ss.Tokens)
+			if !ss.Logits {
+				continue
+			}
+			id, q := sp.sampler.Propose(res.Logits)
+			sp.tokens = append(sp.tokens, id)
+			sp.q = append(sp.q, q)
+			if len(sp.tokens) < sp.limit && !s.eog[id] {
+				next = append(next, rs)
+			}
+		}
+		active = next
+	}
+}
+
+// verify settles a step that fed rs's last token plus its proposals. logits
+// has one row per fed token. Accepted proposals keep their KV; the rest is
+// released. It reports whether the request finished.
+func (s *Scheduler) verify(rs *reqState, logits []float32) bool {
+	sp := rs.spec
+	drafts, q := sp.tokens, sp.q
+	sp.tokens, sp.q = nil, nil
+	base := len(rs.tokens) - len(drafts)
+	rs.tokens = rs.tokens[:base]
+	rs.computed = base
+	V := len(logits) / (len(drafts) + 1)
+	rs.width = V
+	rows := make([][]float32, len(drafts)+1)
+	for i := range rows {
+		rows[i] = logits[i*V : (i+1)*V]
+	}
+	out := rs.sampler.Verify(drafts, q, rows)
+	metrics.SpecTokens.WithLabelValues(rs.req.Model, sp.method, "proposed").Add(float64(len(drafts)))
+	metrics.SpecTokens.WithLabelValues(rs.req.Model, sp.method, "accepted").Add(float64(len(out) - 1))
+	if sp.sampler != nil {
+		sp.sampler.Accept(out...)
+	}
+	for i, id := range out {
+		if s.emit(rs, id) {
+			return true
+		}
+		if i < len(out)-1 {
+			rs.computed++ // an accepted proposal: its KV was written this step
+		}
+	}
+	s.pgr.Truncate(rs.kv, rs.computed)
+	if sp.kv != nil && sp.computed > rs.computed {
+		sp.computed = rs.computed
+		s.draft.pgr.Truncate(sp.kv, sp.computed)
+	}
+	return false
+}
+
+// discardProposals forgets proposals the target will not check, along with
+// the draft KV written for them.
+func (s *Scheduler) discardProposals(rs *reqState) {
+	sp := rs.spec
+	if sp == nil {
+		return
+	}
+	sp.tokens, sp.q = nil, nil
+	if sp.kv != nil && sp.computed > len(rs.tokens) {
+		sp.computed = len(rs.tokens)
+		s.draft.pgr.Truncate(sp.kv, sp.computed)
+	}
+}
+
+func (s *Scheduler) dropSpec(rs *reqState) {
+	if rs.spec == nil {
+		return
+	}
+	if rs.spec.kv != nil {
+		s.draft.pgr.Drop(rs.spec.kv)
+	}
+	rs.spec = nil
+}
@@ -1,40 +1,53 @@
 package engine
 
-// Tokenizer defines how text is split for prefix caching.
+import (
+	"strings"
+	"sync"
+)
+
+// Tokenizer maps text to the token IDs the prefix cache and KV blocks are keyed by.
 // Swap this with your real tokenizer to align prefixes with KV boundaries.
 type Tokenizer interface {
-	Tokenize(s string) []string
-	Join(tokens []string) string
+	Encode(s string) []int
+	Decode(ids []int) string
+}
+
+// whitespaceTokenizer interns whitespace-separated words as IDs in first-seen order.
+type whitespaceTokenizer struct {
+	mu    sync.Mutex
+	ids   map[string]int
+	words []string
 }
 
-type whitespaceTokenizer struct{}
+func newWhitespaceTokenizer() *whitespaceTokenizer {
+	return &whitespaceTokenizer{ids: make(map[string]int)}
+}
 
-func (wh whitespaceTokenizer) Tokenize(s string) []string {
-	out := []string{}
-	start := -1
-	for i, r := range s {
-		if r == ' ' || r == '\n' || r == '\t' || r == '\r' {
-			if start >= 0 {
-				out = append(out, s[start:i])
-				start = -1
-			}
-		} else if start < 0 {
-			start = i
+func (wh *whitespaceTokenizer) Encode(s string) []int {
+	words := strings.Fields(s)
+	out := make([]int, len(words))
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for i, w := range words {
+		id, ok := wh.ids[w]
+		if !ok {
+			id = len(wh.words)
+			wh.ids[w] = id
+			wh.words = append(wh.words, w)
 		}
-	}
-	if start >= 0 {
-		out = append(out, s[start:])
+		out[i] = id
 	}
 	return out
 }
 
-func (wh whitespaceTokenizer) Join(tokens []string) string {
-	if len(tokens) == 0 {
-		return ""
-	}
-	out := tokens[0]
-	for i := 1; i < len(tokens); i++ {
-		out += " " + tokens[i]
+func (wh *whitespaceTokenizer) Decode(ids []int) string {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	words := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id >= 0 && id < len(wh.words) {
+			words = append(words, wh.words[id])
+		}
 	}
-	return out
+	return strings.Join(words, " ")
 }
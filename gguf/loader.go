@@ -10,12 +10,43 @@ import (
 type Model struct {
 	Path       string
 	GGUF       *GGUF
+	Arch       string // general.architecture, e.g. "llama"
 	EmbedDim   int
 	VocabSize  int
 	ContextLen int
 	NumLayers  int
 	NumHeads   int
+	NumKVHeads int
 	HeadDim    int
+	FFNDim     int
+	NormEps    float32
+	RopeBase   float32
+	RopeDim    int    // dimensions of each head that RoPE rotates
+	Pooling    string // mean, cls, last or rank from <arch>.pooling_type; "" if unset
+	Rope       RopeScaling
+
+	// Mixture of experts: each token's feed-forward runs on ExpertsUsed of
+	// Experts, each ExpertFFNDim wide, plus a shared expert in some families.
+	Experts, ExpertsUsed, ExpertFFNDim, SharedFFNDim int
+
+	SlidingWindow int     // attention sees at most this many positions; 0 = all
+	AttnSoftcap   float32 // attention scores are soft-capped to ±AttnSoftcap; 0 = off
+	FinalSoftcap  float32 // likewise the output logits
+}
+
+// RopeScaling is how a long-context fine-tune stretches rotary positions
+// past the context it was pretrained with, from <arch>.rope.scaling.*.
+type RopeScaling struct {
+	Type        string  // none, linear, ntk, yarn or longrope
+	Factor      float32 // how many times the original context is extended
+	OrigContext int     // context length before extension
+	AttnFactor  float32 // scales attention logits (YaRN, LongRoPE); 0 = derived from Factor
+	// YaRN interpolates only frequencies with fewer than BetaFast rotations
+	// over the original context, fully below BetaSlow; 0 = 32 and 1.
+	BetaFast, BetaSlow float32
+	// LongRoPE divides each rotated pair's frequency by a learned factor:
+	// the short set within OrigContext, the long set beyond it.
+	ShortFactors, LongFactors []float32
 }
 
 // LoadModel loads a GGUF file from the models directory
@@ -30,29 +61,88 @@ func LoadModel(path string) (*Model, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse GGUF: %w", err)
 	}
+	return newModel(path, gguf), nil
+}
+
+// MapModel is LoadModel for a model that may not fit in memory. The file is
+// mapped instead of read, and each matrix keeps its data where it lies in
+// the file, as Raw, for the kernels to read in the type it is stored in; the
+// operating system pages it in as it is used and can drop it again. Vectors,
+// such as norm weights and biases, are decoded into Data as usual.
+func MapModel(path string) (*Model, error) {
+	gguf, err := Map(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map GGUF: %w", err)
+	}
+	return newModel(path, gguf), nil
+}
 
+func newModel(path string, gguf *GGUF) *Model {
 	m := &Model{
 		Path: path,
 		GGUF: gguf,
 	}
+	m.Arch, _ = gguf.String("general.architecture")
+	if m.Arch == "" {
+		m.Arch = "llama"
+	}
+	hp := func(key string) int {
+		v, _ := gguf.Int(m.Arch + "." + key)
+		return v
+	}
+	m.EmbedDim = hp("embedding_length")
+	m.NumLayers = hp("block_count")
+	m.NumHeads = hp("attention.head_count")
+	m.NumKVHeads = hp("attention.head_count_kv")
+	m.ContextLen = hp("context_length")
+	m.FFNDim = hp("feed_forward_length")
+	m.RopeDim = hp("rope.dimension_count")
+	if eps, ok := gguf.Float(m.Arch + ".attention.layer_norm_rms_epsilon"); ok {
+		m.NormEps = float32(eps)
+	} else if eps, ok := gguf.Float(m.Arch + ".attention.layer_norm_epsilon"); ok {
+		m.NormEps = float32(eps)
+	}
+	if base, ok := gguf.Float(m.Arch + ".rope.freq_base"); ok {
+		m.RopeBase = float32(base)
+	}
+	m.Rope = ropeScaling(gguf, m.Arch)
+	m.SlidingWindow = hp("attention.sliding_window")
+	m.Experts = hp("expert_count")
+	m.ExpertsUsed = hp("expert_used_count")
+	m.ExpertFFNDim = hp("expert_feed_forward_length")
+	m.SharedFFNDim = hp("expert_shared_feed_forward_length")
+	if c, ok := gguf.Float(m.Arch + ".attn_logit_softcapping"); ok {
+		m.AttnSoftcap = float32(c)
+	}
+	if c, ok := gguf.Float(m.Arch + ".final_logit_softcapping"); ok {
+		m.FinalSoftcap = float32(c)
+	}
+	switch hp("pooling_type") {
+	case 1:
+		m.Pooling = "mean"
+	case 2:
+		m.Pooling = "cls"
+	case 3:
+		m.Pooling = "last"
+	case 4:
+		m.Pooling = "rank"
+	}
+	m.VocabSize = len(gguf.Strings("tokenizer.ggml.tokens"))
 
-	// Extract metadata from tensors (simplified)
-	if tokEmb, ok := gguf.Tensors["tok_embeddings.weight"]; ok {
-		if len(tokEmb.Dims) >= 2 {
-			m.VocabSize = int(tokEmb.Dims[0])
-			m.EmbedDim = int(tokEmb.Dims[1])
+	// Fall back to tensor shapes for anything the metadata left out
+	if tokEmb, ok := gguf.Tensors["token_embd.weight"]; ok && len(tokEmb.Dims) >= 2 {
+		if m.EmbedDim == 0 {
+			m.EmbedDim = int(tokEmb.Dims[0])
+		}
+		if m.VocabSize == 0 {
+			m.VocabSize = int(tokEmb.Dims[1])
 		}
 	}
-
-	// Try to infer architecture from tensor names
-	m.NumLayers = 0
-	for name := range gguf.Tensors {
-		if len(name) > 8 && name[0:8] == "layers." {
+	if m.NumLayers == 0 {
+		for name := range gguf.Tensors {
 			layerIdx := 0
-			if _, err := fmt.Sscanf(name, "layers.%d", &layerIdx); err == nil {
-				if layerIdx >= m.NumLayers {
-					m.NumLayers = layerIdx + 1
-				}
+			if _, err := fmt.Sscanf(name, "blk.%d.", &layerIdx); err == nil && layerIdx >= m.NumLayers {
+				m.NumLayers = layerIdx + 1
 			}
 		}
 	}
@@ -67,12 +157,76 @@ func LoadModel(path string) (*Model, error) {
 	if m.NumLayers == 0 {
 		m.NumLayers = 32 // Default
 	}
-
-	m.NumHeads = 32 // Common default
+	if m.NumHeads == 0 {
+		m.NumHeads = 32 // Common default
+	}
+	if m.NumKVHeads == 0 {
+		m.NumKVHeads = m.NumHeads
+	}
 	m.HeadDim = m.EmbedDim / m.NumHeads
-	m.ContextLen = 2048 // Default context
+	if kl := hp("attention.key_length"); kl > 0 {
+		m.HeadDim = kl
+	}
+	if m.RopeDim == 0 {
+		m.RopeDim = m.HeadDim
+	}
+	if m.FFNDim == 0 {
+		m.FFNDim = 4 * m.EmbedDim
+	}
+	if m.ExpertFFNDim == 0 {
+		m.ExpertFFNDim = m.FFNDim
+	}
+	if m.SharedFFNDim == 0 {
+		m.SharedFFNDim = m.FFNDim
+	}
+	if m.ContextLen == 0 {
+		m.ContextLen = 2048 // Default context
+	}
+	if m.NormEps == 0 {
+		m.NormEps = 1e-5
+	}
+	if m.RopeBase == 0 {
+		m.RopeBase = 10000
+	}
+	if m.Rope.OrigContext == 0 {
+		m.Rope.OrigContext = m.ContextLen
+	}
+	return m
+}
 
-	return m, nil
+func ropeScaling(g *GGUF, arch string) RopeScaling {
+	key := func(k string) string { return arch + ".rope.scaling." + k }
+	f := func(k string) float32 {
+		v, _ := g.Float(key(k))
+		return float32(v)
+	}
+	rs := RopeScaling{
+		Factor:     f("factor"),
+		AttnFactor: f("attn_factor"),
+		BetaFast:   f("yarn_beta_fast"),
+		BetaSlow:   f("yarn_beta_slow"),
+	}
+	rs.Type, _ = g.String(key("type"))
+	rs.OrigContext, _ = g.Int(key("original_context_length"))
+	if rs.Type == "" {
+		// Older files give only a linear factor.
+		if v, ok := g.Float(arch + ".rope.scale_linear"); ok && v != 1 {
+			rs.Type, rs.Factor = "linear", float32(v)
+		}
+	}
+	if t, ok := g.Tensors["rope_factors_long.weight"]; ok {
+		rs.LongFactors = t.Data
+		if t, ok := g.Tensors["rope_factors_short.weight"]; ok {
+			rs.ShortFactors = t.Data
+		}
+		if rs.Type == "" || rs.Type == "su" {
+			rs.Type = "longrope"
+		}
+	}
+	if rs.Type == "" {
+		rs.Type = "none"
+	}
+	return rs
 }
 
 // FindModels scans the models directory for GGUF files
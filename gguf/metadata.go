@@ -0,0 +1,110 @@
+package gguf
+
+// Typed accessors for Metadata. Integer values are widened regardless of the
+// width the file stored them with.
+
+func (g *GGUF) String(key string) (string, bool) {
+	s, ok := g.Metadata[key].(string)
+	return s, ok
+}
+
+func (g *GGUF) Uint(key string) (uint64, bool) {
+	switch v := g.Metadata[key].(type) {
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int8:
+		return uint64(v), v >= 0
+	case int16:
+		return uint64(v), v >= 0
+	case int32:
+		return uint64(v), v >= 0
+	case int64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
+
+func (g *GGUF) Int(key string) (int, bool) {
+	switch v := g.Metadata[key].(type) {
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	}
+	u, ok := g.Uint(key)
+	return int(u), ok
+}
+
+func (g *GGUF) Float(key string) (float64, bool) {
+	switch v := g.Metadata[key].(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	i, ok := g.Int(key)
+	return float64(i), ok
+}
+
+func (g *GGUF) Bool(key string) (bool, bool) {
+	b, ok := g.Metadata[key].(bool)
+	return b, ok
+}
+
+func (g *GGUF) Strings(key string) []string {
+	s, _ := g.Metadata[key].([]string)
+	return s
+}
+
+func (g *GGUF) Floats(key string) []float32 {
+	f, _ := g.Metadata[key].([]float32)
+	return f
+}
+
+// Ints returns an integer array, whichever integer width it was stored with.
+func (g *GGUF) Ints(key string) []int {
+	switch v := g.Metadata[key].(type) {
+	case []int32:
+		out := make([]int, len(v))
+		for i, x := range v {
+			out[i] = int(x)
+		}
+		return out
+	case []uint32:
+		out := make([]int, len(v))
+		for i, x := range v {
+			out[i] = int(x)
+		}
+		return out
+	case []interface{}:
+		out := make([]int, 0, len(v))
+		for _, x := range v {
+			switch n := x.(type) {
+			case int8:
+				out = append(out, int(n))
+			case uint8:
+				out = append(out, int(n))
+			case int16:
+				out = append(out, int(n))
+			case uint16:
+				out = append(out, int(n))
+			case int64:
+				out = append(out, int(n))
+			case uint64:
+				out = append(out, int(n))
+			}
+		}
+		return out
+	}
+	return nil
+}
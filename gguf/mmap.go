@@ -0,0 +1,85 @@
+package gguf
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"unsafe"
+)
+
+// Map parses the GGUF at path from a read-only mapping of the file. Matrices
+// are not read: their Raw slices point into the mapping, so only the pages
+// in use take memory. Vectors are decoded into Data. The mapping lasts until
+// Close, or until the GGUF is garbage collected.
+func Map(path string) (*GGUF, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := ParseHeader(bytes.NewReader(data))
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+	g.mapped = data
+	runtime.SetFinalizer(g, (*GGUF).Close)
+	for _, t := range g.Tensors {
+		bs, ts := BlockSize(t.Type)
+		if bs == 0 {
+			log.Printf("Warning: tensor %s has unsupported type %d, skipping", t.Name, t.Type)
+			continue
+		}
+		start := g.DataOffset + int64(t.Offset)
+		end := start + int64(t.Size/uint64(bs)*uint64(ts))
+		if start < g.DataOffset || end > int64(len(data)) {
+			g.Close()
+			return nil, fmt.Errorf("tensor %s runs past the end of the file", t.Name)
+		}
+		raw := data[start:end:end]
+		if !t.matrix() {
+			t.Data = make([]float32, t.Size)
+			Dequantize(t.Type, raw, t.Data)
+			continue
+		}
+		t.Raw = raw
+		if t.Type == TypeF32 && start%4 == 0 && len(raw) > 0 {
+			t.Data = unsafe.Slice((*float32)(unsafe.Pointer(&raw[0])), t.Size)
+		}
+	}
+	return g, nil
+}
+
+// Mapped reports whether g's matrices are read from a mapping of the file.
+func (g *GGUF) Mapped() bool { return g.mapped != nil }
+
+// Close releases the mapping behind a GGUF from Map. Its Raw slices, and
+// the Data of its mapped F32 matrices, must not be used afterwards.
+func (g *GGUF) Close() error {
+	if g.mapped == nil {
+		return nil
+	}
+	err := unmapFile(g.mapped)
+	g.mapped = nil
+	runtime.SetFinalizer(g, nil)
+	return err
+}
+
+// WillNeed asks the operating system to start reading b, part of a mapped
+// file, ahead of its use.
+func WillNeed(b []byte) { advise(b, adviseWillNeed) }
+
+// DontNeed tells the operating system b, part of a mapped file, will not be
+// used for a while, so it can drop its pages now instead of under memory
+// pressure. Using b again reads it back from the file.
+func DontNeed(b []byte) { advise(b, adviseDontNeed) }
+
+// pages widens b to the whole pages it touches, which is what the advice
+// calls take. A mapping starts on a page, so they are part of it too.
+func pages(b []byte, pageSize int) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	off := int(uintptr(unsafe.Pointer(&b[0])) % uintptr(pageSize))
+	return unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(&b[0]), -off)), off+len(b))
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package gguf
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const (
+	adviseWillNeed = iota
+	adviseDontNeed
+)
+
+func mapFile(path string) ([]byte, error) {
+	return nil, fmt.Errorf("mapping model files is not supported on %s", runtime.GOOS)
+}
+
+func unmapFile(b []byte) error { return nil }
+
+func advise(b []byte, advice int) {}
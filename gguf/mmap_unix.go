@@ -0,0 +1,41 @@
+//go:build unix
+
+package gguf
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	adviseWillNeed = unix.MADV_WILLNEED
+	adviseDontNeed = unix.MADV_DONTNEED
+)
+
+func mapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func unmapFile(b []byte) error { return unix.Munmap(b) }
+
+// advise is best effort: the advice only changes when pages are read or
+// dropped, never what is read.
+func advise(b []byte, advice int) {
+	if b = pages(b, os.Getpagesize()); b != nil {
+		unix.Madvise(b, advice)
+	}
+}
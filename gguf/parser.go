@@ -1,6 +1,7 @@
 package gguf
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -8,21 +9,59 @@ import (
 	"math"
 )
 
-// GGUF File Format (simplified)
+// GGUF File Format
 // Based on: https://github.com/ggerganov/llama.cpp/blob/master/gguf-spec.md
 
 const (
 	GGUFMagic   = 0x46554747 // "GGUF"
-	GGUFCows    = 0x666F     // "fo"
 	GGUFVersion = 3
+
+	DefaultAlignment = 32
+)
+
+// Tensor types (ggml_type)
+const (
+	TypeF32  = 0
+	TypeF16  = 1
+	TypeQ4_0 = 2
+	TypeQ4_1 = 3
+	TypeQ5_0 = 6
+	TypeQ5_1 = 7
+	TypeQ8_0 = 8
+	TypeQ4_K = 12
+	TypeQ5_K = 13
+	TypeQ6_K = 14
+	TypeBF16 = 30
+)
+
+// Metadata value types
+const (
+	valUint8   = 0
+	valInt8    = 1
+	valUint16  = 2
+	valInt16   = 3
+	valUint32  = 4
+	valInt32   = 5
+	valFloat32 = 6
+	valBool    = 7
+	valString  = 8
+	valArray   = 9
+	valUint64  = 10
+	valInt64   = 11
+	valFloat64 = 12
 )
 
 type Tensor struct {
-	Name string
-	Dims []uint32
-	Type uint32
-	Data []float32
-	Size uint64
+	Name   string
+	Dims   []uint32 // Dims[0] is the innermost (contiguous) dimension
+	Type   uint32
+	Offset uint64 // relative to the start of the data section
+	Data   []float32
+	Size   uint64
+	// Raw is the data of a matrix as stored: read by Parse for types other
+	// than F32, and left in place in the file by Map. Data is nil then unless
+	// the type is F32, which it views.
+	Raw []byte
 }
 
 type GGUFHeader struct {
@@ -36,18 +75,42 @@ type GGUF struct {
 	Header   *GGUFHeader
 	Tensors  map[string]*Tensor
 	Metadata map[string]interface{}
+	// DataOffset is the file offset of the tensor data section.
+	DataOffset int64
+
+	mapped []byte // the whole file, if Map read it
 }
 
-// Parse reads a GGUF file and returns the parsed structure
+// Parse reads a GGUF file and returns the parsed structure. Vectors and F32
+// matrices are decoded into Data; other matrices are kept as stored, in Raw,
+// for kernels that compute on their types directly.
 func Parse(r io.ReadSeeker) (*GGUF, error) {
+	g, err := ParseHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range g.Tensors {
+		if _, err := r.Seek(g.DataOffset+int64(t.Offset), io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek to tensor %s: %w", t.Name, err)
+		}
+		if err := readTensorData(bufio.NewReader(r), t); err != nil {
+			return nil, fmt.Errorf("failed to read tensor %s: %w", t.Name, err)
+		}
+	}
+	return g, nil
+}
+
+// ParseHeader reads the header, metadata and tensor infos without loading tensor data.
+func ParseHeader(r io.ReadSeeker) (*GGUF, error) {
 	g := &GGUF{
 		Tensors:  make(map[string]*Tensor),
 		Metadata: make(map[string]interface{}),
 	}
+	br := &countingReader{r: bufio.NewReader(r)}
 
 	// Read magic bytes
 	var magic uint32
-	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+	if err := binary.Read(br, binary.LittleEndian, &magic); err != nil {
 		return nil, fmt.Errorf("failed to read magic: %w", err)
 	}
 	if magic != GGUFMagic {
@@ -56,16 +119,19 @@ func Parse(r io.ReadSeeker) (*GGUF, error) {
 
 	// Read version
 	var version uint32
-	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+	if err := binary.Read(br, binary.LittleEndian, &version); err != nil {
 		return nil, fmt.Errorf("failed to read version: %w", err)
 	}
+	if version < 2 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", version)
+	}
 
 	// Read tensor and KV counts
 	var tensorCount, kvCount uint64
-	if err := binary.Read(r, binary.LittleEndian, &tensorCount); err != nil {
+	if err := binary.Read(br, binary.LittleEndian, &tensorCount); err != nil {
 		return nil, fmt.Errorf("failed to read tensor count: %w", err)
 	}
-	if err := binary.Read(r, binary.LittleEndian, &kvCount); err != nil {
+	if err := binary.Read(br, binary.LittleEndian, &kvCount); err != nil {
 		return nil, fmt.Errorf("failed to read KV count: %w", err)
 	}
 
@@ -76,151 +142,272 @@ func Parse(r io.ReadSeeker) (*GGUF, error) {
 		KVCount:     kvCount,
 	}
 
-	// For now, skip metadata parsing and jump to tensors
-	// TODO: Parse KV metadata
+	for i := uint64(0); i < kvCount; i++ {
+		key, err := readString(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata key %d: %w", i, err)
+		}
+		var vt uint32
+		if err := binary.Read(br, binary.LittleEndian, &vt); err != nil {
+			return nil, fmt.Errorf("failed to read type of %s: %w", key, err)
+		}
+		v, err := readValue(br, vt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value of %s: %w", key, err)
+		}
+		g.Metadata[key] = v
+	}
 
-	// Parse tensors
 	for i := uint64(0); i < tensorCount; i++ {
-		tensor, err := parseTensor(r)
+		tensor, err := parseTensorInfo(br)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse tensor %d: %w", i, err)
 		}
 		g.Tensors[tensor.Name] = tensor
 	}
 
+	align := int64(DefaultAlignment)
+	if a, ok := g.Uint("general.alignment"); ok && a > 0 {
+		align = int64(a)
+	}
+	g.DataOffset = (br.n + align - 1) / align * align
 	return g, nil
 }
 
-func parseTensor(r io.Reader) (*Tensor, error) {
+func parseTensorInfo(r io.Reader) (*Tensor, error) {
 	t := &Tensor{}
-
-	// Read name length
-	var nameLen uint64
-	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+	name, err := readString(r)
+	if err != nil {
 		return nil, err
 	}
+	t.Name = name
 
-	// Read name
-	nameBytes := make([]byte, nameLen)
-	if _, err := io.ReadFull(r, nameBytes); err != nil {
-		return nil, err
-	}
-	t.Name = string(nameBytes)
-
-	// Read number of dimensions
 	var nDims uint32
 	if err := binary.Read(r, binary.LittleEndian, &nDims); err != nil {
 		return nil, err
 	}
-
-	// Read dimensions
-	t.Dims = make([]uint32, nDims)
-	if err := binary.Read(r, binary.LittleEndian, &t.Dims); err != nil {
+	dims := make([]uint64, nDims)
+	if err := binary.Read(r, binary.LittleEndian, dims); err != nil {
 		return nil, err
 	}
-
-	// Read type
+	t.Dims = make([]uint32, nDims)
+	t.Size = 1
+	for i, d := range dims {
+		t.Dims[i] = uint32(d)
+		t.Size *= d
+	}
 	if err := binary.Read(r, binary.LittleEndian, &t.Type); err != nil {
 		return nil, err
 	}
-
-	// Read offset (skip for now, we'll read data directly)
-	var offset uint64
-	if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &t.Offset); err != nil {
 		return nil, err
 	}
+	return t, nil
+}
 
-	// Calculate size
-	t.Size = 1
-	for _, dim := range t.Dims {
-		t.Size *= uint64(dim)
+func readString(r io.Reader) (string, error) {
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
 	}
-
-	// Read data based on type
-	if err := readTensorData(r, t); err != nil {
-		return nil, err
+	if n > 1<<30 {
+		return "", fmt.Errorf("string length %d too large", n)
 	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
 
-	return t, nil
+func readValue(r io.Reader, vt uint32) (interface{}, error) {
+	switch vt {
+	case valUint8:
+		var v uint8
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valInt8:
+		var v int8
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valUint16:
+		var v uint16
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valInt16:
+		var v int16
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valUint32:
+		var v uint32
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valInt32:
+		var v int32
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valFloat32:
+		var v float32
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valBool:
+		var v uint8
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v != 0, err
+	case valString:
+		return readString(r)
+	case valUint64:
+		var v uint64
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valInt64:
+		var v int64
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valFloat64:
+		var v float64
+		err := binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case valArray:
+		return readArray(r)
+	}
+	return nil, fmt.Errorf("unknown metadata type %d", vt)
 }
 
-func readTensorData(r io.Reader, t *Tensor) error {
-	// Read data based on type
-	// Note: Simplified implementation - real GGUF has tensors at specific offsets
-	// For now, read directly (actual files need seek to offset)
-
-	switch t.Type {
-	case 0: // F32
-		t.Data = make([]float32, t.Size)
-		for i := uint64(0); i < t.Size; i++ {
-			if err := binary.Read(r, binary.LittleEndian, &t.Data[i]); err != nil {
-				return err
+// readArray decodes the common element types into typed slices; others become []interface{}.
+func readArray(r io.Reader) (interface{}, error) {
+	var et uint32
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &et); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > 1<<28 {
+		return nil, fmt.Errorf("array length %d too large", n)
+	}
+	switch et {
+	case valString:
+		out := make([]string, n)
+		for i := range out {
+			s, err := readString(r)
+			if err != nil {
+				return nil, err
 			}
+			out[i] = s
 		}
-	case 1: // F16 - convert to F32
-		t.Data = make([]float32, t.Size)
-		for i := uint64(0); i < t.Size; i++ {
-			var f16 uint16
-			if err := binary.Read(r, binary.LittleEndian, &f16); err != nil {
-				return err
-			}
-			t.Data[i] = float16ToFloat32(f16)
+		return out, nil
+	case valFloat32:
+		out := make([]float32, n)
+		return out, binary.Read(r, binary.LittleEndian, out)
+	case valInt32:
+		out := make([]int32, n)
+		return out, binary.Read(r, binary.LittleEndian, out)
+	case valUint32:
+		out := make([]uint32, n)
+		return out, binary.Read(r, binary.LittleEndian, out)
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		v, err := readValue(r, et)
+		if err != nil {
+			return nil, err
 		}
-	case 2, 3: // Q4_0, Q4_1 - quantized, dequantize to F32
-		return readQuantizedTensor(r, t)
-	case 8: // Q8_0
-		return readQuantizedTensor(r, t)
-	default:
-		log.Printf("Warning: unknown tensor type %d, skipping", t.Type)
-		// Skip the tensor data
-		return nil
+		out[i] = v
 	}
-
-	return nil
+	return out, nil
 }
 
-func readQuantizedTensor(r io.Reader, t *Tensor) error {
-	// For quantized formats, we dequantize to F32
-	// This is simplified - real implementation needs proper dequantization
-	t.Data = make([]float32, t.Size)
-	// Q4_0 uses 32 values per block (18 bytes: 2 byte scale + 16 bytes data)
-	blocks := t.Size / 32
-
-	for i := uint64(0); i < blocks; i++ {
-		// Read scale
-		var scale float32
-		if err := binary.Read(r, binary.LittleEndian, &scale); err != nil {
-			return err
-		}
-		// Read quantized data (8 bytes for Q4_0)
-		buf := make([]byte, 8)
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return err
-		}
-		// Dequantize
-		for j := 0; j < 32 && (i*32+uint64(j)) < t.Size; j++ {
-			nibble := (buf[j/2] >> ((j % 2) * 4)) & 0xf
-			q := int8(nibble)
-			t.Data[i*32+uint64(j)] = float32(q-8) * scale
-		}
+func readTensorData(r io.Reader, t *Tensor) error {
+	bs, ts := BlockSize(t.Type)
+	if bs == 0 {
+		log.Printf("Warning: tensor %s has unsupported type %d, skipping", t.Name, t.Type)
+		return nil
+	}
+	raw := make([]byte, t.Size/uint64(bs)*uint64(ts))
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return err
+	}
+	if t.matrix() && t.Type != TypeF32 {
+		t.Raw = raw
+		return nil
 	}
+	t.Data = make([]float32, t.Size)
+	Dequantize(t.Type, raw, t.Data)
 	return nil
 }
 
+// matrix reports whether t has more than one row.
+func (t *Tensor) matrix() bool { return len(t.Dims) >= 2 && uint64(t.Dims[0]) != t.Size }
+
+// countingReader tracks how many bytes of the header have been consumed.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // float16ToFloat32 converts IEEE 754 half-precision to float32
 func float16ToFloat32(f16 uint16) float32 {
-	sign := float32((f16 >> 15) & 0x1)
-	exp := int((f16 >> 10) & 0x1f)
-	mantissa := float32(f16 & 0x3ff)
-
-	if exp == 0 {
-		return sign * mantissa * float32(math.Pow(2, -24))
-	} else if exp == 31 {
-		return (sign*2 - 1) * float32(math.Inf(1))
+	sign := uint32(f16>>15) << 31
+	exp := uint32(f16>>10) & 0x1f
+	mant := uint32(f16) & 0x3ff
+	switch {
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// subnormal: renormalize
+		e := uint32(127 - 15 + 1)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		mant &= 0x3ff
+		return math.Float32frombits(sign | e<<23 | mant<<13)
+	case exp == 31:
+		return math.Float32frombits(sign | 0xff<<23 | mant<<13)
 	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
 
-	expValue := float32(math.Pow(2, float64(exp-15)))
-	mantissaValue := 1.0 + mantissa/1024.0
-
-	return sign * expValue * mantissaValue
+// float32ToFloat16 converts to IEEE 754 half-precision, rounding to nearest even
+func float32ToFloat16(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	e := int(b>>23) & 0xff
+	mant := b & 0x7fffff
+	exp := e - 127 + 15
+	switch {
+	case e == 0xff: // infinity or NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		// subnormal: shift the mantissa, implicit bit included, into place
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		h := mant >> shift
+		rem, half := mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > half || rem == half && h&1 == 1 {
+			h++
+		}
+		return sign | uint16(h)
+	}
+	h := uint32(exp)<<10 | mant>>13
+	if rem := mant & 0x1fff; rem > 0x1000 || rem == 0x1000 && h&1 == 1 {
+		h++ // a carry out of the mantissa correctly bumps the exponent
+	}
+	return sign | uint16(h)
 }
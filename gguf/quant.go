@@ -0,0 +1,289 @@
+package gguf
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const qkK = 256 // super-block size of the K-quants
+
+// BlockSize returns how many elements a block of type t holds and its size in bytes.
+// It returns 0, 0 for types this package cannot decode.
+func BlockSize(t uint32) (elems, bytes int) {
+	switch t {
+	case TypeF32:
+		return 1, 4
+	case TypeF16, TypeBF16:
+		return 1, 2
+	case TypeQ4_0:
+		return 32, 18
+	case TypeQ4_1:
+		return 32, 20
+	case TypeQ5_0:
+		return 32, 22
+	case TypeQ5_1:
+		return 32, 24
+	case TypeQ8_0:
+		return 32, 34
+	case TypeQ4_K:
+		return qkK, 144
+	case TypeQ5_K:
+		return qkK, 176
+	case TypeQ6_K:
+		return qkK, 210
+	}
+	return 0, 0
+}
+
+// TypeName is the ggml name of a tensor type.
+func TypeName(t uint32) string {
+	switch t {
+	case TypeF32:
+		return "f32"
+	case TypeF16:
+		return "f16"
+	case TypeBF16:
+		return "bf16"
+	case TypeQ4_0:
+		return "q4_0"
+	case TypeQ4_1:
+		return "q4_1"
+	case TypeQ5_0:
+		return "q5_0"
+	case TypeQ5_1:
+		return "q5_1"
+	case TypeQ8_0:
+		return "q8_0"
+	case TypeQ4_K:
+		return "q4_k"
+	case TypeQ5_K:
+		return "q5_k"
+	case TypeQ6_K:
+		return "q6_k"
+	}
+	return "unknown"
+}
+
+// SupportedTypes lists the tensor types Dequantize understands.
+func SupportedTypes() []string {
+	var out []string
+	for _, t := range []uint32{TypeF32, TypeF16, TypeBF16, TypeQ4_0, TypeQ4_1, TypeQ5_0, TypeQ5_1, TypeQ8_0, TypeQ4_K, TypeQ5_K, TypeQ6_K} {
+		out = append(out, TypeName(t))
+	}
+	return out
+}
+
+// Float16 decodes an IEEE 754 half-precision value, the format block scales are stored in.
+func Float16(h uint16) float32 { return float16ToFloat32(h) }
+
+// Dequantize decodes raw tensor bytes of type t into out, which must hold every element.
+func Dequantize(t uint32, raw []byte, out []float32) {
+	le := binary.LittleEndian
+	switch t {
+	case TypeF32:
+		for i := range out {
+			out[i] = math.Float32frombits(le.Uint32(raw[i*4:]))
+		}
+	case TypeF16:
+		for i := range out {
+			out[i] = float16ToFloat32(le.Uint16(raw[i*2:]))
+		}
+	case TypeBF16:
+		for i := range out {
+			out[i] = math.Float32frombits(uint32(le.Uint16(raw[i*2:])) << 16)
+		}
+	case TypeQ4_0:
+		for b := 0; b*32 < len(out); b++ {
+			blk := raw[b*18:]
+			d := float16ToFloat32(le.Uint16(blk))
+			y := out[b*32:]
+			for j := 0; j < 16; j++ {
+				y[j] = float32(int(blk[2+j]&0xf)-8) * d
+				y[j+16] = float32(int(blk[2+j]>>4)-8) * d
+			}
+		}
+	case TypeQ4_1:
+		for b := 0; b*32 < len(out); b++ {
+			blk := raw[b*20:]
+			d := float16ToFloat32(le.Uint16(blk))
+			m := float16ToFloat32(le.Uint16(blk[2:]))
+			y := out[b*32:]
+			for j := 0; j < 16; j++ {
+				y[j] = float32(blk[4+j]&0xf)*d + m
+				y[j+16] = float32(blk[4+j]>>4)*d + m
+			}
+		}
+	case TypeQ5_0:
+		for b := 0; b*32 < len(out); b++ {
+			blk := raw[b*22:]
+			d := float16ToFloat32(le.Uint16(blk))
+			qh := le.Uint32(blk[2:])
+			qs := blk[6:]
+			y := out[b*32:]
+			for j := 0; j < 16; j++ {
+				h0 := byte((qh>>j)<<4) & 0x10
+				h1 := byte(qh>>(j+12)) & 0x10
+				y[j] = float32(int(qs[j]&0xf|h0)-16) * d
+				y[j+16] = float32(int(qs[j]>>4|h1)-16) * d
+			}
+		}
+	case TypeQ5_1:
+		for b := 0; b*32 < len(out); b++ {
+			blk := raw[b*24:]
+			d := float16ToFloat32(le.Uint16(blk))
+			m := float16ToFloat32(le.Uint16(blk[2:]))
+			qh := le.Uint32(blk[4:])
+			qs := blk[8:]
+			y := out[b*32:]
+			for j := 0; j < 16; j++ {
+				h0 := byte((qh>>j)<<4) & 0x10
+				h1 := byte(qh>>(j+12)) & 0x10
+				y[j] = float32(qs[j]&0xf|h0)*d + m
+				y[j+16] = float32(qs[j]>>4|h1)*d + m
+			}
+		}
+	case TypeQ8_0:
+		for b := 0; b*32 < len(out); b++ {
+			blk := raw[b*34:]
+			d := float16ToFloat32(le.Uint16(blk))
+			y := out[b*32:]
+			for j := 0; j < 32; j++ {
+				y[j] = float32(int8(blk[2+j])) * d
+			}
+		}
+	case TypeQ4_K:
+		for b := 0; b*qkK < len(out); b++ {
+			blk := raw[b*144:]
+			d := float16ToFloat32(le.Uint16(blk))
+			dmin := float16ToFloat32(le.Uint16(blk[2:]))
+			scales := blk[4:16]
+			q := blk[16:]
+			y := out[b*qkK:]
+			for j, is := 0, 0; j < qkK; j, is = j+64, is+2 {
+				sc, m := scaleMinK4(is, scales)
+				d1, m1 := d*float32(sc), dmin*float32(m)
+				sc, m = scaleMinK4(is+1, scales)
+				d2, m2 := d*float32(sc), dmin*float32(m)
+				for l := 0; l < 32; l++ {
+					y[j+l] = d1*float32(q[l]&0xf) - m1
+					y[j+32+l] = d2*float32(q[l]>>4) - m2
+				}
+				q = q[32:]
+			}
+		}
+	case TypeQ5_K:
+		for b := 0; b*qkK < len(out); b++ {
+			blk := raw[b*176:]
+			d := float16ToFloat32(le.Uint16(blk))
+			dmin := float16ToFloat32(le.Uint16(blk[2:]))
+			scales := blk[4:16]
+			qh := blk[16:48]
+			ql := blk[48:]
+			y := out[b*qkK:]
+			u1, u2 := byte(1), byte(2)
+			for j, is := 0, 0; j < qkK; j, is = j+64, is+2 {
+				sc, m := scaleMinK4(is, scales)
+				d1, m1 := d*float32(sc), dmin*float32(m)
+				sc, m = scaleMinK4(is+1, scales)
+				d2, m2 := d*float32(sc), dmin*float32(m)
+				for l := 0; l < 32; l++ {
+					h1, h2 := float32(0), float32(0)
+					if qh[l]&u1 != 0 {
+						h1 = 16
+					}
+					if qh[l]&u2 != 0 {
+						h2 = 16
+					}
+					y[j+l] = d1*(float32(ql[l]&0xf)+h1) - m1
+					y[j+32+l] = d2*(float32(ql[l]>>4)+h2) - m2
+				}
+				ql = ql[32:]
+				u1 <<= 2
+				u2 <<= 2
+			}
+		}
+	case TypeQ6_K:
+		for b := 0; b*qkK < len(out); b++ {
+			blk := raw[b*210:]
+			ql := blk[:128]
+			qh := blk[128:192]
+			sc := blk[192:208]
+			d := float16ToFloat32(le.Uint16(blk[208:]))
+			y := out[b*qkK:]
+			for n := 0; n < qkK; n += 128 {
+				for l := 0; l < 32; l++ {
+					is := l / 16
+					q1 := int(ql[l]&0xf|((qh[l]>>0)&3)<<4) - 32
+					q2 := int(ql[l+32]&0xf|((qh[l]>>2)&3)<<4) - 32
+					q3 := int(ql[l]>>4|((qh[l]>>4)&3)<<4) - 32
+					q4 := int(ql[l+32]>>4|((qh[l]>>6)&3)<<4) - 32
+					y[n+l] = d * float32(int8(sc[is])) * float32(q1)
+					y[n+l+32] = d * float32(int8(sc[is+2])) * float32(q2)
+					y[n+l+64] = d * float32(int8(sc[is+4])) * float32(q3)
+					y[n+l+96] = d * float32(int8(sc[is+6])) * float32(q4)
+				}
+				ql = ql[64:]
+				qh = qh[32:]
+				sc = sc[8:]
+			}
+		}
+	}
+}
+
+// scaleMinK4 unpacks the 6-bit scale and min of sub-block j from a K-quant scales array.
+func scaleMinK4(j int, q []byte) (sc, m byte) {
+	if j < 4 {
+		return q[j] & 63, q[j+4] & 63
+	}
+	return q[j+4]&0xf | (q[j-4]>>6)<<4, q[j+4]>>4 | (q[j]>>6)<<4
+}
+
+// Quantize encodes x as type t into out, which must hold len(x)/elems blocks.
+// Only Q8_0 and Q4_0 are supported, following llama.cpp's reference
+// quantizers; it reports whether t was one of them.
+func Quantize(t uint32, x []float32, out []byte) bool {
+	le := binary.LittleEndian
+	switch t {
+	case TypeQ8_0:
+		for b := 0; b*32 < len(x); b++ {
+			blk, y := x[b*32:b*32+32], out[b*34:b*34+34]
+			amax := float32(0)
+			for _, v := range blk {
+				amax = max(amax, float32(math.Abs(float64(v))))
+			}
+			d := amax / 127
+			id := float32(0)
+			if d != 0 {
+				id = 1 / d
+			}
+			le.PutUint16(y, float32ToFloat16(d))
+			for j, v := range blk {
+				y[2+j] = byte(int8(math.Round(float64(v * id))))
+			}
+		}
+	case TypeQ4_0:
+		for b := 0; b*32 < len(x); b++ {
+			blk, y := x[b*32:b*32+32], out[b*18:b*18+18]
+			amax, mx := float32(0), float32(0) // the value of largest magnitude maps to -8
+			for _, v := range blk {
+				if a := float32(math.Abs(float64(v))); a > amax {
+					amax, mx = a, v
+				}
+			}
+			d := mx / -8
+			id := float32(0)
+			if d != 0 {
+				id = 1 / d
+			}
+			le.PutUint16(y, float32ToFloat16(d))
+			for j := 0; j < 16; j++ {
+				lo := min(15, int(blk[j]*id+8.5))
+				hi := min(15, int(blk[j+16]*id+8.5))
+				y[2+j] = byte(lo) | byte(hi)<<4
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+package gguf
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The quant tests pack chosen quants by ggml's block layouts and check that
+// Dequantize gives back d*q+m for each. Scales are exact in half precision.
+
+const (
+	half      = 0x3800 // 0.5 as float16
+	quarter   = 0x3400 // 0.25
+	minus1_25 = 0xbd00 // -1.25
+)
+
+// quants is n values in [lo, hi], every one of them at least once if n allows.
+func quants(r *rand.Rand, n, lo, hi int) []int {
+	q := make([]int, n)
+	for i := range q {
+		if i <= hi-lo {
+			q[i] = lo + i
+		} else {
+			q[i] = lo + r.Intn(hi-lo+1)
+		}
+	}
+	r.Shuffle(n, func(i, j int) { q[i], q[j] = q[j], q[i] })
+	return q
+}
+
+// pack32 packs 32 quants of 4 bits with element j in the low nibble of byte
+// j and element j+16 in the high one, and their fifth bits into qh.
+func pack32(q []int, qs []byte) (qh uint32) {
+	for j := 0; j < 16; j++ {
+		qs[j] = byte(q[j]&0xf) | byte(q[j+16]&0xf)<<4
+		qh |= uint32(q[j]>>4&1)<<j | uint32(q[j+16]>>4&1)<<(j+16)
+	}
+	return qh
+}
+
+// packScalesK4 packs eight 6-bit scales and mins as Q4_K and Q5_K do: the
+// first four plainly, the top two bits of the rest above them, and the rest's
+// low four bits in the last four bytes.
+func packScalesK4(sc, m []int) []byte {
+	b := make([]byte, 12)
+	for j := 0; j < 4; j++ {
+		b[j] = byte(sc[j]) | byte(sc[j+4]>>4)<<6
+		b[j+4] = byte(m[j]) | byte(m[j+4]>>4)<<6
+		b[j+8] = byte(sc[j+4]&0xf) | byte(m[j+4]&0xf)<<4
+	}
+	return b
+}
+
+func TestDequantize(t *testing.T) {
+	le := binary.LittleEndian
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		typ  uint32
+		pack func() ([]byte, []float32) // blocks and the values they hold
+	}{
+		{TypeQ4_0, func() ([]byte, []float32) {
+			q := quants(r, 32, 0, 15)
+			b := make([]byte, 18)
+			le.PutUint16(b, half)
+			pack32(q, b[2:])
+			want := make([]float32, 32)
+			for i := range want {
+				want[i] = float32(q[i]-8) * 0.5
+			}
+			return b, want
+		}},
+		{TypeQ4_1, func() ([]byte, []float32) {
+			q := quants(r, 32, 0, 15)
+			b := make([]byte, 20)
+			le.PutUint16(b, half)
+			le.PutUint16(b[2:], minus1_25)
+			pack32(q, b[4:])
+			want := make([]float32, 32)
+			for i := range want {
+				want[i] = float32(q[i])*0.5 - 1.25
+			}
+			return b, want
+		}},
+		{TypeQ5_0, func() ([]byte, []float32) {
+			q := quants(r, 32, 0, 31)
+			b := make([]byte, 22)
+			le.PutUint16(b, half)
+			le.PutUint32(b[2:], pack32(q, b[6:]))
+			want := make([]float32, 32)
+			for i := range want {
+				want[i] = float32(q[i]-16) * 0.5
+			}
+			return b, want
+		}},
+		{TypeQ5_1, func() ([]byte, []float32) {
+			q := quants(r, 32, 0, 31)
+			b := make([]byte, 24)
+			le.PutUint16(b, half)
+			le.PutUint16(b[2:], minus1_25)
+			le.PutUint32(b[4:], pack32(q, b[8:]))
+			want := make([]float32, 32)
+			for i := range want {
+				want[i] = float32(q[i])*0.5 - 1.25
+			}
+			return b, want
+		}},
+		{TypeQ8_0, func() ([]byte, []float32) {
+			q := quants(r, 32, -128, 127)
+			b := make([]byte, 34)
+			le.PutUint16(b, quarter)
+			want := make([]float32, 32)
+			for i := range want {
+				b[2+i] = byte(int8(q[i]))
+				want[i] = float32(q[i]) * 0.25
+			}
+			return b, want
+		}},
+		{TypeQ4_K, func() ([]byte, []float32) {
+			q, sc, m := quants(r, 256, 0, 15), quants(r, 8, 0, 63), quants(r, 8, 0, 63)
+			b := make([]byte, 144)
+			le.PutUint16(b, half)
+			le.PutUint16(b[2:], quarter)
+			copy(b[4:], packScalesK4(sc, m))
+			// Each 32 bytes hold two sub-blocks: the first in the low nibbles.
+			for c := 0; c < 4; c++ {
+				for l := 0; l < 32; l++ {
+					b[16+32*c+l] = byte(q[64*c+l]) | byte(q[64*c+32+l])<<4
+				}
+			}
+			want := make([]float32, 256)
+			for i := range want {
+				want[i] = 0.5*float32(sc[i/32])*float32(q[i]) - 0.25*float32(m[i/32])
+			}
+			return b, want
+		}},
+		{TypeQ5_K, func() ([]byte, []float32) {
+			q, sc, m := quants(r, 256, 0, 31), quants(r, 8, 0, 63), quants(r, 8, 0, 63)
+			b := make([]byte, 176)
+			le.PutUint16(b, half)
+			le.PutUint16(b[2:], quarter)
+			copy(b[4:], packScalesK4(sc, m))
+			// As Q4_K, with sub-block s's fifth bits in bit s of qh.
+			for c := 0; c < 4; c++ {
+				for l := 0; l < 32; l++ {
+					lo, hi := q[64*c+l], q[64*c+32+l]
+					b[48+32*c+l] = byte(lo&0xf) | byte(hi&0xf)<<4
+					b[16+l] |= byte(lo>>4)<<(2*c) | byte(hi>>4)<<(2*c+1)
+				}
+			}
+			want := make([]float32, 256)
+			for i := range want {
+				want[i] = 0.5*float32(sc[i/32])*float32(q[i]) - 0.25*float32(m[i/32])
+			}
+			return b, want
+		}},
+		{TypeQ6_K, func() ([]byte, []float32) {
+			q, sc := quants(r, 256, 0, 63), quants(r, 16, -128, 127)
+			b := make([]byte, 210)
+			ql, qh, scales := b[:128], b[128:192], b[192:208]
+			// Each half of 128 has 64 bytes of low nibbles and 32 of high bit
+			// pairs; four elements 32 apart share a position in them.
+			for h := 0; h < 2; h++ {
+				for l := 0; l < 32; l++ {
+					e := 128*h + l
+					ql[64*h+l] = byte(q[e]&0xf) | byte(q[e+64]&0xf)<<4
+					ql[64*h+l+32] = byte(q[e+32]&0xf) | byte(q[e+96]&0xf)<<4
+					qh[32*h+l] = byte(q[e]>>4) | byte(q[e+32]>>4)<<2 | byte(q[e+64]>>4)<<4 | byte(q[e+96]>>4)<<6
+				}
+			}
+			for s := range sc {
+				scales[s] = byte(int8(sc[s]))
+			}
+			le.PutUint16(b[208:], quarter)
+			want := make([]float32, 256)
+			for i := range want {
+				want[i] = 0.25 * float32(sc[i/16]) * float32(q[i]-32)
+			}
+			return b, want
+		}},
+	}
+	for _, tt := range tests {
+		// Two blocks, to catch a wrong stride between them.
+		b0, w0 := tt.pack()
+		b1, w1 := tt.pack()
+		want := append(w0, w1...)
+		if elems, size := BlockSize(tt.typ); elems != len(w0) || size != len(b0) {
+			t.Fatalf("%s: BlockSize %d, %d; packed %d elements in %d bytes", TypeName(tt.typ), elems, size, len(w0), len(b0))
+		}
+		got := make([]float32, len(want))
+		Dequantize(tt.typ, append(b0, b1...), got)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: element %d is %g, want %g", TypeName(tt.typ), i, got[i], want[i])
+				break
+			}
+		}
+	}
+}
+
+func TestDequantizeFloats(t *testing.T) {
+	want := []float32{1, -2, 0.5, 65504, float32(math.Inf(1)), 0, 1.0 / (1 << 24)}
+	f16 := []uint16{0x3c00, 0xc000, 0x3800, 0x7bff, 0x7c00, 0x8000, 0x0001}
+	raw := make([]byte, 2*len(f16))
+	for i, h := range f16 {
+		binary.LittleEndian.PutUint16(raw[2*i:], h)
+	}
+	got := make([]float32, len(want))
+	Dequantize(TypeF16, raw, got)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("f16 %#04x: %g, want %g", f16[i], got[i], want[i])
+		}
+	}
+	bf16 := []uint16{0x3f80, 0xc000, 0x3f00, 0x477f, 0x7f80, 0x8000, 0x3380}
+	want[3], want[6] = 65280, 1.0/(1<<24)
+	for i, h := range bf16 {
+		binary.LittleEndian.PutUint16(raw[2*i:], h)
+	}
+	Dequantize(TypeBF16, raw, got)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("bf16 %#04x: %g, want %g", bf16[i], got[i], want[i])
+		}
+	}
+	raw = make([]byte, 4*len(want))
+	for i, v := range want {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(v))
+	}
+	Dequantize(TypeF32, raw, got)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("f32: %g, want %g", got[i], want[i])
+		}
+	}
+}
+
+// TestQuantize round-trips random blocks through the two quantizers, which
+// must land within half a step of every value.
+func TestQuantize(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	x := make([]float32, 4*32)
+	for i := range x {
+		x[i] = float32(r.NormFloat64())
+	}
+	for _, typ := range []uint32{TypeQ8_0, TypeQ4_0} {
+		_, size := BlockSize(typ)
+		raw := make([]byte, len(x)/32*size)
+		if !Quantize(typ, x, raw) {
+			t.Fatalf("%s: not quantized", TypeName(typ))
+		}
+		got := make([]float32, len(x))
+		Dequantize(typ, raw, got)
+		for b := 0; b < len(x)/32; b++ {
+			d := float32(math.Abs(float64(Float16(binary.LittleEndian.Uint16(raw[b*size:])))))
+			for j := b * 32; j < b*32+32; j++ {
+				// Half a step, plus the scale's rounding to half precision.
+				if diff := math.Abs(float64(got[j] - x[j])); diff > float64(d)*0.5+1e-3*math.Abs(float64(x[j])) {
+					t.Errorf("%s: element %d is %g, was %g (step %g)", TypeName(typ), j, got[j], x[j], d)
+				}
+			}
+		}
+	}
+	if Quantize(TypeQ4_K, x, make([]byte, 144)) {
+		t.Error("quantized to q4_k, which Quantize does not support")
+	}
+}
@@ -0,0 +1,423 @@
+// Package grammar constrains generation to a context-free grammar written in
+// llama.cpp's GBNF notation. JSON Schemas compile to the same rules.
+package grammar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type elemKind uint8
+
+const (
+	elemChar elemKind = iota // one code point inside ranges, or outside them if negated
+	elemRef                  // another rule
+)
+
+type runeRange struct{ lo, hi rune }
+
+type element struct {
+	kind   elemKind
+	ranges []runeRange
+	negate bool
+	rule   int
+}
+
+func (e *element) matches(r rune) bool {
+	in := false
+	for _, rg := range e.ranges {
+		if r >= rg.lo && r <= rg.hi {
+			in = true
+			break
+		}
+	}
+	return in != e.negate
+}
+
+func ref(rule int) element { return element{kind: elemRef, rule: rule} }
+
+// Grammar is a parsed rule set. Each rule is a list of alternatives and each
+// alternative a sequence of elements; an empty alternative matches nothing.
+// Repetitions and groups become rules of their own.
+type Grammar struct {
+	names []string
+	rules [][][]element
+	root  int
+}
+
+type parseError struct{ msg string }
+
+type parser struct {
+	src     string
+	pos     int
+	g       *Grammar
+	ids     map[string]int
+	defined []bool
+}
+
+// Parse reads a GBNF grammar. It must define root, and no rule may be left recursive.
+func Parse(src string) (g *Grammar, err error) {
+	p := &parser{src: src, g: &Grammar{}, ids: make(map[string]int)}
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			g, err = nil, fmt.Errorf("grammar: %s", pe.msg)
+		}
+	}()
+	p.space(true)
+	for p.pos < len(p.src) {
+		p.rule()
+	}
+	root, ok := p.ids["root"]
+	if !ok {
+		return nil, fmt.Errorf("grammar: no root rule")
+	}
+	for id, ok := range p.defined {
+		if !ok {
+			return nil, fmt.Errorf("grammar: undefined rule %q", p.g.names[id])
+		}
+	}
+	p.g.root = root
+	if err := p.g.checkLeftRecursion(); err != nil {
+		return nil, err
+	}
+	return p.g, nil
+}
+
+func (p *parser) errorf(format string, args ...any) {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	panic(parseError{fmt.Sprintf("line %d: ", line) + fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// space skips blanks and comments, and newlines too if newlineOK.
+func (p *parser) space(newlineOK bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case (c == '\n' || c == '\r') && newlineOK:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) && isWordChar(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// symbol returns the ID of a named rule, creating it on first mention.
+func (p *parser) symbol(name string) int {
+	if id, ok := p.ids[name]; ok {
+		return id
+	}
+	id := len(p.g.names)
+	p.ids[name] = id
+	p.g.names = append(p.g.names, name)
+	p.g.rules = append(p.g.rules, nil)
+	p.defined = append(p.defined, false)
+	return id
+}
+
+// newRule makes an anonymous rule for a group or repetition inside base.
+func (p *parser) newRule(base string) int {
+	id := p.symbol(fmt.Sprintf("%s_%d", base, len(p.g.names)))
+	p.defined[id] = true
+	return id
+}
+
+func (p *parser) rule() {
+	name := p.name()
+	if name == "" {
+		p.errorf("expected rule name, got %q", p.peek())
+	}
+	p.space(false)
+	if !strings.HasPrefix(p.src[p.pos:], "::=") {
+		p.errorf("expected ::= after %s", name)
+	}
+	p.pos += 3
+	p.space(true)
+	id := p.symbol(name)
+	if p.defined[id] {
+		p.errorf("rule %s defined twice", name)
+	}
+	p.defined[id] = true
+	p.g.rules[id] = p.alternates(name, false)
+	if c := p.peek(); c != 0 && c != '\n' && c != '\r' {
+		p.errorf("unexpected %q in rule %s", c, name)
+	}
+	p.space(true)
+}
+
+func (p *parser) alternates(name string, nested bool) [][]element {
+	var alts [][]element
+	for {
+		alts = append(alts, p.sequence(name, nested))
+		if p.peek() != '|' {
+			return alts
+		}
+		p.pos++
+		p.space(true)
+	}
+}
+
+// sequence reads items up to the end of an alternative. Outside parentheses a
+// newline ends it.
+func (p *parser) sequence(name string, nested bool) []element {
+	var seq []element
+	last := -1 // where the last item starts, for a repetition suffix
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			last = len(seq)
+			for p.peek() != '"' {
+				if p.pos >= len(p.src) {
+					p.errorf("unterminated literal")
+				}
+				r := p.char()
+				seq = append(seq, element{kind: elemChar, ranges: []runeRange{{r, r}}})
+			}
+			p.pos++
+		case c == '[':
+			p.pos++
+			e := element{kind: elemChar}
+			if p.peek() == '^' {
+				e.negate = true
+				p.pos++
+			}
+			for p.peek() != ']' {
+				if p.pos >= len(p.src) {
+					p.errorf("unterminated character class")
+				}
+				lo := p.char()
+				hi := lo
+				if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+					p.pos++
+					hi = p.char()
+				}
+				e.ranges = append(e.ranges, runeRange{lo, hi})
+			}
+			p.pos++
+			last = len(seq)
+			seq = append(seq, e)
+		case c == '.':
+			p.pos++
+			last = len(seq)
+			seq = append(seq, element{kind: elemChar, negate: true})
+		case isWordChar(c):
+			last = len(seq)
+			seq = append(seq, ref(p.symbol(p.name())))
+		case c == '(':
+			p.pos++
+			p.space(true)
+			id := p.newRule(name)
+			p.g.rules[id] = p.alternates(name, true)
+			if p.peek() != ')' {
+				p.errorf("expected )")
+			}
+			p.pos++
+			last = len(seq)
+			seq = append(seq, ref(id))
+		case c == '*' || c == '+' || c == '?' || c == '{':
+			if last < 0 {
+				p.errorf("%q without an item to repeat", c)
+			}
+			min, max := p.repetition()
+			seq = append(seq[:last], p.repeat(name, append([]element{}, seq[last:]...), min, max)...)
+			last = -1
+		default:
+			return seq
+		}
+		p.space(nested)
+	}
+	return seq
+}
+
+// repetition reads *, +, ? or {m}, {m,}, {m,n}. max < 0 means unbounded.
+func (p *parser) repetition() (min, max int) {
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case '*':
+		return 0, -1
+	case '+':
+		return 1, -1
+	case '?':
+		return 0, 1
+	}
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		p.errorf("unterminated {")
+	}
+	body := strings.ReplaceAll(p.src[p.pos:p.pos+end], " ", "")
+	p.pos += end + 1
+	lo, hi, comma := strings.Cut(body, ",")
+	var err error
+	if min, err = strconv.Atoi(lo); err != nil {
+		p.errorf("bad repetition {%s}", body)
+	}
+	switch {
+	case !comma:
+		max = min
+	case hi == "":
+		max = -1
+	default:
+		if max, err = strconv.Atoi(hi); err != nil || max < min {
+			p.errorf("bad repetition {%s}", body)
+		}
+	}
+	return min, max
+}
+
+// repeat expands item{min,max} into min copies followed by optional ones,
+// each optional copy nested inside the previous so they can only stop once.
+func (p *parser) repeat(name string, item []element, min, max int) []element {
+	var out []element
+	for i := 0; i < min; i++ {
+		out = append(out, item...)
+	}
+	if max < 0 {
+		// R ::= item R | ε
+		id := p.newRule(name)
+		p.g.rules[id] = [][]element{append(append([]element{}, item...), ref(id)), nil}
+		return append(out, ref(id))
+	}
+	var tail []element
+	for i := min; i < max; i++ {
+		id := p.newRule(name)
+		p.g.rules[id] = [][]element{append(append([]element{}, item...), tail...), nil}
+		tail = []element{ref(id)}
+	}
+	return append(out, tail...)
+}
+
+// char reads one code point of a literal or class, resolving escapes.
+func (p *parser) char() rune {
+	if p.src[p.pos] != '\\' {
+		r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += n
+		return r
+	}
+	p.pos++
+	if p.pos >= len(p.src) {
+		p.errorf("dangling escape")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'x', 'u', 'U':
+		n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+		if p.pos+n > len(p.src) {
+			p.errorf("short \\%c escape", c)
+		}
+		v, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil {
+			p.errorf("bad \\%c escape", c)
+		}
+		p.pos += n
+		return rune(v)
+	case '\\', '"', '[', ']', '-', '^', '/':
+		return rune(c)
+	}
+	p.errorf("unknown escape \\%c", c)
+	return 0
+}
+
+// checkLeftRecursion rejects rules that can reach themselves without
+// consuming input; the matcher would expand them forever.
+func (g *Grammar) checkLeftRecursion() error {
+	nullable := make([]bool, len(g.rules))
+	for changed := true; changed; {
+		changed = false
+		for id, alts := range g.rules {
+			if nullable[id] {
+				continue
+			}
+			for _, alt := range alts {
+				if g.seqNullable(alt, nullable) {
+					nullable[id], changed = true, true
+					break
+				}
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.rules))
+	var visit func(id int) error
+	visit = func(id int) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("grammar: rule %q is left recursive", g.names[id])
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, alt := range g.rules[id] {
+			for _, e := range alt {
+				if e.kind != elemRef {
+					break
+				}
+				if err := visit(e.rule); err != nil {
+					return err
+				}
+				if !nullable[e.rule] {
+					break
+				}
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for id := range g.rules {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Grammar) seqNullable(seq []element, nullable []bool) bool {
+	for _, e := range seq {
+		if e.kind == elemChar || !nullable[e.rule] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+// matches reports whether g matches all of s.
+func matches(g *Grammar, s string) bool {
+	m := g.Matcher()
+	return m.Feed(s) && m.Complete()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name, src      string
+		accept, reject []string
+	}{
+		{"literal", `root ::= "hi"`, []string{"hi"}, []string{"", "h", "hi!", "Hi"}},
+		{"alternatives", `root ::= "a" | "bc" | ""`, []string{"a", "bc", ""}, []string{"b", "abc"}},
+		{"rules", "root ::= greet \" \" who\ngreet ::= \"hi\" | \"yo\"\nwho ::= [a-z]+", []string{"hi bob", "yo x"}, []string{"hi", "hi Bob", "hey bob"}},
+		{"class", `root ::= [a-cx0-9_]`, []string{"a", "c", "x", "5", "_"}, []string{"d", "A", "ab"}},
+		{"negated class", `root ::= [^a-z]`, []string{"A", "é", "\n"}, []string{"q", ""}},
+		{"any char", `root ::= . "!"`, []string{"a!", "日!"}, []string{"!", "ab!"}},
+		{"star", `root ::= "a"*`, []string{"", "a", "aaaa"}, []string{"b"}},
+		{"plus", `root ::= "a"+ "b"`, []string{"ab", "aaab"}, []string{"b", "aa"}},
+		{"optional", `root ::= "a"? "b"`, []string{"b", "ab"}, []string{"aab"}},
+		{"bounded", `root ::= [0-9]{2,3}`, []string{"12", "123"}, []string{"1", "1234"}},
+		{"exact", `root ::= "x"{3}`, []string{"xxx"}, []string{"xx", "xxxx"}},
+		{"open bound", `root ::= "x"{2,}`, []string{"xx", "xxxxx"}, []string{"x"}},
+		{"groups", `root ::= ("a" | "b") ("c" "d")*`, []string{"a", "bcd", "acdcd"}, []string{"ac", "c"}},
+		{"escapes", `root ::= "\"\\\n\t" [\x41-\x42] "é" "\U0001F600"`, []string{"\"\\\n\tAé😀", "\"\\\n\tBé😀"}, []string{"\"\\\n\tCé😀"}},
+		{"comments and newlines", "# a comment\nroot ::= (\"a\" # trailing\n  \"b\")\n\nx ::= \"x\"", []string{"ab"}, []string{"a", "x"}},
+		{"recursion", "root ::= \"(\" root \")\" | \"\"", []string{"", "()", "((()))"}, []string{"(()", ")("}},
+		{"utf-8 literal", `root ::= "héllo"`, []string{"héllo"}, []string{"hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := Parse(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.accept {
+				if !matches(g, s) {
+					t.Errorf("rejected %q", s)
+				}
+			}
+			for _, s := range tt.reject {
+				if matches(g, s) {
+					t.Errorf("accepted %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct{ src, err string }{
+		{``, "no root rule"},
+		{`foo ::= "a"`, "no root rule"},
+		{`root ::= foo`, `undefined rule "foo"`},
+		{"root ::= \"a\"\nroot ::= \"b\"", "line 2: rule root defined twice"},
+		{`root "a"`, "expected ::= after root"},
+		{`::= "a"`, "expected rule name"},
+		{"root ::= \"a\"\n  \"b\"", "line 2: expected rule name"}, // a newline outside parentheses ends the rule
+		{`root ::= "a`, "unterminated literal"},
+		{`root ::= [a-z`, "unterminated character class"},
+		{`root ::= ("a"`, "expected )"},
+		{`root ::= *`, `'*' without an item to repeat`},
+		{`root ::= "a"{2`, "unterminated {"},
+		{`root ::= "a"{x}`, "bad repetition {x}"},
+		{`root ::= "a"{3,1}`, "bad repetition {3,1}"},
+		{`root ::= "\q"`, `unknown escape \q`},
+		{`root ::= "\x4`, `short \x escape`},
+		{`root ::= "\xZZ"`, `bad \x escape`},
+		{`root ::= "a" )`, "unexpected ')' in rule root"},
+		{"root ::= root \"a\" | \"b\"", `rule "root" is left recursive`},
+		{"root ::= a\na ::= \"x\"? root", `is left recursive`},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.src)
+		if err == nil {
+			t.Errorf("%q: parsed", tt.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %q, want it to mention %q", tt.src, err, tt.err)
+		}
+	}
+}
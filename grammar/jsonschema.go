@@ -0,0 +1,388 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// primitives are the GBNF rules JSON Schema types compile to, with the rules
+// each depends on. Whitespace between tokens is bounded so a model cannot pad
+// forever.
+var primitives = map[string]struct {
+	body string
+	deps []string
+}{
+	"space":   {`| " " | "\n" [ \t]{0,20}`, nil},
+	"boolean": {`("true" | "false") space`, []string{"space"}},
+	"null":    {`"null" space`, []string{"space"}},
+	"integer": {`"-"? ([0-9] | [1-9] [0-9]{0,15}) space`, []string{"space"}},
+	"number":  {`"-"? ([0-9] | [1-9] [0-9]{0,15}) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space`, []string{"space"}},
+	"char":    {`[^"\\\x7F\x00-\x1F] | [\\] (["\\/bfnrt] | "u" [0-9a-fA-F]{4})`, nil},
+	"string":  {`"\"" char* "\"" space`, []string{"char", "space"}},
+	"value":   {`object | array | string | number | boolean | null`, []string{"object", "array", "string", "number", "boolean", "null"}},
+	"object":  {`"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`, []string{"string", "value", "space"}},
+	"array":   {`"[" space ( value ("," space value)* )? "]" space`, []string{"value", "space"}},
+}
+
+type schema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Properties           json.RawMessage            `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Enum                 []json.RawMessage          `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	AnyOf                []json.RawMessage          `json:"anyOf"`
+	OneOf                []json.RawMessage          `json:"oneOf"`
+	Ref                  string                     `json:"$ref"`
+	Defs                 map[string]json.RawMessage `json:"$defs"`
+	Definitions          map[string]json.RawMessage `json:"definitions"`
+}
+
+type schemaConv struct {
+	rules map[string]string
+	defs  map[string]json.RawMessage
+}
+
+// FromJSONSchema compiles a JSON Schema into a grammar for the JSON documents
+// it describes. Supported: type (including unions), properties and required,
+// items with minItems/maxItems, string minLength/maxLength, enum, const,
+// anyOf, oneOf and local $ref. Properties come out in schema order; keywords
+// it does not understand are ignored.
+func FromJSONSchema(src []byte) (*Grammar, error) {
+	gbnf, err := JSONSchemaGBNF(src)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(gbnf)
+}
+
+// JSONSchemaGBNF is FromJSONSchema's intermediate step: the schema as GBNF text.
+func JSONSchemaGBNF(src []byte) (string, error) {
+	var top schema
+	if err := json.Unmarshal(src, &top); err != nil {
+		return "", fmt.Errorf("json schema: %w", err)
+	}
+	c := &schemaConv{rules: make(map[string]string), defs: make(map[string]json.RawMessage)}
+	for k, v := range top.Definitions {
+		c.defs["#/definitions/"+k] = v
+	}
+	for k, v := range top.Defs {
+		c.defs["#/$defs/"+k] = v
+	}
+	body, err := c.visit(src, "root")
+	if err != nil {
+		return "", err
+	}
+	c.rules["root"] = body
+	names := make([]string, 0, len(c.rules))
+	for n := range c.rules {
+		if n != "root" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, n := range append([]string{"root"}, names...) {
+		fmt.Fprintf(&sb, "%s ::= %s\n", n, c.rules[n])
+	}
+	return sb.String(), nil
+}
+
+// use adds a primitive rule and what it depends on, and returns its name.
+func (c *schemaConv) use(name string) string {
+	if _, ok := c.rules[name]; ok {
+		return name
+	}
+	p := primitives[name]
+	c.rules[name] = p.body
+	for _, d := range p.deps {
+		c.use(d)
+	}
+	return name
+}
+
+// rule adds name ::= body and returns name.
+func (c *schemaConv) rule(name, body string) string {
+	c.rules[name] = body
+	return name
+}
+
+// visit returns a GBNF expression matching documents valid against raw.
+// name is a prefix for the rules it creates.
+func (c *schemaConv) visit(raw json.RawMessage, name string) (string, error) {
+	if t := bytes.TrimSpace(raw); bytes.Equal(t, []byte("true")) || bytes.Equal(t, []byte("{}")) {
+		return c.use("value"), nil
+	}
+	var s schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("json schema at %s: %w", name, err)
+	}
+	switch {
+	case s.Ref != "":
+		def, ok := c.defs[s.Ref]
+		if !ok {
+			return "", fmt.Errorf("json schema: unresolved $ref %q", s.Ref)
+		}
+		rn := "ref-" + ruleName(s.Ref[strings.LastIndexByte(s.Ref, '/')+1:])
+		if _, ok := c.rules[rn]; !ok {
+			c.rules[rn] = "" // placeholder so recursive schemas terminate
+			body, err := c.visit(def, rn)
+			if err != nil {
+				return "", err
+			}
+			c.rules[rn] = body
+		}
+		return rn, nil
+	case s.Const != nil:
+		return literal(s.Const) + " " + c.use("space"), nil
+	case s.Enum != nil:
+		alts := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			alts[i] = literal(v)
+		}
+		return "(" + strings.Join(alts, " | ") + ") " + c.use("space"), nil
+	case s.AnyOf != nil || s.OneOf != nil:
+		return c.alternatives(append(s.AnyOf, s.OneOf...), name)
+	}
+
+	var types []string
+	if len(s.Type) > 0 && s.Type[0] == '[' {
+		if err := json.Unmarshal(s.Type, &types); err != nil {
+			return "", fmt.Errorf("json schema at %s: %w", name, err)
+		}
+	} else if len(s.Type) > 0 {
+		var t string
+		if err := json.Unmarshal(s.Type, &t); err != nil {
+			return "", fmt.Errorf("json schema at %s: %w", name, err)
+		}
+		types = []string{t}
+	}
+	switch {
+	case len(types) == 0:
+		if s.Properties != nil {
+			return c.object(&s, name)
+		}
+		return c.use("value"), nil
+	case len(types) > 1:
+		var alts []json.RawMessage
+		for _, t := range types {
+			sub, _ := json.Marshal(t)
+			alts = append(alts, withType(raw, sub))
+		}
+		return c.alternatives(alts, name)
+	}
+	switch types[0] {
+	case "object":
+		return c.object(&s, name)
+	case "array":
+		return c.array(&s, name)
+	case "string":
+		if s.MinLength == nil && s.MaxLength == nil {
+			return c.use("string"), nil
+		}
+		return `"\"" ` + c.use("char") + repeatSuffix(s.MinLength, s.MaxLength) + ` "\"" ` + c.use("space"), nil
+	case "number", "integer", "boolean", "null":
+		return c.use(types[0]), nil
+	}
+	return "", fmt.Errorf("json schema at %s: unsupported type %q", name, types[0])
+}
+
+func (c *schemaConv) alternatives(subs []json.RawMessage, name string) (string, error) {
+	alts := make([]string, len(subs))
+	for i, sub := range subs {
+		body, err := c.visit(sub, fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			return "", err
+		}
+		alts[i] = c.rule(fmt.Sprintf("%s-%d", name, i), body)
+	}
+	return "(" + strings.Join(alts, " | ") + ")", nil
+}
+
+// object lists required properties in schema order, each followed by the
+// optional ones after it. Only declared properties are produced.
+func (c *schemaConv) object(s *schema, name string) (string, error) {
+	keys, err := orderedKeys(s.Properties)
+	if err != nil {
+		return "", fmt.Errorf("json schema at %s: %w", name, err)
+	}
+	if len(keys) == 0 {
+		if bytes.Equal(bytes.TrimSpace(s.AdditionalProperties), []byte("false")) {
+			return `"{" ` + c.use("space") + ` "}" ` + c.use("space"), nil
+		}
+		return c.use("object"), nil
+	}
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(s.Properties, &props); err != nil {
+		return "", fmt.Errorf("json schema at %s: %w", name, err)
+	}
+	required := make(map[string]bool, len(s.Required))
+	for _, r := range s.Required {
+		required[r] = true
+	}
+	kv := make([]string, len(keys))
+	for i, k := range keys {
+		pn := name + "-" + ruleName(k)
+		body, err := c.visit(props[k], pn)
+		if err != nil {
+			return "", err
+		}
+		key, _ := json.Marshal(k)
+		kv[i] = c.rule(pn+"-kv", literal(key)+" "+c.use("space")+` ":" `+c.use("space")+" "+c.rule(pn, body))
+	}
+	// tail(i) is the rest of the object after property i has been written.
+	tail := func(i int) string {
+		var parts []string
+		for j := i + 1; j < len(keys); j++ {
+			if required[keys[j]] {
+				parts = append(parts, `"," `+c.use("space")+" "+kv[j])
+			} else {
+				parts = append(parts, `("," `+c.use("space")+" "+kv[j]+")?")
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+	var body string
+	first := -1
+	for i, k := range keys {
+		if required[k] {
+			first = i
+			break
+		}
+	}
+	if first == 0 {
+		body = kv[0] + " " + tail(0)
+	} else {
+		// Any optional property before the first required one may open the object.
+		var alts []string
+		end := first
+		if end < 0 {
+			end = len(keys)
+		}
+		for i := 0; i < end; i++ {
+			alts = append(alts, kv[i]+" "+tail(i))
+		}
+		if first > 0 {
+			alts = append(alts, kv[first]+" "+tail(first))
+			body = "(" + strings.Join(alts, " | ") + ")"
+		} else {
+			body = "(" + strings.Join(alts, " | ") + ")?"
+		}
+	}
+	return `"{" ` + c.use("space") + " " + body + ` "}" ` + c.use("space"), nil
+}
+
+func (c *schemaConv) array(s *schema, name string) (string, error) {
+	var item string
+	if s.Items == nil {
+		item = c.use("value")
+	} else {
+		body, err := c.visit(s.Items, name+"-item")
+		if err != nil {
+			return "", err
+		}
+		item = c.rule(name+"-item", body)
+	}
+	min := 0
+	if s.MinItems != nil {
+		min = *s.MinItems
+	}
+	open, close := `"[" `+c.use("space"), ` "]" `+c.use("space")
+	if s.MaxItems != nil && *s.MaxItems == 0 {
+		return open + close, nil
+	}
+	var restMin, restMax *int
+	if min > 1 {
+		m := min - 1
+		restMin = &m
+	}
+	if s.MaxItems != nil {
+		m := *s.MaxItems - 1
+		restMax = &m
+	}
+	rest := c.rule(name+"-more", `"," `+c.use("space")+" "+item)
+	items := item + " " + rest + repeatSuffix(restMin, restMax)
+	if min == 0 {
+		items = "(" + items + ")?"
+	}
+	return open + " " + items + close, nil
+}
+
+// repeatSuffix is the GBNF repetition for between min and max copies; nil is unbounded.
+func repeatSuffix(min, max *int) string {
+	lo := 0
+	if min != nil {
+		lo = *min
+	}
+	if max == nil {
+		if lo == 0 {
+			return "*"
+		}
+		return fmt.Sprintf("{%d,}", lo)
+	}
+	return fmt.Sprintf("{%d,%d}", lo, *max)
+}
+
+// literal quotes a JSON value's compact encoding as a GBNF string literal.
+func literal(v json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, v); err != nil {
+		buf.Reset()
+		buf.Write(v)
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(buf.String()) + `"`
+}
+
+func ruleName(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if isWordChar(s[i]) && s[i] != '_' {
+			sb.WriteByte(s[i])
+		} else {
+			sb.WriteByte('-')
+		}
+	}
+	return sb.String()
+}
+
+// withType returns schema raw with its type replaced by t.
+func withType(raw, t json.RawMessage) json.RawMessage {
+	var m map[string]json.RawMessage
+	json.Unmarshal(raw, &m)
+	m["type"] = t
+	out, _ := json.Marshal(m)
+	return out
+}
+
+// orderedKeys returns the keys of a JSON object in document order.
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("properties must be an object")
+	}
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
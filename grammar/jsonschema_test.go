@@ -0,0 +1,105 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONSchemaGBNF(t *testing.T) {
+	tests := []struct{ name, schema, gbnf string }{
+		{"enum", `{"enum": ["red", "green", 3]}`, `
+root ::= ("\"red\"" | "\"green\"" | "3") space
+space ::= | " " | "\n" [ \t]{0,20}
+`},
+		{"array", `{"type": "array", "items": {"type": "number"}, "minItems": 1, "maxItems": 3}`, `
+root ::= "[" space root-item root-more{0,2} "]" space
+number ::= "-"? ([0-9] | [1-9] [0-9]{0,15}) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space
+root-item ::= number
+root-more ::= "," space root-item
+space ::= | " " | "\n" [ \t]{0,20}
+`},
+		{"object", `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "required": ["name"]}`, `
+root ::= "{" space root-name-kv ("," space root-age-kv)? "}" space
+char ::= [^"\\\x7F\x00-\x1F] | [\\] (["\\/bfnrt] | "u" [0-9a-fA-F]{4})
+integer ::= "-"? ([0-9] | [1-9] [0-9]{0,15}) space
+root-age ::= integer
+root-age-kv ::= "\"age\"" space ":" space root-age
+root-name ::= string
+root-name-kv ::= "\"name\"" space ":" space root-name
+space ::= | " " | "\n" [ \t]{0,20}
+string ::= "\"" char* "\"" space
+`},
+	}
+	for _, tt := range tests {
+		got, err := JSONSchemaGBNF([]byte(tt.schema))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := strings.TrimPrefix(tt.gbnf, "\n"); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func TestFromJSONSchema(t *testing.T) {
+	tests := []struct {
+		name, schema   string
+		accept, reject []string
+	}{
+		{"required and optional",
+			`{"type": "object", "properties": {"id": {"type": "integer"}, "tag": {"type": "string"}, "ok": {"type": "boolean"}}, "required": ["id", "ok"]}`,
+			[]string{`{"id": 1, "ok": true}`, `{"id": -20, "tag": "x", "ok": false}`, "{\n  \"id\": 0,\"ok\":true}"},
+			[]string{`{"ok": true}`, `{"id": 1}`, `{"id": 1, "ok": true, "tag": "x"}`, `{"id": 01, "ok": true}`, `{"id": 1, "ok": true, "x": 1}`}},
+		{"all optional",
+			`{"type": "object", "properties": {"a": {"type": "boolean"}, "b": {"type": "null"}}}`,
+			[]string{`{}`, `{"a": true}`, `{"b": null}`, `{"a": false, "b": null}`},
+			[]string{`{"b": null, "a": true}`, `{"a": null}`, `{,}`}},
+		{"nested array of enums",
+			`{"type": "object", "properties": {"colors": {"type": "array", "items": {"enum": ["red", "blue"]}, "maxItems": 2}}, "required": ["colors"]}`,
+			[]string{`{"colors": []}`, `{"colors": ["red"]}`, `{"colors": ["blue", "red"]}`},
+			[]string{`{"colors": ["green"]}`, `{"colors": ["red", "red", "red"]}`, `{"colors": "red"}`}},
+		{"string length", `{"type": "string", "minLength": 2, "maxLength": 3}`,
+			[]string{`"ab"`, `"a\"c"`, `"日本"`}, []string{`"a"`, `"abcd"`, `ab`}},
+		{"const and anyOf", `{"anyOf": [{"const": {"k": 1}}, {"type": "null"}]}`,
+			[]string{`{"k":1}`, `null`}, []string{`{"k": 1}`, `1`}},
+		{"type union", `{"type": ["integer", "null"]}`, []string{`7`, `null`}, []string{`"7"`, `true`}},
+		{"recursive $ref",
+			`{"$defs": {"node": {"type": "object", "properties": {"next": {"$ref": "#/$defs/node"}}}}, "$ref": "#/$defs/node"}`,
+			[]string{`{}`, `{"next": {"next": {}}}`}, []string{`{"next": 1}`}},
+		{"any value", `{}`, []string{`[1, {"a": "b"}, null]`, `"s"`}, []string{`[1,]`, `{a: 1}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := FromJSONSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.accept {
+				if !matches(g, s) {
+					t.Errorf("rejected %s", s)
+				}
+			}
+			for _, s := range tt.reject {
+				if matches(g, s) {
+					t.Errorf("accepted %s", s)
+				}
+			}
+		})
+	}
+}
+
+func TestFromJSONSchemaErrors(t *testing.T) {
+	tests := []struct{ schema, err string }{
+		{`{"type": "object"`, "json schema:"},
+		{`{"type": "date"}`, `unsupported type "date"`},
+		{`{"$ref": "#/$defs/missing"}`, `unresolved $ref "#/$defs/missing"`},
+		{`{"type": "object", "properties": [1]}`, "properties must be an object"},
+	}
+	for _, tt := range tests {
+		_, err := FromJSONSchema([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want it to mention %q", tt.schema, err, tt.err)
+		}
+	}
+}
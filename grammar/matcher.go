@@ -0,0 +1,228 @@
+package grammar
+
+import (
+	"math"
+	"unicode/utf8"
+)
+
+// frame is one level of a parse stack: element idx of alternative alt of rule
+// is the next to match. Stacks share tails, so frames are never modified.
+type frame struct {
+	rule, alt, idx int
+	next           *frame
+}
+
+func (g *Grammar) elem(f *frame) *element { return &g.rules[f.rule][f.alt][f.idx] }
+
+// expand follows rule references from f until every resulting stack has a
+// character element on top, and adds them to out. A nil stack means the
+// input so far is a complete match.
+func (g *Grammar) expand(f *frame, out []*frame) []*frame {
+	for f != nil && f.idx == len(g.rules[f.rule][f.alt]) {
+		f = f.next
+	}
+	if f == nil || g.elem(f).kind == elemChar {
+		for _, o := range out {
+			if sameStack(o, f) {
+				return out
+			}
+		}
+		return append(out, f)
+	}
+	e := g.elem(f)
+	rest := &frame{f.rule, f.alt, f.idx + 1, f.next}
+	for a := range g.rules[e.rule] {
+		out = g.expand(&frame{e.rule, a, 0, rest}, out)
+	}
+	return out
+}
+
+func sameStack(a, b *frame) bool {
+	for a != b {
+		if a == nil || b == nil || a.rule != b.rule || a.alt != b.alt || a.idx != b.idx {
+			return false
+		}
+		a, b = a.next, b.next
+	}
+	return true
+}
+
+// advance returns the stacks that remain after matching r.
+func (g *Grammar) advance(stacks []*frame, r rune) []*frame {
+	var out []*frame
+	for _, f := range stacks {
+		if f == nil || !g.elem(f).matches(r) {
+			continue
+		}
+		out = g.expand(&frame{f.rule, f.alt, f.idx + 1, f.next}, out)
+	}
+	return out
+}
+
+// Matcher tracks how far some text has got through a grammar.
+type Matcher struct {
+	g      *Grammar
+	stacks []*frame
+}
+
+func (g *Grammar) Matcher() *Matcher {
+	m := &Matcher{g: g}
+	for a := range g.rules[g.root] {
+		m.stacks = g.expand(&frame{g.root, a, 0, nil}, m.stacks)
+	}
+	return m
+}
+
+// Feed consumes s and reports whether the grammar allows it. On false the
+// matcher is left as it was.
+func (m *Matcher) Feed(s string) bool {
+	stacks := m.stacks
+	for _, r := range s {
+		if stacks = m.g.advance(stacks, r); len(stacks) == 0 {
+			return false
+		}
+	}
+	m.stacks = stacks
+	return true
+}
+
+// Complete reports whether the text so far is a full match.
+func (m *Matcher) Complete() bool {
+	for _, f := range m.stacks {
+		if f == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Done reports whether the text is a full match that nothing can extend.
+func (m *Matcher) Done() bool { return len(m.stacks) == 1 && m.stacks[0] == nil }
+
+// Vocab indexes a tokenizer's token texts by prefix so a whole vocabulary can
+// be checked against a grammar in one walk. Build it once per model.
+type Vocab struct {
+	text []string
+	eog  []int
+	root *trieNode
+}
+
+type trieNode struct {
+	kids map[rune]*trieNode
+	ids  []int // tokens whose text ends here
+}
+
+// NewVocab takes the decoded text of every token ID and the IDs that end
+// generation. Tokens with empty text or partial UTF-8 (lone byte tokens) are
+// never allowed under a grammar.
+func NewVocab(text []string, eog []int) *Vocab {
+	v := &Vocab{text: text, eog: eog, root: &trieNode{}}
+	isEOG := make(map[int]bool, len(eog))
+	for _, id := range eog {
+		isEOG[id] = true
+	}
+	for id, t := range text {
+		if t == "" || isEOG[id] || !utf8.ValidString(t) {
+			continue
+		}
+		n := v.root
+		for _, r := range t {
+			k := n.kids[r]
+			if k == nil {
+				if n.kids == nil {
+					n.kids = make(map[rune]*trieNode)
+				}
+				k = &trieNode{}
+				n.kids[r] = k
+			}
+			n = k
+		}
+		n.ids = append(n.ids, id)
+	}
+	return v
+}
+
+// Constraint masks logits to the tokens a grammar allows next. It satisfies
+// sampling.Constraint.
+type Constraint struct {
+	m       *Matcher
+	v       *Vocab
+	allowed []bool
+	eog     []float32 // the model's end-of-generation logits, saved by Mask
+	ended   bool
+}
+
+func NewConstraint(g *Grammar, v *Vocab) *Constraint {
+	return &Constraint{m: g.Matcher(), v: v}
+}
+
+func (c *Constraint) Mask(logits []float32) {
+	if len(c.allowed) < len(logits) {
+		c.allowed = make([]bool, len(logits))
+	}
+	allowed := c.allowed[:len(logits)]
+	for i := range allowed {
+		allowed[i] = false
+	}
+	c.walk(c.v.root, c.m.stacks, allowed)
+	c.eog = c.eog[:0]
+	for _, id := range c.v.eog {
+		if id < len(logits) {
+			c.eog = append(c.eog, logits[id])
+		}
+	}
+	open := false
+	for i := range logits {
+		if !allowed[i] {
+			logits[i] = float32(math.Inf(-1))
+		} else if !math.IsInf(float64(logits[i]), -1) {
+			open = true
+		}
+	}
+	if c.m.Complete() || !open {
+		// Ending is allowed once the text is complete, at the model's own
+		// odds so it can still prefer to go on, and is the way out if no
+		// token can continue it.
+		k := 0
+		for _, id := range c.v.eog {
+			if id < len(logits) {
+				logits[id] = c.eog[k]
+				if !open && math.IsInf(float64(logits[id]), -1) {
+					logits[id] = 0
+				}
+				k++
+			}
+		}
+	}
+}
+
+func (c *Constraint) walk(n *trieNode, stacks []*frame, allowed []bool) {
+	for r, k := range n.kids {
+		next := c.m.g.advance(stacks, r)
+		if len(next) == 0 {
+			continue
+		}
+		for _, id := range k.ids {
+			if id < len(allowed) {
+				allowed[id] = true
+			}
+		}
+		c.walk(k, next, allowed)
+	}
+}
+
+func (c *Constraint) Accept(id int) {
+	for _, e := range c.v.eog {
+		if e == id {
+			c.ended = true
+			return
+		}
+	}
+	if id >= 0 && id < len(c.v.text) {
+		c.m.Feed(c.v.text[id])
+	}
+}
+
+// Done reports whether generation must end: the grammar is fully matched and
+// admits nothing more, or an end-of-generation token was accepted.
+func (c *Constraint) Done() bool { return c.ended || c.m.Done() }
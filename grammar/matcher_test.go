@@ -0,0 +1,146 @@
+package grammar
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// listVocab is a vocabulary whose tokens cross rule boundaries of listGrammar
+// in both directions, with multi-byte characters and tokens no grammar may
+// produce.
+var listVocab = []string{
+	0:  "[",
+	1:  "]",
+	2:  ",",
+	3:  `"`,
+	4:  "a",
+	5:  `"a"`,      // a whole item
+	6:  `["`,       // the list and an item opened together
+	7:  `","`,      // one item closed and the next opened
+	8:  "é",        // two bytes
+	9:  "日本",       // two characters of three bytes
+	10: "\xe6\x97", // part of 日: never allowed
+	11: "",         // never allowed
+	12: "</s>",     // end of generation
+	13: "A",
+	14: `"]`,
+}
+
+const listEOG = 12
+
+const listGrammar = `
+root ::= "[" item ("," item)* "]"
+item ::= "\"" [a-zé日本]* "\""
+`
+
+// masked runs Mask over logits of 0 with the end-of-generation token at eog,
+// and returns the tokens left allowed and the end-of-generation logit.
+func masked(c *Constraint, eog float32) ([]int, float32) {
+	logits := make([]float32, len(listVocab))
+	logits[listEOG] = eog
+	c.Mask(logits)
+	var ids []int
+	for id, l := range logits {
+		if id != listEOG && !math.IsInf(float64(l), -1) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, logits[listEOG]
+}
+
+func TestConstraintMask(t *testing.T) {
+	g, err := Parse(listGrammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVocab(listVocab, []int{listEOG})
+	ninf := float32(math.Inf(-1))
+	tests := []struct {
+		accepted []int
+		allowed  []int
+		eog      float32 // the end-of-generation logit after Mask, given -1
+	}{
+		{nil, []int{0, 6}, ninf},
+		{[]int{0}, []int{3, 5}, ninf},
+		{[]int{6}, []int{3, 4, 7, 8, 9, 14}, ninf},
+		{[]int{6, 9, 8}, []int{3, 4, 7, 8, 9, 14}, ninf},
+		{[]int{0, 5}, []int{1, 2}, ninf},
+		{[]int{0, 5, 2}, []int{3, 5}, ninf},
+		{[]int{6, 4, 7, 9}, []int{3, 4, 7, 8, 9, 14}, ninf},
+		// Complete: ending keeps the model's odds, and nothing extends the list.
+		{[]int{6, 9, 14}, nil, -1},
+		{[]int{0, 5, 1}, nil, -1},
+	}
+	for _, tt := range tests {
+		c := NewConstraint(g, v)
+		for _, id := range tt.accepted {
+			c.Accept(id)
+		}
+		allowed, eog := masked(c, -1)
+		if !slices.Equal(allowed, tt.allowed) || eog != tt.eog {
+			t.Errorf("after %v: allowed %v, end-of-generation %g; want %v, %g", tt.accepted, allowed, eog, tt.allowed, tt.eog)
+		}
+	}
+}
+
+func TestConstraintEOG(t *testing.T) {
+	g, err := Parse(`root ::= "a" "b"?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vocab := []string{"a", "b", "</s>"}
+	c := NewConstraint(g, NewVocab(vocab, []int{2}))
+	mask := func(eog float32) []float32 {
+		logits := []float32{0.5, 0.25, eog}
+		c.Mask(logits)
+		return logits
+	}
+	ninf := float32(math.Inf(-1))
+
+	if got := mask(3); got[2] != ninf || got[0] != 0.5 {
+		t.Errorf("before a full match: %v", got)
+	}
+	c.Accept(0)
+	if c.Done() {
+		t.Error("done after a, which b can extend")
+	}
+	// Complete but extendable: b and ending are both allowed, at the model's odds.
+	if got := mask(3); !slices.Equal(got, []float32{ninf, 0.25, 3}) {
+		t.Errorf("after a: %v", got)
+	}
+	// The model ruled ending out, but b still continues: leave it so.
+	if got := mask(ninf); got[2] != ninf {
+		t.Errorf("after a, with ending ruled out: %v", got)
+	}
+	c.Accept(1)
+	if !c.Done() {
+		t.Error("not done after ab")
+	}
+	// Nothing continues: ending is the way out, even if the model ruled it out.
+	if got := mask(ninf); !slices.Equal(got, []float32{ninf, ninf, 0}) {
+		t.Errorf("after ab, with ending ruled out: %v", got)
+	}
+
+	c = NewConstraint(g, NewVocab(vocab, []int{2}))
+	c.Accept(0)
+	c.Accept(2)
+	if !c.Done() {
+		t.Error("not done after accepting end of generation")
+	}
+}
+
+// TestConstraintMaskedOutByModel checks that a token the model gives no
+// chance to does not count as a way to continue.
+func TestConstraintMaskedOutByModel(t *testing.T) {
+	g, err := Parse(`root ::= "a"+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConstraint(g, NewVocab([]string{"a", "</s>"}, []int{1}))
+	logits := []float32{float32(math.Inf(-1)), float32(math.Inf(-1))}
+	c.Mask(logits)
+	if logits[1] != 0 {
+		t.Errorf("with a ruled out before a full match, ending got %g, want 0", logits[1])
+	}
+}
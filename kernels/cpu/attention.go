@@ -0,0 +1,178 @@
+package cpu
+
+import (
+	"math"
+	"sort"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// PagedKV is one layer of a sequence's K and V as the KV cache pages them:
+// Block(i) returns the K and V rows of positions i*BlockLen onward, BlockLen
+// rows of NKVHead*HeadDim elements each. They may be quantized, if each
+// head's part of a row is whole blocks.
+type PagedKV struct {
+	BlockLen int
+	Block    func(i int) (k, v Matrix)
+}
+
+// Attention is causal scaled dot-product attention for N queries at
+// positions Pos..Pos+N-1. Query head h reads KV head h/(NHead/NKVHead).
+type Attention struct {
+	NHead, NKVHead, HeadDim int
+	Pos, N                  int
+	Scale                   float32 // applied to q·k
+	Window                  int     // a query sees only the last Window positions, its own included; 0 = all
+	Softcap                 float32 // scores become Softcap·tanh(s/Softcap); 0 = off
+}
+
+// queryTile is how many queries a task takes. All the heads sharing a KV
+// head go in the same task, so each K/V block is read once for all of them.
+const queryTile = 32
+
+// Run writes the attention of q, [N][NHead*HeadDim], to out, laid out the
+// same way. It never holds more than one KV block of scores per query: K
+// and V stream past block by block and the softmax is kept online, a running
+// maximum and sum per query rescaling what has been accumulated whenever the
+// maximum grows. Its memory is independent of the sequence length.
+func (a Attention) Run(out, q []float32, kv PagedKV) {
+	RunBatch([]Attention{a}, out, q, []PagedKV{kv})
+}
+
+// RunBatch runs the attention of several sequences packed into one ragged
+// batch: the N queries of seqs[i] are the rows of q and out after those of
+// seqs[i-1], and each sees only its own kv[i], causally from its own Pos.
+// Every sequence's tasks share one set of goroutines, so a step of many
+// short sequences keeps them all busy.
+func RunBatch(seqs []Attention, out, q []float32, kv []PagedKV) {
+	if len(seqs) == 0 {
+		return
+	}
+	// start[i] is the first task of seqs[i], row[i] its first query row.
+	start, row := make([]int, len(seqs)+1), make([]int, len(seqs))
+	scratchLen, work, r := 0, 0, 0
+	for i, a := range seqs {
+		row[i] = r
+		r += max(a.N, 0)
+		start[i+1] = start[i] + a.tasks()
+		scratchLen = max(scratchLen, a.scratchLen(kv[i].BlockLen))
+		work += max(a.N, 0) * (a.Pos + a.N) * a.HeadDim * a.NHead
+	}
+	parallel(start[len(seqs)], work, scratchLen, func(task int, buf []float32) {
+		i := sort.SearchInts(start[1:], task+1)
+		a := seqs[i]
+		qDim := a.NHead * a.HeadDim
+		a.task(task-start[i], out[row[i]*qDim:], q[row[i]*qDim:], kv[i], buf)
+	})
+}
+
+// tasks is how many (KV head, query tile) tasks a splits into.
+func (a Attention) tasks() int {
+	if a.N <= 0 {
+		return 0
+	}
+	return a.NKVHead * ((a.N + queryTile - 1) / queryTile)
+}
+
+// scratchLen is what a task needs: the output accumulators, a block of
+// scores, each row's running maximum and sum, and a block of K and V decoded.
+func (a Attention) scratchLen(bl int) int {
+	rows := queryTile * a.NHead / a.NKVHead
+	return rows*a.HeadDim + rows*bl + 2*rows + 2*bl*a.HeadDim
+}
+
+// task computes one KV head's heads for one tile of queries.
+func (a Attention) task(task int, out, q []float32, kv PagedKV, buf []float32) {
+	hd, group := a.HeadDim, a.NHead/a.NKVHead
+	qDim := a.NHead * hd
+	bl := kv.BlockLen
+	tiles := (a.N + queryTile - 1) / queryTile
+	rows := queryTile * group
+	g, t := task/tiles, task%tiles
+	i0 := t * queryTile
+	i1 := min(i0+queryTile, a.N)
+	acc, s := buf[:rows*hd], buf[rows*hd:rows*(hd+bl)]
+	m, l := buf[rows*(hd+bl):rows*(hd+bl+1)], buf[rows*(hd+bl+1):rows*(hd+bl+2)]
+	kbuf := buf[rows*(hd+bl+2) : rows*(hd+bl+2)+bl*hd]
+	vbuf := buf[rows*(hd+bl+2)+bl*hd:]
+	for r := range m {
+		m[r], l[r] = float32(math.Inf(-1)), 0
+	}
+	clear(acc)
+
+	first := a.first(a.Pos + i0)
+	last := a.Pos + i1 - 1
+	for b := first / bl; b <= last/bl; b++ {
+		km, vm := kv.Block(b)
+		kb, kStride := headRows(km, g, hd, kbuf)
+		vb, vStride := headRows(vm, g, hd, vbuf)
+		for i := i0; i < i1; i++ {
+			p := a.Pos + i
+			jlo, jhi := max(a.first(p)-b*bl, 0), min(p-b*bl, bl-1)
+			if jlo > jhi {
+				continue
+			}
+			for h := g * group; h < (g+1)*group; h++ {
+				r := (i-i0)*group + h - g*group
+				qv := q[i*qDim+h*hd : i*qDim+(h+1)*hd]
+				sr := s[r*bl : (r+1)*bl]
+				mb := m[r]
+				for j := jlo; j <= jhi; j++ {
+					x := dot(qv, kb[j*kStride:]) * a.Scale
+					if a.Softcap > 0 {
+						x = a.Softcap * float32(math.Tanh(float64(x/a.Softcap)))
+					}
+					sr[j] = x
+					mb = max(mb, x)
+				}
+				o := acc[r*hd : (r+1)*hd]
+				if mb > m[r] {
+					c := float32(math.Exp(float64(m[r] - mb)))
+					l[r] *= c
+					for d := range o {
+						o[d] *= c
+					}
+					m[r] = mb
+				}
+				for j := jlo; j <= jhi; j++ {
+					e := float32(math.Exp(float64(sr[j] - mb)))
+					l[r] += e
+					axpy(o, e, vb[j*vStride:])
+				}
+			}
+		}
+	}
+
+	for i := i0; i < i1; i++ {
+		for h := g * group; h < (g+1)*group; h++ {
+			r := (i-i0)*group + h - g*group
+			o := out[i*qDim+h*hd : i*qDim+(h+1)*hd]
+			inv := 1 / l[r]
+			for d, v := range acc[r*hd : (r+1)*hd] {
+				o[d] = v * inv
+			}
+		}
+	}
+}
+
+// first is the earliest position the query at position p sees.
+func (a Attention) first(p int) int {
+	if a.Window > 0 && p >= a.Window {
+		return p - a.Window + 1
+	}
+	return 0
+}
+
+// headRows returns KV head g's part of each row of m as float32, and the
+// stride between rows: read in place for F32, otherwise decoded into buf.
+func headRows(m Matrix, g, hd int, buf []float32) ([]float32, int) {
+	if m.Type == gguf.TypeF32 {
+		return m.F32[g*hd:], m.Cols
+	}
+	elems, size := gguf.BlockSize(m.Type)
+	rb, off, n := m.rowBytes(), g*hd/elems*size, hd/elems*size
+	for r := 0; r < m.Rows; r++ {
+		gguf.Dequantize(m.Type, m.Raw[r*rb+off:r*rb+off+n], buf[r*hd:(r+1)*hd])
+	}
+	return buf, hd
+}
@@ -0,0 +1,162 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// naiveAttention is softmax(q·kᵀ·scale)·v for each query and head, over the
+// whole rows of k and v, [positions][NKVHead*HeadDim].
+func naiveAttention(a Attention, q, k, v []float32) []float32 {
+	hd, group := a.HeadDim, a.NHead/a.NKVHead
+	qDim, kvDim := a.NHead*hd, a.NKVHead*hd
+	out := make([]float32, a.N*qDim)
+	for i := 0; i < a.N; i++ {
+		p := a.Pos + i
+		for h := 0; h < a.NHead; h++ {
+			kh := h / group
+			qv := q[i*qDim+h*hd : i*qDim+(h+1)*hd]
+			var scores []float64
+			js := 0
+			if a.Window > 0 {
+				js = max(0, p-a.Window+1)
+			}
+			mx := math.Inf(-1)
+			for j := js; j <= p; j++ {
+				s := 0.0
+				for d := 0; d < hd; d++ {
+					s += float64(qv[d]) * float64(k[j*kvDim+kh*hd+d])
+				}
+				s *= float64(a.Scale)
+				if a.Softcap > 0 {
+					s = float64(a.Softcap) * math.Tanh(s/float64(a.Softcap))
+				}
+				scores = append(scores, s)
+				mx = max(mx, s)
+			}
+			sum := 0.0
+			for n := range scores {
+				scores[n] = math.Exp(scores[n] - mx)
+				sum += scores[n]
+			}
+			o := out[i*qDim+h*hd : i*qDim+(h+1)*hd]
+			for d := range o {
+				acc := 0.0
+				for n, w := range scores {
+					acc += w * float64(v[(js+n)*kvDim+kh*hd+d])
+				}
+				o[d] = float32(acc / sum)
+			}
+		}
+	}
+	return out
+}
+
+// pagedKV pages k and v, [n][cols], into blocks of bl rows stored as typ,
+// and returns them with the values they hold decoded. Rows past n, in the
+// last block, are NaN: attention must not read them.
+func pagedKV(t *testing.T, r *rand.Rand, typ uint32, n, cols, bl int) (PagedKV, []float32, []float32) {
+	t.Helper()
+	nb := (n + bl - 1) / bl
+	var ks, vs []Matrix
+	var kf, vf []float32
+	for b := 0; b < nb; b++ {
+		k, kd := kvBlock(t, r, typ, bl, cols, n-b*bl)
+		v, vd := kvBlock(t, r, typ, bl, cols, n-b*bl)
+		ks, vs = append(ks, k), append(vs, v)
+		kf, vf = append(kf, kd...), append(vf, vd...)
+	}
+	return PagedKV{BlockLen: bl, Block: func(i int) (Matrix, Matrix) { return ks[i], vs[i] }}, kf[:n*cols], vf[:n*cols]
+}
+
+// kvBlock is a block of rows rows of which the first used are values.
+func kvBlock(t *testing.T, r *rand.Rand, typ uint32, rows, cols, used int) (Matrix, []float32) {
+	t.Helper()
+	nan := float32(math.NaN())
+	if typ == gguf.TypeF32 {
+		x := randFloats(r, rows*cols)
+		for i := max(used, 0) * cols; i < len(x); i++ {
+			x[i] = nan
+		}
+		return FromF32(x, rows, cols), x
+	}
+	m, x := testMatrix(t, r, typ, rows, cols)
+	elems, size := gguf.BlockSize(typ)
+	for i := max(used, 0) * cols / elems; i < rows*cols/elems; i++ {
+		binary.LittleEndian.PutUint16(m.Raw[i*size:], 0x7e00) // a NaN scale
+	}
+	return m, x
+}
+
+func TestAttention(t *testing.T) {
+	tests := []struct {
+		a   Attention
+		typ uint32
+		bl  int
+	}{
+		// More queries than a tile, ending part way into a block.
+		{Attention{NHead: 4, NKVHead: 4, HeadDim: 16, N: 37}, gguf.TypeF32, 16},
+		// Queries starting mid-block, three query heads to a KV head.
+		{Attention{NHead: 6, NKVHead: 2, HeadDim: 8, Pos: 21, N: 12}, gguf.TypeF32, 16},
+		// One decode step at the last slot of a block, and at the first.
+		{Attention{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 47, N: 1}, gguf.TypeF32, 16},
+		{Attention{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 48, N: 1}, gguf.TypeF32, 16},
+		// Blocks smaller than the window, and larger.
+		{Attention{NHead: 4, NKVHead: 1, HeadDim: 8, Pos: 3, N: 40, Window: 7}, gguf.TypeF32, 4},
+		{Attention{NHead: 2, NKVHead: 2, HeadDim: 8, Pos: 30, N: 5, Window: 20}, gguf.TypeF32, 32},
+		{Attention{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 5, N: 20, Softcap: 0.5}, gguf.TypeF32, 16},
+		{Attention{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 5, N: 20, Window: 9, Softcap: 2}, gguf.TypeF32, 8},
+		// Quantized K and V, decoded a head at a time.
+		{Attention{NHead: 4, NKVHead: 2, HeadDim: 32, Pos: 10, N: 30}, gguf.TypeQ8_0, 16},
+		{Attention{NHead: 8, NKVHead: 2, HeadDim: 64, Pos: 17, N: 3, Window: 12}, gguf.TypeQ8_0, 16},
+		{Attention{NHead: 4, NKVHead: 2, HeadDim: 32, Pos: 10, N: 30}, gguf.TypeQ4_0, 16},
+		{Attention{NHead: 2, NKVHead: 2, HeadDim: 32, Pos: 0, N: 33, Softcap: 1}, gguf.TypeQ4_0, 16},
+	}
+	r := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		a := tt.a
+		a.Scale = 1 / float32(math.Sqrt(float64(a.HeadDim)))
+		name := fmt.Sprintf("%s/%+v/block=%d", gguf.TypeName(tt.typ), tt.a, tt.bl)
+		kv, k, v := pagedKV(t, r, tt.typ, a.Pos+a.N, a.NKVHead*a.HeadDim, tt.bl)
+		q := randFloats(r, a.N*a.NHead*a.HeadDim)
+		got := make([]float32, len(q))
+		a.Run(got, q, kv)
+		want := naiveAttention(a, q, k, v)
+		if e := relErr(got, want); !(e <= 1e-5) {
+			t.Errorf("%s: relative error %g", name, e)
+		}
+	}
+}
+
+// TestRunBatch packs sequences of different lengths and positions into one
+// call, which must give each what it gets alone.
+func TestRunBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	seqs := []Attention{
+		{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 0, N: 40},
+		{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 33, N: 1},
+		{NHead: 4, NKVHead: 2, HeadDim: 16, Pos: 9, N: 7, Window: 4},
+	}
+	var kvs []PagedKV
+	var q, want []float32
+	for i := range seqs {
+		seqs[i].Scale = 0.25
+		kv, _, _ := pagedKV(t, r, gguf.TypeF32, seqs[i].Pos+seqs[i].N, 32, 16)
+		qs := randFloats(r, seqs[i].N*64)
+		alone := make([]float32, len(qs))
+		seqs[i].Run(alone, qs, kv)
+		kvs, q, want = append(kvs, kv), append(q, qs...), append(want, alone...)
+	}
+	got := make([]float32, len(q))
+	RunBatch(seqs, got, q, kvs)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("element %d: %g packed, %g alone", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package cpu holds the kernels the CPU backends run on: cache-blocked GEMM
+// and GEMV split across GOMAXPROCS goroutines, over weights stored as F32,
+// F16 or any GGUF quantized type, and tiled attention over paged KV. The dot
+// products at the bottom of them are assembly on amd64 (AVX2, AVX-512) and
+// arm64 (NEON), picked by what the CPU supports; build with -tags purego to
+// run the Go versions only.
+package cpu
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// Matrix is a weight matrix of Rows rows of Cols contiguous elements, the
+// [out][in] layout GGUF stores linear layers in. F32 holds it for TypeF32;
+// for every other type Raw holds each row's blocks as the file packs them.
+type Matrix struct {
+	Type       uint32
+	Rows, Cols int
+	F32        []float32
+	Raw        []byte
+}
+
+// FromF32 wraps a row-major [rows][cols] float32 matrix.
+func FromF32(data []float32, rows, cols int) Matrix {
+	return Matrix{Type: gguf.TypeF32, Rows: rows, Cols: cols, F32: data}
+}
+
+// NewMatrix wraps raw GGUF tensor data of type t. Rows must be whole blocks.
+func NewMatrix(t uint32, raw []byte, rows, cols int) (Matrix, error) {
+	if t == gguf.TypeF32 {
+		return Matrix{}, fmt.Errorf("cpu: f32 weights go through FromF32")
+	}
+	elems, size := gguf.BlockSize(t)
+	if elems == 0 {
+		return Matrix{}, fmt.Errorf("cpu: unsupported weight type %s", gguf.TypeName(t))
+	}
+	if cols%elems != 0 {
+		return Matrix{}, fmt.Errorf("cpu: %s rows of %d elements are not whole %d-element blocks", gguf.TypeName(t), cols, elems)
+	}
+	if want := rows * cols / elems * size; len(raw) < want {
+		return Matrix{}, fmt.Errorf("cpu: %d bytes of %s for %dx%d, want %d", len(raw), gguf.TypeName(t), rows, cols, want)
+	}
+	return Matrix{Type: t, Rows: rows, Cols: cols, Raw: raw}, nil
+}
+
+// Slice returns rows [r0, r1) of w, sharing its storage.
+func (w Matrix) Slice(r0, r1 int) Matrix {
+	s := Matrix{Type: w.Type, Rows: r1 - r0, Cols: w.Cols}
+	if w.Type == gguf.TypeF32 {
+		s.F32 = w.F32[r0*w.Cols : r1*w.Cols]
+	} else {
+		rb := w.rowBytes()
+		s.Raw = w.Raw[r0*rb : r1*rb]
+	}
+	return s
+}
+
+// Row writes row r of w to dst as float32.
+func (w Matrix) Row(r int, dst []float32) {
+	copy(dst[:w.Cols], w.rows(r, r+1, dst))
+}
+
+// rowBytes is the size of one packed row of Raw.
+func (w Matrix) rowBytes() int {
+	elems, size := gguf.BlockSize(w.Type)
+	return w.Cols / elems * size
+}
+
+// rows returns rows [r0, r1) as float32, decoding them into buf unless they
+// are stored that way already.
+func (w Matrix) rows(r0, r1 int, buf []float32) []float32 {
+	if w.Type == gguf.TypeF32 {
+		return w.F32[r0*w.Cols : r1*w.Cols]
+	}
+	rb := w.rowBytes()
+	out := buf[:(r1-r0)*w.Cols]
+	gguf.Dequantize(w.Type, w.Raw[r0*rb:r1*rb], out)
+	return out
+}
+
+// serialWork is the multiply-add count below which splitting a call across
+// goroutines costs more than it saves.
+const serialWork = 1 << 16
+
+// parallel runs f over tasks [0, n), handing them out one at a time to up to
+// GOMAXPROCS goroutines. Each gets its own scratch buffer of at least
+// scratchLen floats, reused across calls.
+func parallel(n, work, scratchLen int, f func(task int, scratch []float32)) {
+	workers := min(runtime.GOMAXPROCS(0), n)
+	if work < serialWork {
+		workers = 1
+	}
+	if workers <= 1 {
+		s := getScratch(scratchLen)
+		for i := 0; i < n; i++ {
+			f(i, *s)
+		}
+		scratch.Put(s)
+		return
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for g := 0; g < workers; g++ {
+		go func() {
+			defer wg.Done()
+			s := getScratch(scratchLen)
+			defer scratch.Put(s)
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				f(i, *s)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+var (
+	scratch     = sync.Pool{New: func() any { return new([]float32) }}
+	int8Scratch = sync.Pool{New: func() any { return new([]int8) }}
+)
+
+func getScratch(n int) *[]float32 {
+	s := scratch.Get().(*[]float32)
+	if cap(*s) < n {
+		*s = make([]float32, n)
+	}
+	*s = (*s)[:n]
+	return s
+}
+
+func getInt8(n int) *[]int8 {
+	s := int8Scratch.Get().(*[]int8)
+	if cap(*s) < n {
+		*s = make([]int8, n)
+	}
+	*s = (*s)[:n]
+	return s
+}
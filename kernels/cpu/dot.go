@@ -0,0 +1,137 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// The dot products the kernels spend their time in. They start as the Go
+// versions below; dot_amd64.go and dot_arm64.go swap in assembly when the CPU
+// has the instructions for it. The Go versions stay the reference the
+// assembly is checked against.
+var (
+	dot     = dotGo
+	dot4    = dot4Go
+	dotQ8_0 = dotQ8_0Go
+	dotQ4_0 = dotQ4_0Go
+)
+
+// Impl names the dot products in use: "go", "avx2", "avx512" or "neon".
+var Impl = "go"
+
+// dotGo returns the dot product of a and b[:len(a)].
+func dotGo(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
+
+// axpy adds a*x[:len(y)] to y.
+func axpy(y []float32, a float32, x []float32) {
+	x = x[:len(y)]
+	for i, v := range x {
+		y[i] += a * v
+	}
+}
+
+// dot4Go writes the dot products of x with the four rows of w starting
+// stride elements apart.
+func dot4Go(x, w []float32, stride int, out *[4]float32) {
+	n := len(x)
+	w0, w1, w2, w3 := w[:n], w[stride:stride+n], w[2*stride:2*stride+n], w[3*stride:3*stride+n]
+	var s0, s1, s2, s3 float32
+	for i, v := range x {
+		s0 += v * w0[i]
+		s1 += v * w1[i]
+		s2 += v * w2[i]
+		s3 += v * w3[i]
+	}
+	*out = [4]float32{s0, s1, s2, s3}
+}
+
+// dot4Tail adds the products of elements from..len(x) to out, for the
+// assembly versions of dot4, which stop at a multiple of their vector width.
+func dot4Tail(x, w []float32, stride, from int, out *[4]float32) {
+	for i := from; i < len(x); i++ {
+		for r := range out {
+			out[r] += x[i] * w[r*stride+i]
+		}
+	}
+}
+
+// The quantized dot products take one weight row of GGUF blocks, its block
+// scales already decoded into wd, and a row of x quantized to Q8_0: 32 int8
+// per block in xq and the block scales in xd. Each block's integer dot
+// product is exact; only the scaling is in floating point.
+//
+// xq must stay within ±127, as quantizeQ8_0 leaves it. The AVX2 versions
+// move the weights' signs onto x with VPSIGNB, which cannot negate -128:
+// an x of -128 against a negative weight would count as -128, not 128.
+
+const qk = 32 // elements per Q8_0 and Q4_0 block
+
+func dotQ8_0Go(w []byte, wd []float32, xq []int8, xd []float32) float32 {
+	s := float32(0)
+	for b := range xd {
+		qs, xs := w[b*34+2:b*34+34], xq[b*qk:(b+1)*qk]
+		sum := int32(0)
+		for j, q := range qs {
+			sum += int32(int8(q)) * int32(xs[j])
+		}
+		s += wd[b] * xd[b] * float32(sum)
+	}
+	return s
+}
+
+func dotQ4_0Go(w []byte, wd []float32, xq []int8, xd []float32) float32 {
+	s := float32(0)
+	for b := range xd {
+		qs, xs := w[b*18+2:b*18+18], xq[b*qk:(b+1)*qk]
+		sum := int32(0)
+		for j, q := range qs {
+			sum += (int32(q&0xf)-8)*int32(xs[j]) + (int32(q>>4)-8)*int32(xs[j+16])
+		}
+		s += wd[b] * xd[b] * float32(sum)
+	}
+	return s
+}
+
+// quantizeQ8_0 quantizes x into 32-element blocks of int8 and a scale each,
+// the way llama.cpp quantizes activations for its integer dot products.
+func quantizeQ8_0(xq []int8, xd []float32, x []float32) {
+	for b := range xd {
+		blk := x[b*qk : (b+1)*qk]
+		amax := float32(0)
+		for _, v := range blk {
+			amax = max(amax, float32(math.Abs(float64(v))))
+		}
+		d := amax / 127
+		xd[b] = d
+		inv := float32(0)
+		if d != 0 {
+			inv = 1 / d
+		}
+		for j, v := range blk {
+			xq[b*qk+j] = int8(math.Round(float64(v * inv)))
+		}
+	}
+}
+
+// blockScales decodes the f16 scale at the head of each block of row.
+func blockScales(wd []float32, row []byte, blockBytes int) {
+	for b := range wd {
+		wd[b] = gguf.Float16(binary.LittleEndian.Uint16(row[b*blockBytes:]))
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !purego
+
+package cpu
+
+import sys "golang.org/x/sys/cpu"
+
+func init() {
+	if !sys.X86.HasAVX2 || !sys.X86.HasFMA {
+		return
+	}
+	dot, dot4, Impl = dotAVX2, dot4AVX2, "avx2"
+	dotQ8_0, dotQ4_0 = dotQ8_0AVX2, dotQ4_0AVX2
+	// The quantized blocks are 32 bytes, one AVX2 register already, so only
+	// the float loops widen to 512 bits.
+	if sys.X86.HasAVX512F {
+		dot, dot4, Impl = dotAVX512, dot4AVX512, "avx512"
+	}
+}
+
+func dot4AVX2(x, w []float32, stride int, out *[4]float32) {
+	n := len(x) &^ 7
+	dot4AVX2Asm(x[:n], w, stride, out)
+	dot4Tail(x, w, stride, n, out)
+}
+
+func dot4AVX512(x, w []float32, stride int, out *[4]float32) {
+	n := len(x) &^ 7
+	dot4AVX512Asm(x[:n], w, stride, out)
+	dot4Tail(x, w, stride, n, out)
+}
+
+//go:noescape
+func dotAVX2(a, b []float32) float32
+
+//go:noescape
+func dotAVX512(a, b []float32) float32
+
+// The dot4 kernels take len(x) as a multiple of 8.
+
+//go:noescape
+func dot4AVX2Asm(x, w []float32, stride int, out *[4]float32)
+
+//go:noescape
+func dot4AVX512Asm(x, w []float32, stride int, out *[4]float32)
+
+//go:noescape
+func dotQ8_0AVX2(w []byte, wd []float32, xq []int8, xd []float32) float32
+
+//go:noescape
+func dotQ4_0AVX2(w []byte, wd []float32, xq []int8, xd []float32) float32
@@ -0,0 +1,389 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// HSUM_Y0 leaves the sum of Y0's eight floats in X0.
+#define HSUM_Y0 \
+	VEXTRACTF128 $1, Y0, X1; \
+	VADDPS       X1, X0, X0; \
+	VHADDPS      X0, X0, X0; \
+	VHADDPS      X0, X0, X0
+
+// HSUM4 leaves in X0 the sums of Y0, Y1, Y2 and Y3, one per lane.
+#define HSUM4 \
+	VHADDPS      Y1, Y0, Y0; \
+	VHADDPS      Y3, Y2, Y2; \
+	VHADDPS      Y2, Y0, Y0; \
+	VEXTRACTF128 $1, Y0, X1; \
+	VADDPS       X1, X0, X0
+
+// func dotAVX2(a, b []float32) float32
+TEXT ·dotAVX2(SB), NOSPLIT, $0-52
+	MOVQ   a_base+0(FP), SI
+	MOVQ   a_len+8(FP), CX
+	MOVQ   b_base+24(FP), DI
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y2, Y2, Y2
+	VXORPS Y3, Y3, Y3
+
+loop32:
+	CMPQ        CX, $32
+	JL          loop8
+	VMOVUPS     (SI), Y4
+	VMOVUPS     32(SI), Y5
+	VMOVUPS     64(SI), Y6
+	VMOVUPS     96(SI), Y7
+	VFMADD231PS (DI), Y4, Y0
+	VFMADD231PS 32(DI), Y5, Y1
+	VFMADD231PS 64(DI), Y6, Y2
+	VFMADD231PS 96(DI), Y7, Y3
+	ADDQ        $128, SI
+	ADDQ        $128, DI
+	SUBQ        $32, CX
+	JMP         loop32
+
+loop8:
+	CMPQ        CX, $8
+	JL          reduce
+	VMOVUPS     (SI), Y4
+	VFMADD231PS (DI), Y4, Y0
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         loop8
+
+reduce:
+	VADDPS Y1, Y0, Y0
+	VADDPS Y3, Y2, Y2
+	VADDPS Y2, Y0, Y0
+	HSUM_Y0
+
+tail:
+	TESTQ       CX, CX
+	JZ          done
+	VMOVSS      (SI), X1
+	VFMADD231SS (DI), X1, X0
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         tail
+
+done:
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func dotAVX512(a, b []float32) float32
+TEXT ·dotAVX512(SB), NOSPLIT, $0-52
+	MOVQ   a_base+0(FP), SI
+	MOVQ   a_len+8(FP), CX
+	MOVQ   b_base+24(FP), DI
+	VXORPS Z0, Z0, Z0
+	VXORPS Z1, Z1, Z1
+	VXORPS Z2, Z2, Z2
+	VXORPS Z3, Z3, Z3
+
+loop64:
+	CMPQ        CX, $64
+	JL          loop16
+	VMOVUPS     (SI), Z4
+	VMOVUPS     64(SI), Z5
+	VMOVUPS     128(SI), Z6
+	VMOVUPS     192(SI), Z7
+	VFMADD231PS (DI), Z4, Z0
+	VFMADD231PS 64(DI), Z5, Z1
+	VFMADD231PS 128(DI), Z6, Z2
+	VFMADD231PS 192(DI), Z7, Z3
+	ADDQ        $256, SI
+	ADDQ        $256, DI
+	SUBQ        $64, CX
+	JMP         loop64
+
+loop16:
+	CMPQ        CX, $16
+	JL          fold
+	VMOVUPS     (SI), Z4
+	VFMADD231PS (DI), Z4, Z0
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JMP         loop16
+
+fold:
+	VADDPS        Z1, Z0, Z0
+	VADDPS        Z3, Z2, Z2
+	VADDPS        Z2, Z0, Z0
+	VEXTRACTF64X4 $1, Z0, Y1
+	VADDPS        Y1, Y0, Y0
+
+loop8:
+	CMPQ        CX, $8
+	JL          reduce
+	VMOVUPS     (SI), Y4
+	VFMADD231PS (DI), Y4, Y0
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         loop8
+
+reduce:
+	HSUM_Y0
+
+tail:
+	TESTQ       CX, CX
+	JZ          done
+	VMOVSS      (SI), X1
+	VFMADD231SS (DI), X1, X0
+	ADDQ        $4, SI
+	ADDQ        $4, DI
+	DECQ        CX
+	JMP         tail
+
+done:
+	VZEROUPPER
+	MOVSS X0, ret+48(FP)
+	RET
+
+// func dot4AVX2Asm(x, w []float32, stride int, out *[4]float32)
+TEXT ·dot4AVX2Asm(SB), NOSPLIT, $0-64
+	MOVQ   x_base+0(FP), SI
+	MOVQ   x_len+8(FP), CX
+	MOVQ   w_base+24(FP), R8
+	MOVQ   stride+48(FP), DX
+	SHLQ   $2, DX
+	LEAQ   (R8)(DX*1), R9
+	LEAQ   (R9)(DX*1), R10
+	LEAQ   (R10)(DX*1), R11
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y2, Y2, Y2
+	VXORPS Y3, Y3, Y3
+	VXORPS Y5, Y5, Y5
+	VXORPS Y6, Y6, Y6
+	VXORPS Y7, Y7, Y7
+	VXORPS Y8, Y8, Y8
+
+	// Two sets of accumulators, so eight multiply-adds are in flight.
+loop16:
+	CMPQ        CX, $16
+	JL          loop8
+	VMOVUPS     (SI), Y4
+	VMOVUPS     32(SI), Y9
+	VFMADD231PS (R8), Y4, Y0
+	VFMADD231PS (R9), Y4, Y1
+	VFMADD231PS (R10), Y4, Y2
+	VFMADD231PS (R11), Y4, Y3
+	VFMADD231PS 32(R8), Y9, Y5
+	VFMADD231PS 32(R9), Y9, Y6
+	VFMADD231PS 32(R10), Y9, Y7
+	VFMADD231PS 32(R11), Y9, Y8
+	ADDQ        $64, SI
+	ADDQ        $64, R8
+	ADDQ        $64, R9
+	ADDQ        $64, R10
+	ADDQ        $64, R11
+	SUBQ        $16, CX
+	JMP         loop16
+
+loop8:
+	CMPQ        CX, $8
+	JL          reduce
+	VMOVUPS     (SI), Y4
+	VFMADD231PS (R8), Y4, Y0
+	VFMADD231PS (R9), Y4, Y1
+	VFMADD231PS (R10), Y4, Y2
+	VFMADD231PS (R11), Y4, Y3
+	ADDQ        $32, SI
+	ADDQ        $32, R8
+	ADDQ        $32, R9
+	ADDQ        $32, R10
+	ADDQ        $32, R11
+	SUBQ        $8, CX
+	JMP         loop8
+
+reduce:
+	VADDPS  Y5, Y0, Y0
+	VADDPS  Y6, Y1, Y1
+	VADDPS  Y7, Y2, Y2
+	VADDPS  Y8, Y3, Y3
+	HSUM4
+	MOVQ    out+56(FP), DI
+	VMOVUPS X0, (DI)
+	VZEROUPPER
+	RET
+
+// func dot4AVX512Asm(x, w []float32, stride int, out *[4]float32)
+TEXT ·dot4AVX512Asm(SB), NOSPLIT, $0-64
+	MOVQ   x_base+0(FP), SI
+	MOVQ   x_len+8(FP), CX
+	MOVQ   w_base+24(FP), R8
+	MOVQ   stride+48(FP), DX
+	SHLQ   $2, DX
+	LEAQ   (R8)(DX*1), R9
+	LEAQ   (R9)(DX*1), R10
+	LEAQ   (R10)(DX*1), R11
+	VXORPS Z0, Z0, Z0
+	VXORPS Z1, Z1, Z1
+	VXORPS Z2, Z2, Z2
+	VXORPS Z3, Z3, Z3
+	VXORPS Z5, Z5, Z5
+	VXORPS Z6, Z6, Z6
+	VXORPS Z7, Z7, Z7
+	VXORPS Z8, Z8, Z8
+
+loop32:
+	CMPQ        CX, $32
+	JL          loop16
+	VMOVUPS     (SI), Z4
+	VMOVUPS     64(SI), Z9
+	VFMADD231PS (R8), Z4, Z0
+	VFMADD231PS (R9), Z4, Z1
+	VFMADD231PS (R10), Z4, Z2
+	VFMADD231PS (R11), Z4, Z3
+	VFMADD231PS 64(R8), Z9, Z5
+	VFMADD231PS 64(R9), Z9, Z6
+	VFMADD231PS 64(R10), Z9, Z7
+	VFMADD231PS 64(R11), Z9, Z8
+	ADDQ        $128, SI
+	ADDQ        $128, R8
+	ADDQ        $128, R9
+	ADDQ        $128, R10
+	ADDQ        $128, R11
+	SUBQ        $32, CX
+	JMP         loop32
+
+loop16:
+	CMPQ        CX, $16
+	JL          fold
+	VMOVUPS     (SI), Z4
+	VFMADD231PS (R8), Z4, Z0
+	VFMADD231PS (R9), Z4, Z1
+	VFMADD231PS (R10), Z4, Z2
+	VFMADD231PS (R11), Z4, Z3
+	ADDQ        $64, SI
+	ADDQ        $64, R8
+	ADDQ        $64, R9
+	ADDQ        $64, R10
+	ADDQ        $64, R11
+	SUBQ        $16, CX
+	JMP         loop16
+
+fold:
+	VADDPS        Z5, Z0, Z0
+	VADDPS        Z6, Z1, Z1
+	VADDPS        Z7, Z2, Z2
+	VADDPS        Z8, Z3, Z3
+	VEXTRACTF64X4 $1, Z0, Y4
+	VADDPS        Y4, Y0, Y0
+	VEXTRACTF64X4 $1, Z1, Y4
+	VADDPS        Y4, Y1, Y1
+	VEXTRACTF64X4 $1, Z2, Y4
+	VADDPS        Y4, Y2, Y2
+	VEXTRACTF64X4 $1, Z3, Y4
+	VADDPS        Y4, Y3, Y3
+
+	// At most 8 elements are left; len(x) is a multiple of 8.
+	CMPQ        CX, $8
+	JL          reduce
+	VMOVUPS     (SI), Y4
+	VFMADD231PS (R8), Y4, Y0
+	VFMADD231PS (R9), Y4, Y1
+	VFMADD231PS (R10), Y4, Y2
+	VFMADD231PS (R11), Y4, Y3
+
+reduce:
+	HSUM4
+	MOVQ    out+56(FP), DI
+	VMOVUPS X0, (DI)
+	VZEROUPPER
+	RET
+
+// Y15 holds int16 ones, for VPMADDWD to add adjacent pairs into int32.
+#define ONES_Y15 \
+	VPCMPEQW Y15, Y15, Y15; \
+	VPSRLW   $15, Y15, Y15
+
+// QBLOCK multiplies the 32 int8 weights in Y2 by the 32 int8 of x at DI and
+// adds the block's products, scaled by wd[b]*xd[b] at R8 and R9, to Y0.
+// VPMADDUBSW wants one operand unsigned, so the weights' signs move onto x.
+#define QBLOCK \
+	VMOVSS       (R8), X1; \
+	VMULSS       (R9), X1, X1; \
+	VBROADCASTSS X1, Y1; \
+	VMOVDQU      (DI), Y3; \
+	VPSIGNB      Y2, Y2, Y4; \
+	VPSIGNB      Y2, Y3, Y5; \
+	VPMADDUBSW   Y5, Y4, Y6; \
+	VPMADDWD     Y15, Y6, Y6; \
+	VCVTDQ2PS    Y6, Y6; \
+	VFMADD231PS  Y6, Y1, Y0; \
+	ADDQ         $32, DI; \
+	ADDQ         $4, R8; \
+	ADDQ         $4, R9
+
+// func dotQ8_0AVX2(w []byte, wd []float32, xq []int8, xd []float32) float32
+TEXT ·dotQ8_0AVX2(SB), NOSPLIT, $0-100
+	MOVQ   w_base+0(FP), SI
+	MOVQ   wd_base+24(FP), R8
+	MOVQ   xq_base+48(FP), DI
+	MOVQ   xd_base+72(FP), R9
+	MOVQ   xd_len+80(FP), CX
+	VXORPS Y0, Y0, Y0
+	ONES_Y15
+
+loop:
+	TESTQ   CX, CX
+	JZ      done
+	VMOVDQU 2(SI), Y2
+	QBLOCK
+	ADDQ    $34, SI
+	DECQ    CX
+	JMP     loop
+
+done:
+	HSUM_Y0
+	VZEROUPPER
+	MOVSS X0, ret+96(FP)
+	RET
+
+// func dotQ4_0AVX2(w []byte, wd []float32, xq []int8, xd []float32) float32
+TEXT ·dotQ4_0AVX2(SB), NOSPLIT, $0-100
+	MOVQ         w_base+0(FP), SI
+	MOVQ         wd_base+24(FP), R8
+	MOVQ         xq_base+48(FP), DI
+	MOVQ         xd_base+72(FP), R9
+	MOVQ         xd_len+80(FP), CX
+	VXORPS       Y0, Y0, Y0
+	ONES_Y15
+
+	// VEX moves only: a legacy SSE move here, with the upper halves of the
+	// Y registers dirty, made the whole loop several times slower.
+	MOVL         $0x0f0f0f0f, AX
+	VMOVD        AX, X14
+	VPBROADCASTD X14, Y14
+	MOVL         $0x08080808, AX
+	VMOVD        AX, X13
+	VPBROADCASTD X13, Y13
+
+loop:
+	TESTQ CX, CX
+	JZ    done
+
+	// A block's 16 bytes hold elements 0-15 in their low nibbles and 16-31
+	// in their high ones.
+	VMOVDQU     2(SI), X2
+	VPSRLW      $4, X2, X7
+	VINSERTI128 $1, X7, Y2, Y2
+	VPAND       Y14, Y2, Y2
+	VPSUBB      Y13, Y2, Y2
+	QBLOCK
+	ADDQ        $18, SI
+	DECQ        CX
+	JMP         loop
+
+done:
+	HSUM_Y0
+	VZEROUPPER
+	MOVSS X0, ret+96(FP)
+	RET
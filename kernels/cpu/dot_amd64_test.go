@@ -0,0 +1,17 @@
+//go:build !purego
+
+package cpu
+
+import sys "golang.org/x/sys/cpu"
+
+// dotImpls is every set of dot products this CPU can run.
+func dotImpls() []dotImpl {
+	impls := []dotImpl{goDots}
+	if sys.X86.HasAVX2 && sys.X86.HasFMA {
+		impls = append(impls, dotImpl{"avx2", dotAVX2, dot4AVX2, dotQ8_0AVX2, dotQ4_0AVX2})
+		if sys.X86.HasAVX512F {
+			impls = append(impls, dotImpl{"avx512", dotAVX512, dot4AVX512, dotQ8_0AVX2, dotQ4_0AVX2})
+		}
+	}
+	return impls
+}
@@ -0,0 +1,33 @@
+//go:build !purego
+
+package cpu
+
+import sys "golang.org/x/sys/cpu"
+
+func init() {
+	if !sys.ARM64.HasASIMD {
+		return
+	}
+	dot, dot4, Impl = dotNEON, dot4NEON, "neon"
+	dotQ8_0, dotQ4_0 = dotQ8_0NEON, dotQ4_0NEON
+}
+
+func dot4NEON(x, w []float32, stride int, out *[4]float32) {
+	n := len(x) &^ 3
+	dot4NEONAsm(x[:n], w, stride, out)
+	dot4Tail(x, w, stride, n, out)
+}
+
+//go:noescape
+func dotNEON(a, b []float32) float32
+
+// dot4NEONAsm takes len(x) as a multiple of 4.
+//
+//go:noescape
+func dot4NEONAsm(x, w []float32, stride int, out *[4]float32)
+
+//go:noescape
+func dotQ8_0NEON(w []byte, wd []float32, xq []int8, xd []float32) float32
+
+//go:noescape
+func dotQ4_0NEON(w []byte, wd []float32, xq []int8, xd []float32) float32
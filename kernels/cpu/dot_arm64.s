@@ -0,0 +1,174 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// func dotNEON(a, b []float32) float32
+TEXT ·dotNEON(SB), NOSPLIT, $0-52
+	MOVD a_base+0(FP), R0
+	MOVD a_len+8(FP), R2
+	MOVD b_base+24(FP), R1
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+	VEOR V2.B16, V2.B16, V2.B16
+	VEOR V3.B16, V3.B16, V3.B16
+
+loop16:
+	CMP    $16, R2
+	BLT    loop4
+	VLD1.P 64(R0), [V4.S4, V5.S4, V6.S4, V7.S4]
+	VLD1.P 64(R1), [V8.S4, V9.S4, V10.S4, V11.S4]
+	VFMLA  V4.S4, V8.S4, V0.S4
+	VFMLA  V5.S4, V9.S4, V1.S4
+	VFMLA  V6.S4, V10.S4, V2.S4
+	VFMLA  V7.S4, V11.S4, V3.S4
+	SUB    $16, R2
+	B      loop16
+
+loop4:
+	CMP    $4, R2
+	BLT    reduce
+	VLD1.P 16(R0), [V4.S4]
+	VLD1.P 16(R1), [V8.S4]
+	VFMLA  V4.S4, V8.S4, V0.S4
+	SUB    $4, R2
+	B      loop4
+
+reduce:
+	VFADD  V1.S4, V0.S4, V0.S4
+	VFADD  V3.S4, V2.S4, V2.S4
+	VFADD  V2.S4, V0.S4, V0.S4
+	VFADDP V0.S4, V0.S4, V0.S4
+	VFADDP V0.S4, V0.S4, V0.S4
+
+tail:
+	CBZ   R2, done
+	FMOVS (R0), F4
+	FMOVS (R1), F5
+	FMULS F4, F5, F5
+	FADDS F5, F0
+	ADD   $4, R0
+	ADD   $4, R1
+	SUB   $1, R2
+	B     tail
+
+done:
+	FMOVS F0, ret+48(FP)
+	RET
+
+// func dot4NEONAsm(x, w []float32, stride int, out *[4]float32)
+TEXT ·dot4NEONAsm(SB), NOSPLIT, $0-64
+	MOVD x_base+0(FP), R0
+	MOVD x_len+8(FP), R2
+	MOVD w_base+24(FP), R3
+	MOVD stride+48(FP), R7
+	LSL  $2, R7, R7
+	ADD  R7, R3, R4
+	ADD  R7, R4, R5
+	ADD  R7, R5, R6
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+	VEOR V2.B16, V2.B16, V2.B16
+	VEOR V3.B16, V3.B16, V3.B16
+
+loop4:
+	CBZ    R2, reduce
+	VLD1.P 16(R0), [V4.S4]
+	VLD1.P 16(R3), [V5.S4]
+	VLD1.P 16(R4), [V6.S4]
+	VLD1.P 16(R5), [V7.S4]
+	VLD1.P 16(R6), [V8.S4]
+	VFMLA  V4.S4, V5.S4, V0.S4
+	VFMLA  V4.S4, V6.S4, V1.S4
+	VFMLA  V4.S4, V7.S4, V2.S4
+	VFMLA  V4.S4, V8.S4, V3.S4
+	SUB    $4, R2
+	B      loop4
+
+reduce:
+	VFADDP V1.S4, V0.S4, V0.S4
+	VFADDP V3.S4, V2.S4, V2.S4
+	VFADDP V2.S4, V0.S4, V0.S4
+	MOVD   out+56(FP), R8
+	VST1   [V0.S4], (R8)
+	RET
+
+// QBLOCK multiplies the 32 int8 weights in V2 and V3 by the 32 int8 of x at
+// R1 and adds the block's products, scaled by wd[b]*xd[b] at R3 and R4, to
+// V0. Two int8 products always fit an int16, so pairs are summed there before
+// widening to int32.
+#define QBLOCK \
+	VLD1.P  32(R1), [V4.B16, V5.B16]; \
+	VSMULL  V2.B8, V4.B8, V6.H8; \
+	VSMLAL  V3.B8, V5.B8, V6.H8; \
+	VSMULL2 V2.B16, V4.B16, V7.H8; \
+	VSMLAL2 V3.B16, V5.B16, V7.H8; \
+	VSXTL   V6.H4, V8.S4; \
+	VSXTL2  V6.H8, V9.S4; \
+	VADD    V9.S4, V8.S4, V8.S4; \
+	VSXTL   V7.H4, V9.S4; \
+	VADD    V9.S4, V8.S4, V8.S4; \
+	VSXTL2  V7.H8, V9.S4; \
+	VADD    V9.S4, V8.S4, V8.S4; \
+	VSCVTF  V8.S4, V8.S4; \
+	FMOVS.P 4(R3), F10; \
+	FMOVS.P 4(R4), F11; \
+	FMULS   F10, F11, F11; \
+	VDUP    V11.S[0], V12.S4; \
+	VFMLA   V8.S4, V12.S4, V0.S4
+
+// func dotQ8_0NEON(w []byte, wd []float32, xq []int8, xd []float32) float32
+TEXT ·dotQ8_0NEON(SB), NOSPLIT, $0-100
+	MOVD w_base+0(FP), R0
+	MOVD wd_base+24(FP), R3
+	MOVD xq_base+48(FP), R1
+	MOVD xd_base+72(FP), R4
+	MOVD xd_len+80(FP), R2
+	VEOR V0.B16, V0.B16, V0.B16
+
+loop:
+	CBZ  R2, done
+	ADD  $2, R0, R5
+	VLD1 (R5), [V2.B16, V3.B16]
+	QBLOCK
+	ADD  $34, R0
+	SUB  $1, R2
+	B    loop
+
+done:
+	VFADDP V0.S4, V0.S4, V0.S4
+	VFADDP V0.S4, V0.S4, V0.S4
+	FMOVS  F0, ret+96(FP)
+	RET
+
+// func dotQ4_0NEON(w []byte, wd []float32, xq []int8, xd []float32) float32
+TEXT ·dotQ4_0NEON(SB), NOSPLIT, $0-100
+	MOVD  w_base+0(FP), R0
+	MOVD  wd_base+24(FP), R3
+	MOVD  xq_base+48(FP), R1
+	MOVD  xd_base+72(FP), R4
+	MOVD  xd_len+80(FP), R2
+	VEOR  V0.B16, V0.B16, V0.B16
+	VMOVI $15, V14.B16
+	VMOVI $8, V13.B16
+
+loop:
+	CBZ R2, done
+
+	// A block's 16 bytes hold elements 0-15 in their low nibbles and 16-31
+	// in their high ones.
+	ADD   $2, R0, R5
+	VLD1  (R5), [V2.B16]
+	VUSHR $4, V2.B16, V3.B16
+	VAND  V14.B16, V2.B16, V2.B16
+	VSUB  V13.B16, V2.B16, V2.B16
+	VSUB  V13.B16, V3.B16, V3.B16
+	QBLOCK
+	ADD   $18, R0
+	SUB   $1, R2
+	B     loop
+
+done:
+	VFADDP V0.S4, V0.S4, V0.S4
+	VFADDP V0.S4, V0.S4, V0.S4
+	FMOVS  F0, ret+96(FP)
+	RET
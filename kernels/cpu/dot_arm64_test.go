@@ -0,0 +1,14 @@
+//go:build !purego
+
+package cpu
+
+import sys "golang.org/x/sys/cpu"
+
+// dotImpls is every set of dot products this CPU can run.
+func dotImpls() []dotImpl {
+	impls := []dotImpl{goDots}
+	if sys.ARM64.HasASIMD {
+		impls = append(impls, dotImpl{"neon", dotNEON, dot4NEON, dotQ8_0NEON, dotQ4_0NEON})
+	}
+	return impls
+}
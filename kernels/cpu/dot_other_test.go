@@ -0,0 +1,6 @@
+//go:build purego || !(amd64 || arm64)
+
+package cpu
+
+// dotImpls is every set of dot products this build can run: only Go's.
+func dotImpls() []dotImpl { return []dotImpl{goDots} }
@@ -0,0 +1,216 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The tests below check every set of dot products the CPU can run against
+// the Go references. Run them with -tags purego as well, which leaves only
+// the references, to keep that build covered.
+
+// dotImpl is one set of dot products, as init might install them.
+type dotImpl struct {
+	name       string
+	dot        func(a, b []float32) float32
+	dot4       func(x, w []float32, stride int, out *[4]float32)
+	q8_0, q4_0 func(w []byte, wd []float32, xq []int8, xd []float32) float32
+}
+
+var goDots = dotImpl{"go", dotGo, dot4Go, dotQ8_0Go, dotQ4_0Go}
+
+// Lengths around the vector widths: 4 and 8 floats for NEON and AVX2, 16 for
+// AVX-512, with tails of every size after them.
+var dotLengths = []int{0, 1, 3, 4, 5, 7, 8, 9, 15, 16, 17, 31, 32, 33, 63, 64, 65, 100, 255, 1024, 1031}
+
+// closeTo reports whether got is want up to float32 rounding in sums of
+// terms whose magnitudes add up to scale, taken in any order.
+func closeTo(got, want, scale float32) bool {
+	return math.Abs(float64(got-want)) <= 1e-5*float64(scale)+1e-30
+}
+
+func absDot(a, b []float32) float32 {
+	s := float32(0)
+	for i := range a {
+		s += float32(math.Abs(float64(a[i] * b[i])))
+	}
+	return s
+}
+
+func TestDot(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, im := range dotImpls() {
+		for _, n := range dotLengths {
+			// b runs past a, which dot must leave alone.
+			a, b := randFloats(r, n), randFloats(r, n+5)
+			if got, want := im.dot(a, b), dotGo(a, b); !closeTo(got, want, absDot(a, b)) {
+				t.Errorf("n=%d: %s dot %g, Go %g", n, im.name, got, want)
+			}
+		}
+	}
+}
+
+func TestDot4(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for _, im := range dotImpls() {
+		for _, n := range dotLengths {
+			for _, stride := range []int{n, n + 1, n + 13, 2*n + 64} {
+				x := randFloats(r, n)
+				w := randFloats(r, 3*stride+n)
+				var got, want [4]float32
+				im.dot4(x, w, stride, &got)
+				dot4Go(x, w, stride, &want)
+				for k := range got {
+					if !closeTo(got[k], want[k], absDot(x, w[k*stride:])) {
+						t.Errorf("n=%d stride=%d row %d: %s dot4 %g, Go %g", n, stride, k, im.name, got[k], want[k])
+					}
+				}
+			}
+		}
+	}
+}
+
+// quantRow is a row of nb random blocks in the layout of blockBytes-byte
+// Q8_0 or Q4_0 blocks, its decoded scales, and x quantized to Q8_0.
+func quantRow(r *rand.Rand, nb, blockBytes int) (w []byte, wd []float32, xq []int8, xd []float32) {
+	w = make([]byte, nb*blockBytes)
+	r.Read(w)
+	wd, xd = make([]float32, nb), make([]float32, nb)
+	xq = make([]int8, nb*qk)
+	quantizeQ8_0(xq, xd, randFloats(r, nb*qk))
+	for b := range wd {
+		wd[b] = float32(r.NormFloat64()) * 0.01
+	}
+	return w, wd, xq, xd
+}
+
+// absQ is the scale of a quantized dot product for closeTo: the sum of its
+// blocks' magnitudes, each bounded by 32 products of at most 128*127.
+func absQ(wd, xd []float32) float32 {
+	s := float32(0)
+	for b := range wd {
+		s += float32(math.Abs(float64(wd[b]*xd[b]))) * 32 * 128 * 127
+	}
+	return s
+}
+
+func TestDotQ(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for _, im := range dotImpls() {
+		for _, nb := range []int{0, 1, 2, 3, 7, 8, 33} {
+			w, wd, xq, xd := quantRow(r, nb, 34)
+			if got, want := im.q8_0(w, wd, xq, xd), dotQ8_0Go(w, wd, xq, xd); !closeTo(got, want, absQ(wd, xd)) {
+				t.Errorf("q8_0 %d blocks: %s %g, Go %g", nb, im.name, got, want)
+			}
+			w, wd, xq, xd = quantRow(r, nb, 18)
+			if got, want := im.q4_0(w, wd, xq, xd), dotQ4_0Go(w, wd, xq, xd); !closeTo(got, want, absQ(wd, xd)) {
+				t.Errorf("q4_0 %d blocks: %s %g, Go %g", nb, im.name, got, want)
+			}
+		}
+	}
+}
+
+// TestDotQExtremes takes the weights and x to the ends of their ranges, where
+// the AVX2 kernels' sign tricks and 16-bit pair sums are closest to
+// overflowing. Weights may be -128; x stops at ±127.
+func TestDotQExtremes(t *testing.T) {
+	for _, im := range dotImpls() {
+		for _, wv := range []int8{-128, -127, 127} {
+			for _, xv := range []int8{-127, 127} {
+				w := make([]byte, 34)
+				for j := 2; j < 34; j++ {
+					w[j] = byte(wv)
+				}
+				xq := make([]int8, qk)
+				for j := range xq {
+					xq[j] = xv
+				}
+				wd, xd := []float32{1}, []float32{1}
+				if got, want := im.q8_0(w, wd, xq, xd), dotQ8_0Go(w, wd, xq, xd); got != want {
+					t.Errorf("w=%d x=%d: %s %g, Go %g", wv, xv, im.name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantizeQ8_0Range(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	x := randFloats(r, 64*qk)
+	x[5], x[40] = -1e30, 1e30
+	xq, xd := make([]int8, len(x)), make([]float32, len(x)/qk)
+	quantizeQ8_0(xq, xd, x)
+	for i, q := range xq {
+		if q == -128 {
+			t.Fatalf("x[%d] quantized to -128", i)
+		}
+	}
+}
+
+// floats decodes data as float32s clamped to ±1e3, so sums of products stay
+// far from overflow, with NaNs and infinities made 0.
+func floats(data []byte) []float32 {
+	out := make([]float32, len(data)/4)
+	for i := range out {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		if v != v || math.IsInf(float64(v), 0) {
+			v = 0
+		}
+		out[i] = max(-1e3, min(1e3, v))
+	}
+	return out
+}
+
+func FuzzDot(f *testing.F) {
+	f.Add(make([]byte, 4*33), 7)
+	f.Fuzz(func(t *testing.T, data []byte, stride int) {
+		v := floats(data)
+		n := len(v) / 5
+		x, rest := v[:n], v[n:]
+		if stride < n || 3*stride+n > len(rest) {
+			stride = n
+		}
+		for _, im := range dotImpls() {
+			if got, want := im.dot(x, rest), dotGo(x, rest); !closeTo(got, want, absDot(x, rest)) {
+				t.Fatalf("n=%d: %s dot %g, Go %g", n, im.name, got, want)
+			}
+			var got, want [4]float32
+			im.dot4(x, rest, stride, &got)
+			dot4Go(x, rest, stride, &want)
+			for k := range got {
+				if !closeTo(got[k], want[k], absDot(x, rest[k*stride:])) {
+					t.Fatalf("n=%d stride=%d row %d: %s dot4 %g, Go %g", n, stride, k, im.name, got[k], want[k])
+				}
+			}
+		}
+	})
+}
+
+func FuzzDotQ(f *testing.F) {
+	f.Add(make([]byte, 3*(34+qk)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, blockBytes := range []int{34, 18} {
+			nb := len(data) / (blockBytes + qk)
+			w, xs := data[:nb*blockBytes], data[nb*blockBytes:nb*(blockBytes+qk)]
+			xq := make([]int8, nb*qk)
+			for j, b := range xs {
+				xq[j] = max(-127, int8(b)) // as quantizeQ8_0 leaves them
+			}
+			wd, xd := make([]float32, nb), make([]float32, nb)
+			for b := range wd {
+				wd[b], xd[b] = float32(w[b*blockBytes])/256, float32(xs[b*qk])/256
+			}
+			for _, im := range dotImpls() {
+				dq, ref := im.q8_0, dotQ8_0Go
+				if blockBytes == 18 {
+					dq, ref = im.q4_0, dotQ4_0Go
+				}
+				if got, want := dq(w, wd, xq, xd), ref(w, wd, xq, xd); !closeTo(got, want, absQ(wd, xd)) {
+					t.Fatalf("%d-byte blocks, %d of them: %s %g, Go %g", blockBytes, nb, im.name, got, want)
+				}
+			}
+		}
+	})
+}
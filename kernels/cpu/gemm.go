@@ -0,0 +1,118 @@
+package cpu
+
+import "github.com/haydenlabs/gollum/gguf"
+
+// A task covers rowTile rows of the weights. Inside it x is walked xTileBytes
+// at a time, so the block of x and the weight tile both stay in cache while
+// every row of one meets every row of the other.
+const (
+	rowTile    = 16
+	xTileBytes = 256 << 10
+)
+
+// Linear computes y = x Wᵀ for n rows of x: y[i][o] is the dot product of row
+// i of x, w.Cols long, with row o of w. y holds n rows of w.Rows. With n == 1
+// this is a GEMV. Q8_0 and Q4_0 weights are multiplied by integer block dot
+// products against x quantized to Q8_0, as llama.cpp does; other types are
+// decoded a tile at a time into scratch, never as a whole.
+func Linear(y, x []float32, w Matrix, n int) {
+	in, out := w.Cols, w.Rows
+	if n <= 0 || out <= 0 {
+		return
+	}
+	if w.Type == gguf.TypeQ8_0 || w.Type == gguf.TypeQ4_0 {
+		linearQ(y, x, w, n)
+		return
+	}
+	scratchLen := 0
+	if w.Type != gguf.TypeF32 {
+		scratchLen = rowTile * in
+	}
+	xTile := max(1, xTileBytes/4/max(in, 1))
+	tiles := (out + rowTile - 1) / rowTile
+	parallel(tiles, n*in*out, scratchLen, func(t int, buf []float32) {
+		r0 := t * rowTile
+		r1 := min(r0+rowTile, out)
+		wt := w.rows(r0, r1, buf)
+		for i0 := 0; i0 < n; i0 += xTile {
+			block(y, x, wt, i0, min(i0+xTile, n), r0, r1, in, out)
+		}
+	})
+}
+
+// block fills y[i][r0:r1] for rows i0 to i1 of x from wt, which holds
+// weight rows r0 to r1. Four weight rows are taken at once so each load of x
+// feeds four sums.
+func block(y, x, wt []float32, i0, i1, r0, r1, in, out int) {
+	o := r0
+	for ; o+4 <= r1; o += 4 {
+		w := wt[(o-r0)*in : (o-r0+4)*in]
+		for i := i0; i < i1; i++ {
+			dot4(x[i*in:(i+1)*in], w, in, (*[4]float32)(y[i*out+o:]))
+		}
+	}
+	for ; o < r1; o++ {
+		w := wt[(o-r0)*in : (o-r0+1)*in]
+		for i := i0; i < i1; i++ {
+			y[i*out+o] = dot(x[i*in:(i+1)*in], w)
+		}
+	}
+}
+
+// linearQ is Linear for Q8_0 and Q4_0 weights.
+func linearQ(y, x []float32, w Matrix, n int) {
+	in, out := w.Cols, w.Rows
+	nb, rb := in/qk, w.rowBytes()
+	dotQ, blockBytes := dotQ8_0, 34
+	if w.Type == gguf.TypeQ4_0 {
+		dotQ, blockBytes = dotQ4_0, 18
+	}
+	xq := getInt8(n * in)
+	defer int8Scratch.Put(xq)
+	xd := getScratch(n * nb)
+	defer scratch.Put(xd)
+	quantizeQ8_0(*xq, *xd, x[:n*in])
+
+	xTile := max(1, xTileBytes/max(in, 1))
+	tiles := (out + rowTile - 1) / rowTile
+	parallel(tiles, n*in*out, rowTile*nb, func(t int, wd []float32) {
+		r0 := t * rowTile
+		r1 := min(r0+rowTile, out)
+		for o := r0; o < r1; o++ {
+			blockScales(wd[(o-r0)*nb:(o-r0+1)*nb], w.Raw[o*rb:(o+1)*rb], blockBytes)
+		}
+		for i0 := 0; i0 < n; i0 += xTile {
+			for o := r0; o < r1; o++ {
+				row, wdo := w.Raw[o*rb:(o+1)*rb], wd[(o-r0)*nb:(o-r0+1)*nb]
+				for i := i0; i < min(i0+xTile, n); i++ {
+					y[i*out+o] = dotQ(row, wdo, (*xq)[i*in:(i+1)*in], (*xd)[i*nb:(i+1)*nb])
+				}
+			}
+		}
+	})
+}
+
+// MatMul computes c = a b for row-major a [m][k] and b [k][n]; c is [m][n].
+// b is transposed into scratch first, so both operands are read along rows
+// rather than b down its columns.
+func MatMul(c, a, b []float32, m, n, k int) {
+	bt := getScratch(n * k)
+	defer scratch.Put(bt)
+	transpose(*bt, b, k, n)
+	Linear(c, a, FromF32(*bt, n, k), m)
+}
+
+// transpose writes the [cols][rows] transpose of src, [rows][cols], to dst in
+// square tiles, so neither side is strided across more than a tile.
+func transpose(dst, src []float32, rows, cols int) {
+	const t = 32
+	for r0 := 0; r0 < rows; r0 += t {
+		for c0 := 0; c0 < cols; c0 += t {
+			for r := r0; r < min(r0+t, rows); r++ {
+				for c := c0; c < min(c0+t, cols); c++ {
+					dst[c*rows+r] = src[r*cols+c]
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// naiveLinear is the triple loop Linear replaced.
+func naiveLinear(y, x, w []float32, n, in, out int) {
+	for i := 0; i < n; i++ {
+		xi := x[i*in : (i+1)*in]
+		yi := y[i*out : (i+1)*out]
+		for o := 0; o < out; o++ {
+			wo := w[o*in : (o+1)*in]
+			sum := float32(0)
+			for k, xv := range xi {
+				sum += wo[k] * xv
+			}
+			yi[o] = sum
+		}
+	}
+}
+
+// naiveMatMul is the triple loop MatMul replaced.
+func naiveMatMul(c, a, b []float32, m, n, k int) {
+	for i := 0; i < m; i++ {
+		for j := 0; j < n; j++ {
+			sum := float32(0)
+			for p := 0; p < k; p++ {
+				sum += a[i*k+p] * b[p*n+j]
+			}
+			c[i*n+j] = sum
+		}
+	}
+}
+
+func randFloats(r *rand.Rand, n int) []float32 {
+	x := make([]float32, n)
+	for i := range x {
+		x[i] = float32(r.NormFloat64())
+	}
+	return x
+}
+
+// testMatrix is a random [rows][cols] matrix stored as typ, with its
+// values as stored decoded to float32.
+func testMatrix(t testing.TB, r *rand.Rand, typ uint32, rows, cols int) (Matrix, []float32) {
+	t.Helper()
+	x := randFloats(r, rows*cols)
+	if typ == gguf.TypeF32 {
+		return FromF32(x, rows, cols), x
+	}
+	elems, size := gguf.BlockSize(typ)
+	raw := make([]byte, rows*cols/elems*size)
+	if typ == gguf.TypeF16 {
+		for i, v := range x {
+			binary.LittleEndian.PutUint16(raw[2*i:], toF16(v))
+		}
+	} else if !gguf.Quantize(typ, x, raw) {
+		t.Fatalf("cannot quantize to %s", gguf.TypeName(typ))
+	}
+	m, err := NewMatrix(typ, raw, rows, cols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gguf.Dequantize(typ, raw, x)
+	return m, x
+}
+
+// toF16 truncates v to half precision; it is only given normal numbers.
+func toF16(v float32) uint16 {
+	b := math.Float32bits(v)
+	exp := int(b>>23&0xff) - 127 + 15
+	if exp <= 0 {
+		return uint16(b>>16) & 0x8000
+	}
+	return uint16(b>>16)&0x8000 | uint16(exp)<<10 | uint16(b>>13&0x3ff)
+}
+
+// relErr is the RMS of got-want relative to the RMS of want.
+func relErr(got, want []float32) float64 {
+	var d, w float64
+	for i := range want {
+		d += float64(got[i]-want[i]) * float64(got[i]-want[i])
+		w += float64(want[i]) * float64(want[i])
+	}
+	return math.Sqrt(d / w)
+}
+
+var linearTypes = []uint32{gguf.TypeF32, gguf.TypeF16, gguf.TypeQ8_0, gguf.TypeQ4_0}
+
+func TestLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, typ := range linearTypes {
+		// Q8_0 and Q4_0 quantize x too, which the reference does not.
+		tol := 1e-6
+		if typ == gguf.TypeQ8_0 || typ == gguf.TypeQ4_0 {
+			tol = 1e-2
+		}
+		for _, n := range []int{1, 3, 17} {
+			// 37 rows leave partial row tiles and a tail after groups of four.
+			w, wf := testMatrix(t, r, typ, 37, 96)
+			x := randFloats(r, n*96)
+			got, want := make([]float32, n*37), make([]float32, n*37)
+			Linear(got, x, w, n)
+			naiveLinear(want, x, wf, n, 96, 37)
+			if e := relErr(got, want); e > tol {
+				t.Errorf("%s n=%d: relative error %g, want at most %g", gguf.TypeName(typ), n, e, tol)
+			}
+		}
+	}
+}
+
+func TestMatMul(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	m, n, k := 7, 45, 70
+	a, b := randFloats(r, m*k), randFloats(r, k*n)
+	got, want := make([]float32, m*n), make([]float32, m*n)
+	MatMul(got, a, b, m, n, k)
+	naiveMatMul(want, a, b, m, n, k)
+	if e := relErr(got, want); e > 1e-6 {
+		t.Errorf("relative error %g", e)
+	}
+}
+
+// BenchmarkLinear runs a 1024x1024 layer for one token and for a batch,
+// in each weight type, next to the triple loop on the same weights as F32.
+func BenchmarkLinear(b *testing.B) {
+	const in, out = 1024, 1024
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 32} {
+		x := randFloats(r, n*in)
+		y := make([]float32, n*out)
+		for _, typ := range linearTypes {
+			w, _ := testMatrix(b, r, typ, out, in)
+			b.Run(fmt.Sprintf("%s/n=%d", gguf.TypeName(typ), n), func(b *testing.B) {
+				b.SetBytes(int64(len(w.Raw) + 4*len(w.F32)))
+				for i := 0; i < b.N; i++ {
+					Linear(y, x, w, n)
+				}
+			})
+		}
+		_, wf := testMatrix(b, r, gguf.TypeF32, out, in)
+		b.Run(fmt.Sprintf("naive/n=%d", n), func(b *testing.B) {
+			b.SetBytes(4 * in * out)
+			for i := 0; i < b.N; i++ {
+				naiveLinear(y, x, wf, n, in, out)
+			}
+		})
+	}
+}
+
+func BenchmarkMatMul(b *testing.B) {
+	const m, n, k = 256, 256, 256
+	r := rand.New(rand.NewSource(2))
+	a, bm, c := randFloats(r, m*k), randFloats(r, k*n), make([]float32, m*n)
+	b.Run("tiled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			MatMul(c, a, bm, m, n, k)
+		}
+	})
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			naiveMatMul(c, a, bm, m, n, k)
+		}
+	})
+}
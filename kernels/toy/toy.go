@@ -1,43 +1,60 @@
 package toy
 
 import (
-	"math/rand"
-	"strings"
+	"math"
 	"time"
 
 	"github.com/haydenlabs/gollum/engine"
+	"github.com/haydenlabs/gollum/tokenizer"
 )
 
-type ToyBackend struct{}
+var toyWords = []string{" llama", " on", " the", " high", " plain", ".", " gentle", ",", " wind", " hums", " softly"}
 
-func NewToyBackend() *ToyBackend { return &ToyBackend{} }
+const period = 5 // index of "." in toyWords
 
-func (t *ToyBackend) Prefill(batch *engine.Batch) error {
-	// Toy implementation: just simulate some processing time
-	time.Sleep(10 * time.Millisecond)
-	return nil
+type ToyBackend struct {
+	tok *tokenizer.Pieces
 }
 
-func (t *ToyBackend) Decode(step *engine.Step) (int, error) {
-	// Toy implementation: simulate processing time
-	time.Sleep(5 * time.Millisecond)
-	return step.BatchSize, nil
-}
+func NewToyBackend() *ToyBackend { return &ToyBackend{tok: tokenizer.NewPieces(toyWords)} }
 
-func (t *ToyBackend) PredictNext(ctxs []engine.DecodeCtx) []string {
-	results := make([]string, len(ctxs))
-	for i, ctx := range ctxs {
-		results[i] = t.NextToken(ctx.Prompt)
-	}
-	return results
+func (t *ToyBackend) Capabilities() engine.Capabilities {
+	return engine.Capabilities{MaxBatch: 32, MaxBatchTokens: 512, DTypes: []string{"f32"}, VocabSize: t.tok.VocabSize(), ContextLen: 4096}
 }
 
-// NextToken emits a tiny "continuation" that looks language-ish.
-func (t *ToyBackend) NextToken(prefix string) string {
-	rand.Seed(time.Now().UnixNano())
-	w := []string{" llama", " on", " the", " high", " plain", ".", " gentle", ",", " wind", " hums", " softly"}
-	if strings.HasSuffix(prefix, ".") {
-		return " "
+func (t *ToyBackend) Tokenizer() engine.Tokenizer { return t.tok }
+
+// Forward emits a tiny "continuation" that looks language-ish: every word is
+// equally likely, except that a period is always followed by a space.
+func (t *ToyBackend) Forward(step *engine.Step) ([]engine.SeqResult, error) {
+	// Toy implementation: simulate processing time
+	time.Sleep(5 * time.Millisecond)
+	results := make([]engine.SeqResult, 0, len(step.Seqs))
+	V := t.tok.VocabSize()
+	for _, s := range step.Seqs {
+		rows := s.Tokens
+		switch {
+		case s.AllLogits:
+		case s.Logits:
+			rows = rows[len(rows)-1:]
+		default:
+			continue
+		}
+		logits := make([]float32, len(rows)*V)
+		for r, tok := range rows {
+			row := logits[r*V : (r+1)*V]
+			for i := range row {
+				row[i] = float32(math.Inf(-1))
+			}
+			if tok == period {
+				row[len(toyWords)+' '] = 0
+			} else {
+				for i := range toyWords {
+					row[i] = 0
+				}
+			}
+		}
+		results = append(results, engine.SeqResult{Seq: s.Seq, Logits: logits})
 	}
-	return w[rand.Intn(len(w))]
+	return results, nil
 }
@@ -28,21 +28,81 @@ var (
 		Help: "Cache events (hits/misses) by type and model",
 	}, []string{"cache_type", "hit_kind", "model"}) // cache_type: prompt|prefix, hit_kind: hit|miss
 
-	// KV events: alloc/pin/unpin/evict by model
+	// KV events: alloc/share/release/evict by model
 	KVEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "gollum_kv_events_total",
 		Help: "KV pager events by action and model",
-	}, []string{"action", "model"}) // action: alloc|pin|unpin|evict
+	}, []string{"action", "model"}) // action: alloc|share|release|evict|exhausted
+
+	StepTokens = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gollum_step_tokens",
+		Help:    "Tokens processed per step by phase",
+		Buckets: []float64{1, 4, 16, 64, 128, 256, 512, 1024, 2048},
+	}, []string{"model", "phase"}) // phase: prefill|decode
 
 	DecodeSteps = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "gollum_decode_steps_total",
 		Help: "Decode steps executed",
 	}, []string{"model"})
+
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_backend_errors_total",
+		Help: "Sequences failed by backend errors",
+	}, []string{"model", "scope"}) // scope: step|seq|draft
+
+	SpecTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_spec_tokens_total",
+		Help: "Speculative tokens proposed and accepted by the target",
+	}, []string{"model", "method", "outcome"}) // method: draft|lookup; outcome: proposed|accepted
+
+	ExpertTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_moe_expert_tokens_total",
+		Help: "Tokens routed to each mixture-of-experts expert, summed over layers",
+	}, []string{"model", "expert"})
+
+	ExpertBatch = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gollum_moe_expert_batch_tokens",
+		Help:    "Tokens an expert's weights were read for in one forward pass",
+		Buckets: []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512},
+	}, []string{"model"})
+
+	ContextOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_context_overflows_total",
+		Help: "Requests that outgrew the context window, by what was done",
+	}, []string{"model", "action"}) // action: reject|truncate|shift
+
+	ModelLoads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_model_loads_total",
+		Help: "Model loads by outcome",
+	}, []string{"model", "outcome"}) // outcome: ok|error
+
+	ModelLoadSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gollum_model_load_seconds",
+		Help:    "Time to load a model",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 120},
+	}, []string{"model"})
+
+	ModelLoadWaits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_model_load_waits_total",
+		Help: "Requests that waited for their model to load, by outcome",
+	}, []string{"model", "outcome"}) // outcome: served|timeout|cancelled
+
+	ModelEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollum_model_evictions_total",
+		Help: "Models unloaded, by reason",
+	}, []string{"model", "reason"}) // reason: idle|memory|admin
+
+	ResidentBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gollum_model_resident_bytes",
+		Help: "Memory held by a resident model's weights and KV",
+	}, []string{"model"})
 )
 
 func MustRegister() {
 	prometheus.MustRegister(
-		TTFTMs, TPOTMs, BatchSize,
-		CacheEvents, KVEvents, DecodeSteps,
+		TTFTMs, TPOTMs, BatchSize, StepTokens,
+		CacheEvents, KVEvents, DecodeSteps, BackendErrors, SpecTokens, ContextOverflows,
+		ExpertTokens, ExpertBatch,
+		ModelLoads, ModelLoadSeconds, ModelLoadWaits, ModelEvictions, ResidentBytes,
 	)
 }
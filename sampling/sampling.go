@@ -0,0 +1,370 @@
+package sampling
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Params controls how a token is picked from a row of logits.
+// Zero values switch a stage off, so an empty Params is greedy decoding.
+type Params struct {
+	Temperature      float32 // <= 0 picks the most likely token
+	TopK             int
+	TopP             float32
+	MinP             float32 // drop tokens below MinP times the top probability
+	TypicalP         float32
+	RepeatPenalty    float32 // > 1 discourages tokens seen in the last RepeatLastN
+	RepeatLastN      int     // window for RepeatPenalty; 0 means 64, -1 the whole history
+	PresencePenalty  float32 // subtracted once from every token already generated
+	FrequencyPenalty float32 // subtracted per occurrence of a generated token
+	Mirostat         int     // 2 enables Mirostat v2; TopK/TopP/MinP/TypicalP are then ignored
+	MirostatTau      float32 // target surprise; 0 means 5
+	MirostatEta      float32 // learning rate; 0 means 0.1
+	Seed             *int64  // fixes the random stream so results can be reproduced
+}
+
+// Deterministic reports whether the same request always yields the same tokens.
+func (p Params) Deterministic() bool {
+	return p.Temperature <= 0 || p.Seed != nil
+}
+
+// Key is a stable string form of p for use in cache keys.
+func (p Params) Key() string {
+	seed := "-"
+	if p.Seed != nil {
+		seed = fmt.Sprint(*p.Seed)
+	}
+	return fmt.Sprintf("t%g k%d p%g m%g y%g r%g/%d pp%g fp%g ms%d/%g/%g s%s",
+		p.Temperature, p.TopK, p.TopP, p.MinP, p.TypicalP, p.RepeatPenalty, p.RepeatLastN,
+		p.PresencePenalty, p.FrequencyPenalty, p.Mirostat, p.MirostatTau, p.MirostatEta, seed)
+}
+
+// Sampler holds the per-request state sampling needs: the random stream,
+// the token history penalties look at and the Mirostat target.
+type Sampler struct {
+	p       Params
+	rng     *rand.Rand
+	history []int
+	counts  map[int]int // generated token -> occurrences
+	mu      float64
+	cands   []candidate
+	c       Constraint
+}
+
+// Constraint limits which tokens may come next, for example a grammar.
+type Constraint interface {
+	Mask(logits []float32) // set logits of disallowed tokens to -Inf
+	Accept(id int)         // advance past a sampled token
+}
+
+type candidate struct {
+	id    int
+	logit float32
+	p     float64
+}
+
+func New(p Params) *Sampler {
+	seed := time.Now().UnixNano()
+	if p.Seed != nil {
+		seed = *p.Seed
+	}
+	if p.RepeatLastN == 0 {
+		p.RepeatLastN = 64
+	}
+	if p.MirostatTau == 0 {
+		p.MirostatTau = 5
+	}
+	if p.MirostatEta == 0 {
+		p.MirostatEta = 0.1
+	}
+	return &Sampler{
+		p:      p,
+		rng:    rand.New(rand.NewSource(seed)),
+		counts: make(map[int]int),
+		mu:     2 * float64(p.MirostatTau),
+	}
+}
+
+// Accept records tokens that are part of the context without being sampled,
+// such as the prompt, so the repetition penalty can see them.
+func (s *Sampler) Accept(ids ...int) {
+	s.history = append(s.history, ids...)
+}
+
+// Constrain restricts every later Sample to tokens c allows.
+func (s *Sampler) Constrain(c Constraint) { s.c = c }
+
+// Sample picks the next token from logits and records it in the history.
+// logits is modified in place by the penalties and any constraint.
+func (s *Sampler) Sample(logits []float32) int {
+	s.applyPenalties(logits)
+	if s.c != nil {
+		s.c.Mask(logits)
+	}
+	var id int
+	switch {
+	case s.p.Temperature <= 0:
+		id = argmax(logits)
+	case s.p.Mirostat == 2:
+		id = s.mirostatV2(logits)
+	default:
+		id = s.sample(logits)
+	}
+	s.record(id)
+	return id
+}
+
+func (s *Sampler) record(id int) {
+	s.history = append(s.history, id)
+	s.counts[id]++
+	if s.c != nil {
+		s.c.Accept(id)
+	}
+}
+
+// Speculative reports whether the sampler's output can be produced by
+// speculative decoding: Mirostat and constraints carry state that a rejected
+// draft token would have to undo.
+func (s *Sampler) Speculative() bool { return s.p.Mirostat != 2 && s.c == nil }
+
+// Propose draws a draft token and returns the distribution it came from,
+// without recording it. It is the draft side of speculative decoding.
+func (s *Sampler) Propose(logits []float32) (int, []float32) {
+	s.applyPenalties(logits)
+	c := s.dist(logits)
+	return s.pick(c), dense(c, len(logits))
+}
+
+// Verify is the target side of speculative decoding. draft[i] was drawn from
+// q[i], and target[i] holds the target's logits for the position draft[i]
+// fills; target has one more row, for the position after the last draft.
+// Each draft token is kept with probability min(1, p/q). The first rejected
+// one is replaced by a draw from the leftover mass max(0, p-q); if none is
+// rejected, a bonus token comes from the last row. The tokens returned follow
+// the target distribution exactly, and are recorded as Sample would.
+func (s *Sampler) Verify(draft []int, q [][]float32, target [][]float32) []int {
+	out := make([]int, 0, len(draft)+1)
+	for i, d := range draft {
+		s.applyPenalties(target[i])
+		p := dense(s.dist(target[i]), len(target[i]))
+		// A draft token the target has no logit for is rejected outright.
+		if d >= 0 && d < len(p) && d < len(q[i]) && s.rng.Float64()*float64(q[i][d]) < float64(p[d]) {
+			s.record(d)
+			out = append(out, d)
+			continue
+		}
+		sum := float32(0)
+		for j := range p {
+			r := p[j]
+			if j < len(q[i]) {
+				r -= q[i][j]
+			}
+			if r > 0 {
+				p[j] = r
+				sum += r
+			} else {
+				p[j] = 0
+			}
+		}
+		id := s.pickDense(p, sum)
+		s.record(id)
+		return append(out, id)
+	}
+	last := target[len(draft)]
+	s.applyPenalties(last)
+	id := s.pick(s.dist(last))
+	s.record(id)
+	return append(out, id)
+}
+
+func dense(c []candidate, n int) []float32 {
+	p := make([]float32, n)
+	for _, x := range c {
+		p[x.id] = float32(x.p)
+	}
+	return p
+}
+
+// pickDense draws from unnormalized weights p summing to sum.
+func (s *Sampler) pickDense(p []float32, sum float32) int {
+	r := float32(s.rng.Float64()) * sum
+	last := 0
+	for id, w := range p {
+		if w <= 0 {
+			continue
+		}
+		if r < w {
+			return id
+		}
+		r -= w
+		last = id
+	}
+	return last
+}
+
+func (s *Sampler) applyPenalties(logits []float32) {
+	if s.p.RepeatPenalty > 0 && s.p.RepeatPenalty != 1 {
+		window := s.history
+		if n := s.p.RepeatLastN; n > 0 && len(window) > n {
+			window = window[len(window)-n:]
+		}
+		seen := make(map[int]bool, len(window))
+		for _, id := range window {
+			if id < 0 || id >= len(logits) || seen[id] {
+				continue
+			}
+			seen[id] = true
+			if logits[id] > 0 {
+				logits[id] /= s.p.RepeatPenalty
+			} else {
+				logits[id] *= s.p.RepeatPenalty
+			}
+		}
+	}
+	if s.p.PresencePenalty != 0 || s.p.FrequencyPenalty != 0 {
+		for id, n := range s.counts {
+			if id >= 0 && id < len(logits) {
+				logits[id] -= float32(n)*s.p.FrequencyPenalty + s.p.PresencePenalty
+			}
+		}
+	}
+}
+
+// sample runs top-k, typical-p, top-p and min-p over the tempered distribution.
+func (s *Sampler) sample(logits []float32) int {
+	return s.pick(s.dist(logits))
+}
+
+// dist returns the normalized candidates sample draws from, most likely first.
+func (s *Sampler) dist(logits []float32) []candidate {
+	if s.p.Temperature <= 0 {
+		c := append(s.cands[:0], candidate{id: argmax(logits), p: 1})
+		s.cands = c
+		return c
+	}
+	c := s.candidates(logits)
+	if k := s.p.TopK; k > 0 && k < len(c) {
+		c = c[:k]
+	}
+	softmax(c)
+	if tp := s.p.TypicalP; tp > 0 && tp < 1 {
+		c = typical(c, float64(tp))
+	}
+	if tp := s.p.TopP; tp > 0 && tp < 1 {
+		cum := 0.0
+		for i := range c {
+			cum += c[i].p
+			if cum >= float64(tp) {
+				c = c[:i+1]
+				break
+			}
+		}
+	}
+	if mp := s.p.MinP; mp > 0 {
+		floor := float64(mp) * c[0].p
+		for i := 1; i < len(c); i++ {
+			if c[i].p < floor {
+				c = c[:i]
+				break
+			}
+		}
+	}
+	softmax(c)
+	return c
+}
+
+// mirostatV2 truncates tokens more surprising than mu and steers mu toward tau.
+func (s *Sampler) mirostatV2(logits []float32) int {
+	c := s.candidates(logits)
+	softmax(c)
+	keep := 1
+	for keep < len(c) && -math.Log2(c[keep].p) <= s.mu {
+		keep++
+	}
+	c = c[:keep]
+	softmax(c)
+	id := s.pick(c)
+	for _, x := range c {
+		if x.id == id {
+			s.mu -= float64(s.p.MirostatEta) * (-math.Log2(x.p) - float64(s.p.MirostatTau))
+			break
+		}
+	}
+	return id
+}
+
+// candidates returns all tokens with tempered logits, most likely first.
+func (s *Sampler) candidates(logits []float32) []candidate {
+	c := s.cands[:0]
+	t := s.p.Temperature
+	for id, l := range logits {
+		c = append(c, candidate{id: id, logit: l / t})
+	}
+	s.cands = c
+	sort.Slice(c, func(i, j int) bool { return c[i].logit > c[j].logit })
+	return c
+}
+
+func (s *Sampler) pick(c []candidate) int {
+	r := s.rng.Float64()
+	cum := 0.0
+	for _, x := range c {
+		cum += x.p
+		if r < cum {
+			return x.id
+		}
+	}
+	return c[len(c)-1].id
+}
+
+// typical keeps the tokens whose surprise is closest to the distribution's entropy.
+func typical(c []candidate, mass float64) []candidate {
+	ent := 0.0
+	for _, x := range c {
+		if x.p > 0 {
+			ent -= x.p * math.Log(x.p)
+		}
+	}
+	dev := func(x candidate) float64 { return math.Abs(-math.Log(x.p) - ent) }
+	sort.SliceStable(c, func(i, j int) bool { return dev(c[i]) < dev(c[j]) })
+	cum := 0.0
+	for i := range c {
+		cum += c[i].p
+		if cum >= mass {
+			c = c[:i+1]
+			break
+		}
+	}
+	sort.SliceStable(c, func(i, j int) bool { return c[i].p > c[j].p })
+	return c
+}
+
+func softmax(c []candidate) {
+	max := c[0].logit
+	for _, x := range c {
+		if x.logit > max {
+			max = x.logit
+		}
+	}
+	sum := 0.0
+	for i := range c {
+		c[i].p = math.Exp(float64(c[i].logit - max))
+		sum += c[i].p
+	}
+	for i := range c {
+		c[i].p /= sum
+	}
+}
+
+func argmax(logits []float32) int {
+	best := 0
+	for i, l := range logits {
+		if l > logits[best] {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,254 @@
+package sampling
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// logitsOf returns logits whose softmax at temperature 1 is p.
+func logitsOf(p ...float64) []float32 {
+	l := make([]float32, len(p))
+	for i, x := range p {
+		l[i] = float32(math.Log(x))
+	}
+	return l
+}
+
+func seed(n int64) *int64 { return &n }
+
+func TestDist(t *testing.T) {
+	// Probabilities 1/2, 1/4, 1/8, 1/8: surprises of 1, 2, 3 and 3 bits
+	// around an entropy of 1.75 bits.
+	base := logitsOf(0.5, 0.25, 0.125, 0.125)
+	tests := []struct {
+		name string
+		p    Params
+		want []float64 // by token id; 0 for tokens filtered out
+	}{
+		{"greedy", Params{}, []float64{1, 0, 0, 0}},
+		{"temperature 1", Params{Temperature: 1}, []float64{0.5, 0.25, 0.125, 0.125}},
+		{"temperature 0.5 squares", Params{Temperature: 0.5}, []float64{16.0 / 22, 4.0 / 22, 1.0 / 22, 1.0 / 22}},
+		{"temperature 2 takes roots", Params{Temperature: 2}, []float64{2 / (2 + math.Sqrt2 + 2), math.Sqrt2 / (2 + math.Sqrt2 + 2), 1 / (2 + math.Sqrt2 + 2), 1 / (2 + math.Sqrt2 + 2)}},
+		{"top-k", Params{Temperature: 1, TopK: 2}, []float64{2.0 / 3, 1.0 / 3, 0, 0}},
+		{"top-k past the vocabulary", Params{Temperature: 1, TopK: 10}, []float64{0.5, 0.25, 0.125, 0.125}},
+		{"top-p stops once reached", Params{Temperature: 1, TopP: 0.7}, []float64{2.0 / 3, 1.0 / 3, 0, 0}},
+		{"top-p reached exactly", Params{Temperature: 1, TopP: 0.5}, []float64{1, 0, 0, 0}},
+		{"top-p 1 is off", Params{Temperature: 1, TopP: 1}, []float64{0.5, 0.25, 0.125, 0.125}},
+		{"min-p", Params{Temperature: 1, MinP: 0.3}, []float64{2.0 / 3, 1.0 / 3, 0, 0}},
+		{"min-p below every token", Params{Temperature: 1, MinP: 0.2}, []float64{0.5, 0.25, 0.125, 0.125}},
+		// Token 1 sits 0.25 bits from the entropy, token 0 0.75 bits.
+		{"typical drops the most likely token", Params{Temperature: 1, TypicalP: 0.2}, []float64{0, 1, 0, 0}},
+		{"typical", Params{Temperature: 1, TypicalP: 0.3}, []float64{2.0 / 3, 1.0 / 3, 0, 0}},
+		{"top-k then top-p", Params{Temperature: 1, TopK: 3, TopP: 0.9}, []float64{4.0 / 7, 2.0 / 7, 1.0 / 7, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logits := append([]float32(nil), base...)
+			got := dense(New(tt.p).dist(logits), len(logits))
+			for id, want := range tt.want {
+				if math.Abs(float64(got[id])-want) > 1e-6 {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRepeatPenalty(t *testing.T) {
+	tests := []struct {
+		name  string
+		lastN int
+		want  []float32
+	}{
+		{"last four", 4, []float32{2, 1, -2, 3}},
+		{"whole history", -1, []float32{1, 1, -2, 3}},
+		{"default window", 0, []float32{1, 1, -2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(Params{RepeatPenalty: 2, RepeatLastN: tt.lastN})
+			s.Accept(0, 1, 2, 2, 9) // 9 is outside the row and ignored
+			logits := []float32{2, 2, -1, 3}
+			s.applyPenalties(logits)
+			for i := range logits {
+				if logits[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", logits, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPresenceFrequencyPenalty(t *testing.T) {
+	s := New(Params{PresencePenalty: 0.5, FrequencyPenalty: 0.25})
+	s.Accept(3) // prompt tokens are not penalized
+	for _, id := range []int{1, 1, 2} {
+		s.record(id)
+	}
+	logits := make([]float32, 4)
+	s.applyPenalties(logits)
+	want := []float32{0, -1, -0.75, 0}
+	for i := range logits {
+		if logits[i] != want[i] {
+			t.Fatalf("got %v, want %v", logits, want)
+		}
+	}
+}
+
+func TestMirostatV2(t *testing.T) {
+	// With tau 1.1, mu starts at 2.2 bits: tokens 0 and 1 (1 and 2 bits of
+	// surprise) survive, renormalized to 2/3 and 1/3.
+	seen := map[int]int{}
+	for n := int64(0); n < 200; n++ {
+		s := New(Params{Temperature: 1, Mirostat: 2, MirostatTau: 1.1, Seed: seed(n)})
+		id := s.Sample(logitsOf(0.5, 0.25, 0.125, 0.125))
+		seen[id]++
+		p := map[int]float64{0: 2.0 / 3, 1: 1.0 / 3}[id]
+		if p == 0 {
+			t.Fatalf("seed %d sampled token %d beyond mu", n, id)
+		}
+		if want := 2.2 - 0.1*(-math.Log2(p)-1.1); math.Abs(s.mu-want) > 1e-6 {
+			t.Fatalf("after token %d mu = %v, want %v", id, s.mu, want)
+		}
+	}
+	if seen[0] == 0 || seen[1] == 0 {
+		t.Errorf("tokens drawn: %v", seen)
+	}
+
+	// A target below every token's surprise leaves only the top one, which
+	// is certain once renormalized, so each draw pushes mu back up.
+	s := New(Params{Temperature: 1, Mirostat: 2, MirostatTau: 0.1, MirostatEta: 0.5, Seed: seed(1)})
+	for i := 0; i < 5; i++ {
+		if id := s.Sample(logitsOf(0.25, 0.25, 0.25, 0.25)); id != 0 {
+			t.Fatalf("draw %d: token %d, want 0", i, id)
+		}
+	}
+	if want := 0.2 + 5*0.5*0.1; math.Abs(s.mu-want) > 1e-6 {
+		t.Errorf("mu = %v, want %v", s.mu, want)
+	}
+}
+
+func TestSeedReproduces(t *testing.T) {
+	draw := func(p Params) []int {
+		s := New(p)
+		var out []int
+		for i := 0; i < 64; i++ {
+			out = append(out, s.Sample(logitsOf(0.3, 0.2, 0.2, 0.1, 0.1, 0.1)))
+		}
+		return out
+	}
+	p := Params{Temperature: 1, RepeatPenalty: 1.1, Seed: seed(42)}
+	a, b := draw(p), draw(p)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("same seed diverged at %d: %v vs %v", i, a, b)
+		}
+	}
+	p.Seed = seed(43)
+	c := draw(p)
+	same := true
+	for i := range a {
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Errorf("seeds 42 and 43 drew the same %v", a)
+	}
+	if !p.Deterministic() || (Params{Temperature: 1}).Deterministic() {
+		t.Error("Deterministic should follow the seed")
+	}
+}
+
+func TestVerifyGreedy(t *testing.T) {
+	q := []float32{0.25, 0.25, 0.25, 0.25}
+	tests := []struct {
+		name  string
+		draft []int
+		want  []int
+	}{
+		{"all accepted plus bonus", []int{2, 1}, []int{2, 1, 3}},
+		{"first rejected", []int{0, 1}, []int{2}},
+		{"second rejected", []int{2, 3}, []int{2, 1}},
+		{"out of range", []int{4}, []int{2}},
+		{"negative", []int{-1}, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(Params{Seed: seed(1)})
+			target := [][]float32{{0, 1, 3, 2}, {0, 3, 1, 2}, {0, 1, 2, 3}}
+			qs := make([][]float32, len(tt.draft))
+			for i := range qs {
+				qs[i] = q
+			}
+			got := s.Verify(tt.draft, qs, target[:len(tt.draft)+1])
+			if !equal(got, tt.want) || !equal(s.history, tt.want) {
+				t.Errorf("got %v (history %v), want %v", got, s.history, tt.want)
+			}
+		})
+	}
+}
+
+// TestVerifyDistribution checks the accepted-or-resampled token follows the
+// target distribution whatever the draft distribution was.
+func TestVerifyDistribution(t *testing.T) {
+	p := []float64{0.5, 0.25, 0.125, 0.125}
+	drafts := map[string][]float32{
+		"uniform draft":  {0.25, 0.25, 0.25, 0.25},
+		"skewed draft":   {0.1, 0.1, 0.1, 0.7},
+		"draft too wide": {0.2, 0.2, 0.2, 0.2, 0.2}, // token 4 is beyond the target
+	}
+	const n = 20000
+	for name, q := range drafts {
+		t.Run(name, func(t *testing.T) {
+			s := New(Params{Temperature: 1, Seed: seed(7)})
+			rng := rand.New(rand.NewSource(8))
+			counts := make([]int, len(p))
+			for i := 0; i < n; i++ {
+				d := pickFrom(rng, q)
+				target := [][]float32{logitsOf(p...), logitsOf(p...)}
+				out := s.Verify([]int{d}, [][]float32{q}, target)
+				counts[out[0]]++
+			}
+			for id := range p {
+				if got := float64(counts[id]) / n; math.Abs(got-p[id]) > 0.015 {
+					t.Errorf("token %d: frequency %.3f, want %.3f", id, got, p[id])
+				}
+			}
+		})
+	}
+}
+
+func pickFrom(rng *rand.Rand, q []float32) int {
+	r := rng.Float32()
+	for id, w := range q {
+		if r < w {
+			return id
+		}
+		r -= w
+	}
+	return len(q) - 1
+}
+
+func TestPropose(t *testing.T) {
+	s := New(Params{Temperature: 1, TopK: 2, Seed: seed(3)})
+	id, q := s.Propose(logitsOf(0.5, 0.25, 0.125, 0.125))
+	if id > 1 || math.Abs(float64(q[0])-2.0/3) > 1e-6 || q[2] != 0 {
+		t.Errorf("proposed %d from %v", id, q)
+	}
+	if len(s.history) != 0 {
+		t.Errorf("Propose recorded %v", s.history)
+	}
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,258 @@
+package tokenizer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// BPE is the GPT-2 style byte-level BPE (tokenizer.ggml.model = "gpt2") used by
+// Llama 3, Qwen2 and others. Bytes are spelled as printable runes before merging.
+type BPE struct {
+	vocab
+	ranks   map[[2]string]int
+	byteEnc [256]rune
+	byteDec map[rune]byte
+	split   func(string) []string // pre-tokenizer; merges never cross its pieces
+}
+
+// newBPE builds the tokenizer for a vocabulary whose pre-tokenizer is named
+// pre, as in tokenizer.ggml.pre. Names other than Llama 3's and Qwen2's get
+// GPT-2's.
+func newBPE(v vocab, merges []string, pre string) *BPE {
+	t := &BPE{vocab: v, ranks: make(map[[2]string]int, len(merges)), byteDec: make(map[rune]byte, 256), split: pretokenize}
+	switch pre {
+	case "llama3", "llama-bpe", "smaug-bpe":
+		t.split = func(s string) []string { return pretokenizeLlama3(s, 3) }
+	case "qwen2":
+		t.split = func(s string) []string { return pretokenizeLlama3(s, 1) }
+	}
+	for i, m := range merges {
+		if a, b, ok := strings.Cut(m, " "); ok {
+			t.ranks[[2]string{a, b}] = i
+		}
+	}
+	// bytes_to_unicode: printable bytes map to themselves, the rest to 256+n.
+	n := 0
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xa1 && b <= 0xac) || (b >= 0xae && b <= 0xff) {
+			t.byteEnc[b] = rune(b)
+		} else {
+			t.byteEnc[b] = rune(256 + n)
+			n++
+		}
+		t.byteDec[t.byteEnc[b]] = byte(b)
+	}
+	return t
+}
+
+func (t *BPE) Encode(text string) []int {
+	var out []int
+	if t.addBOS && t.bos >= 0 {
+		out = append(out, t.bos)
+	}
+	return t.splitSpecial(text, func(s string, out []int) []int {
+		for _, piece := range t.split(s) {
+			out = t.encodePiece(piece, out)
+		}
+		return out
+	}, out)
+}
+
+func (t *BPE) encodePiece(piece string, out []int) []int {
+	var sb strings.Builder
+	for i := 0; i < len(piece); i++ {
+		sb.WriteRune(t.byteEnc[piece[i]])
+	}
+	enc := sb.String()
+	if id, ok := t.ids[enc]; ok {
+		return append(out, id)
+	}
+	var syms []string
+	for _, r := range enc {
+		syms = append(syms, string(r))
+	}
+	for len(syms) > 1 {
+		best, bestRank := -1, 0
+		for i := 0; i+1 < len(syms); i++ {
+			if r, ok := t.ranks[[2]string{syms[i], syms[i+1]}]; ok && (best < 0 || r < bestRank) {
+				best, bestRank = i, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+		syms[best] += syms[best+1]
+		syms = append(syms[:best+1], syms[best+2:]...)
+	}
+	for _, s := range syms {
+		if id, ok := t.ids[s]; ok {
+			out = append(out, id)
+			continue
+		}
+		for _, r := range s {
+			if id, ok := t.ids[string(r)]; ok {
+				out = append(out, id)
+			} else if t.unk >= 0 {
+				out = append(out, t.unk)
+			}
+		}
+	}
+	return out
+}
+
+func (t *BPE) Decode(ids []int) string {
+	var sb strings.Builder
+	for _, id := range ids {
+		if id < 0 || id >= len(t.tokens) {
+			continue
+		}
+		switch t.typ(id) {
+		case TypeControl, TypeUnused:
+			continue
+		case TypeUserDefined:
+			sb.WriteString(t.tokens[id])
+			continue
+		}
+		for _, r := range t.tokens[id] {
+			if b, ok := t.byteDec[r]; ok {
+				sb.WriteByte(b)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// pretokenize splits text the way GPT-2's pattern does: lower-case
+// contractions, ` ?letters`, ` ?digits`, ` ?other`, and whitespace runs whose
+// last space is left to prefix the following word.
+func pretokenize(s string) []string {
+	rs := []rune(s)
+	var out []string
+	isOther := func(r rune) bool { return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+	for i := 0; i < len(rs); {
+		start := i
+		if rs[i] == '\'' && i+1 < len(rs) {
+			if i+2 < len(rs) {
+				two := string(rs[i+1 : i+3])
+				if two == "re" || two == "ve" || two == "ll" {
+					out = append(out, string(rs[i:i+3]))
+					i += 3
+					continue
+				}
+			}
+			switch rs[i+1] {
+			case 's', 't', 'm', 'd':
+				out = append(out, string(rs[i:i+2]))
+				i += 2
+				continue
+			}
+		}
+		j := i
+		if rs[j] == ' ' && j+1 < len(rs) && !unicode.IsSpace(rs[j+1]) {
+			j++
+		}
+		var class func(rune) bool
+		switch {
+		case unicode.IsLetter(rs[j]):
+			class = unicode.IsLetter
+		case unicode.IsNumber(rs[j]):
+			class = unicode.IsNumber
+		case isOther(rs[j]):
+			class = isOther
+		}
+		if class != nil {
+			for j < len(rs) && class(rs[j]) {
+				j++
+			}
+			out = append(out, string(rs[start:j]))
+			i = j
+			continue
+		}
+		// whitespace run
+		for j < len(rs) && unicode.IsSpace(rs[j]) {
+			j++
+		}
+		if j < len(rs) && j-i > 1 {
+			j-- // leave the last whitespace to attach to the next word
+		}
+		out = append(out, string(rs[i:j]))
+		i = j
+	}
+	return out
+}
+
+// pretokenizeLlama3 splits text as Llama 3's pattern does, which Qwen2's
+// differs from only in taking digits one at a time rather than up to three:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Unlike GPT-2's, a letter run takes any one character before it, not only
+// a space, and newlines are split from the whitespace around them.
+func pretokenizeLlama3(s string, maxDigits int) []string {
+	rs := []rune(s)
+	var out []string
+	isNL := func(r rune) bool { return r == '\r' || r == '\n' }
+	isOther := func(r rune) bool { return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+	for i := 0; i < len(rs); {
+		j := i
+		switch {
+		case rs[i] == '\'' && i+1 < len(rs) && contraction(rs[i+1:]) > 0:
+			j = i + 1 + contraction(rs[i+1:])
+		case unicode.IsLetter(rs[i]) || (!isNL(rs[i]) && !unicode.IsNumber(rs[i]) && i+1 < len(rs) && unicode.IsLetter(rs[i+1])):
+			j++
+			for j < len(rs) && unicode.IsLetter(rs[j]) {
+				j++
+			}
+		case unicode.IsNumber(rs[i]):
+			for j < len(rs) && j-i < maxDigits && unicode.IsNumber(rs[j]) {
+				j++
+			}
+		case isOther(rs[i]) || (rs[i] == ' ' && i+1 < len(rs) && isOther(rs[i+1])):
+			j++
+			for j < len(rs) && isOther(rs[j]) {
+				j++
+			}
+			for j < len(rs) && isNL(rs[j]) {
+				j++
+			}
+		default: // whitespace
+			for j < len(rs) && unicode.IsSpace(rs[j]) {
+				j++
+			}
+			last := -1 // the run up to its last newline, if it has one
+			for k := i; k < j; k++ {
+				if isNL(rs[k]) {
+					last = k
+				}
+			}
+			switch {
+			case last >= 0:
+				j = last + 1
+			case j < len(rs) && j-i > 1:
+				j-- // leave the last whitespace to attach to the next word
+			}
+		}
+		out = append(out, string(rs[i:j]))
+		i = j
+	}
+	return out
+}
+
+// contraction is the length of the English contraction suffix rs starts
+// with, after an apostrophe, matched without regard to case; 0 if none.
+func contraction(rs []rune) int {
+	if len(rs) >= 2 {
+		switch strings.ToLower(string(rs[:2])) {
+		case "re", "ve", "ll":
+			return 2
+		}
+	}
+	switch unicode.ToLower(rs[0]) {
+	case 's', 't', 'm', 'd':
+		return 1
+	}
+	return 0
+}
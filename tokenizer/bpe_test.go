@@ -0,0 +1,134 @@
+package tokenizer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// gpt2Byte is GPT-2's bytes_to_unicode: printable bytes spell themselves and
+// the rest take the runes from 256 up, in byte order.
+func gpt2Byte(b byte) string {
+	if (b >= '!' && b <= '~') || (b >= 0xa1 && b <= 0xac) || b >= 0xae {
+		return string(rune(b))
+	}
+	n := 0
+	for c := 0; c < int(b); c++ {
+		if !((c >= '!' && c <= '~') || (c >= 0xa1 && c <= 0xac) || c >= 0xae) {
+			n++
+		}
+	}
+	return string(rune(256 + n))
+}
+
+// bpeMerges are the merges of bpeGGUF's vocabulary, which takes IDs from 256
+// in this order after the 256 byte tokens.
+var bpeMerges = []string{
+	"Ġ t",   // 256 Ġt
+	"h e",   // 257 he
+	"Ġt he", // 258 Ġthe
+	"1 2",   // 259 12
+	"12 3",  // 260 123
+	"' s",   // 261 's
+	"Ċ Ċ",   // 262 ĊĊ
+	"4 5",   // 263 45
+	"( t",   // 264 (t
+	"(t he", // 265 (the
+	"Ġ Ġ",   // 266 ĠĠ
+	"L L",   // 267 LL
+}
+
+// bpeGGUF is a byte-level BPE vocabulary, token i < 256 being byte i, with
+// the pre-tokenizer named pre.
+func bpeGGUF(pre string) *gguf.GGUF {
+	var tokens []string
+	for b := 0; b < 256; b++ {
+		tokens = append(tokens, gpt2Byte(byte(b)))
+	}
+	for _, m := range []string{"Ġt", "he", "Ġthe", "12", "123", "'s", "ĊĊ", "45", "(t", "(the", "ĠĠ", "LL"} {
+		tokens = append(tokens, m)
+	}
+	tokens = append(tokens, "<|endoftext|>")
+	types := make([]int32, len(tokens))
+	for i := range types {
+		types[i] = TypeNormal
+	}
+	types[len(types)-1] = TypeControl
+	return &gguf.GGUF{Metadata: map[string]interface{}{
+		"tokenizer.ggml.model":        "gpt2",
+		"tokenizer.ggml.pre":          pre,
+		"tokenizer.ggml.tokens":       tokens,
+		"tokenizer.ggml.token_type":   types,
+		"tokenizer.ggml.merges":       bpeMerges,
+		"tokenizer.ggml.eos_token_id": uint32(len(tokens) - 1),
+	}}
+}
+
+func TestBPE(t *testing.T) {
+	const text = "the 12345's\n\n(the  'LL<|endoftext|>"
+	const eot = 268
+	tests := []struct {
+		pre  string
+		want []int
+	}{
+		// the | Ġ12345 | 's | Ċ | Ċ | ( | the | Ġ | Ġ' | LL: only lower case
+		// contractions, and no run of letters after a bracket.
+		{"gpt2", []int{'t', 257, ' ', 260, 263, 261, '\n', '\n', '(', 't', 257, ' ', ' ', '\'', 267, eot}},
+		{"", []int{'t', 257, ' ', 260, 263, 261, '\n', '\n', '(', 't', 257, ' ', ' ', '\'', 267, eot}},
+		// the | Ġ | 123 | 45 | 's | ĊĊ | (the | Ġ | Ġ' | LL
+		{"llama-bpe", []int{'t', 257, ' ', 260, 263, 261, 262, 265, ' ', ' ', '\'', 267, eot}},
+		{"llama3", []int{'t', 257, ' ', 260, 263, 261, 262, 265, ' ', ' ', '\'', 267, eot}},
+		// Digits one at a time.
+		{"qwen2", []int{'t', 257, ' ', '1', '2', '3', '4', '5', 261, 262, 265, ' ', ' ', '\'', 267, eot}},
+	}
+	for _, tt := range tests {
+		tok, err := FromGGUF(bpeGGUF(tt.pre))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := tok.Encode(text)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("pre %q: Encode(%q) = %v, want %v", tt.pre, text, got, tt.want)
+		}
+		if s := tok.Decode(got); s != "the 12345's\n\n(the  'LL" {
+			t.Errorf("pre %q: Decode = %q", tt.pre, s)
+		}
+	}
+}
+
+func TestBPEBytes(t *testing.T) {
+	tok, err := FromGGUF(bpeGGUF("llama3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// é and 日 are not in the vocabulary and fall back to their bytes.
+	const text = "é日\x00"
+	want := []int{0xc3, 0xa9, 0xe6, 0x97, 0xa5, 0}
+	if got := tok.Encode(text); !slices.Equal(got, want) {
+		t.Errorf("Encode(%q) = %v, want %v", text, got, want)
+	}
+	if got := tok.Decode(want); got != text {
+		t.Errorf("Decode = %q, want %q", got, text)
+	}
+}
+
+func TestPretokenize(t *testing.T) {
+	const text = "Hello world 12345!!\n\n  foo's I'LL x\t\ty  "
+	tests := []struct {
+		name  string
+		split func(string) []string
+		want  []string
+	}{
+		{"gpt2", pretokenize, []string{"Hello", " world", " 12345", "!!", "\n\n ", " foo", "'s", " I", "'", "LL", " x", "\t", "\t", "y", "  "}},
+		{"llama3", func(s string) []string { return pretokenizeLlama3(s, 3) },
+			[]string{"Hello", " world", " ", "123", "45", "!!\n\n", " ", " foo", "'s", " I", "'LL", " x", "\t", "\ty", "  "}},
+		{"qwen2", func(s string) []string { return pretokenizeLlama3(s, 1) },
+			[]string{"Hello", " world", " ", "1", "2", "3", "4", "5", "!!\n\n", " ", " foo", "'s", " I", "'LL", " x", "\t", "\ty", "  "}},
+	}
+	for _, tt := range tests {
+		if got := tt.split(text); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package tokenizer
+
+import "strings"
+
+// Pieces is a fixed word list with one fallback token per byte, so any text
+// can be encoded. IDs below len(pieces) are the words; the bytes follow.
+// The toy backends use it in place of a model vocabulary.
+type Pieces struct {
+	pieces []string
+}
+
+func NewPieces(pieces []string) *Pieces {
+	return &Pieces{pieces: pieces}
+}
+
+func (p *Pieces) Encode(text string) []int {
+	var out []int
+	for i := 0; i < len(text); {
+		best := -1
+		for id, w := range p.pieces {
+			if w != "" && strings.HasPrefix(text[i:], w) && (best < 0 || len(w) > len(p.pieces[best])) {
+				best = id
+			}
+		}
+		if best >= 0 {
+			out = append(out, best)
+			i += len(p.pieces[best])
+			continue
+		}
+		out = append(out, len(p.pieces)+int(text[i]))
+		i++
+	}
+	return out
+}
+
+func (p *Pieces) Decode(ids []int) string {
+	var sb strings.Builder
+	for _, id := range ids {
+		switch {
+		case id >= 0 && id < len(p.pieces):
+			sb.WriteString(p.pieces[id])
+		case id >= len(p.pieces) && id < len(p.pieces)+256:
+			sb.WriteByte(byte(id - len(p.pieces)))
+		}
+	}
+	return sb.String()
+}
+
+func (p *Pieces) VocabSize() int { return len(p.pieces) + 256 }
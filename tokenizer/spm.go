@@ -0,0 +1,160 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SentencePiece is the score-driven BPE used by Llama-family GGUF files
+// (tokenizer.ggml.model = "llama"). Spaces are spelled "▁" and characters
+// missing from the vocabulary fall back to <0xXX> byte tokens.
+type SentencePiece struct {
+	vocab
+	scores   []float32
+	addSpace bool
+	byteIDs  [256]int
+}
+
+func newSPM(v vocab, scores []float32, addSpace bool) *SentencePiece {
+	t := &SentencePiece{vocab: v, scores: scores, addSpace: addSpace}
+	for b := range t.byteIDs {
+		t.byteIDs[b] = -1
+		if id, ok := v.ids[fmt.Sprintf("<0x%02X>", b)]; ok {
+			t.byteIDs[b] = id
+		}
+	}
+	return t
+}
+
+func (t *SentencePiece) Encode(text string) []int {
+	var out []int
+	if t.addBOS && t.bos >= 0 {
+		out = append(out, t.bos)
+	}
+	first := true
+	return t.splitSpecial(text, func(s string, out []int) []int {
+		if first && t.addSpace {
+			s = " " + s
+		}
+		first = false
+		return t.encode(strings.ReplaceAll(s, " ", "▁"), out)
+	}, out)
+}
+
+type spmSymbol struct {
+	text       string
+	prev, next int
+}
+
+type spmBigram struct {
+	left, right int
+	score       float32
+	size        int
+}
+
+type bigramQueue []spmBigram
+
+func (q bigramQueue) Len() int { return len(q) }
+func (q bigramQueue) Less(i, j int) bool {
+	if q[i].score != q[j].score {
+		return q[i].score > q[j].score
+	}
+	return q[i].left < q[j].left
+}
+func (q bigramQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *bigramQueue) Push(x any)   { *q = append(*q, x.(spmBigram)) }
+func (q *bigramQueue) Pop() any {
+	old := *q
+	b := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return b
+}
+
+// encode merges adjacent symbols, best scoring vocabulary entry first, until no pair is in the vocabulary.
+func (t *SentencePiece) encode(s string, out []int) []int {
+	var syms []spmSymbol
+	for i, r := range s {
+		n := utf8.RuneLen(r)
+		if r == utf8.RuneError {
+			n = 1
+		}
+		syms = append(syms, spmSymbol{text: s[i : i+n], prev: len(syms) - 1, next: len(syms) + 1})
+	}
+	if len(syms) == 0 {
+		return out
+	}
+	syms[len(syms)-1].next = -1
+	q := &bigramQueue{}
+	try := func(l, r int) {
+		if l < 0 || r < 0 {
+			return
+		}
+		merged := syms[l].text + syms[r].text
+		if id, ok := t.ids[merged]; ok {
+			heap.Push(q, spmBigram{left: l, right: r, score: t.score(id), size: len(merged)})
+		}
+	}
+	for i := 1; i < len(syms); i++ {
+		try(i-1, i)
+	}
+	for q.Len() > 0 {
+		b := heap.Pop(q).(spmBigram)
+		l, r := &syms[b.left], &syms[b.right]
+		if l.text == "" || r.text == "" || len(l.text)+len(r.text) != b.size {
+			continue // one side was merged into something else since this pair was queued
+		}
+		l.text += r.text
+		r.text = ""
+		l.next = r.next
+		if r.next >= 0 {
+			syms[r.next].prev = b.left
+		}
+		try(l.prev, b.left)
+		try(b.left, l.next)
+	}
+	for i := 0; i >= 0; i = syms[i].next {
+		sym := syms[i].text
+		if id, ok := t.ids[sym]; ok {
+			out = append(out, id)
+			continue
+		}
+		for j := 0; j < len(sym); j++ {
+			if id := t.byteIDs[sym[j]]; id >= 0 {
+				out = append(out, id)
+			} else if t.unk >= 0 {
+				out = append(out, t.unk)
+			}
+		}
+	}
+	return out
+}
+
+func (t *SentencePiece) score(id int) float32 {
+	if id < len(t.scores) {
+		return t.scores[id]
+	}
+	return 0
+}
+
+func (t *SentencePiece) Decode(ids []int) string {
+	var sb strings.Builder
+	for _, id := range ids {
+		if id < 0 || id >= len(t.tokens) {
+			continue
+		}
+		switch t.typ(id) {
+		case TypeControl, TypeUnused:
+			continue
+		case TypeByte:
+			var b byte
+			if _, err := fmt.Sscanf(t.tokens[id], "<0x%02X>", &b); err == nil {
+				sb.WriteByte(b)
+			}
+			continue
+		}
+		sb.WriteString(strings.ReplaceAll(t.tokens[id], "▁", " "))
+	}
+	return sb.String()
+}
@@ -0,0 +1,77 @@
+package tokenizer
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// spmGGUF is a SentencePiece vocabulary with byte fallback for newlines and
+// 日, whose merges are driven by the scores.
+func spmGGUF(addSpace bool) *gguf.GGUF {
+	tokens := []string{"<unk>", "<s>", "</s>"}
+	types := []int32{TypeUnknown, TypeControl, TypeControl}
+	scores := []float32{0, 0, 0}
+	for _, b := range []byte{'\n', 0xe6, 0x97, 0xa5} { // 3-6
+		tokens = append(tokens, fmt.Sprintf("<0x%02X>", b))
+		types = append(types, TypeByte)
+		scores = append(scores, 0)
+	}
+	for _, p := range []struct {
+		text  string
+		score float32
+	}{
+		{"▁", -1}, {"t", -1}, {"h", -1}, {"e", -1}, // 7-10
+		{"▁t", -2}, {"he", -3}, {"▁the", -4}, // 11-13
+		{"th", -10}, // 14: scores too low to be picked over ▁t
+		{"é", -1},   // 15
+	} {
+		tokens = append(tokens, p.text)
+		types = append(types, TypeNormal)
+		scores = append(scores, p.score)
+	}
+	return &gguf.GGUF{Metadata: map[string]interface{}{
+		"tokenizer.ggml.model":            "llama",
+		"tokenizer.ggml.tokens":           tokens,
+		"tokenizer.ggml.token_type":       types,
+		"tokenizer.ggml.scores":           scores,
+		"tokenizer.ggml.bos_token_id":     uint32(1),
+		"tokenizer.ggml.eos_token_id":     uint32(2),
+		"tokenizer.ggml.unknown_token_id": uint32(0),
+		"tokenizer.ggml.add_space_prefix": addSpace,
+	}}
+}
+
+func TestSentencePiece(t *testing.T) {
+	tests := []struct {
+		text     string
+		addSpace bool
+		want     []int
+		decoded  string
+	}{
+		// ▁t beats th; then he, then ▁the.
+		{"the", true, []int{1, 13}, " the"},
+		{"the the", true, []int{1, 13, 13}, " the the"},
+		{"the", false, []int{1, 8, 12}, "the"},
+		// \n and 日 fall back to bytes; q has neither a piece nor a byte token.
+		{"the\n日é", true, []int{1, 13, 3, 4, 5, 6, 15}, " the\n日é"},
+		{"q", true, []int{1, 7, 0}, " <unk>"},
+		// A special token in the text is kept whole; only the first run gets a space.
+		{"the</s>the", true, []int{1, 13, 2, 8, 12}, " thethe"},
+	}
+	for _, tt := range tests {
+		tok, err := FromGGUF(spmGGUF(tt.addSpace))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := tok.Encode(tt.text)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+		if s := tok.Decode(got); s != tt.decoded {
+			t.Errorf("Decode(%v) = %q, want %q", got, s, tt.decoded)
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 // Tokenizer interface for pluggable tokenization
 type Tokenizer interface {
-	Encode(text string) ([]int, error)
+	Encode(text string) []int
 	Decode(ids []int) string
 	VocabSize() int
 }
@@ -30,35 +30,35 @@ func NewSimpleBPE(vocabSize int) *SimpleBytePairEncoding {
 	}
 }
 
-func (bpe *SimpleBytePairEncoding) Encode(text string) ([]int, error) {
+func (bpe *SimpleBytePairEncoding) Encode(text string) []int {
 	// For now, implement simple tokenization
 	// In production, load vocab from GGUF metadata and implement BPE merge rules
-	
+
 	bpe.mu.RLock()
 	defer bpe.mu.RUnlock()
-	
+
 	// Simple fallback: split on whitespace and assign sequential IDs
 	words := strings.Fields(text)
 	ids := make([]int, 0, len(words))
-	
+
 	for _, word := range words {
 		// Assign a hash-based ID (consistent mapping)
 		id := hashString(word) % int32(bpe.vocabSize)
-		
+
 		// Add bos/eos tokens
 		ids = append(ids, int(id))
 	}
-	
+
 	// Add EOS token (simplified)
 	ids = append(ids, 2)
-	
-	return ids, nil
+
+	return ids
 }
 
 func (bpe *SimpleBytePairEncoding) Decode(ids []int) string {
 	bpe.mu.RLock()
 	defer bpe.mu.RUnlock()
-	
+
 	// Simple reverse mapping
 	var tokens []string
 	for _, id := range ids {
@@ -68,7 +68,7 @@ func (bpe *SimpleBytePairEncoding) Decode(ids []int) string {
 		// In production, look up in vocabRev
 		tokens = append(tokens, string(rune(id)))
 	}
-	
+
 	return strings.Join(tokens, " ")
 }
 
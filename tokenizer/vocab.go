@@ -0,0 +1,178 @@
+package tokenizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// Token types from tokenizer.ggml.token_type
+const (
+	TypeNormal      = 1
+	TypeUnknown     = 2
+	TypeControl     = 3
+	TypeUserDefined = 4
+	TypeUnused      = 5
+	TypeByte        = 6
+)
+
+// vocab is the part SentencePiece and BPE vocabularies share: token strings,
+// their types, and the special tokens that are matched verbatim in input text.
+type vocab struct {
+	tokens  []string
+	types   []int
+	ids     map[string]int
+	special []string // control and user-defined tokens, longest first
+	bos     int
+	eos     int
+	unk     int
+	eog     []int
+	addBOS  bool
+}
+
+// eogText lists control tokens that end a turn in common chat templates.
+var eogText = []string{"<|eot_id|>", "<|eom_id|>", "<|im_end|>", "<|end|>", "<end_of_turn>", "<|endoftext|>"}
+
+func newVocab(tokens []string, types []int) vocab {
+	v := vocab{tokens: tokens, types: types, ids: make(map[string]int, len(tokens)), bos: -1, eos: -1, unk: -1}
+	for i, t := range tokens {
+		if _, dup := v.ids[t]; !dup {
+			v.ids[t] = i
+		}
+		if typ := v.typ(i); (typ == TypeControl || typ == TypeUserDefined) && len(t) > 1 {
+			v.special = append(v.special, t)
+		}
+	}
+	sort.Slice(v.special, func(i, j int) bool { return len(v.special[i]) > len(v.special[j]) })
+	return v
+}
+
+func (v *vocab) typ(id int) int {
+	if id < len(v.types) {
+		return v.types[id]
+	}
+	return TypeNormal
+}
+
+func (v *vocab) VocabSize() int { return len(v.tokens) }
+
+// BOS and EOS return the beginning and end of sequence token IDs, or -1.
+func (v *vocab) BOS() int { return v.bos }
+func (v *vocab) EOS() int { return v.eos }
+
+// EOG returns the token IDs that end generation: EOS plus any end-of-turn tokens.
+func (v *vocab) EOG() []int { return v.eog }
+
+func (v *vocab) addEOG(id int) {
+	if id < 0 || id >= len(v.tokens) {
+		return
+	}
+	for _, e := range v.eog {
+		if e == id {
+			return
+		}
+	}
+	v.eog = append(v.eog, id)
+}
+
+// Token returns the vocabulary string of id.
+func (v *vocab) Token(id int) string {
+	if id < 0 || id >= len(v.tokens) {
+		return ""
+	}
+	return v.tokens[id]
+}
+
+// splitSpecial cuts text at special tokens. Plain runs are passed to enc;
+// special tokens map straight to their IDs.
+func (v *vocab) splitSpecial(text string, enc func(string, []int) []int, out []int) []int {
+	start := 0
+	for i := 0; i < len(text); {
+		matched := ""
+		if text[i] == '<' || text[i] == '[' || text[i] == '|' {
+			for _, sp := range v.special {
+				if strings.HasPrefix(text[i:], sp) {
+					matched = sp
+					break
+				}
+			}
+		}
+		if matched == "" {
+			i++
+			continue
+		}
+		if start < i {
+			out = enc(text[start:i], out)
+		}
+		out = append(out, v.ids[matched])
+		i += len(matched)
+		start = i
+	}
+	if start < len(text) {
+		out = enc(text[start:], out)
+	}
+	return out
+}
+
+// FromGGUF builds the tokenizer described by a model's tokenizer.ggml.* metadata.
+func FromGGUF(g *gguf.GGUF) (Tokenizer, error) {
+	tokens := g.Strings("tokenizer.ggml.tokens")
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("tokenizer: no tokenizer.ggml.tokens in metadata")
+	}
+	v := newVocab(tokens, g.Ints("tokenizer.ggml.token_type"))
+	if id, ok := g.Int("tokenizer.ggml.bos_token_id"); ok {
+		v.bos = id
+	}
+	if id, ok := g.Int("tokenizer.ggml.eos_token_id"); ok {
+		v.eos = id
+	}
+	if id, ok := g.Int("tokenizer.ggml.unknown_token_id"); ok {
+		v.unk = id
+	}
+	v.addEOG(v.eos)
+	for _, key := range []string{"tokenizer.ggml.eot_token_id", "tokenizer.ggml.eom_token_id"} {
+		if id, ok := g.Int(key); ok {
+			v.addEOG(id)
+		}
+	}
+	for _, t := range eogText {
+		if id, ok := v.ids[t]; ok && v.typ(id) == TypeControl {
+			v.addEOG(id)
+		}
+	}
+	model, _ := g.String("tokenizer.ggml.model")
+	switch model {
+	case "llama", "":
+		v.addBOS = true
+		if b, ok := g.Bool("tokenizer.ggml.add_bos_token"); ok {
+			v.addBOS = b
+		}
+		addSpace := true
+		if b, ok := g.Bool("tokenizer.ggml.add_space_prefix"); ok {
+			addSpace = b
+		}
+		return newSPM(v, g.Floats("tokenizer.ggml.scores"), addSpace), nil
+	case "gpt2":
+		if b, ok := g.Bool("tokenizer.ggml.add_bos_token"); ok {
+			v.addBOS = b
+		}
+		pre, _ := g.String("tokenizer.ggml.pre")
+		return newBPE(v, g.Strings("tokenizer.ggml.merges"), pre), nil
+	case "bert":
+		cls, sep := v.bos, v.eos
+		if id, ok := g.Int("tokenizer.ggml.cls_token_id"); ok {
+			cls = id
+		}
+		if id, ok := g.Int("tokenizer.ggml.seperator_token_id"); ok { // sic, as llama.cpp writes it
+			sep = id
+		}
+		if id, ok := v.ids["[UNK]"]; ok && v.unk < 0 {
+			v.unk = id
+		}
+		return newWPM(v, cls, sep), nil
+	}
+	return nil, fmt.Errorf("tokenizer: unsupported tokenizer model %q", model)
+}
@@ -0,0 +1,151 @@
+package tokenizer
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxWordChars is the longest word WordPiece will split; longer ones are unknown.
+const maxWordChars = 100
+
+// WordPiece is the greedy longest-match tokenizer of BERT-style encoders
+// (tokenizer.ggml.model = "bert"). llama.cpp's conversion spells word-initial
+// pieces with a leading "▁" and continuations bare; vocabularies that keep
+// BERT's "##" continuations work too. Input is lowercased with accents
+// stripped, as the uncased models expect, and wrapped in [CLS] ... [SEP].
+type WordPiece struct {
+	vocab
+	cls, sep int
+	hashes   bool // continuations are "##piece"
+}
+
+func newWPM(v vocab, cls, sep int) *WordPiece {
+	t := &WordPiece{vocab: v, cls: cls, sep: sep, hashes: true}
+	for _, tok := range v.tokens {
+		if strings.HasPrefix(tok, "▁") {
+			t.hashes = false
+			break
+		}
+	}
+	return t
+}
+
+func (t *WordPiece) Encode(text string) []int {
+	var out []int
+	if t.cls >= 0 {
+		out = append(out, t.cls)
+	}
+	out = t.splitSpecial(text, func(s string, out []int) []int {
+		for _, w := range wpmWords(s) {
+			out = t.encodeWord(w, out)
+		}
+		return out
+	}, out)
+	if t.sep >= 0 {
+		out = append(out, t.sep)
+	}
+	return out
+}
+
+// wpmWords normalizes s and splits it at whitespace, with each punctuation
+// mark and CJK character a word of its own.
+func wpmWords(s string) []string {
+	var words []string
+	var cur []rune
+	flush := func() {
+		if len(cur) > 0 {
+			words = append(words, string(cur))
+			cur = cur[:0]
+		}
+	}
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.Is(unicode.Mn, r), unicode.IsControl(r), unicode.Is(unicode.Cf, r), r == 0xfffd:
+		case isWPMPunct(r) || isCJK(r):
+			flush()
+			words = append(words, string(r))
+		default:
+			cur = append(cur, unicode.ToLower(r))
+		}
+	}
+	flush()
+	return words
+}
+
+// isWPMPunct follows BERT: all non-alphanumeric ASCII counts as punctuation.
+func isWPMPunct(r rune) bool {
+	return r >= 33 && r <= 47 || r >= 58 && r <= 64 || r >= 91 && r <= 96 || r >= 123 && r <= 126 || unicode.IsPunct(r)
+}
+
+func isCJK(r rune) bool {
+	return r >= 0x4E00 && r <= 0x9FFF || r >= 0x3400 && r <= 0x4DBF || r >= 0x20000 && r <= 0x2A6DF ||
+		r >= 0x2A700 && r <= 0x2CEAF || r >= 0xF900 && r <= 0xFAFF || r >= 0x2F800 && r <= 0x2FA1F
+}
+
+// encodeWord splits w into the longest pieces the vocabulary has, left to
+// right. A word that cannot be covered becomes a single unknown token.
+func (t *WordPiece) encodeWord(w string, out []int) []int {
+	runes := []rune(w)
+	if len(runes) > maxWordChars {
+		return t.appendUnk(out)
+	}
+	start := len(out)
+	for i := 0; i < len(runes); {
+		id, end := -1, i
+		for j := len(runes); j > i; j-- {
+			if id = t.piece(string(runes[i:j]), i == 0); id >= 0 {
+				end = j
+				break
+			}
+		}
+		if id < 0 {
+			return t.appendUnk(out[:start])
+		}
+		out = append(out, id)
+		i = end
+	}
+	return out
+}
+
+func (t *WordPiece) piece(s string, initial bool) int {
+	switch {
+	case initial && !t.hashes:
+		s = "▁" + s
+	case !initial && t.hashes:
+		s = "##" + s
+	}
+	if id, ok := t.ids[s]; ok {
+		return id
+	}
+	return -1
+}
+
+func (t *WordPiece) appendUnk(out []int) []int {
+	if t.unk >= 0 {
+		out = append(out, t.unk)
+	}
+	return out
+}
+
+func (t *WordPiece) Decode(ids []int) string {
+	var sb strings.Builder
+	for _, id := range ids {
+		if id < 0 || id >= len(t.tokens) || t.typ(id) == TypeControl || id == t.cls || id == t.sep {
+			continue
+		}
+		tok := t.tokens[id]
+		switch {
+		case t.hashes && strings.HasPrefix(tok, "##"):
+			sb.WriteString(tok[2:])
+		case t.hashes:
+			sb.WriteString(" " + tok)
+		default:
+			sb.WriteString(strings.ReplaceAll(tok, "▁", " "))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,83 @@
+package tokenizer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/haydenlabs/gollum/gguf"
+)
+
+// wpmGGUF is a BERT vocabulary with "##" continuations, or spelled as
+// llama.cpp converts it, with "▁" on word-initial pieces instead. The ids
+// are the same either way.
+func wpmGGUF(hashes bool) *gguf.GGUF {
+	tokens := []string{"[PAD]", "[UNK]", "[CLS]", "[SEP]", "[MASK]"}
+	types := []int32{TypeControl, TypeUnknown, TypeControl, TypeControl, TypeControl}
+	for _, w := range []string{
+		"the", "un", "##aff", "##able", "aff", // 5-9
+		"cafe", "##s", ",", "!", "日", // 10-14
+		"##a", "##ff", "u", // 15-17: shorter pieces the longest match passes over
+	} {
+		if !hashes {
+			if rest, ok := strings.CutPrefix(w, "##"); ok {
+				w = rest
+			} else {
+				w = "▁" + w
+			}
+		}
+		tokens = append(tokens, w)
+		types = append(types, TypeNormal)
+	}
+	return &gguf.GGUF{Metadata: map[string]interface{}{
+		"tokenizer.ggml.model":              "bert",
+		"tokenizer.ggml.tokens":             tokens,
+		"tokenizer.ggml.token_type":         types,
+		"tokenizer.ggml.cls_token_id":       uint32(2),
+		"tokenizer.ggml.seperator_token_id": uint32(3),
+	}}
+}
+
+func TestWordPiece(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    []int
+		decoded string
+		// decoded from the "▁" spelling where it differs: [UNK] has no "▁"
+		// to become a space.
+		decodedSP string
+	}{
+		{"the", []int{2, 5, 3}, " the", ""},
+		// Longest match first: un, then ##aff over ##a, then ##able.
+		{"unaffable", []int{2, 6, 7, 8, 3}, " unaffable", ""},
+		{"aff unaff", []int{2, 9, 6, 7, 3}, " aff unaff", ""},
+		// Lowercased, accents stripped, punctuation and CJK split off.
+		{"The CAFÉS, 日!", []int{2, 5, 10, 11, 12, 14, 13, 3}, " the cafes , 日 !", ""},
+		// A word that cannot be covered is one unknown token, even if it starts well.
+		{"unx the", []int{2, 1, 5, 3}, " [UNK] the", "[UNK] the"},
+		{"本", []int{2, 1, 3}, " [UNK]", "[UNK]"},
+		{strings.Repeat("a", 101), []int{2, 1, 3}, " [UNK]", "[UNK]"},
+		// Special tokens in the text are kept whole and not decoded.
+		{"the[SEP]the", []int{2, 5, 3, 5, 3}, " the the", ""},
+		{" \t\n", []int{2, 3}, "", ""},
+	}
+	for _, hashes := range []bool{true, false} {
+		tok, err := FromGGUF(wpmGGUF(hashes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			got := tok.Encode(tt.text)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("hashes %v: Encode(%q) = %v, want %v", hashes, tt.text, got, tt.want)
+			}
+			decoded := tt.decoded
+			if !hashes && tt.decodedSP != "" {
+				decoded = tt.decodedSP
+			}
+			if s := tok.Decode(got); s != decoded {
+				t.Errorf("hashes %v: Decode(%v) = %q, want %q", hashes, got, s, decoded)
+			}
+		}
+	}
+}